@@ -1,20 +1,27 @@
 package main
 
 import (
+	"bufio"
 	"fmt"
 	"github.com/function61/gokit/dynversion"
 	"github.com/function61/gokit/logex"
 	"github.com/function61/gokit/ossignal"
 	"github.com/function61/gokit/systemdinstaller"
+	"github.com/function61/passitron/pkg/breachcheck"
 	"github.com/function61/passitron/pkg/httpserver"
 	"github.com/function61/passitron/pkg/keepassimport"
 	"github.com/function61/passitron/pkg/sshagent"
 	"github.com/function61/passitron/pkg/state"
 	"github.com/spf13/cobra"
+	"golang.org/x/term"
+	"io"
 	"os"
+	"strings"
 )
 
 func serverEntrypoint() *cobra.Command {
+	autoUnlockKeyFile := ""
+
 	server := &cobra.Command{
 		Use:   "server",
 		Short: "Starts the server",
@@ -24,10 +31,18 @@ func serverEntrypoint() *cobra.Command {
 
 			exitIfError(httpserver.Run(
 				ossignal.InterruptOrTerminateBackgroundCtx(rootLogger),
+				autoUnlockKeyFile,
 				rootLogger))
 		},
 	}
 
+	server.Flags().StringVarP(
+		&autoUnlockKeyFile,
+		"auto-unlock-key-file",
+		"",
+		"",
+		"At boot, unlock decryption keys protected by this key file alone (if the file is present). Anyone with the device and the key file then has your secrets!")
+
 	server.AddCommand(&cobra.Command{
 		Use:   "init-config [adminUsername] [adminPassword]",
 		Short: "Initializes configuration file",
@@ -37,6 +52,24 @@ func serverEntrypoint() *cobra.Command {
 		},
 	})
 
+	server.AddCommand(&cobra.Command{
+		Use:   "verify-log [username]",
+		Short: "Verifies integrity of the event log (with username: also verifies user's MACs, asking for the master password)",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			username, password := "", ""
+			if len(args) == 1 {
+				username = args[0]
+
+				var err error
+				password, err = readPassword("Master password: ")
+				exitIfError(err)
+			}
+
+			exitIfError(verifyLog(username, password))
+		},
+	})
+
 	server.AddCommand(&cobra.Command{
 		Use:   "install",
 		Short: "Installs systemd unit file to make Passitron start on system boot",
@@ -69,9 +102,58 @@ func main() {
 
 	rootCmd.AddCommand(keepassimport.Entrypoint())
 
+	rootCmd.AddCommand(breachcheck.Entrypoint())
+
 	exitIfError(rootCmd.Execute())
 }
 
+func verifyLog(username string, password string) error {
+	report, err := state.VerifyEventLog(username, password)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Entries: %d\n", report.Entries)
+	fmt.Printf("Head hash: %s\n", report.HeadHash)
+	fmt.Printf("MACs verified: %d\n", report.MacsVerified)
+	fmt.Printf("MACs not verified (key not available): %d\n", report.MacsNoKey)
+
+	if report.PartialAtTail > 0 {
+		fmt.Printf("Partially written entry at end: %d byte(s)\n", report.PartialAtTail)
+	}
+
+	if report.FirstBroken != nil {
+		return fmt.Errorf("hash chain broken, first at %s", report.FirstBroken.String())
+	}
+
+	fmt.Println("OK")
+
+	return nil
+}
+
+// not taken as an argument, as those end up in shell history and are visible to other
+// users (/proc/<pid>/cmdline). from a terminal without echo, otherwise the first line of stdin
+func readPassword(prompt string) (string, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && !(err == io.EOF && line != "") {
+			return "", fmt.Errorf("readPassword: %w", err)
+		}
+
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+
+	password, err := term.ReadPassword(int(os.Stdin.Fd()))
+	if err != nil {
+		return "", fmt.Errorf("readPassword: %w", err)
+	}
+
+	return string(password), nil
+}
+
 func exitIfError(err error) {
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -45,6 +45,13 @@ export class SecretListing extends React.Component<SecretListingProps, {}> {
 					<td />
 					<td>
 						<a href={accountUrl({ id: account.Id })}>{account.Title}</a>
+						{account.PasswordBreached ? (
+							<span
+								className="label label-danger margin-left"
+								title="Password found in a data breach">
+								breached
+							</span>
+						) : null}
 					</td>
 					<td>{account.Username}</td>
 					<td>
@@ -17,6 +17,7 @@ import {
 	AccountAddPassword,
 	AccountAddSecretNote,
 	AccountAddSshKey,
+	AccountGenerateSshKey,
 	AccountChangeDescription,
 	AccountChangeUrl,
 	AccountChangeUsername,
@@ -24,14 +25,17 @@ import {
 	AccountDelete,
 	AccountDeleteSecret,
 	AccountRename,
+	AccountSetSshKeyCa,
 } from 'generated/apitypes_commands';
 import {
+	attachmentDownloadUrl,
 	getAccount,
 	getFolder,
 	getKeylistItem,
 	getKeylistItemChallenge,
 	getSecrets,
 	totpBarcodeExportUrl,
+	uploadAttachmentUrl,
 } from 'generated/apitypes_endpoints';
 import {
 	Account,
@@ -94,6 +98,65 @@ class SecretsFetcher extends React.Component<SecretsFetcherProps, SecretsFetcher
 	}
 }
 
+interface AttachmentUploaderProps {
+	account: string;
+}
+
+interface AttachmentUploaderState {
+	status: string;
+}
+
+// not a command, because commands are JSON and attachments are streamed as request body
+class AttachmentUploader extends React.Component<AttachmentUploaderProps, AttachmentUploaderState> {
+	state: AttachmentUploaderState = { status: '' };
+
+	render() {
+		return (
+			<label style={{ fontWeight: 'normal', cursor: 'pointer' }}>
+				+ Attachment {this.state.status}
+				<input
+					type="file"
+					style={{ display: 'none' }}
+					onChange={(e) => {
+						const files = e.target.files;
+						if (files && files.length > 0) {
+							shouldAlwaysSucceed(this.upload(files[0]));
+						}
+					}}
+				/>
+			</label>
+		);
+	}
+
+	private async upload(file: File) {
+		const title = prompt('Title for the attachment', file.name);
+		if (title === null) {
+			return;
+		}
+
+		this.setState({ status: '(uploading)' });
+
+		const response = await fetch(uploadAttachmentUrl(this.props.account, title, file.name), {
+			method: 'POST',
+			credentials: 'same-origin',
+			headers: { 'x-csrf-token': csrfTokenFromCookie() },
+			body: file,
+		});
+
+		if (!response.ok) {
+			this.setState({ status: `(failed: ${response.status})` });
+			return;
+		}
+
+		document.location.reload();
+	}
+}
+
+function csrfTokenFromCookie(): string {
+	const match = /(?:^|; )csrf_token=([^;]*)/.exec(document.cookie);
+	return match ? decodeURIComponent(match[1]) : '';
+}
+
 interface KeylistAccessorProps {
 	account: string;
 	secret: Secret;
@@ -253,6 +316,7 @@ export default class AccountPage extends React.Component<AccountPageProps, Accou
 							<CommandLink command={AccountDelete(account.Id)} />
 
 							<CommandLink command={AccountAddSshKey(account.Id)} />
+							<CommandLink command={AccountGenerateSshKey(account.Id)} />
 							<CommandLink command={AccountAddKeylist(account.Id)} />
 							<CommandLink command={AccountAddPassword(account.Id)} />
 							<CommandLink command={AccountAddSecretNote(account.Id)} />
@@ -260,6 +324,7 @@ export default class AccountPage extends React.Component<AccountPageProps, Accou
 							<CommandLink command={AccountAddExternalYubicoOtpToken(account.Id)} />
 
 							<a href={importOtpTokenUrl({ account: account.Id })}>+ OTP token</a>
+							<AttachmentUploader account={account.Id} />
 						</Dropdown>
 					</h1>
 					&nbsp;
@@ -357,9 +422,16 @@ export default class AccountPage extends React.Component<AccountPageProps, Accou
 				return (
 					<tr key={secret.Id}>
 						<th>
-							<span title={relativeDateFormat(secret.Created)}>SSH public key</span>
+							<span title={relativeDateFormat(secret.Created)}>
+								SSH public key
+								{secret.NonExportable ? ' (non-exportable)' : ''}
+								{secret.SshCa ? ' (CA)' : ''}
+							</span>
 							<span className="margin-left">
 								<CommandIcon command={AccountDeleteSecret(account.Id, secret.Id)} />
+								<CommandIcon
+									command={AccountSetSshKeyCa(account.Id, secret.Id, secret.SshCa)}
+								/>
 							</span>
 						</th>
 						<td>{secret.SshPublicKeyAuthorized}</td>
@@ -381,6 +453,20 @@ export default class AccountPage extends React.Component<AccountPageProps, Accou
 							<div>
 								<MutedText>{secret.Title}</MutedText>
 							</div>
+							{secret.Breached ? (
+								<div>
+									<span
+										className="label label-danger"
+										title="Found in a data breach. Change it!">
+										breached
+									</span>
+								</div>
+							) : null}
+							{secret.PasswordPolicy ? (
+								<div>
+									<MutedText>Generated: {secret.PasswordPolicy}</MutedText>
+								</div>
+							) : null}
 						</th>
 						<td>
 							<SecretReveal secret={secret.Password} noAutomaticClipboard={true} />
@@ -409,6 +495,13 @@ export default class AccountPage extends React.Component<AccountPageProps, Accou
 						</th>
 						<td>
 							{exposedSecret.OtpProof}
+							{exposedSecret.OtpCounter !== null ? (
+								<span
+									className="label label-default margin-left"
+									title="HOTP counter. Each view uses a code">
+									#{exposedSecret.OtpCounter}
+								</span>
+							) : null}
 							<a
 								style={{ marginLeft: '16px' }}
 								title="Export to Google Authenticator"
@@ -483,6 +576,35 @@ export default class AccountPage extends React.Component<AccountPageProps, Accou
 						</td>
 					</tr>
 				);
+			case SecretKind.Attachment:
+				return (
+					<tr key={secret.Id}>
+						<th>
+							<span title={relativeDateFormat(secret.Created)}>Attachment</span>
+							<span className="margin-left">
+								<CommandIcon
+									command={AccountDeleteSecret(account.Id, secret.Id, {
+										disambiguation: secret.Title,
+									})}
+								/>
+							</span>
+							<div>
+								<MutedText>{secret.Title}</MutedText>
+							</div>
+						</th>
+						<td colSpan={2}>
+							<a
+								href={attachmentDownloadUrl(
+									account.Id,
+									secret.Id,
+									exposedSecret.AttachmentDownloadMac,
+								)}>
+								{secret.Filename}
+							</a>{' '}
+							<MutedText>({secret.Size} bytes)</MutedText>
+						</td>
+					</tr>
+				);
 			default:
 				return unrecognizedValue(secret.Kind);
 		}
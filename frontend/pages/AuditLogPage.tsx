@@ -4,30 +4,45 @@ import { Timestamp } from 'f61ui/component/timestamp';
 import { defaultErrorHandler } from 'f61ui/errors';
 import { auditLogEntries } from 'generated/apitypes_endpoints';
 import { AuditlogEntry } from 'generated/apitypes_types';
+import { accountUrl, indexUrl } from 'generated/apitypes_uiroutes';
 import { RootFolderName } from 'generated/domain_types';
 import { AppDefaultLayout } from 'layout/appdefaultlayout';
 import * as React from 'react';
-import { indexUrl } from 'generated/apitypes_uiroutes';
 
 interface AuditLogPageState {
 	entries: AuditlogEntry[];
+	nextPage: string;
 }
 
 export default class AuditLogPage extends React.Component<{}, AuditLogPageState> {
 	private title = 'Audit log';
 
 	componentDidMount() {
-		this.fetchData();
+		this.fetchData('');
 	}
 
 	render() {
-		const entryToRow = (entry: AuditlogEntry, idx: number) => (
-			<tr key={idx}>
+		const entryToRow = (entry: AuditlogEntry) => (
+			<tr key={entry.Seq}>
 				<td>
 					<Timestamp ts={entry.Timestamp} />
 				</td>
 				<td>{entry.UserId}</td>
-				<td>{entry.Message}</td>
+				<td>{entry.Event}</td>
+				<td>
+					{entry.AccountId ? (
+						<a href={accountUrl({ id: entry.AccountId })}>{entry.AccountId}</a>
+					) : (
+						''
+					)}
+				</td>
+				<td>{entry.SecretIds.join(', ')}</td>
+				<td>
+					{entry.SecretUsedType}
+					{entry.KeylistKey ? ` (${entry.KeylistKey})` : ''}
+				</td>
+				<td>{entry.IpAddress}</td>
+				<td>{entry.UserAgent}</td>
 			</tr>
 		);
 
@@ -47,8 +62,30 @@ export default class AuditLogPage extends React.Component<{}, AuditLogPageState>
 				<h1>{this.title}</h1>
 
 				<table className="table table-striped">
+					<thead>
+						<tr>
+							<th>Time</th>
+							<th>User</th>
+							<th>Event</th>
+							<th>Account</th>
+							<th>Secrets</th>
+							<th>Secret used</th>
+							<th>IP</th>
+							<th>User agent</th>
+						</tr>
+					</thead>
 					<tbody>{rows}</tbody>
 				</table>
+
+				{this.state && this.state.nextPage ? (
+					<button
+						className="btn btn-default"
+						onClick={() => {
+							this.fetchData(this.state.nextPage);
+						}}>
+						Older
+					</button>
+				) : null}
 			</AppDefaultLayout>
 		);
 	}
@@ -60,10 +97,13 @@ export default class AuditLogPage extends React.Component<{}, AuditLogPageState>
 		];
 	}
 
-	private fetchData() {
-		auditLogEntries().then((entries) => {
+	private fetchData(before: string) {
+		auditLogEntries('', '', '', '', '', '', before, '').then((page) => {
+			const previousEntries = this.state && before ? this.state.entries : [];
+
 			this.setState({
-				entries,
+				entries: previousEntries.concat(page.Entries),
+				nextPage: page.NextPage,
 			});
 		}, defaultErrorHandler);
 	}
@@ -1,3 +1,4 @@
+import { U2fSigner } from 'components/U2F';
 import { DangerAlert, InfoAlert } from 'f61ui/component/alerts';
 import { Button, Panel } from 'f61ui/component/bootstrap';
 import { Breadcrumb } from 'f61ui/component/breadcrumbtrail';
@@ -13,15 +14,37 @@ import {
 	UserAddAccessToken,
 	UserChangeDecryptionKeyPassword,
 	UserChangePassword,
+	UserConfigureAutoSeal,
 	UserCreate,
+	UserCreateRecoveryShares,
+	UserLockDecryptionKey,
+	UserRecoverDecryptionKey,
 	UserRegisterU2FToken,
+	UserRotateDecryptionKey,
+	UserScanBreachedPasswords,
 } from 'generated/apitypes_commands';
-import { u2fEnrolledTokens, u2fEnrollmentChallenge, userList } from 'generated/apitypes_endpoints';
-import { RegisterResponse, U2FEnrolledToken, User } from 'generated/apitypes_types';
+import {
+	healthReport,
+	recoveryShares,
+	recoverySharesChallenge,
+	u2fEnrolledTokens,
+	u2fEnrollmentChallenge,
+	userList,
+} from 'generated/apitypes_endpoints';
+import {
+	HealthReport,
+	PasswordHealth,
+	RecoveryShares,
+	RegisterResponse,
+	U2FChallengeBundle,
+	U2FEnrolledToken,
+	U2FResponseBundle,
+	User,
+} from 'generated/apitypes_types';
 import { RootFolderName } from 'generated/domain_types';
 import { AppDefaultLayout } from 'layout/appdefaultlayout';
 import * as React from 'react';
-import { indexUrl } from 'generated/apitypes_uiroutes';
+import { accountUrl, indexUrl } from 'generated/apitypes_uiroutes';
 import { isU2FError, u2fErrorMsg, U2FStdRegisterResponse } from 'u2ftypes';
 
 interface SettingsPageState {
@@ -30,6 +53,9 @@ interface SettingsPageState {
 	enrolledTokens?: U2FEnrolledToken[];
 	enrollmentError?: string;
 	users?: User[];
+	recoverySharesChallenge?: U2FChallengeBundle;
+	recoveryShares?: RecoveryShares;
+	healthReport?: HealthReport;
 }
 
 export default class SettingsPage extends React.Component<{}, SettingsPageState> {
@@ -49,9 +75,25 @@ export default class SettingsPage extends React.Component<{}, SettingsPageState>
 					<div className="col-md-4">
 						<Panel heading="Actions">
 							<div>
+								<CommandButton command={UserLockDecryptionKey()} />
+							</div>
+
+							<div className="margin-top">
+								<CommandButton command={UserConfigureAutoSeal()} />
+							</div>
+
+							<div className="margin-top">
+								<CommandButton command={UserScanBreachedPasswords()} />
+							</div>
+
+							<div className="margin-top">
 								<CommandButton command={UserChangeDecryptionKeyPassword()} />
 							</div>
 
+							<div className="margin-top">
+								<CommandButton command={UserRotateDecryptionKey()} />
+							</div>
+
 							<div className="margin-top">
 								<CommandButton command={DatabaseExportToKeepass()} />
 							</div>
@@ -71,6 +113,10 @@ export default class SettingsPage extends React.Component<{}, SettingsPageState>
 
 							{this.u2fEnrollmentUi()}
 						</Panel>
+
+						<Panel heading="Recovery shares">{this.renderRecoveryShares()}</Panel>
+
+						<Panel heading="Password health">{this.renderHealthReport()}</Panel>
 					</div>
 				</div>
 			</AppDefaultLayout>
@@ -157,6 +203,150 @@ export default class SettingsPage extends React.Component<{}, SettingsPageState>
 		);
 	}
 
+	private renderRecoveryShares() {
+		const shares = this.state.recoveryShares;
+
+		return (
+			<div>
+				<p>
+					If you forget your master password, any {shares ? shares.Threshold : 'N'} of the
+					shares can be combined to set a new one.
+				</p>
+
+				{shares ? (
+					<table className="table">
+						<thead>
+							<tr>
+								<th>Share</th>
+								<th>QR code</th>
+							</tr>
+						</thead>
+						<tbody>
+							{shares.Shares.map((share, idx) => (
+								<tr key={share}>
+									<td>
+										<code>{share}</code>
+									</td>
+									<td>
+										<img
+											src={`data:image/png;base64,${shares.QrCodesPng[idx]}`}
+										/>
+									</td>
+								</tr>
+							))}
+						</tbody>
+					</table>
+				) : this.state.recoverySharesChallenge ? (
+					<U2fSigner
+						challenge={this.state.recoverySharesChallenge}
+						signed={(signature) => {
+							this.setState({ recoverySharesChallenge: undefined });
+
+							shouldAlwaysSucceed(this.fetchRecoveryShares(signature));
+						}}
+					/>
+				) : (
+					<Button
+						label="Show shares"
+						click={() => {
+							shouldAlwaysSucceed(this.fetchRecoverySharesChallenge());
+						}}
+					/>
+				)}
+
+				<div className="margin-top">
+					<CommandButton command={UserCreateRecoveryShares()} />
+					&nbsp;
+					<CommandButton command={UserRecoverDecryptionKey()} />
+				</div>
+			</div>
+		);
+	}
+
+	private renderHealthReport() {
+		const report = this.state.healthReport;
+
+		if (!report) {
+			return (
+				<Button
+					label="Show report"
+					click={() => {
+						shouldAlwaysSucceed(this.fetchHealthReport());
+					}}
+				/>
+			);
+		}
+
+		const passwordsTable = (passwords: PasswordHealth[]) => (
+			<table className="table">
+				<thead>
+					<tr>
+						<th>Account</th>
+						<th>Secret</th>
+						<th>Created</th>
+						<th>Entropy (bits)</th>
+					</tr>
+				</thead>
+				<tbody>
+					{passwords.map((pwd) => (
+						<tr key={pwd.SecretId}>
+							<td>
+								<a href={accountUrl({ id: pwd.AccountId })}>{pwd.AccountTitle}</a>
+							</td>
+							<td>{pwd.SecretTitle}</td>
+							<td>
+								<Timestamp ts={pwd.Created} />
+							</td>
+							<td>{pwd.EntropyBits}</td>
+						</tr>
+					))}
+				</tbody>
+			</table>
+		);
+
+		return (
+			<div>
+				<h3>Reused ({report.Reused.length} groups)</h3>
+				{report.Reused.map((group, idx) => (
+					<div key={idx}>{passwordsTable(group.Passwords)}</div>
+				))}
+
+				<h3>Weak (under {report.WeakBelowEntropyBits} bits)</h3>
+				{passwordsTable(report.Weak)}
+
+				<h3>Older than {report.MaxAgeDays} days</h3>
+				{passwordsTable(report.Old)}
+
+				<h3>Breached</h3>
+				{passwordsTable(report.Breached)}
+			</div>
+		);
+	}
+
+	private async fetchHealthReport() {
+		try {
+			this.setState({ healthReport: await healthReport('') });
+		} catch (ex) {
+			defaultErrorHandler(ex);
+		}
+	}
+
+	private async fetchRecoverySharesChallenge() {
+		try {
+			this.setState({ recoverySharesChallenge: await recoverySharesChallenge() });
+		} catch (ex) {
+			defaultErrorHandler(ex);
+		}
+	}
+
+	private async fetchRecoveryShares(signature: U2FResponseBundle) {
+		try {
+			this.setState({ recoveryShares: await recoveryShares(signature) });
+		} catch (ex) {
+			defaultErrorHandler(ex);
+		}
+	}
+
 	private renderEnrolledTokens() {
 		return this.state.enrolledTokens ? (
 			<table className="table">
@@ -17,11 +17,11 @@ require (
 	github.com/mattetti/filebuffer v0.0.0-20171024213321-3a1e8e5a6548
 	github.com/microsoft/go-winio v0.4.12
 	github.com/patrickmn/go-cache v2.1.0+incompatible
-	github.com/pquerna/otp v1.1.0
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/pflag v1.0.5
 	github.com/tobischo/gokeepasslib v1.0.0
 	github.com/tstranex/u2f v1.0.0
-	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
-	golang.org/x/sys v0.0.0-20200122134326-e047566fdf82
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	golang.org/x/sys v0.0.0-20201119102817-f84b799fce68
+	golang.org/x/term v0.0.0-20201126162022-7de9c90e9dd1
 )
@@ -0,0 +1,297 @@
+// Streams new audit log entries to external destinations (syslog, files), so they leave
+// the device as soon as they happen
+package auditsink
+
+import (
+	"context"
+	"fmt"
+	"github.com/function61/gokit/atomicfilewrite"
+	"github.com/function61/gokit/fileexists"
+	"github.com/function61/gokit/jsonfile"
+	"github.com/function61/gokit/logex"
+	"github.com/function61/passitron/pkg/apitypes"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	ConfigFilename  = "auditsinks.json"
+	CursorsFilename = "auditsinks-cursors.json"
+	maxBackoff      = 1 * time.Minute
+)
+
+type Sink interface {
+	// returning error means the entry will be retried later
+	Deliver(entry apitypes.AuditlogEntry) error
+	Close() error
+}
+
+type Config struct {
+	Type    string `json:"type"`              // "jsonlines" | "syslog"
+	Path    string `json:"path,omitempty"`    // jsonlines
+	Network string `json:"network,omitempty"` // syslog: "udp" | "tcp" | "unix" | "unixgram"
+	Address string `json:"address,omitempty"` // syslog: "host:port" or socket path
+}
+
+func (c Config) String() string {
+	switch c.Type {
+	case "jsonlines":
+		return c.Type + ":" + c.Path
+	default:
+		return c.Type + ":" + c.Network + ":" + c.Address
+	}
+}
+
+// returns empty list if config file does not exist (= audit sinks not in use)
+func ReadConfig(path string) ([]Config, error) {
+	exists, err := fileexists.Exists(path)
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	configs := []Config{}
+	if err := jsonfile.Read(path, &configs, true); err != nil {
+		return nil, err
+	}
+
+	return configs, nil
+}
+
+func New(config Config) (Sink, error) {
+	switch config.Type {
+	case "jsonlines":
+		return NewJsonLines(config.Path)
+	case "syslog":
+		return NewSyslog(config.Network, config.Address)
+	default:
+		return nil, fmt.Errorf("unsupported sink type: %s", config.Type)
+	}
+}
+
+// the audit log, which is a projection of the event log (so entries can be re-read). Seq
+// is per-user, starting from 1
+type Source interface {
+	UserIds() []string
+	AuditLogAfter(userId string, seq int) []apitypes.AuditlogEntry
+}
+
+// delivers entries to sinks in the background. each sink has its own cursor (per user: Seq
+// of the last delivered entry) that is persisted after each delivery, so entries missed due
+// to a slow or unavailable sink (or us being restarted) are re-read from the audit log
+// instead of being dropped. each sink is also delivered to independently, so one sink
+// doesn't hold up the others (or the caller).
+type Dispatcher struct {
+	workers     []*sinkWorker
+	source      Source
+	cursorsPath string
+	cursors     map[string]map[string]int // sink name => user id => Seq of last delivered entry
+	cursorsMu   sync.Mutex
+	logl        *logex.Leveled
+}
+
+type sinkWorker struct {
+	name   string
+	sink   Sink
+	wakeup chan struct{}
+}
+
+func NewDispatcher(configs []Config, source Source, cursorsPath string, logger *log.Logger) (*Dispatcher, error) {
+	d := &Dispatcher{
+		workers:     []*sinkWorker{},
+		source:      source,
+		cursorsPath: cursorsPath,
+		cursors:     map[string]map[string]int{},
+		logl:        logex.Levels(logger),
+	}
+
+	exists, err := fileexists.Exists(cursorsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if exists {
+		if err := jsonfile.Read(cursorsPath, &d.cursors, true); err != nil {
+			return nil, fmt.Errorf("%s: %w", cursorsPath, err)
+		}
+	}
+
+	for _, config := range configs {
+		sink, err := New(config)
+		if err != nil {
+			d.closeSinks()
+			return nil, fmt.Errorf("%s: %w", config.String(), err)
+		}
+
+		d.addSink(config.String(), sink)
+	}
+
+	if err := d.initCursorsOfNewSinks(); err != nil {
+		d.closeSinks()
+		return nil, err
+	}
+
+	return d, nil
+}
+
+func (d *Dispatcher) addSink(name string, sink Sink) {
+	d.workers = append(d.workers, &sinkWorker{
+		name:   name,
+		sink:   sink,
+		wakeup: make(chan struct{}, 1),
+	})
+}
+
+// never blocks. only wakes up the workers, which read the entry (and anything else they
+// haven't delivered yet) from the Source
+func (d *Dispatcher) Submit(_ apitypes.AuditlogEntry) {
+	for _, worker := range d.workers {
+		select {
+		case worker.wakeup <- struct{}{}:
+		default: // already has a pending wakeup
+		}
+	}
+}
+
+func (d *Dispatcher) Run(ctx context.Context) error {
+	defer d.closeSinks()
+
+	wg := sync.WaitGroup{}
+
+	for _, worker := range d.workers {
+		wg.Add(1)
+
+		go func(worker *sinkWorker) {
+			defer wg.Done()
+
+			d.runWorker(ctx, worker)
+		}(worker)
+	}
+
+	wg.Wait()
+
+	return nil
+}
+
+func (d *Dispatcher) runWorker(ctx context.Context, worker *sinkWorker) {
+	for {
+		// catches up with entries that were missed (e.g. during our downtime) at start
+		if err := d.deliverPending(ctx, worker); err != nil {
+			return // only errors if ctx is done
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-worker.wakeup:
+		}
+	}
+}
+
+func (d *Dispatcher) deliverPending(ctx context.Context, worker *sinkWorker) error {
+	for _, userId := range d.source.UserIds() {
+		for _, entry := range d.source.AuditLogAfter(userId, d.cursor(worker.name, userId)) {
+			if err := d.deliver(ctx, worker, entry); err != nil {
+				return err
+			}
+
+			if err := d.advanceCursor(worker.name, userId, entry.Seq); err != nil {
+				// the entry will be delivered again after restart, which is better than
+				// not delivering it at all
+				d.logl.Error.Printf("%s: advanceCursor: %v", worker.name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// retries until success. only errors if ctx is done
+func (d *Dispatcher) deliver(ctx context.Context, worker *sinkWorker, entry apitypes.AuditlogEntry) error {
+	backoff := 1 * time.Second
+
+	for {
+		err := worker.sink.Deliver(entry)
+		if err == nil {
+			return nil
+		}
+
+		d.logl.Error.Printf("%s: retrying in %s: %v", worker.name, backoff, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// sinks that we haven't seen before start from the current entries, instead of having the
+// whole history delivered to them
+func (d *Dispatcher) initCursorsOfNewSinks() error {
+	d.cursorsMu.Lock()
+	defer d.cursorsMu.Unlock()
+
+	if len(d.workers) == 0 { // don't litter the disk when sinks are not in use
+		return nil
+	}
+
+	for _, worker := range d.workers {
+		if _, seen := d.cursors[worker.name]; seen {
+			continue
+		}
+
+		cursors := map[string]int{}
+
+		for _, userId := range d.source.UserIds() {
+			if entries := d.source.AuditLogAfter(userId, 0); len(entries) > 0 {
+				cursors[userId] = entries[len(entries)-1].Seq
+			}
+		}
+
+		d.cursors[worker.name] = cursors
+	}
+
+	return d.saveCursors()
+}
+
+func (d *Dispatcher) cursor(sinkName string, userId string) int {
+	d.cursorsMu.Lock()
+	defer d.cursorsMu.Unlock()
+
+	return d.cursors[sinkName][userId]
+}
+
+func (d *Dispatcher) advanceCursor(sinkName string, userId string, seq int) error {
+	d.cursorsMu.Lock()
+	defer d.cursorsMu.Unlock()
+
+	if _, has := d.cursors[sinkName]; !has {
+		d.cursors[sinkName] = map[string]int{}
+	}
+
+	d.cursors[sinkName][userId] = seq
+
+	return d.saveCursors()
+}
+
+// caller must hold cursorsMu
+func (d *Dispatcher) saveCursors() error {
+	return atomicfilewrite.Write(d.cursorsPath, func(sink io.Writer) error {
+		return jsonfile.Marshal(sink, d.cursors)
+	})
+}
+
+func (d *Dispatcher) closeSinks() {
+	for _, worker := range d.workers {
+		if err := worker.sink.Close(); err != nil {
+			d.logl.Error.Printf("%s: Close: %v", worker.name, err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package auditsink
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/passitron/pkg/apitypes"
+	"github.com/function61/passitron/pkg/domain"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var (
+	t0 = time.Date(2020, 2, 20, 14, 2, 0, 0, time.UTC)
+)
+
+func testEntry() apitypes.AuditlogEntry {
+	secretUsedType := domain.SecretUsedTypeKeylistKeyExposed
+
+	return apitypes.AuditlogEntry{
+		Seq:            3,
+		Timestamp:      t0,
+		UserId:         "1",
+		Event:          "account.SecretUsed",
+		AccountId:      "acc1",
+		SecretIds:      []string{"klId5"},
+		SecretUsedType: &secretUsedType,
+		KeylistKey:     `"0]2\`,
+	}
+}
+
+func TestFormatSyslogMessage(t *testing.T) {
+	msg, err := formatSyslogMessage(testEntry(), "myhost", 123)
+	assert.Ok(t, err)
+
+	assert.EqualString(t, msg, `<85>1 2020-02-20T14:02:00.000000Z myhost passitron 123 account.SecretUsed [audit@32473 seq="3" user="1" account="acc1" secrets="klId5" secretUsedType="KeylistKeyExposed" keylistKey="\"0\]2\\"] {"AccountId":"acc1","Event":"account.SecretUsed","IpAddress":"","KeylistKey":"\"0]2\\","SecretIds":["klId5"],"SecretUsedType":"KeylistKeyExposed","Seq":3,"Timestamp":"2020-02-20T14:02:00Z","UserAgent":"","UserId":"1"}`)
+}
+
+func TestSyslogOverTcp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Ok(t, err)
+	defer listener.Close()
+
+	received := make(chan string, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		// octet counting framing: "<length> <message>"
+		reader := bufio.NewReader(conn)
+
+		lengthSerialized, _ := reader.ReadString(' ')
+		length, _ := strconv.Atoi(strings.TrimSuffix(lengthSerialized, " "))
+
+		msg := make([]byte, length)
+		_, _ = io.ReadFull(reader, msg)
+
+		received <- string(msg)
+	}()
+
+	sink, err := NewSyslog("tcp", listener.Addr().String())
+	assert.Ok(t, err)
+	defer sink.Close()
+
+	assert.Ok(t, sink.Deliver(testEntry()))
+
+	hostname, err := os.Hostname()
+	assert.Ok(t, err)
+
+	expected, err := formatSyslogMessage(testEntry(), hostname, os.Getpid())
+	assert.Ok(t, err)
+
+	assert.EqualString(t, <-received, expected)
+}
+
+type flakySink struct {
+	failuresLeft int
+	delivered    chan apitypes.AuditlogEntry
+}
+
+func (f *flakySink) Deliver(entry apitypes.AuditlogEntry) error {
+	if f.failuresLeft > 0 {
+		f.failuresLeft--
+		return errors.New("sink unavailable")
+	}
+
+	f.delivered <- entry
+	return nil
+}
+
+func (f *flakySink) Close() error {
+	return nil
+}
+
+type testSource struct {
+	mu      sync.Mutex
+	entries []apitypes.AuditlogEntry // all for user "1"
+}
+
+func (s *testSource) UserIds() []string {
+	return []string{"1"}
+}
+
+func (s *testSource) AuditLogAfter(userId string, seq int) []apitypes.AuditlogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]apitypes.AuditlogEntry{}, s.entries[seq:]...)
+}
+
+func (s *testSource) add() apitypes.AuditlogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry := testEntry()
+	entry.Seq = len(s.entries) + 1
+	s.entries = append(s.entries, entry)
+
+	return entry
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "auditsink")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	source := &testSource{}
+
+	dispatcher, err := NewDispatcher(nil, source, filepath.Join(dir, CursorsFilename), nil)
+	assert.Ok(t, err)
+
+	sink := &flakySink{
+		failuresLeft: 1,
+		delivered:    make(chan apitypes.AuditlogEntry, 1),
+	}
+
+	dispatcher.addSink("flaky", sink)
+
+	go func() {
+		_ = dispatcher.Run(ctx)
+	}()
+
+	dispatcher.Submit(source.add())
+
+	select {
+	case entry := <-sink.delivered:
+		assert.Assert(t, entry.Seq == 1)
+	case <-time.After(5 * time.Second):
+		t.Fatal("entry not delivered")
+	}
+}
+
+// entries that a sink missed (we were stopped, or it was busy/unavailable) are delivered
+// after restart, and delivered entries are not re-delivered
+func TestDispatcherCatchesUpFromCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auditsink")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	source := &testSource{}
+	cursorsPath := filepath.Join(dir, CursorsFilename)
+
+	runUntilDelivered := func(expectedSeqs ...int) {
+		t.Helper()
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		dispatcher, err := NewDispatcher(nil, source, cursorsPath, nil)
+		assert.Ok(t, err)
+
+		sink := &flakySink{delivered: make(chan apitypes.AuditlogEntry, 10)}
+		dispatcher.addSink("sink1", sink)
+
+		stopped := make(chan interface{})
+		go func() {
+			defer close(stopped)
+			_ = dispatcher.Run(ctx)
+		}()
+
+		for _, expectedSeq := range expectedSeqs {
+			select {
+			case entry := <-sink.delivered:
+				assert.Assert(t, entry.Seq == expectedSeq)
+			case <-time.After(5 * time.Second):
+				t.Fatal("entry not delivered")
+			}
+		}
+
+		cancel()
+		<-stopped
+
+		assert.Assert(t, len(sink.delivered) == 0)
+	}
+
+	source.add()
+	source.add()
+
+	runUntilDelivered(1, 2)
+
+	// these are submitted while nobody is listening
+	source.add()
+	source.add()
+	source.add()
+
+	runUntilDelivered(3, 4, 5)
+}
@@ -0,0 +1,39 @@
+package auditsink
+
+import (
+	"encoding/json"
+	"github.com/function61/passitron/pkg/apitypes"
+	"os"
+)
+
+// appends each entry as a JSON-encoded line to a file
+type jsonLines struct {
+	file *os.File
+}
+
+func NewJsonLines(path string) (Sink, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &jsonLines{file}, nil
+}
+
+func (j *jsonLines) Deliver(entry apitypes.AuditlogEntry) error {
+	line, err := json.Marshal(&entry)
+	if err != nil {
+		return err
+	}
+
+	// one write, so the line doesn't get interleaved with others'
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+
+	return j.file.Sync()
+}
+
+func (j *jsonLines) Close() error {
+	return j.file.Close()
+}
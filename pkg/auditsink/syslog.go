@@ -0,0 +1,165 @@
+package auditsink
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/function61/passitron/pkg/apitypes"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	syslogAppName = "passitron"
+	// facility=authpriv(10) severity=notice(5) => 10*8+5
+	syslogPriority = 85
+	// private enterprise number reserved for documentation (RFC 5612)
+	syslogSdId       = "audit@32473"
+	syslogNetTimeout = 10 * time.Second
+)
+
+// RFC 5424 syslog messages over UDP, TCP or unix socket. stream transports use octet
+// counting framing (RFC 6587), datagram transports send one message per datagram.
+type syslog struct {
+	network  string
+	address  string
+	hostname string
+	conn     net.Conn // nil when not connected
+}
+
+func NewSyslog(network string, address string) (Sink, error) {
+	switch network {
+	case "udp", "tcp", "unix", "unixgram":
+	default:
+		return nil, fmt.Errorf("unsupported syslog network: %s", network)
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslog{
+		network:  network,
+		address:  address,
+		hostname: hostname,
+	}, nil
+}
+
+func (s *syslog) Deliver(entry apitypes.AuditlogEntry) error {
+	msg, err := formatSyslogMessage(entry, s.hostname, os.Getpid())
+	if err != nil {
+		return err
+	}
+
+	if s.network == "tcp" || s.network == "unix" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	if s.conn == nil {
+		conn, err := net.DialTimeout(s.network, s.address, syslogNetTimeout)
+		if err != nil {
+			return err
+		}
+
+		s.conn = conn
+	}
+
+	if err := s.conn.SetWriteDeadline(time.Now().Add(syslogNetTimeout)); err != nil {
+		return s.disconnect(err)
+	}
+
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		// reconnect on next try
+		return s.disconnect(err)
+	}
+
+	return nil
+}
+
+func (s *syslog) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+
+	return s.disconnect(nil)
+}
+
+func (s *syslog) disconnect(errRet error) error {
+	err := s.conn.Close()
+	s.conn = nil
+
+	if errRet != nil {
+		return errRet
+	}
+
+	return err
+}
+
+// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID [STRUCTURED-DATA] MSG
+func formatSyslogMessage(entry apitypes.AuditlogEntry, hostname string, pid int) (string, error) {
+	msg, err := json.Marshal(&entry)
+	if err != nil {
+		return "", err
+	}
+
+	secretUsedType := ""
+	if entry.SecretUsedType != nil {
+		secretUsedType = string(*entry.SecretUsedType)
+	}
+
+	params := []string{}
+	addParam := func(name string, value string) {
+		if value != "" {
+			params = append(params, fmt.Sprintf(`%s="%s"`, name, syslogEscapeParamValue(value)))
+		}
+	}
+
+	addParam("seq", fmt.Sprintf("%d", entry.Seq))
+	addParam("user", entry.UserId)
+	addParam("account", entry.AccountId)
+	addParam("secrets", strings.Join(entry.SecretIds, ","))
+	addParam("secretUsedType", secretUsedType)
+	addParam("keylistKey", entry.KeylistKey)
+	addParam("ip", entry.IpAddress)
+	addParam("userAgent", entry.UserAgent)
+
+	return fmt.Sprintf(
+		"<%d>1 %s %s %s %d %s [%s %s] %s",
+		syslogPriority,
+		entry.Timestamp.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(hostname, 255),
+		syslogAppName,
+		pid,
+		syslogHeaderField(entry.Event, 32),
+		syslogSdId,
+		strings.Join(params, " "),
+		msg), nil
+}
+
+// header fields are length-limited printable US-ASCII without spaces. "-" stands for nil
+func syslogHeaderField(value string, maxLen int) string {
+	sanitized := strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, value)
+
+	if sanitized == "" {
+		return "-"
+	}
+
+	if len(sanitized) > maxLen {
+		return sanitized[:maxLen]
+	}
+
+	return sanitized
+}
+
+var syslogParamValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func syslogEscapeParamValue(value string) string {
+	return syslogParamValueEscaper.Replace(value)
+}
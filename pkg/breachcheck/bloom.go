@@ -0,0 +1,165 @@
+package breachcheck
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// file format: magic | hash kind (1 byte) | hash function count (1 byte) | bit count (uint64) | bits
+var bloomMagic = []byte("pwbloom1")
+
+const bloomHeaderLen = 8 + 1 + 1 + 8
+
+// much smaller than the sorted file (~1.5 GB instead of ~35 GB for HIBP's ~850M hashes at
+// 0.1 % false positive rate), and only reads a few bytes per lookup
+type bloomFilter struct {
+	file      *os.File
+	hashKind  HashKind
+	hashFns   int
+	bitsCount uint64
+}
+
+func openBloomFilter(file *os.File, size int64) (*bloomFilter, error) {
+	header := make([]byte, bloomHeaderLen)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+
+	filter := &bloomFilter{
+		file:      file,
+		hashKind:  HashKind(header[8]),
+		hashFns:   int(header[9]),
+		bitsCount: binary.BigEndian.Uint64(header[10:]),
+	}
+
+	if filter.hashKind != HashSha1 && filter.hashKind != HashNtlm {
+		return nil, fmt.Errorf("unknown hash kind: %d", filter.hashKind)
+	}
+
+	if filter.hashFns == 0 || filter.bitsCount == 0 {
+		return nil, errEmptyDataset
+	}
+
+	if expectedSize := int64(bloomHeaderLen) + int64(bitsToBytes(filter.bitsCount)); size != expectedSize {
+		return nil, fmt.Errorf("bloom filter size %d; expecting %d", size, expectedSize)
+	}
+
+	return filter, nil
+}
+
+func (b *bloomFilter) Contains(password []byte) (bool, error) {
+	bit := make([]byte, 1)
+
+	for _, pos := range bloomBitPositions(hashPassword(password, b.hashKind), b.hashFns, b.bitsCount) {
+		if _, err := b.file.ReadAt(bit, int64(bloomHeaderLen)+int64(pos/8)); err != nil {
+			return false, err
+		}
+
+		if bit[0]&(1<<(pos%8)) == 0 {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+func (b *bloomFilter) Close() error {
+	return b.file.Close()
+}
+
+// builds a bloom filter from HIBP's sorted file. the sorted file is read twice (first to
+// count the hashes). the filter is built in memory, so do this on a computer with enough
+// of it, and copy the result to the device
+func BuildBloomFilter(sortedPath string, falsePositiveRate float64, output io.Writer) error {
+	if falsePositiveRate <= 0 || falsePositiveRate >= 1 {
+		return errors.New("falsePositiveRate must be between 0 and 1")
+	}
+
+	sorted, err := os.Open(sortedPath)
+	if err != nil {
+		return err
+	}
+	defer sorted.Close()
+
+	var hashKind HashKind
+	hashCount := uint64(0)
+
+	if err := eachHash(bufio.NewReader(sorted), func(hash []byte) error {
+		if hashCount == 0 {
+			kind, err := hashKindFromHexLength(len(hash) * 2)
+			if err != nil {
+				return err
+			}
+
+			hashKind = kind
+		}
+
+		hashCount++
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if hashCount == 0 {
+		return errEmptyDataset
+	}
+
+	// optimal parameters: https://en.wikipedia.org/wiki/Bloom_filter#Optimal_number_of_hash_functions
+	bitsCount := uint64(math.Ceil(-float64(hashCount) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	hashFns := int(math.Round(float64(bitsCount) / float64(hashCount) * math.Ln2))
+	if hashFns < 1 {
+		hashFns = 1
+	}
+
+	bits := make([]byte, bitsToBytes(bitsCount))
+
+	if _, err := sorted.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := eachHash(bufio.NewReader(sorted), func(hash []byte) error {
+		for _, pos := range bloomBitPositions(hash, hashFns, bitsCount) {
+			bits[pos/8] |= 1 << (pos % 8)
+		}
+
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	header := make([]byte, bloomHeaderLen)
+	copy(header, bloomMagic)
+	header[8] = byte(hashKind)
+	header[9] = byte(hashFns)
+	binary.BigEndian.PutUint64(header[10:], bitsCount)
+
+	if _, err := output.Write(header); err != nil {
+		return err
+	}
+
+	_, err = output.Write(bits)
+	return err
+}
+
+// the hashes are uniformly distributed already, so we derive the positions from them
+// with double hashing instead of hashing again
+func bloomBitPositions(hash []byte, hashFns int, bitsCount uint64) []uint64 {
+	h1 := binary.BigEndian.Uint64(hash[0:8])
+	h2 := binary.BigEndian.Uint64(hash[8:16]) | 1
+
+	positions := make([]uint64, hashFns)
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % bitsCount
+	}
+
+	return positions
+}
+
+func bitsToBytes(bits uint64) uint64 {
+	return (bits + 7) / 8
+}
@@ -0,0 +1,159 @@
+// Offline check of passwords against Have I Been Pwned's "Pwned Passwords" dataset. the
+// dataset is either HIBP's SHA-1 or NTLM file (ordered by hash) or a bloom filter built
+// from one. nothing about the passwords leaves the device.
+package breachcheck
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/md4"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	// looked up from working directory, bloom filter first
+	BloomFilterFilename = "hibp-passwords.bloom"
+	SortedFilename      = "hibp-passwords.txt"
+)
+
+type HashKind byte
+
+const (
+	HashSha1 HashKind = 1
+	HashNtlm HashKind = 2
+)
+
+type Dataset interface {
+	// is the password in the breach corpus. bloom filters have false positives
+	Contains(password []byte) (bool, error)
+	Close() error
+}
+
+// nil, nil if there's no dataset on the device
+func OpenDefault() (Dataset, error) {
+	for _, filename := range []string{BloomFilterFilename, SortedFilename} {
+		dataset, err := Open(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		return dataset, nil
+	}
+
+	return nil, nil
+}
+
+// format is detected from the content
+func Open(path string) (Dataset, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dataset, err := openFile(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return dataset, nil
+}
+
+func openFile(file *os.File) (Dataset, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	magic := make([]byte, len(bloomMagic))
+	if _, err := file.ReadAt(magic, 0); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if bytes.Equal(magic, bloomMagic) {
+		return openBloomFilter(file, stat.Size())
+	}
+
+	return openSorted(file, stat.Size())
+}
+
+func hashPassword(password []byte, kind HashKind) []byte {
+	switch kind {
+	case HashSha1:
+		digest := sha1.Sum(password)
+		return digest[:]
+	case HashNtlm: // MD4 of UTF-16LE
+		utf16le := []byte{}
+		for _, codeUnit := range utf16.Encode([]rune(string(password))) {
+			utf16le = append(utf16le, byte(codeUnit), byte(codeUnit>>8))
+		}
+
+		hash := md4.New()
+		hash.Write(utf16le)
+		return hash.Sum(nil)
+	default:
+		panic(fmt.Errorf("unknown HashKind: %d", kind))
+	}
+}
+
+func hashKindFromHexLength(length int) (HashKind, error) {
+	switch length {
+	case hex.EncodedLen(sha1.Size):
+		return HashSha1, nil
+	case hex.EncodedLen(md4.Size):
+		return HashNtlm, nil
+	default:
+		return 0, fmt.Errorf("unrecognized hash length %d. expecting SHA-1 or NTLM", length)
+	}
+}
+
+// HIBP's line format is "<hash in uppercase hex>:<count>"
+func parseLine(line string) (string, error) {
+	line = strings.TrimRight(line, "\r\n")
+
+	colonIdx := strings.IndexByte(line, ':')
+	if colonIdx == -1 {
+		return "", fmt.Errorf("invalid line: %s", line)
+	}
+
+	return strings.ToUpper(line[:colonIdx]), nil
+}
+
+// calls fn for each hash in the sorted file
+func eachHash(sorted io.Reader, fn func(hash []byte) error) error {
+	lines := bufio.NewScanner(sorted)
+	for lines.Scan() {
+		if len(lines.Bytes()) == 0 {
+			continue
+		}
+
+		hashHex, err := parseLine(lines.Text())
+		if err != nil {
+			return err
+		}
+
+		hash, err := hex.DecodeString(hashHex)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(hash); err != nil {
+			return err
+		}
+	}
+
+	return lines.Err()
+}
+
+var errEmptyDataset = errors.New("dataset is empty")
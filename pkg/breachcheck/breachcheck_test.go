@@ -0,0 +1,101 @@
+package breachcheck
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"github.com/function61/gokit/assert"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestHashPassword(t *testing.T) {
+	assert.EqualString(t, hex.EncodeToString(hashPassword([]byte("password"), HashSha1)), "5baa61e4c9b93f3f0682250b6cf8331b7ee68fd8")
+	assert.EqualString(t, hex.EncodeToString(hashPassword([]byte("password"), HashNtlm)), "8846f7eaee8fb117ad06bdd830b7586c")
+}
+
+func TestSortedAndBloomFilter(t *testing.T) {
+	for _, hashKind := range []HashKind{HashSha1, HashNtlm} {
+		hashKind := hashKind
+
+		t.Run(fmt.Sprintf("HashKind=%d", hashKind), func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "breachcheck")
+			assert.Ok(t, err)
+			defer os.RemoveAll(dir)
+
+			breached := []string{"password", "hunter2", "correcthorsebatterystaple", "päss"}
+
+			sortedPath := filepath.Join(dir, SortedFilename)
+			assert.Ok(t, ioutil.WriteFile(sortedPath, makeSortedFile(breached, hashKind, 1000), 0600))
+
+			bloomFilter := &bytes.Buffer{}
+			assert.Ok(t, BuildBloomFilter(sortedPath, 0.001, bloomFilter))
+
+			bloomPath := filepath.Join(dir, BloomFilterFilename)
+			assert.Ok(t, ioutil.WriteFile(bloomPath, bloomFilter.Bytes(), 0600))
+
+			for _, path := range []string{sortedPath, bloomPath} {
+				dataset, err := Open(path)
+				assert.Ok(t, err)
+
+				for _, password := range breached {
+					contains, err := dataset.Contains([]byte(password))
+					assert.Ok(t, err)
+					assert.Assert(t, contains)
+				}
+
+				for _, password := range []string{"", "notBreached", "hunter3", "zzzzzz"} {
+					contains, err := dataset.Contains([]byte(password))
+					assert.Ok(t, err)
+					assert.Assert(t, !contains)
+				}
+
+				assert.Ok(t, dataset.Close())
+			}
+		})
+	}
+}
+
+func TestOpenInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "breachcheck")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, SortedFilename)
+	assert.Ok(t, ioutil.WriteFile(path, []byte("ABCD:3\r\n"), 0600))
+
+	_, err = Open(path)
+	assert.EqualString(t, err.Error(), path+": unrecognized hash length 4. expecting SHA-1 or NTLM")
+}
+
+// in HIBP's format: uppercase hash, count and CRLF line endings
+func makeSortedFile(passwords []string, hashKind HashKind, randomHashes int) []byte {
+	hashLen := len(hashPassword(nil, hashKind))
+
+	lines := []string{}
+	for _, password := range passwords {
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(hashPassword([]byte(password), hashKind))))
+	}
+
+	rnd := rand.New(rand.NewSource(42))
+	for i := 0; i < randomHashes; i++ {
+		hash := make([]byte, hashLen)
+		rnd.Read(hash)
+
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(hash)))
+	}
+
+	sort.Strings(lines)
+
+	buf := &bytes.Buffer{}
+	for i, line := range lines {
+		fmt.Fprintf(buf, "%s:%d\r\n", line, i+1)
+	}
+
+	return buf.Bytes()
+}
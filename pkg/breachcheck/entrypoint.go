@@ -0,0 +1,42 @@
+package breachcheck
+
+import (
+	"fmt"
+	"github.com/function61/gokit/atomicfilewrite"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+)
+
+func Entrypoint() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "breachcheck",
+		Short: "Offline dataset of breached passwords (Have I Been Pwned)",
+	}
+
+	falsePositiveRate := 0.001
+
+	buildBloom := &cobra.Command{
+		Use:   "build-bloom [sortedpath]",
+		Short: "Builds " + BloomFilterFilename + " from HIBP's SHA-1 or NTLM file (ordered by hash)",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			exitIfError(atomicfilewrite.Write(BloomFilterFilename, func(output io.Writer) error {
+				return BuildBloomFilter(args[0], falsePositiveRate, output)
+			}))
+		},
+	}
+
+	buildBloom.Flags().Float64VarP(&falsePositiveRate, "false-positive-rate", "", falsePositiveRate, "Chance of flagging a password not in the dataset")
+
+	cmd.AddCommand(buildBloom)
+
+	return cmd
+}
+
+func exitIfError(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,138 @@
+package breachcheck
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+)
+
+// lines are ~45 bytes (hash + count), so this always covers the start of the next line
+const sortedReadChunk = 128
+
+// HIBP's "ordered by hash" file. it's tens of gigabytes, so we binary search it on disk
+type sortedFile struct {
+	file     *os.File
+	size     int64
+	hashKind HashKind
+}
+
+func openSorted(file *os.File, size int64) (*sortedFile, error) {
+	if size == 0 {
+		return nil, errEmptyDataset
+	}
+
+	firstLine, _, err := readLineAt(file, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	firstHash, err := parseLine(firstLine)
+	if err != nil {
+		return nil, err
+	}
+
+	hashKind, err := hashKindFromHexLength(len(firstHash))
+	if err != nil {
+		return nil, err
+	}
+
+	return &sortedFile{
+		file:     file,
+		size:     size,
+		hashKind: hashKind,
+	}, nil
+}
+
+func (s *sortedFile) Contains(password []byte) (bool, error) {
+	target := strings.ToUpper(hex.EncodeToString(hashPassword(password, s.hashKind)))
+
+	// invariant: if target's line exists, it starts within [lo, hi)
+	lo, hi := int64(0), s.size
+
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+
+		lineStart, err := s.lineStartAtOrAfter(mid)
+		if err != nil {
+			return false, err
+		}
+
+		if lineStart >= hi {
+			hi = mid
+			continue
+		}
+
+		line, lineEnd, err := readLineAt(s.file, lineStart)
+		if err != nil {
+			return false, err
+		}
+
+		hash, err := parseLine(line)
+		if err != nil {
+			return false, err
+		}
+
+		switch {
+		case hash == target:
+			return true, nil
+		case hash < target:
+			lo = lineEnd
+		default: // no line starts within [mid, lineStart)
+			hi = mid
+		}
+	}
+
+	return false, nil
+}
+
+func (s *sortedFile) Close() error {
+	return s.file.Close()
+}
+
+// returns s.size if there are no more lines
+func (s *sortedFile) lineStartAtOrAfter(pos int64) (int64, error) {
+	if pos == 0 {
+		return 0, nil
+	}
+
+	// start reading from previous byte, so we notice if pos itself starts a line
+	chunk, err := readChunkAt(s.file, pos-1)
+	if err != nil {
+		return 0, err
+	}
+
+	newlineIdx := bytes.IndexByte(chunk, '\n')
+	if newlineIdx == -1 {
+		return s.size, nil
+	}
+
+	return pos - 1 + int64(newlineIdx) + 1, nil
+}
+
+// returns line and the position where the next line starts
+func readLineAt(file *os.File, pos int64) (string, int64, error) {
+	chunk, err := readChunkAt(file, pos)
+	if err != nil {
+		return "", 0, err
+	}
+
+	newlineIdx := bytes.IndexByte(chunk, '\n')
+	if newlineIdx == -1 { // last line without trailing newline
+		return string(chunk), pos + int64(len(chunk)), nil
+	}
+
+	return string(chunk[:newlineIdx]), pos + int64(newlineIdx) + 1, nil
+}
+
+func readChunkAt(file *os.File, pos int64) ([]byte, error) {
+	chunk := make([]byte, sortedReadChunk)
+
+	n, err := file.ReadAt(chunk, pos)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return chunk[:n], nil
+}
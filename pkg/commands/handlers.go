@@ -1,9 +1,8 @@
 package commands
 
 import (
-	"crypto/x509"
+	"crypto"
 	"encoding/json"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"github.com/function61/eventhorizon/pkg/ehevent"
@@ -12,27 +11,31 @@ import (
 	"github.com/function61/gokit/cryptorandombytes"
 	"github.com/function61/gokit/httpauth"
 	"github.com/function61/gokit/logex"
-	"github.com/function61/gokit/randompassword"
 	"github.com/function61/gokit/storedpassword"
 	"github.com/function61/passitron/pkg/apitypes"
+	"github.com/function61/passitron/pkg/compositekey"
 	"github.com/function61/passitron/pkg/domain"
 	"github.com/function61/passitron/pkg/keepassexport"
+	"github.com/function61/passitron/pkg/otptoken"
+	"github.com/function61/passitron/pkg/passwordgen"
+	"github.com/function61/passitron/pkg/securebuf"
+	"github.com/function61/passitron/pkg/sshkey"
 	"github.com/function61/passitron/pkg/state"
 	"github.com/function61/passitron/pkg/u2futil"
-	"github.com/pquerna/otp"
-	"github.com/pquerna/otp/totp"
 	"github.com/tstranex/u2f"
 	"golang.org/x/crypto/ssh"
 	"log"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strings"
 	"time"
 )
 
 var (
 	errAccountNotFound = errors.New("Account not found")
 	errFolderNotFound  = errors.New("Folder not found")
+	errUserNotFound    = errors.New("User not found")
 )
 
 type Handlers struct {
@@ -44,6 +47,20 @@ func (c *Handlers) userData(ctx *command.Ctx) *state.UserStorage {
 	return c.state.User(ctx.Meta.UserId)
 }
 
+// see AccountKeyOrCreate()
+func (c *Handlers) accountKeyFor(accountId string, ctx *command.Ctx) (*state.AccountKey, error) {
+	accountKey, keyCreated, err := c.userData(ctx).AccountKeyOrCreate(accountId, ctx.Meta)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyCreated != nil {
+		ctx.RaisesEvent(keyCreated)
+	}
+
+	return accountKey, nil
+}
+
 func New(state *state.AppState, logger *log.Logger) *Handlers {
 	return &Handlers{state, logex.Levels(logger)}
 }
@@ -139,6 +156,7 @@ func (h *Handlers) AccountDeleteSecret(a *apitypes.AccountDeleteSecret, ctx *com
 
 	// TODO: validate secret
 
+	// attachment content (if any) gets deleted once the event is stored
 	ctx.RaisesEvent(domain.NewAccountSecretDeleted(
 		a.Account,
 		a.Secret,
@@ -247,23 +265,44 @@ func (h *Handlers) AccountCreate(a *apitypes.AccountCreate, ctx *command.Ctx) er
 			ctx.Meta))
 	}
 
-	if a.Password != "" {
+	if a.Password != "" || a.PasswordPolicy != "" {
 		// if PasswordRepeat given, verify it
 		if err := verifyRepeatPassword(a.Password, a.PasswordRepeat); a.PasswordRepeat != "" && err != nil {
 			return err
 		}
 
-		envelope, err := h.userData(ctx).Crypto().Encrypt([]byte(a.Password))
+		password, policy, err := passwordOrGenerated(a.Password, a.PasswordPolicy)
+		if err != nil {
+			return err
+		}
+
+		secretId := state.RandomId()
+
+		accountKey, err := h.accountKeyFor(accountId, ctx)
+		if err != nil {
+			return err
+		}
+
+		envelope, err := accountKey.Encrypt([]byte(password), state.SecretContext{
+			AccountId: accountId,
+			SecretId:  secretId,
+			Kind:      domain.SecretKindPassword,
+		})
 		if err != nil {
 			return err
 		}
 
 		ctx.RaisesEvent(domain.NewAccountPasswordAdded(
 			accountId,
-			state.RandomId(),
+			secretId,
 			"", // not supported in this "quickly add password" use case
 			envelope,
+			policy,
 			ctx.Meta))
+
+		if err := h.checkPasswordBreached(accountId, secretId, password, ctx); err != nil {
+			return err
+		}
 	}
 
 	if a.Url != "" {
@@ -287,6 +326,19 @@ func (h *Handlers) AccountDelete(a *apitypes.AccountDelete, ctx *command.Ctx) er
 		return errAccountNotFound
 	}
 
+	// makes the account's secrets unrecoverable, even from the event log's history. the
+	// key and attachment content get destroyed once the events are stored. secrets from
+	// before account keys are not covered: they're encrypted for the user's decryption key,
+	// and stay recoverable from the history until it's rotated (see accountkeys.go)
+	keyDestroyed, err := h.userData(ctx).DestroyAccountKey(a.Id, ctx.Meta)
+	if err != nil {
+		return err
+	}
+
+	if keyDestroyed != nil {
+		ctx.RaisesEvent(keyDestroyed)
+	}
+
 	ctx.RaisesEvent(domain.NewAccountDeleted(
 		a.Id,
 		ctx.Meta))
@@ -303,24 +355,49 @@ func (h *Handlers) AccountAddPassword(a *apitypes.AccountAddPassword, ctx *comma
 		return err
 	}
 
-	password := a.Password
+	password, policy, err := passwordOrGenerated(a.Password, a.PasswordPolicy)
+	if err != nil {
+		return err
+	}
+
+	secretId := state.RandomId()
 
-	if password == "_auto" {
-		password = randompassword.Build(randompassword.DefaultAlphabet, 16)
+	accountKey, err := h.accountKeyFor(a.Account, ctx)
+	if err != nil {
+		return err
 	}
 
-	envelope, err := h.userData(ctx).Crypto().Encrypt([]byte(password))
+	envelope, err := accountKey.Encrypt([]byte(password), state.SecretContext{
+		AccountId: a.Account,
+		SecretId:  secretId,
+		Kind:      domain.SecretKindPassword,
+	})
 	if err != nil {
 		return err
 	}
 
 	ctx.RaisesEvent(domain.NewAccountPasswordAdded(
 		a.Account,
-		state.RandomId(),
+		secretId,
 		a.Title,
 		envelope,
+		policy,
 		ctx.Meta))
 
+	return h.checkPasswordBreached(a.Account, secretId, password, ctx)
+}
+
+// doesn't prevent storing the password (it might be in use somewhere), but flags it
+func (h *Handlers) checkPasswordBreached(accountId string, secretId string, password string, ctx *command.Ctx) error {
+	breachEvent, err := h.userData(ctx).CheckPasswordBreached(accountId, secretId, []byte(password), ctx.Meta)
+	if err != nil {
+		return err
+	}
+
+	if breachEvent != nil {
+		ctx.RaisesEvent(breachEvent)
+	}
+
 	return nil
 }
 
@@ -329,14 +406,25 @@ func (h *Handlers) AccountAddSecretNote(a *apitypes.AccountAddSecretNote, ctx *c
 		return errAccountNotFound
 	}
 
-	envelope, err := h.userData(ctx).Crypto().Encrypt([]byte(a.Note))
+	secretId := state.RandomId()
+
+	accountKey, err := h.accountKeyFor(a.Account, ctx)
+	if err != nil {
+		return err
+	}
+
+	envelope, err := accountKey.Encrypt([]byte(a.Note), state.SecretContext{
+		AccountId: a.Account,
+		SecretId:  secretId,
+		Kind:      domain.SecretKindNote,
+	})
 	if err != nil {
 		return err
 	}
 
 	ctx.RaisesEvent(domain.NewAccountSecretNoteAdded(
 		a.Account,
-		state.RandomId(),
+		secretId,
 		a.Title,
 		envelope,
 		ctx.Meta))
@@ -420,14 +508,25 @@ func (h *Handlers) AccountAddKeylist(a *apitypes.AccountAddKeylist, ctx *command
 		return err
 	}
 
-	envelope, err := h.userData(ctx).Crypto().Encrypt(keysJson)
+	secretId := state.RandomId()
+
+	accountKey, err := h.accountKeyFor(a.Account, ctx)
+	if err != nil {
+		return err
+	}
+
+	envelope, err := accountKey.Encrypt(keysJson, state.SecretContext{
+		AccountId: a.Account,
+		SecretId:  secretId,
+		Kind:      domain.SecretKindKeylist,
+	})
 	if err != nil {
 		return err
 	}
 
 	ctx.RaisesEvent(domain.NewAccountKeylistAdded(
 		a.Account,
-		state.RandomId(),
+		secretId,
 		a.Title,
 		keyExample,
 		envelope,
@@ -442,49 +541,112 @@ func (h *Handlers) AccountAddSshKey(a *apitypes.AccountAddSshKey, ctx *command.C
 	}
 
 	// validate and re-format SSH key
-	block, rest := pem.Decode([]byte(a.SshPrivateKey))
-	if block == nil {
-		return errors.New("Failed to parse PEM block")
+	privateKey, err := sshkey.Parse([]byte(a.SshPrivateKey), []byte(a.Passphrase))
+	if err != nil {
+		return err
 	}
+	defer securebuf.ZeroPrivateKey(privateKey)
 
-	if len(rest) > 0 {
-		return errors.New("Extra data included in PEM content")
+	secretId, envelope, publicKeyAuthorizedFormat, err := h.encryptSshKey(a.Id, privateKey, ctx)
+	if err != nil {
+		return err
 	}
 
-	if block.Type != "RSA PRIVATE KEY" {
-		return errors.New("Currently we only support RSA format keys")
+	ctx.RaisesEvent(domain.NewAccountSshKeyAdded(
+		a.Id,
+		secretId,
+		envelope,
+		publicKeyAuthorizedFormat,
+		ctx.Meta))
+
+	return nil
+}
+
+func (h *Handlers) AccountGenerateSshKey(a *apitypes.AccountGenerateSshKey, ctx *command.Ctx) error {
+	if h.userData(ctx).WrappedAccountById(a.Id) == nil {
+		return errAccountNotFound
 	}
 
-	if x509.IsEncryptedPEMBlock(block) {
-		// TODO: maybe implement here in import phase
-		return errors.New("We do not support encypted PEM blocks yet")
+	keyType := a.KeyType
+	if keyType == "" {
+		keyType = sshkey.KeyTypeEd25519
 	}
 
-	privateKeyReformatted := pem.EncodeToMemory(block)
+	privateKey, err := sshkey.Generate(keyType)
+	if err != nil {
+		return err
+	}
+	defer securebuf.ZeroPrivateKey(privateKey)
 
-	privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	secretId, envelope, publicKeyAuthorizedFormat, err := h.encryptSshKey(a.Id, privateKey, ctx)
 	if err != nil {
 		return err
 	}
 
+	// the public key (authorized_keys line) is the only thing that comes out of this
+	ctx.RaisesEvent(domain.NewAccountSshKeyGenerated(
+		a.Id,
+		secretId,
+		envelope,
+		publicKeyAuthorizedFormat,
+		ctx.Meta))
+
+	ctx.CreatedRecordId(secretId)
+
+	return nil
+}
+
+// returns secret id, envelope (of PKCS#8 PEM) and public key in authorized_keys format
+func (h *Handlers) encryptSshKey(
+	accountId string,
+	privateKey crypto.Signer,
+	ctx *command.Ctx,
+) (string, []byte, string, error) {
+	privateKeyPem, err := sshkey.MarshalPkcs8Pem(privateKey)
+	if err != nil {
+		return "", nil, "", err
+	}
+	defer securebuf.Zero(privateKeyPem)
+
 	// convert to SSH public key
-	publicKeySsh, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	publicKeySsh, err := ssh.NewPublicKey(privateKey.Public())
 	if err != nil {
-		return err
+		return "", nil, "", err
 	}
 
-	publicKeyAuthorizedFormat := string(ssh.MarshalAuthorizedKey(publicKeySsh))
+	secretId := state.RandomId()
 
-	envelope, err := h.userData(ctx).Crypto().Encrypt([]byte(privateKeyReformatted))
+	accountKey, err := h.accountKeyFor(accountId, ctx)
 	if err != nil {
-		return err
+		return "", nil, "", err
 	}
 
-	ctx.RaisesEvent(domain.NewAccountSshKeyAdded(
-		a.Id,
-		state.RandomId(),
-		envelope,
-		publicKeyAuthorizedFormat,
+	envelope, err := accountKey.Encrypt(privateKeyPem, state.SecretContext{
+		AccountId: accountId,
+		SecretId:  secretId,
+		Kind:      domain.SecretKindSshKey,
+	})
+	if err != nil {
+		return "", nil, "", err
+	}
+
+	return secretId, envelope, string(ssh.MarshalAuthorizedKey(publicKeySsh)), nil
+}
+
+func (h *Handlers) AccountSetSshKeyCa(a *apitypes.AccountSetSshKeyCa, ctx *command.Ctx) error {
+	secret := h.userData(ctx).InternalSecretById(a.Account, a.Secret)
+	if secret == nil || secret.Kind != domain.SecretKindSshKey {
+		return errors.New("SSH key not found")
+	}
+
+	if secret.SshCa == a.Ca {
+		return nil
+	}
+
+	ctx.RaisesEvent(domain.NewAccountSshKeyCaChanged(
+		a.Account,
+		a.Secret,
+		a.Ca,
 		ctx.Meta))
 
 	return nil
@@ -495,18 +657,29 @@ func (h *Handlers) AccountAddOtpToken(a *apitypes.AccountAddOtpToken, ctx *comma
 		return errAccountNotFound
 	}
 
-	if err := validateTotpProvisioningUrl(a.OtpProvisioningUrl); err != nil {
+	if _, err := otptoken.Parse(a.OtpProvisioningUrl); err != nil {
 		return fmt.Errorf("invalid OtpProvisioningUrl: %s", err)
 	}
 
-	envelope, err := h.userData(ctx).Crypto().Encrypt([]byte(a.OtpProvisioningUrl))
+	secretId := state.RandomId()
+
+	accountKey, err := h.accountKeyFor(a.Account, ctx)
+	if err != nil {
+		return err
+	}
+
+	envelope, err := accountKey.Encrypt([]byte(a.OtpProvisioningUrl), state.SecretContext{
+		AccountId: a.Account,
+		SecretId:  secretId,
+		Kind:      domain.SecretKindOtpToken,
+	})
 	if err != nil {
 		return err
 	}
 
 	ctx.RaisesEvent(domain.NewAccountOtpTokenAdded(
 		a.Account,
-		state.RandomId(),
+		secretId,
 		envelope,
 		ctx.Meta))
 
@@ -518,13 +691,94 @@ func (h *Handlers) UserChangeDecryptionKeyPassword(a *apitypes.UserChangeDecrypt
 		return err
 	}
 
+	passphrase, err := masterKeyPassphrase(a.NewMasterPassword, a.NewKeyFile)
+	if err != nil {
+		return err
+	}
+
 	userDecryptionKeyChanged, err := h.userData(ctx).Crypto().ChangeDecryptionKeyPassword(
+		passphrase,
+		ctx.Meta)
+	if err != nil {
+		return err
+	}
+
+	ctx.RaisesEvent(userDecryptionKeyChanged)
+
+	return nil
+}
+
+func (h *Handlers) UserRotateDecryptionKey(a *apitypes.UserRotateDecryptionKey, ctx *command.Ctx) error {
+	userData := h.userData(ctx)
+
+	passphrase, err := masterKeyPassphrase(a.Password, a.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	rotation, err := userData.Crypto().RotateDecryptionKey(passphrase, ctx.Meta)
+	if err != nil {
+		return err
+	}
+	defer rotation.Destroy()
+
+	ctx.RaisesEvent(rotation.Event)
+
+	// the old keys get retired, so everything encrypted for them must be rewrapped
+	if err := userData.RewrapAccountKeys(rotation); err != nil {
+		return err
+	}
+
+	// the rest of the envelopes are encrypted for the old keys
+	secretsRewrapped, err := userData.RewrapLegacySecrets(rotation, ctx.Meta)
+	if err != nil {
+		return err
+	}
+
+	for _, secretRewrapped := range secretsRewrapped {
+		ctx.RaisesEvent(secretRewrapped)
+	}
+
+	recoveryRewrapped, err := userData.RewrapRecovery(rotation, ctx.Meta)
+	if err != nil {
+		return err
+	}
+
+	if recoveryRewrapped != nil {
+		ctx.RaisesEvent(recoveryRewrapped)
+	}
+
+	return nil
+}
+
+func (h *Handlers) UserCreateRecoveryShares(a *apitypes.UserCreateRecoveryShares, ctx *command.Ctx) error {
+	recoverySharesCreated, err := h.userData(ctx).Crypto().CreateRecoveryShares(
+		a.Threshold,
+		a.ShareCount,
+		ctx.Meta)
+	if err != nil {
+		return err
+	}
+
+	ctx.RaisesEvent(recoverySharesCreated)
+
+	return nil
+}
+
+func (h *Handlers) UserRecoverDecryptionKey(a *apitypes.UserRecoverDecryptionKey, ctx *command.Ctx) error {
+	if err := verifyRepeatPassword(a.NewMasterPassword, a.NewMasterPasswordRepeat); err != nil {
+		return err
+	}
+
+	userDecryptionKeyChanged, err := h.userData(ctx).RecoverDecryptionKey(
+		strings.Split(a.Shares, "\n"),
 		a.NewMasterPassword,
 		ctx.Meta)
 	if err != nil {
 		return err
 	}
 
+	ctx.RaisesEvent(domain.NewUserDecryptionKeyRecovered(ctx.Meta))
 	ctx.RaisesEvent(userDecryptionKeyChanged)
 
 	return nil
@@ -622,21 +876,84 @@ func (h *Handlers) SessionSignOut(a *apitypes.SessionSignOut, ctx *command.Ctx)
 }
 
 func (h *Handlers) DatabaseExportToKeepass(a *apitypes.DatabaseExportToKeepass, ctx *command.Ctx) error {
-	return keepassexport.Export(h.state, ctx.Meta.UserId, a.MasterPassword)
+	masterKey, err := compositekey.New(a.MasterPassword, keyFileOrNil(a.KeyFile))
+	if err != nil {
+		return err
+	}
+
+	return keepassexport.Export(h.state, ctx.Meta.UserId, masterKey)
 }
 
 func (h *Handlers) UserUnlockDecryptionKey(a *apitypes.UserUnlockDecryptionKey, ctx *command.Ctx) error {
-	if err := h.userData(ctx).Crypto().UnlockDecryptionKey(a.Password); err != nil {
+	crypto := h.userData(ctx).Crypto()
+
+	passphrase, err := masterKeyPassphrase(a.Password, a.KeyFile)
+	if err != nil {
 		return err
 	}
 
+	if err := crypto.UnlockDecryptionKey(passphrase); err != nil {
+		return err
+	}
+
+	if upgraded := crypto.DecryptionKeyUpgrade(ctx.Meta); upgraded != nil {
+		h.logl.Info.Printf("Upgrading decryption key encryption of %s", ctx.Meta.UserId)
+
+		ctx.RaisesEvent(upgraded)
+	}
+
 	ctx.RaisesEvent(domain.NewUserDecryptionKeyUnlocked(ctx.Meta))
 
 	return nil
 }
 
+func (h *Handlers) UserLockDecryptionKey(a *apitypes.UserLockDecryptionKey, ctx *command.Ctx) error {
+	sealed := h.userData(ctx).SealDecryptionKey(domain.DecryptionKeySealReasonManual, ctx.Meta)
+	if sealed == nil {
+		return state.ErrDecryptionKeyLocked
+	}
+
+	ctx.RaisesEvent(sealed)
+
+	return nil
+}
+
+func (h *Handlers) UserScanBreachedPasswords(a *apitypes.UserScanBreachedPasswords, ctx *command.Ctx) error {
+	breachEvents, err := h.userData(ctx).ScanBreachedPasswords(ctx.Meta)
+	if err != nil {
+		return err
+	}
+
+	for _, breachEvent := range breachEvents {
+		ctx.RaisesEvent(breachEvent)
+	}
+
+	return nil
+}
+
+func (h *Handlers) UserConfigureAutoSeal(a *apitypes.UserConfigureAutoSeal, ctx *command.Ctx) error {
+	if a.IdleTimeoutMinutes < 0 || a.MaxUnlockedMinutes < 0 {
+		return errors.New("durations cannot be negative")
+	}
+
+	ctx.RaisesEvent(domain.NewUserAutoSealConfigured(
+		a.IdleTimeoutMinutes,
+		a.MaxUnlockedMinutes,
+		ctx.Meta))
+
+	return nil
+}
+
 func (h *Handlers) UserAddAccessToken(a *apitypes.UserAddAccessToken, ctx *command.Ctx) error {
-	if h.userData(ctx).SensitiveUser().AccessToken != "" {
+	targetUser, err := h.state.UserManagedBy(a.User, ctx.Meta.UserId)
+	if err != nil {
+		return err
+	}
+	if targetUser == nil {
+		return errUserNotFound
+	}
+
+	if targetUser.SensitiveUser().AccessToken != "" {
 		return errors.New("multiple access tokens not currently supported")
 	}
 
@@ -662,6 +979,10 @@ func (h *Handlers) UserCreate(a *apitypes.UserCreate, ctx *command.Ctx) error {
 		return err
 	}
 
+	if h.state.FindUserByUsername(a.Username) != nil {
+		return errors.New("username already taken")
+	}
+
 	uid := state.RandomId()
 
 	meta := ehevent.Meta(time.Now(), uid)
@@ -677,6 +998,15 @@ func (h *Handlers) UserCreate(a *apitypes.UserCreate, ctx *command.Ctx) error {
 		false,
 		meta))
 
+	// without a decryption key the user couldn't store any secrets. it's protected by
+	// the same password, which the user can later change separately
+	decryptionKeyChanged, err := state.NewDecryptionKey(a.Password, meta)
+	if err != nil {
+		return err
+	}
+
+	ctx.RaisesEvent(decryptionKeyChanged)
+
 	return nil
 }
 
@@ -687,12 +1017,24 @@ func (h *Handlers) UserChangePassword(a *apitypes.UserChangePassword, ctx *comma
 		return err
 	}
 
+	targetUser, err := h.state.UserManagedBy(a.User, ctx.Meta.UserId)
+	if err != nil {
+		return err
+	}
+	if targetUser == nil {
+		return errUserNotFound
+	}
+
 	passwordHashed, err := storedpassword.Store(a.Password, storedpassword.CurrentBestDerivationStrategy)
 	if err != nil {
 		return err
 	}
 
-	ctx.RaisesEvent(domain.NewUserPasswordUpdated(a.User, string(passwordHashed), false, ctx.Meta))
+	ctx.RaisesEvent(domain.NewUserPasswordUpdated(
+		a.User,
+		string(passwordHashed),
+		false,
+		ctx.Meta))
 
 	return nil
 }
@@ -732,19 +1074,37 @@ func (h *Handlers) UserRegisterU2FToken(a *apitypes.UserRegisterU2FToken, ctx *c
 	return nil
 }
 
-func validateTotpProvisioningUrl(provisioningUrl string) error {
-	key, err := otp.NewKeyFromURL(provisioningUrl)
+// "_auto" password gets generated with the policy (or the default policy). so does an
+// empty password, but only if a policy is given explicitly
+func passwordOrGenerated(password string, policyName string) (string, string, error) {
+	switch {
+	case password == "_auto":
+		if policyName == "" {
+			policyName = passwordgen.DefaultPolicy
+		}
+	case password == "":
+		if policyName == "" {
+			return "", "", errors.New("password missing")
+		}
+	default:
+		if policyName != "" {
+			return "", "", errors.New("PasswordPolicy is only for generated passwords")
+		}
+
+		return password, "", nil
+	}
+
+	policy, err := passwordgen.PolicyByName(policyName)
 	if err != nil {
-		return err
+		return "", "", err
 	}
 
-	// apparently NewKeyFromURL() can succeed even if GenerateCode() could fail,
-	// so that's why we must actually go this far as to verify this
-	if _, err := totp.GenerateCode(key.Secret(), time.Now()); err != nil {
-		return err
+	generated, err := passwordgen.Generate(*policy)
+	if err != nil {
+		return "", "", err
 	}
 
-	return nil
+	return generated, policy.Name, nil
 }
 
 func verifyRepeatPassword(pwd, pwdRepeat string) error {
@@ -755,6 +1115,24 @@ func verifyRepeatPassword(pwd, pwdRepeat string) error {
 	return nil
 }
 
+// decryption key can be protected with password, key file or both
+func masterKeyPassphrase(password string, keyFile string) (string, error) {
+	masterKey, err := compositekey.New(password, keyFileOrNil(keyFile))
+	if err != nil {
+		return "", err
+	}
+
+	return masterKey.Passphrase()
+}
+
+func keyFileOrNil(keyFile string) []byte {
+	if keyFile == "" {
+		return nil
+	}
+
+	return []byte(keyFile)
+}
+
 func failAndSleepWithBadUsernameOrPassword() error {
 	// to lessen efficacy of brute forcing. yes, `storedpassword.Verify()` by design is
 	// already slow, but this is an addititional layer of protection.
@@ -0,0 +1,140 @@
+// Master key made of a password and/or a key file, in the same way as KeePass does it.
+// this lets KeePass users keep using their existing key files.
+package compositekey
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type Key struct {
+	Password string
+	KeyFile  []byte // contents of the key file. nil if not used
+}
+
+func New(password string, keyFile []byte) (*Key, error) {
+	if password == "" && len(keyFile) == 0 {
+		return nil, errors.New("password or key file required")
+	}
+
+	if keyFile != nil && len(keyFile) == 0 {
+		return nil, errors.New("key file is empty")
+	}
+
+	return &Key{password, keyFile}, nil
+}
+
+// what we give to slowcrypto. password-only keys give the password as-is, so keys
+// protected before key file support keep working
+func (k *Key) Passphrase() (string, error) {
+	if k.KeyFile == nil {
+		return k.Password, nil
+	}
+
+	passwordHash, keyFileKey, err := k.Components()
+	if err != nil {
+		return "", err
+	}
+
+	composite := sha256.Sum256(append(passwordHash, keyFileKey...))
+
+	return hex.EncodeToString(composite[:]), nil
+}
+
+// KeePass' composite key components: sha256(password) (nil if no password) and the
+// 32-byte key from the key file (nil if no key file)
+func (k *Key) Components() ([]byte, []byte, error) {
+	var passwordHash []byte
+	if k.Password != "" {
+		digest := sha256.Sum256([]byte(k.Password))
+		passwordHash = digest[:]
+	}
+
+	var keyFileKey []byte
+	if k.KeyFile != nil {
+		var err error
+		keyFileKey, err = parseKeyFile(k.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return passwordHash, keyFileKey, nil
+}
+
+// KeePass key file formats: XML (version 1.0: base64, 2.0: hex with checksum), 32 raw
+// bytes, 64 hex characters or anything else (hashed)
+func parseKeyFile(keyFile []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(keyFile)
+
+	if bytes.HasPrefix(trimmed, []byte("<")) {
+		if key, isXml, err := parseXmlKeyFile(trimmed); isXml {
+			return key, err
+		}
+	}
+
+	if len(keyFile) == 32 {
+		return keyFile, nil
+	}
+
+	if len(keyFile) == 64 {
+		if key, err := hex.DecodeString(string(keyFile)); err == nil {
+			return key, nil
+		}
+	}
+
+	digest := sha256.Sum256(keyFile)
+	return digest[:], nil
+}
+
+type xmlKeyFile struct {
+	XMLName xml.Name `xml:"KeyFile"`
+	Meta    struct {
+		Version string `xml:"Version"`
+	} `xml:"Meta"`
+	Key struct {
+		Data struct {
+			Hash  string `xml:"Hash,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"Data"`
+	} `xml:"Key"`
+}
+
+// isXml=false means it wasn't a KeePass XML key file after all, and should be treated
+// as an arbitrary file
+func parseXmlKeyFile(keyFile []byte) ([]byte, bool, error) {
+	parsed := xmlKeyFile{}
+	if err := xml.Unmarshal(keyFile, &parsed); err != nil {
+		return nil, false, nil
+	}
+
+	switch parsed.Meta.Version {
+	case "1.0":
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parsed.Key.Data.Value))
+		if err != nil {
+			return nil, true, fmt.Errorf("key file: %w", err)
+		}
+
+		return key, true, nil
+	case "2.0":
+		key, err := hex.DecodeString(strings.Join(strings.Fields(parsed.Key.Data.Value), ""))
+		if err != nil {
+			return nil, true, fmt.Errorf("key file: %w", err)
+		}
+
+		checksum := sha256.Sum256(key)
+		if !strings.EqualFold(parsed.Key.Data.Hash, hex.EncodeToString(checksum[:4])) {
+			return nil, true, errors.New("key file: checksum mismatch")
+		}
+
+		return key, true, nil
+	default:
+		return nil, true, fmt.Errorf("key file: unsupported version: %s", parsed.Meta.Version)
+	}
+}
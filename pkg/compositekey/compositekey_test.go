@@ -0,0 +1,69 @@
+package compositekey
+
+import (
+	"encoding/hex"
+	"github.com/function61/gokit/assert"
+	"testing"
+)
+
+const (
+	testKeyHex = "8b9c3ec7f3cb8a299a3f41e95b2ba9c62a12c67e0de80a994d6cf9c7aa02b1aa"
+
+	testXmlKeyFileV2 = `<?xml version="1.0" encoding="utf-8"?>
+<KeyFile>
+	<Meta>
+		<Version>2.0</Version>
+	</Meta>
+	<Key>
+		<Data Hash="DD1D856E">
+			8B9C3EC7 F3CB8A29 9A3F41E9 5B2BA9C6
+			2A12C67E 0DE80A99 4D6CF9C7 AA02B1AA
+		</Data>
+	</Key>
+</KeyFile>
+`
+)
+
+func TestPassphrase(t *testing.T) {
+	passphrase := func(password string, keyFile []byte) string {
+		t.Helper()
+
+		key, err := New(password, keyFile)
+		assert.Ok(t, err)
+
+		passphrase, err := key.Passphrase()
+		assert.Ok(t, err)
+
+		return passphrase
+	}
+
+	testKey, _ := hex.DecodeString(testKeyHex)
+
+	// backwards compatible
+	assert.EqualString(t, passphrase("hunter2", nil), "hunter2")
+
+	// sha256(sha256("hunter2") || key)
+	assert.EqualString(t, passphrase("hunter2", []byte(testXmlKeyFileV2)), "911e55a0e23ee943aa6df8b5df13c7b06e6c8c2941e1f7a804aefbc74ee2b9b9")
+	assert.EqualString(t, passphrase("hunter2", []byte(testKeyHex)), "911e55a0e23ee943aa6df8b5df13c7b06e6c8c2941e1f7a804aefbc74ee2b9b9")
+	assert.EqualString(t, passphrase("hunter2", testKey), "911e55a0e23ee943aa6df8b5df13c7b06e6c8c2941e1f7a804aefbc74ee2b9b9")
+
+	// key file only: sha256(key)
+	assert.EqualString(t, passphrase("", []byte(testXmlKeyFileV2)), "dd1d856e74c5d8a79efa2299792c20bc1efc903cbc43dbecfa05c3d20841838d")
+
+	// arbitrary file: sha256(sha256("hunter2") || sha256(file))
+	assert.EqualString(t, passphrase("hunter2", []byte("arbitrary file\n")), "15741621d24363e6caead122ba106068337b664f0134fa8c579c91c234e18835")
+}
+
+func TestValidation(t *testing.T) {
+	_, err := New("", nil)
+	assert.EqualString(t, err.Error(), "password or key file required")
+
+	_, err = New("hunter2", []byte{})
+	assert.EqualString(t, err.Error(), "key file is empty")
+
+	key, err := New("", []byte(`<KeyFile><Meta><Version>2.0</Version></Meta><Key><Data Hash="00000000">`+testKeyHex+`</Data></Key></KeyFile>`))
+	assert.Ok(t, err)
+
+	_, err = key.Passphrase()
+	assert.EqualString(t, err.Error(), "key file: checksum mismatch")
+}
@@ -0,0 +1,312 @@
+// Append-only, fsync'd event log stored in a local file. Implements the same interface as
+// the EventHorizon client, so it can be consumed with ehreader like the real thing.
+package ehfilelog
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/gokit/logex"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+/*	Format: one JSON-encoded ehclient.LogEntry per line, i.e. JSON lines. Events inside
+	an entry are in EventHorizon's line format, so they never contain newlines. Each line
+	also carries hash chain fields (see hashchain.go).
+
+	An entry is durable only after its line was fully written and fsync'd. If we crashed
+	mid-write, there can be a partial line at the end of the file, which we discard on open.
+*/
+
+var (
+	ErrLocked = errors.New("event log is locked by another process")
+)
+
+type EventLog struct {
+	file      *os.File
+	size      int64 // size of the file up to the last complete entry
+	streams   map[string][]ehclient.LogEntry
+	hashes    map[string][][]byte // hash chain's hash of each entry in streams
+	lastHash  []byte
+	macKeyFor MacKeyForStream
+	readOnly  bool
+	mu        sync.Mutex
+}
+
+// interface assertion
+var _ ehclient.ReaderWriter = (*EventLog)(nil)
+
+// opens existing or creates a new log file. holds an exclusive lock on the file until Close()
+func Open(path string, logger *log.Logger) (*EventLog, error) {
+	logl := logex.Levels(logger)
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := lockExclusive(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	e := &EventLog{
+		file:    file,
+		streams: map[string][]ehclient.LogEntry{},
+		hashes:  map[string][][]byte{},
+	}
+
+	partialBytes, err := e.load(path, logl)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if partialBytes > 0 {
+		logl.Error.Printf(
+			"discarding %d byte(s) of partially written entry at end of %s",
+			partialBytes,
+			path)
+
+		if err := file.Truncate(e.size); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	if _, err := file.Seek(e.size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+// reads the log as it currently is, without locking it (so the log can be in use by
+// another process). appending is not supported
+func OpenReadOnly(path string, logger *log.Logger) (*EventLog, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &EventLog{
+		file:     file,
+		streams:  map[string][]ehclient.LogEntry{},
+		hashes:   map[string][][]byte{},
+		readOnly: true,
+	}
+
+	// partially written entry is ignored (it's probably being written right now)
+	if _, err := e.load(path, logex.Levels(logger)); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return e, nil
+}
+
+func (e *EventLog) Close() error {
+	return e.file.Close()
+}
+
+// entries appended to streams for which fn returns a key, get MAC'd with that key
+func (e *EventLog) SetMacKeyResolver(fn MacKeyForStream) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.macKeyFor = fn
+}
+
+func (e *EventLog) Append(ctx context.Context, stream string, events []string) (*ehclient.AppendResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.appendAfterInternal(
+		ehclient.At(stream, int64(len(e.streams[stream])-1)),
+		events)
+}
+
+func (e *EventLog) AppendAfter(ctx context.Context, after ehclient.Cursor, events []string) (*ehclient.AppendResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.appendAfterInternal(after, events)
+}
+
+func (e *EventLog) Read(_ context.Context, lastKnown ehclient.Cursor) (*ehclient.ReadResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	streamAllEntries := e.streams[lastKnown.Stream()]
+
+	nextCur := lastKnown.Next()
+
+	if nextCur.Version() > int64(len(streamAllEntries)) {
+		return nil, fmt.Errorf(
+			"ehfilelog: read from %s beyond end of stream",
+			lastKnown.Serialize())
+	}
+
+	// cannot be appended to by others, because appends only ever add to the end
+	entries := streamAllEntries[nextCur.Version():]
+
+	lastEntryCur := lastKnown
+
+	if len(entries) > 0 {
+		lastEntry := entries[len(entries)-1]
+
+		lastEntryCur = ehclient.At(lastEntry.Stream, lastEntry.Version)
+	}
+
+	return &ehclient.ReadResult{
+		Entries:   entries,
+		LastEntry: lastEntryCur,
+		More:      false,
+	}, nil
+}
+
+// hash chain's hash of the entry at cursor, i.e. a fingerprint of the whole log up to and
+// including it. lets snapshots be tied to the log they were made from
+func (e *EventLog) EntryHash(cursor ehclient.Cursor) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	hashes := e.hashes[cursor.Stream()]
+
+	if cursor.Version() < 0 || cursor.Version() >= int64(len(hashes)) {
+		return nil, fmt.Errorf("ehfilelog: EntryHash: no entry at %s", cursor.Serialize())
+	}
+
+	return append([]byte{}, hashes[cursor.Version()]...), nil
+}
+
+func (e *EventLog) appendAfterInternal(after ehclient.Cursor, events []string) (*ehclient.AppendResult, error) {
+	if e.readOnly {
+		return nil, errors.New("ehfilelog: append: log opened read-only")
+	}
+
+	stream := after.Stream()
+
+	afterRequested := after.Next()
+	afterActual := ehclient.At(stream, int64(len(e.streams[stream])))
+
+	if !afterRequested.Equal(afterActual) {
+		return nil, ehclient.NewErrOptimisticLockingFailed(fmt.Errorf(
+			"conflict: afterRequested=%s afterActual=%s",
+			afterRequested.Serialize(),
+			afterActual.Serialize()))
+	}
+
+	entry := ehclient.LogEntry{
+		Stream:  stream,
+		Version: afterActual.Version(),
+		Events:  events,
+	}
+
+	hash, err := chainHash(e.lastHash, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	fentry := fileEntry{
+		LogEntry: entry,
+		Hash:     hex.EncodeToString(hash),
+	}
+
+	if e.macKeyFor != nil {
+		if macKey := e.macKeyFor(stream); macKey != nil {
+			fentry.Mac = hex.EncodeToString(entryMac(macKey.Key, hash))
+			fentry.MacKeyId = macKey.Id
+		}
+	}
+
+	line, err := json.Marshal(&fentry)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.writeDurably(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("ehfilelog: append: %w", err)
+	}
+
+	e.streams[stream] = append(e.streams[stream], entry)
+	e.hashes[stream] = append(e.hashes[stream], hash)
+	e.lastHash = hash
+
+	return &ehclient.AppendResult{
+		Cursor: afterActual,
+	}, nil
+}
+
+func (e *EventLog) writeDurably(line []byte) error {
+	rollback := func(errRet error) error {
+		// don't leave a partial entry behind for the next append to be concatenated with
+		if err := e.file.Truncate(e.size); err != nil {
+			return fmt.Errorf("%v; also failed rolling back: %v", errRet, err)
+		}
+
+		if _, err := e.file.Seek(e.size, io.SeekStart); err != nil {
+			return fmt.Errorf("%v; also failed rolling back: %v", errRet, err)
+		}
+
+		return errRet
+	}
+
+	if _, err := e.file.Write(line); err != nil {
+		return rollback(err)
+	}
+
+	if err := e.file.Sync(); err != nil {
+		return rollback(err)
+	}
+
+	e.size += int64(len(line))
+
+	return nil
+}
+
+// returns count of bytes after the last complete line. broken hash chain is not fatal
+// (we'd rather keep running), but it is reported.
+func (e *EventLog) load(path string, logl *logex.Leveled) (int64, error) {
+	// MACs cannot be verified here, since the keys are not available at this point
+	chain := newChainVerifier(nil)
+
+	completeBytes, partialBytes, err := readEntries(e.file, func(offset int64, entry fileEntry) error {
+		expectedVersion := int64(len(e.streams[entry.Stream]))
+
+		if entry.Version != expectedVersion {
+			return fmt.Errorf(
+				"entry at offset %d: expected %s@%d, got @%d",
+				offset,
+				entry.Stream,
+				expectedVersion,
+				entry.Version)
+		}
+
+		chain.verify(offset, entry)
+
+		e.streams[entry.Stream] = append(e.streams[entry.Stream], entry.LogEntry)
+		e.hashes[entry.Stream] = append(e.hashes[entry.Stream], chain.prevHash)
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("ehfilelog: %s: %w", path, err)
+	}
+
+	if broken := chain.report.FirstBroken; broken != nil {
+		logl.Error.Printf("%s: hash chain broken, first at %s", path, broken.String())
+	}
+
+	e.size = completeBytes
+	e.lastHash = chain.prevHash
+
+	return partialBytes, nil
+}
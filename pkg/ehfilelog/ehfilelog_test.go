@@ -0,0 +1,226 @@
+package ehfilelog
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/gokit/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAppendAndReopen(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "ehfilelog")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.log")
+
+	eventLog, err := Open(path, nil)
+	assert.Ok(t, err)
+
+	// nothing yet
+	res, err := eventLog.Read(ctx, ehclient.Beginning("/t-1/pism"))
+	assert.Ok(t, err)
+	assert.Assert(t, len(res.Entries) == 0)
+	assert.EqualString(t, res.LastEntry.Serialize(), "/t-1/pism@-1")
+
+	_, err = eventLog.Append(ctx, "/t-1/pism", []string{"event 1", "event 2"})
+	assert.Ok(t, err)
+
+	appendResult, err := eventLog.Append(ctx, "/t-1/pism", []string{"event 3"})
+	assert.Ok(t, err)
+	assert.EqualString(t, appendResult.Cursor.Serialize(), "/t-1/pism@1")
+
+	_, err = eventLog.AppendAfter(ctx, ehclient.At("/t-1/pism", 0), []string{"conflicts"})
+	_, isLockingErr := err.(*ehclient.ErrOptimisticLockingFailed)
+	assert.Assert(t, isLockingErr)
+
+	// another process cannot open the same log concurrently
+	_, err = Open(path, nil)
+	assert.Assert(t, err == ErrLocked)
+
+	assert.Ok(t, eventLog.Close())
+
+	// simulate crash in the middle of writing an entry
+	logFile, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.Ok(t, err)
+	_, err = logFile.Write([]byte(`{"s":"/t-1/pism","v":2,"e":["half-writ`))
+	assert.Ok(t, err)
+	assert.Ok(t, logFile.Close())
+
+	eventLog, err = Open(path, nil)
+	assert.Ok(t, err)
+	defer eventLog.Close()
+
+	res, err = eventLog.Read(ctx, ehclient.Beginning("/t-1/pism"))
+	assert.Ok(t, err)
+	assert.EqualJson(t, res.Entries, `[
+  {
+    "s": "/t-1/pism",
+    "v": 0,
+    "meta_event": null,
+    "e": [
+      "event 1",
+      "event 2"
+    ]
+  },
+  {
+    "s": "/t-1/pism",
+    "v": 1,
+    "meta_event": null,
+    "e": [
+      "event 3"
+    ]
+  }
+]`)
+
+	// partial entry was discarded, so appending continues where the last complete entry left
+	appendResult, err = eventLog.Append(ctx, "/t-1/pism", []string{"event 4"})
+	assert.Ok(t, err)
+	assert.EqualString(t, appendResult.Cursor.Serialize(), "/t-1/pism@2")
+
+	res, err = eventLog.Read(ctx, ehclient.At("/t-1/pism", 1))
+	assert.Ok(t, err)
+	assert.Assert(t, len(res.Entries) == 1)
+	assert.EqualString(t, res.Entries[0].Events[0], "event 4")
+}
+
+func TestHashChain(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "ehfilelog")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.log")
+
+	eventLog, err := Open(path, nil)
+	assert.Ok(t, err)
+
+	macKey := &MacKey{Id: "key1", Key: []byte("secret")}
+
+	// only user 1's entries get MAC'd
+	eventLog.SetMacKeyResolver(func(stream string) *MacKey {
+		if stream == "/t-1/pism" {
+			return macKey
+		}
+		return nil
+	})
+
+	_, err = eventLog.Append(ctx, "/t-1/pism", []string{"event 1"})
+	assert.Ok(t, err)
+	_, err = eventLog.Append(ctx, "/t-2/pism", []string{"event 2"})
+	assert.Ok(t, err)
+	_, err = eventLog.Append(ctx, "/t-1/pism", []string{"event 3"})
+	assert.Ok(t, err)
+
+	headHash, err := eventLog.EntryHash(ehclient.At("/t-1/pism", 1))
+	assert.Ok(t, err)
+
+	_, err = eventLog.EntryHash(ehclient.At("/t-1/pism", 2))
+	assert.EqualString(t, err.Error(), "ehfilelog: EntryHash: no entry at /t-1/pism@2")
+
+	assert.Ok(t, eventLog.Close())
+
+	macKeyForVerify := func(stream string, keyId string) []byte {
+		if keyId == macKey.Id {
+			return macKey.Key
+		}
+		return nil
+	}
+
+	report, err := VerifyFile(path, macKeyForVerify)
+	assert.Ok(t, err)
+	assert.Assert(t, report.FirstBroken == nil)
+	assert.Assert(t, report.Entries == 3)
+	assert.Assert(t, report.MacsVerified == 2)
+	assert.EqualString(t, hex.EncodeToString(headHash), report.HeadHash)
+
+	report, err = VerifyFile(path, nil)
+	assert.Ok(t, err)
+	assert.Assert(t, report.FirstBroken == nil)
+	assert.Assert(t, report.MacsNoKey == 2)
+
+	logContent, err := ioutil.ReadFile(path)
+	assert.Ok(t, err)
+
+	tamper := func(from string, to string) {
+		t.Helper()
+
+		assert.Ok(t, ioutil.WriteFile(
+			path,
+			[]byte(strings.Replace(string(logContent), from, to, 1)),
+			0600))
+	}
+
+	tamper("event 2", "event X")
+
+	report, err = VerifyFile(path, macKeyForVerify)
+	assert.Ok(t, err)
+	assert.EqualString(
+		t,
+		report.FirstBroken.String(),
+		"/t-2/pism@0 (at offset 212): hash mismatch (entry or one before it edited or removed)")
+
+	// broken chain is reported, but does not prevent from using the log
+	eventLog, err = Open(path, nil)
+	assert.Ok(t, err)
+
+	// hashes are as the file claims them to be (the break is not for us to fix)
+	reopenedHeadHash, err := eventLog.EntryHash(ehclient.At("/t-1/pism", 1))
+	assert.Ok(t, err)
+	assert.EqualString(t, hex.EncodeToString(reopenedHeadHash), hex.EncodeToString(headHash))
+
+	assert.Ok(t, eventLog.Close())
+
+	// hashes can be recomputed by anyone, but MACs cannot be forged without the key
+	tamper(`"e":["event 1"]`, `"e":["event X"]`)
+	rehashed, err := ioutil.ReadFile(path)
+	assert.Ok(t, err)
+	assert.Ok(t, ioutil.WriteFile(path, rehash(t, rehashed), 0600))
+
+	report, err = VerifyFile(path, nil)
+	assert.Ok(t, err)
+	assert.Assert(t, report.FirstBroken == nil)
+
+	report, err = VerifyFile(path, macKeyForVerify)
+	assert.Ok(t, err)
+	assert.EqualString(t, report.FirstBroken.String(), "/t-1/pism@0 (at offset 0): MAC mismatch")
+}
+
+// what an attacker with disk access would do
+func rehash(t *testing.T, logContent []byte) []byte {
+	t.Helper()
+
+	rehashed := []byte{}
+	prevHash := []byte{}
+
+	_, _, err := readEntries(bytes.NewReader(logContent), func(_ int64, entry fileEntry) error {
+		hash, err := chainHash(prevHash, entry.LogEntry)
+		if err != nil {
+			return err
+		}
+
+		entry.Hash = hex.EncodeToString(hash)
+		prevHash = hash
+
+		line, err := json.Marshal(&entry)
+		if err != nil {
+			return err
+		}
+
+		rehashed = append(rehashed, append(line, '\n')...)
+		return nil
+	})
+	assert.Ok(t, err)
+
+	return rehashed
+}
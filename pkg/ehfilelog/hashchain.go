@@ -0,0 +1,205 @@
+package ehfilelog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"io"
+	"os"
+)
+
+/*	Hash chain: each line carries SHA-256(previous line's hash || its own entry), so editing
+	or removing an entry breaks the chain from that point on. Truncating entries from the end
+	cannot be detected this way, which is why we report the head hash so it can be recorded
+	somewhere else.
+
+	Anyone with disk access could recompute the whole chain, so an entry can additionally
+	carry a MAC of its hash, made with a key that only the owner of the stream has (derived
+	from their decryption key, so only available while it's unlocked). Since a hash covers
+	all history before it, a valid MAC vouches for every entry before it as well.
+*/
+
+// on-disk representation of an entry
+type fileEntry struct {
+	ehclient.LogEntry
+	Hash     string `json:"h"`
+	Mac      string `json:"m,omitempty"`
+	MacKeyId string `json:"mk,omitempty"`
+}
+
+type MacKey struct {
+	Id  string // so the verifier knows which key to use
+	Key []byte
+}
+
+// returns nil if entries to the stream should not be MAC'd (e.g. the key is not available)
+type MacKeyForStream func(stream string) *MacKey
+
+// returns nil if the key is not available for verification
+type MacKeyForVerify func(stream string, keyId string) []byte
+
+type BrokenLink struct {
+	Offset  int64 // file offset of the line
+	Stream  string
+	Version int64
+	Reason  string
+}
+
+func (b *BrokenLink) String() string {
+	return fmt.Sprintf("%s@%d (at offset %d): %s", b.Stream, b.Version, b.Offset, b.Reason)
+}
+
+type VerifyReport struct {
+	Entries       int
+	MacsVerified  int
+	MacsNoKey     int         // MAC'd entries which we didn't have the key to verify
+	HeadHash      string      // hash of the last entry
+	FirstBroken   *BrokenLink // nil if chain intact
+	PartialAtTail int64       // bytes of partially written entry at end of file
+}
+
+// verifies the log file without locking it, so this can be used while the log is in use
+func VerifyFile(path string, macKeyFor MacKeyForVerify) (*VerifyReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	chain := newChainVerifier(macKeyFor)
+
+	_, partialBytes, err := readEntries(file, func(offset int64, entry fileEntry) error {
+		chain.verify(offset, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("ehfilelog: %s: %w", path, err)
+	}
+
+	chain.report.PartialAtTail = partialBytes
+
+	return &chain.report, nil
+}
+
+type chainVerifier struct {
+	macKeyFor MacKeyForVerify
+	prevHash  []byte
+	report    VerifyReport
+}
+
+func newChainVerifier(macKeyFor MacKeyForVerify) *chainVerifier {
+	return &chainVerifier{
+		macKeyFor: macKeyFor,
+		prevHash:  []byte{}, // genesis
+	}
+}
+
+func (c *chainVerifier) verify(offset int64, entry fileEntry) {
+	c.report.Entries++
+
+	broken := func(reason string) {
+		if c.report.FirstBroken == nil {
+			c.report.FirstBroken = &BrokenLink{
+				Offset:  offset,
+				Stream:  entry.Stream,
+				Version: entry.Version,
+				Reason:  reason,
+			}
+		}
+	}
+
+	expectedHash, err := chainHash(c.prevHash, entry.LogEntry)
+	if err != nil {
+		broken(err.Error())
+		return
+	}
+
+	hash, err := hex.DecodeString(entry.Hash)
+	switch {
+	case err != nil || len(hash) == 0:
+		broken("missing or malformed hash")
+		hash = expectedHash
+	case !hmac.Equal(hash, expectedHash):
+		broken("hash mismatch (entry or one before it edited or removed)")
+	}
+
+	// continue from the hash the file claims, so later entries get verified against the
+	// log as it is (and so appends after a break still chain on to the actual file)
+	c.prevHash = hash
+	c.report.HeadHash = hex.EncodeToString(hash)
+
+	if entry.Mac == "" {
+		return
+	}
+
+	var key []byte
+	if c.macKeyFor != nil {
+		key = c.macKeyFor(entry.Stream, entry.MacKeyId)
+	}
+
+	if key == nil {
+		c.report.MacsNoKey++
+		return
+	}
+
+	mac, err := hex.DecodeString(entry.Mac)
+	if err != nil || !hmac.Equal(mac, entryMac(key, hash)) {
+		broken("MAC mismatch")
+		return
+	}
+
+	c.report.MacsVerified++
+}
+
+func chainHash(prevHash []byte, entry ehclient.LogEntry) ([]byte, error) {
+	entryJson, err := json.Marshal(&entry)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.New()
+	_, _ = hash.Write(prevHash)
+	_, _ = hash.Write(entryJson)
+	return hash.Sum(nil), nil
+}
+
+func entryMac(key []byte, hash []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write(hash)
+	return mac.Sum(nil)
+}
+
+// calls fn for each complete line. returns count of bytes in complete lines and count of
+// bytes after the last complete line
+func readEntries(file io.Reader, fn func(offset int64, entry fileEntry) error) (int64, int64, error) {
+	reader := bufio.NewReader(file)
+
+	offset := int64(0)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			if err == io.EOF {
+				return offset, int64(len(line)), nil
+			}
+
+			return 0, 0, err
+		}
+
+		entry := fileEntry{}
+		if err := json.Unmarshal(bytes.TrimSuffix(line, []byte{'\n'}), &entry); err != nil {
+			return 0, 0, fmt.Errorf("entry at offset %d: %w", offset, err)
+		}
+
+		if err := fn(offset, entry); err != nil {
+			return 0, 0, err
+		}
+
+		offset += int64(len(line))
+	}
+}
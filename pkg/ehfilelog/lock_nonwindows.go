@@ -0,0 +1,20 @@
+// +build !windows
+
+package ehfilelog
+
+import (
+	"os"
+	"syscall"
+)
+
+func lockExclusive(file *os.File) error {
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if err == syscall.EWOULDBLOCK {
+			return ErrLocked
+		}
+
+		return err
+	}
+
+	return nil
+}
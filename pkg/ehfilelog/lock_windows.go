@@ -0,0 +1,12 @@
+// +build windows
+
+package ehfilelog
+
+import (
+	"os"
+)
+
+// the server is only supported on Linux, this exists just to keep the package compiling
+func lockExclusive(file *os.File) error {
+	return nil
+}
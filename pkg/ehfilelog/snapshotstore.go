@@ -0,0 +1,79 @@
+package ehfilelog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/gokit/atomicfilewrite"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// stores the latest snapshot of each stream as a file in a directory
+type SnapshotStore struct {
+	dir string
+}
+
+// interface assertion
+var _ ehreader.SnapshotStore = (*SnapshotStore)(nil)
+
+func NewSnapshotStore(dir string) (*SnapshotStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &SnapshotStore{dir}, nil
+}
+
+type snapshotFile struct {
+	Stream  string `json:"stream"`
+	Version int64  `json:"version"`
+	Data    []byte `json:"data"`
+}
+
+func (s *SnapshotStore) LoadSnapshot(_ context.Context, cursor ehclient.Cursor) (*ehreader.Snapshot, error) {
+	file, err := os.Open(s.pathFor(cursor.Stream()))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, os.ErrNotExist // contract of the interface
+		}
+
+		return nil, err
+	}
+	defer file.Close()
+
+	snap := snapshotFile{}
+	if err := json.NewDecoder(file).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("LoadSnapshot: %w", err)
+	}
+
+	if snap.Stream != cursor.Stream() {
+		return nil, fmt.Errorf(
+			"LoadSnapshot: expected stream %s, got %s",
+			cursor.Stream(),
+			snap.Stream)
+	}
+
+	return ehreader.NewSnapshot(ehclient.At(snap.Stream, snap.Version), snap.Data), nil
+}
+
+func (s *SnapshotStore) StoreSnapshot(_ context.Context, snapshot ehreader.Snapshot) error {
+	return atomicfilewrite.Write(s.pathFor(snapshot.Cursor.Stream()), func(sink io.Writer) error {
+		return json.NewEncoder(sink).Encode(&snapshotFile{
+			Stream:  snapshot.Cursor.Stream(),
+			Version: snapshot.Cursor.Version(),
+			Data:    snapshot.Data,
+		})
+	})
+}
+
+// "/t-1/pism" => "<dir>/t-1_pism.json"
+func (s *SnapshotStore) pathFor(stream string) string {
+	return filepath.Join(
+		s.dir,
+		strings.ReplaceAll(strings.TrimPrefix(stream, "/"), "/", "_")+".json")
+}
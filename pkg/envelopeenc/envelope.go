@@ -1,92 +1,251 @@
-// Envelope encryption - envelope contains secret content encrypted with NaCl secretbox
-// symmetric key, and that key is separately encrypted for each RSA public key recipient.
+// Envelope encryption - envelope contains secret content encrypted with a symmetric key
+// (XChaCha20-Poly1305, or NaCl secretbox in version 1), and that key is separately
+// encrypted for each recipient (RSA or X25519 public key).
 package envelopeenc
 
 import (
+	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
 	"errors"
 	"fmt"
 	"github.com/function61/gokit/cryptoutil"
+	"github.com/function61/passitron/pkg/securebuf"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/nacl/secretbox"
 	"io"
 )
 
+const (
+	// content = nonce || secretbox_ciphertext. no associated data, so content can be moved
+	// to another context (e.g. another account) without anyone noticing. decrypt only
+	Version1 = 1
+	// content = nonce || xchacha20poly1305_ciphertext, authenticating associated data
+	Version2 = 2
+	// same content as Version2, but key slots are of different types (Version1 and
+	// Version2 only have RSA-OAEP key slots)
+	Version3 = 3
+)
+
+type KekType uint64
+
+const (
+	KekTypeRsaOaepSha256 KekType = 1 // DekEncrypted = RSA_OAEP_SHA256(kekPub, dek)
+	KekTypeX25519        KekType = 2 // DekEncrypted = ephemeralPub || ChaCha20Poly1305(hkdf(X25519(ephemeral, kekPub)), dek)
+)
+
 type Envelope struct {
+	Version          uint64            `json:"version"`
 	KeySlots         []envelopeKeySlot `json:"key_slots"`
-	EncryptedContent []byte            `json:"content"` // nonce || secretbox_ciphertext
+	EncryptedContent []byte            `json:"content"`
 }
 
 type envelopeKeySlot struct {
-	KekId        string `json:"kek_id"`        // SHA256-fingerprint of RSA public key
-	DekEncrypted []byte `json:"dek_encrypted"` // RSA_OAEP_SHA256(kekPub, secretboxSecretKey)
+	KekType      KekType `json:"kek_type"`
+	KekId        string  `json:"kek_id"` // KekId() of recipient's public key
+	DekEncrypted []byte  `json:"dek_encrypted"`
 }
 
-func Encrypt(plaintext []byte, keks []*rsa.PublicKey) (*Envelope, error) {
-	return encryptWithRand(plaintext, keks, rand.Reader)
+// keks are *rsa.PublicKey or *X25519PublicKey (mixing allowed). associatedData is not
+// stored in the envelope, but is authenticated along with the content. i.e. the same
+// associatedData must be given to Decrypt()
+func Encrypt(plaintext []byte, keks []crypto.PublicKey, associatedData []byte) (*Envelope, error) {
+	return encryptWithRand(plaintext, keks, associatedData, rand.Reader)
 }
 
-func encryptWithRand(plaintext []byte, keks []*rsa.PublicKey, cryptoRandReader io.Reader) (*Envelope, error) {
-	var secretKey [32]byte
-	if _, err := io.ReadFull(cryptoRandReader, secretKey[:]); err != nil {
+func encryptWithRand(
+	plaintext []byte,
+	keks []crypto.PublicKey,
+	associatedData []byte,
+	cryptoRandReader io.Reader,
+) (*Envelope, error) {
+	secretKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(cryptoRandReader, secretKey); err != nil {
 		return nil, err
 	}
 
-	var nonce [24]byte
-	if _, err := io.ReadFull(cryptoRandReader, nonce[:]); err != nil {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if _, err := io.ReadFull(cryptoRandReader, nonce); err != nil {
 		return nil, err
 	}
 
-	keySlots := []envelopeKeySlot{}
+	aead, err := chacha20poly1305.NewX(secretKey)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, kek := range keks {
-		keySlot, err := makeKeySlot(secretKey[:], kek)
+	keySlots, err := makeKeySlots(secretKey, keks)
+	if err != nil {
+		return nil, err
+	}
+
+	// return is basically append(nonce, ciphertext...)
+	nonceAndCiphertext := aead.Seal(nonce, nonce, plaintext, associatedData)
+
+	return &Envelope{
+		Version:          Version3,
+		KeySlots:         keySlots,
+		EncryptedContent: nonceAndCiphertext,
+	}, nil
+}
+
+// privKey is *rsa.PrivateKey or *X25519PrivateKey. associatedData must be the same that
+// was given to Encrypt(). it is ignored for Version1 envelopes, as they did not support it
+func (e *Envelope) Decrypt(privKey crypto.PrivateKey, associatedData []byte) ([]byte, error) {
+	dek, err := e.decryptDek(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.Version {
+	case Version1:
+		return decryptContentV1(e.EncryptedContent, dek)
+	case Version2, Version3:
+		return decryptContentV2(e.EncryptedContent, dek, associatedData)
+	default:
+		return nil, fmt.Errorf("unsupported envelope version: %d", e.Version)
+	}
+}
+
+// re-encrypts the DEK for new recipients, without touching the encrypted content. the
+// recipient privKey is not carried over (unless its public key is included in keks).
+// Version1 content cannot have other than RSA key slots, so it is upgraded by re-encrypting
+// it with a new DEK, bound to associatedData (which is ignored for other versions).
+func (e *Envelope) Rewrap(
+	privKey crypto.PrivateKey,
+	keks []crypto.PublicKey,
+	associatedData []byte,
+) (*Envelope, error) {
+	dek, err := e.decryptDek(privKey)
+	if err != nil {
+		return nil, err
+	}
+	defer securebuf.Zero(dek)
+
+	if e.Version == Version1 {
+		plaintext, err := decryptContentV1(e.EncryptedContent, dek)
 		if err != nil {
 			return nil, err
 		}
+		defer securebuf.Zero(plaintext)
 
-		keySlots = append(keySlots, *keySlot)
+		return Encrypt(plaintext, keks, associatedData)
 	}
 
-	// return is basically append(nonce, ciphertext...)
-	nonceAndCiphertext := secretbox.Seal(nonce[:], plaintext, &nonce, &secretKey)
+	keySlots, err := makeKeySlots(dek, keks)
+	if err != nil {
+		return nil, err
+	}
+
+	version := e.Version
+	if version == Version2 { // content is compatible, so we can have any kinds of slots
+		version = Version3
+	}
 
 	return &Envelope{
+		Version:          version,
 		KeySlots:         keySlots,
-		EncryptedContent: nonceAndCiphertext,
+		EncryptedContent: e.EncryptedContent,
 	}, nil
 }
 
-func (e *Envelope) Decrypt(privKey *rsa.PrivateKey) ([]byte, error) {
-	kekId, err := cryptoutil.Sha256FingerprintForPublicKey(&privKey.PublicKey)
+// removes a recipient's access. doesn't need any private key, since the DEK (and thus the
+// content) stays the same. errors if that would leave the envelope without recipients
+func (e *Envelope) WithoutRecipient(pubKey crypto.PublicKey) (*Envelope, error) {
+	kekId, err := KekId(pubKey)
 	if err != nil {
 		return nil, err
 	}
 
+	keySlots := []envelopeKeySlot{}
+	for _, slot := range e.KeySlots {
+		if slot.KekId != kekId {
+			keySlots = append(keySlots, slot)
+		}
+	}
+
+	if len(keySlots) == 0 {
+		return nil, errors.New("WithoutRecipient: would leave no recipients")
+	}
+
+	return &Envelope{
+		Version:          e.Version,
+		KeySlots:         keySlots,
+		EncryptedContent: e.EncryptedContent,
+	}, nil
+}
+
+// whether the DEK is encrypted for the given public key
+func (e *Envelope) HasRecipient(pubKey crypto.PublicKey) bool {
+	kekId, err := KekId(pubKey)
+	if err != nil {
+		return false
+	}
+
 	for _, slot := range e.KeySlots {
 		if slot.KekId == kekId {
-			return e.decryptWithSlot(&slot, privKey)
+			return true
 		}
 	}
 
-	return nil, fmt.Errorf("no slot found for %s", kekId)
+	return false
 }
 
-func (e *Envelope) decryptWithSlot(slot *envelopeKeySlot, privKey *rsa.PrivateKey) ([]byte, error) {
-	dek, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, privKey, slot.DekEncrypted, nil)
+func (e *Envelope) decryptDek(privKey crypto.PrivateKey) ([]byte, error) {
+	slot, err := e.slotFor(privKey)
 	if err != nil {
-		return nil, fmt.Errorf("decryptWithSlot DecryptOAEP: %v", err)
+		return nil, err
+	}
+
+	switch key := privKey.(type) {
+	case *rsa.PrivateKey:
+		dek, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, slot.DekEncrypted, nil)
+		if err != nil {
+			return nil, fmt.Errorf("decryptDek DecryptOAEP: %v", err)
+		}
+
+		return dek, nil
+	case *X25519PrivateKey:
+		return x25519OpenDek(slot.DekEncrypted, key)
+	default:
+		return nil, fmt.Errorf("unsupported private key type: %T", privKey)
+	}
+}
+
+func (e *Envelope) slotFor(privKey crypto.PrivateKey) (*envelopeKeySlot, error) {
+	kekType, kekPub, err := kekTypeAndPublicKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	kekId, err := KekId(kekPub)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, slot := range e.KeySlots {
+		if slot.KekType == kekType && slot.KekId == kekId {
+			return &slot, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no slot found for %s", kekId)
+}
+
+func decryptContentV1(encryptedContent []byte, dek []byte) ([]byte, error) {
+	if len(encryptedContent) < 24 {
+		return nil, errors.New("content too short")
 	}
 
 	var nonce [24]byte
-	copy(nonce[:], e.EncryptedContent[:24])
+	copy(nonce[:], encryptedContent[:24])
 
 	var dekStatic [32]byte
 	copy(dekStatic[:], dek)
 
 	plaintext := []byte{}
-	plaintext, ok := secretbox.Open(plaintext, e.EncryptedContent[24:], &nonce, &dekStatic)
+	plaintext, ok := secretbox.Open(plaintext, encryptedContent[24:], &nonce, &dekStatic)
 	if !ok {
 		return nil, errors.New("secretbox.Open failed")
 	}
@@ -94,19 +253,95 @@ func (e *Envelope) decryptWithSlot(slot *envelopeKeySlot, privKey *rsa.PrivateKe
 	return plaintext, nil
 }
 
-func makeKeySlot(dek []byte, kekPub *rsa.PublicKey) (*envelopeKeySlot, error) {
-	kekId, err := cryptoutil.Sha256FingerprintForPublicKey(kekPub)
+func decryptContentV2(encryptedContent []byte, dek []byte, associatedData []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(dek)
 	if err != nil {
 		return nil, err
 	}
 
-	dekCiphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, kekPub, dek, nil)
+	if len(encryptedContent) < aead.NonceSize() {
+		return nil, errors.New("content too short")
+	}
+
+	nonce := encryptedContent[:aead.NonceSize()]
+
+	plaintext, err := aead.Open(nil, nonce, encryptedContent[aead.NonceSize():], associatedData)
+	if err != nil {
+		// content tampered with, or given in wrong context
+		return nil, errors.New("aead.Open failed")
+	}
+
+	return plaintext, nil
+}
+
+// fingerprint that identifies the recipient's key slot
+func KekId(pubKey crypto.PublicKey) (string, error) {
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		return cryptoutil.Sha256FingerprintForPublicKey(key)
+	case *X25519PublicKey:
+		return key.fingerprint(), nil
+	default:
+		return "", fmt.Errorf("unsupported public key type: %T", pubKey)
+	}
+}
+
+func kekTypeAndPublicKey(privKey crypto.PrivateKey) (KekType, crypto.PublicKey, error) {
+	switch key := privKey.(type) {
+	case *rsa.PrivateKey:
+		return KekTypeRsaOaepSha256, &key.PublicKey, nil
+	case *X25519PrivateKey:
+		return KekTypeX25519, &key.PublicKey, nil
+	default:
+		return 0, nil, fmt.Errorf("unsupported private key type: %T", privKey)
+	}
+}
+
+func makeKeySlots(dek []byte, keks []crypto.PublicKey) ([]envelopeKeySlot, error) {
+	keySlots := []envelopeKeySlot{}
+
+	for _, kek := range keks {
+		keySlot, err := makeKeySlot(dek, kek)
+		if err != nil {
+			return nil, err
+		}
+
+		keySlots = append(keySlots, *keySlot)
+	}
+
+	return keySlots, nil
+}
+
+func makeKeySlot(dek []byte, kekPub crypto.PublicKey) (*envelopeKeySlot, error) {
+	kekId, err := KekId(kekPub)
 	if err != nil {
 		return nil, err
 	}
 
-	return &envelopeKeySlot{
-		KekId:        kekId,
-		DekEncrypted: dekCiphertext,
-	}, nil
+	switch key := kekPub.(type) {
+	case *rsa.PublicKey:
+		dekCiphertext, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, dek, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		return &envelopeKeySlot{
+			KekType:      KekTypeRsaOaepSha256,
+			KekId:        kekId,
+			DekEncrypted: dekCiphertext,
+		}, nil
+	case *X25519PublicKey:
+		dekCiphertext, err := x25519SealDek(dek, key, rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		return &envelopeKeySlot{
+			KekType:      KekTypeX25519,
+			KekId:        kekId,
+			DekEncrypted: dekCiphertext,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type: %T", kekPub)
+	}
 }
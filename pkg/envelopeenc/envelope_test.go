@@ -2,12 +2,15 @@ package envelopeenc
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/rand"
 	"crypto/rsa"
 	"encoding/hex"
 	"github.com/function61/gokit/assert"
 	"github.com/function61/gokit/cryptoutil"
 	"golang.org/x/crypto/nacl/secretbox"
 	"io"
+	"strings"
 	"testing"
 )
 
@@ -15,7 +18,7 @@ func TestEncryptAndDecrypt(t *testing.T) {
 	kek1, err := cryptoutil.ParsePemPkcs1EncodedRsaPrivateKey([]byte(testKek1))
 	assert.Ok(t, err)
 
-	oneKey := []*rsa.PublicKey{&kek1.PublicKey}
+	oneKey := []crypto.PublicKey{&kek1.PublicKey}
 
 	// we can observe from expected outputs that nonce is at front of EncryptedContent
 	tcs := []struct {
@@ -26,17 +29,17 @@ func TestEncryptAndDecrypt(t *testing.T) {
 		{
 			0x00,
 			0x01,
-			"0101010101010101010101010101010101010101010101018a7339270718de7fb3ab5bed387b75fc3824d11162466d",
+			"010101010101010101010101010101010101010101010101a89e1a97ca2073cb7f9de8bf6ddb983c08269dbc382a21",
 		},
 		{
 			0xcc, // change encryption key
 			0x01,
-			"010101010101010101010101010101010101010101010101336d698a0b1d33381ca943b2edd78acc9b5dc1b1e80623",
+			"010101010101010101010101010101010101010101010101a7463c0bd8276e1e54fa9f01fd448fa4c526378e05d20c",
 		},
 		{
 			0xcc,
 			0x21, // change nonce
-			"21212121212121212121212121212121212121212121212139eb1f77b8f42d1cdc7b75254f115678cb130ffc5cf247",
+			"21212121212121212121212121212121212121212121212137ad290289e9e41f6c422fe55a075be9a76507fd17ec18",
 		},
 	}
 
@@ -45,6 +48,7 @@ func TestEncryptAndDecrypt(t *testing.T) {
 			pwdEnvelope, err := encryptWithRand(
 				[]byte("hunter2"),
 				oneKey,
+				[]byte("acc1/pwd1"),
 				deterministicRand(tc.encryptionKey, tc.nonce))
 			assert.Ok(t, err)
 
@@ -55,16 +59,185 @@ func TestEncryptAndDecrypt(t *testing.T) {
 
 			nonceLen := 24
 
-			assert.Assert(t, len(pwdEnvelope.EncryptedContent)-nonceLen == len("hunter2")+secretbox.Overhead)
+			assert.Assert(t, len(pwdEnvelope.EncryptedContent)-nonceLen == len("hunter2")+16) // 16 = Poly1305 tag
 
-			decrypted, err := pwdEnvelope.Decrypt(kek1)
+			decrypted, err := pwdEnvelope.Decrypt(kek1, []byte("acc1/pwd1"))
 			assert.Ok(t, err)
 
 			assert.EqualString(t, string(decrypted), "hunter2")
+
+			// content moved to another context
+			_, err = pwdEnvelope.Decrypt(kek1, []byte("acc2/pwd1"))
+			assert.EqualString(t, err.Error(), "aead.Open failed")
 		})
 	}
 }
 
+func TestDecryptVersion1(t *testing.T) {
+	kek1, err := cryptoutil.ParsePemPkcs1EncodedRsaPrivateKey([]byte(testKek1))
+	assert.Ok(t, err)
+
+	keySlot, err := makeKeySlot(bytes.Repeat([]byte{0xcc}, 32), &kek1.PublicKey)
+	assert.Ok(t, err)
+
+	// content as encrypted before Version2 existed
+	content, err := hex.DecodeString("010101010101010101010101010101010101010101010101336d698a0b1d33381ca943b2edd78acc9b5dc1b1e80623")
+	assert.Ok(t, err)
+
+	serialized, err := (&Envelope{
+		Version:          Version1,
+		KeySlots:         []envelopeKeySlot{*keySlot},
+		EncryptedContent: content,
+	}).Marshal()
+	assert.Ok(t, err)
+
+	envelope, err := Unmarshal(serialized)
+	assert.Ok(t, err)
+
+	// associated data not supported in Version1, so it's ignored
+	decrypted, err := envelope.Decrypt(kek1, []byte("acc1/pwd1"))
+	assert.Ok(t, err)
+	assert.EqualString(t, string(decrypted), "hunter2")
+
+	assert.Assert(t, len(content)-24 == len("hunter2")+secretbox.Overhead)
+
+	kekX25519, err := GenerateX25519Key()
+	assert.Ok(t, err)
+
+	// Version1 cannot have X25519 key slots, so content gets upgraded
+	rewrapped, err := envelope.Rewrap(kek1, []crypto.PublicKey{&kekX25519.PublicKey}, []byte("acc1/pwd1"))
+	assert.Ok(t, err)
+	assert.Assert(t, rewrapped.Version == Version3)
+
+	decrypted, err = rewrapped.Decrypt(kekX25519, []byte("acc1/pwd1"))
+	assert.Ok(t, err)
+	assert.EqualString(t, string(decrypted), "hunter2")
+
+	// now bound to associated data
+	_, err = rewrapped.Decrypt(kekX25519, []byte("acc2/pwd1"))
+	assert.EqualString(t, err.Error(), "aead.Open failed")
+}
+
+func TestRewrap(t *testing.T) {
+	kek1, err := cryptoutil.ParsePemPkcs1EncodedRsaPrivateKey([]byte(testKek1))
+	assert.Ok(t, err)
+
+	kek2, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Ok(t, err)
+
+	envelope, err := Encrypt([]byte("hunter2"), []crypto.PublicKey{&kek1.PublicKey}, nil)
+	assert.Ok(t, err)
+
+	rewrapped, err := envelope.Rewrap(kek1, []crypto.PublicKey{&kek2.PublicKey}, nil)
+	assert.Ok(t, err)
+
+	// content was not re-encrypted
+	assert.Assert(t, bytes.Equal(rewrapped.EncryptedContent, envelope.EncryptedContent))
+	assert.Assert(t, rewrapped.Version == Version3)
+
+	decrypted, err := rewrapped.Decrypt(kek2, nil)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(decrypted), "hunter2")
+
+	// old key no longer has access
+	_, err = rewrapped.Decrypt(kek1, nil)
+	assert.Assert(t, err != nil)
+
+	// but can still open the original envelope
+	decrypted, err = envelope.Decrypt(kek1, nil)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(decrypted), "hunter2")
+
+	_, err = rewrapped.Rewrap(kek1, []crypto.PublicKey{&kek1.PublicKey}, nil)
+	assert.Assert(t, err != nil)
+}
+
+func TestWithoutRecipient(t *testing.T) {
+	kek1, err := GenerateX25519Key()
+	assert.Ok(t, err)
+
+	kek2, err := GenerateX25519Key()
+	assert.Ok(t, err)
+
+	envelope, err := Encrypt([]byte("hunter2"), []crypto.PublicKey{&kek1.PublicKey, &kek2.PublicKey}, nil)
+	assert.Ok(t, err)
+
+	withoutKek1, err := envelope.WithoutRecipient(&kek1.PublicKey)
+	assert.Ok(t, err)
+	assert.Assert(t, !withoutKek1.HasRecipient(&kek1.PublicKey))
+
+	_, err = withoutKek1.Decrypt(kek1, nil)
+	assert.Assert(t, err != nil)
+
+	decrypted, err := withoutKek1.Decrypt(kek2, nil)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(decrypted), "hunter2")
+
+	_, err = withoutKek1.WithoutRecipient(&kek2.PublicKey)
+	assert.EqualString(t, err.Error(), "WithoutRecipient: would leave no recipients")
+}
+
+func TestX25519AndMixedRecipients(t *testing.T) {
+	kekRsa, err := cryptoutil.ParsePemPkcs1EncodedRsaPrivateKey([]byte(testKek1))
+	assert.Ok(t, err)
+
+	// RFC 7748 test vector
+	alicePriv, err := hex.DecodeString("77076d0a7318a57d3c16c17251b26645df4c2f87ebc0992ab177fba51db92c2a")
+	assert.Ok(t, err)
+	alice, err := NewX25519PrivateKey(alicePriv)
+	assert.Ok(t, err)
+	assert.EqualString(t, hex.EncodeToString(alice.PublicKey[:]), "8520f0098930a754748b7ddcb43ef75a0dbf3a0d26381af4eba4a98eaa9b4e6a")
+
+	kekX25519, err := NewX25519PrivateKey(bytes.Repeat([]byte{0x42}, 32))
+	assert.Ok(t, err)
+
+	kekId, err := KekId(&kekX25519.PublicKey)
+	assert.Ok(t, err)
+	assert.EqualString(t, kekId, "SHA256:lROCBqaCy5BnXv3WVAjWfcrLNA0uveEUwjSMmwYuA3c")
+
+	kekX25519Other, err := GenerateX25519Key()
+	assert.Ok(t, err)
+
+	envelope, err := Encrypt(
+		[]byte("hunter2"),
+		[]crypto.PublicKey{&kekRsa.PublicKey, &kekX25519.PublicKey},
+		[]byte("acc1/pwd1"))
+	assert.Ok(t, err)
+
+	// survives serialization
+	serialized, err := envelope.Marshal()
+	assert.Ok(t, err)
+	envelope, err = Unmarshal(serialized)
+	assert.Ok(t, err)
+
+	assert.Assert(t, envelope.KeySlots[0].KekType == KekTypeRsaOaepSha256)
+	assert.Assert(t, envelope.KeySlots[1].KekType == KekTypeX25519)
+	// ephemeral pub + DEK + Poly1305 tag
+	assert.Assert(t, len(envelope.KeySlots[1].DekEncrypted) == 32+32+16)
+
+	for _, kek := range []crypto.PrivateKey{kekRsa, kekX25519} {
+		decrypted, err := envelope.Decrypt(kek, []byte("acc1/pwd1"))
+		assert.Ok(t, err)
+		assert.EqualString(t, string(decrypted), "hunter2")
+	}
+
+	_, err = envelope.Decrypt(kekX25519Other, []byte("acc1/pwd1"))
+	assert.Assert(t, strings.HasPrefix(err.Error(), "no slot found for SHA256:"))
+
+	// tampered key slot
+	envelope.KeySlots[1].DekEncrypted[40] ^= 0x01
+	_, err = envelope.Decrypt(kekX25519, []byte("acc1/pwd1"))
+	assert.EqualString(t, err.Error(), "x25519OpenDek: aead.Open failed")
+
+	// RSA -> X25519
+	rewrapped, err := envelope.Rewrap(kekRsa, []crypto.PublicKey{&kekX25519Other.PublicKey}, []byte("acc1/pwd1"))
+	assert.Ok(t, err)
+
+	decrypted, err := rewrapped.Decrypt(kekX25519Other, []byte("acc1/pwd1"))
+	assert.Ok(t, err)
+	assert.EqualString(t, string(decrypted), "hunter2")
+}
+
 func deterministicRand(encryptionKey byte, nonce byte) io.Reader {
 	return bytes.NewBuffer(append(
 		bytes.Repeat([]byte{encryptionKey}, 32),
@@ -7,17 +7,16 @@ import (
 	"io"
 )
 
-const marshalVersion = 1
-
 /*	Format:
 
-	uvarint  version (always 1)
+	uvarint  version (Version1 | Version2 | Version3, tells how to decrypt EncryptedContent)
 	uvarint  length of EncryptedContent
 	[]byte   EncryptedContent
 	uvarint  amount of key slots
 
 	for each key slot
 
+		uvarint  KekType (only in Version3. earlier versions are always KekTypeRsaOaepSha256)
 		uvarint  length of KekId
 		string   KekId
 		uvarint  length of DekEncrypted
@@ -44,7 +43,11 @@ func (e *Envelope) Marshal() ([]byte, error) {
 		writeBytes(buf[0:binary.PutUvarint(buf, num)])
 	}
 
-	writeUvarint(uint64(marshalVersion))
+	if !supportedVersion(e.Version) {
+		return nil, fmt.Errorf("Marshal: unsupported version: %d", e.Version)
+	}
+
+	writeUvarint(e.Version)
 
 	writeUvarint(uint64(len(e.EncryptedContent)))
 
@@ -53,6 +56,12 @@ func (e *Envelope) Marshal() ([]byte, error) {
 	writeUvarint(uint64(len(e.KeySlots)))
 
 	for _, keySlot := range e.KeySlots {
+		if e.Version >= Version3 {
+			writeUvarint(uint64(keySlot.KekType))
+		} else if keySlot.KekType != KekTypeRsaOaepSha256 {
+			return nil, fmt.Errorf("Marshal: version %d supports only RSA key slots", e.Version)
+		}
+
 		writeUvarint(uint64(len(keySlot.KekId)))
 
 		writeBytes([]byte(keySlot.KekId))
@@ -73,11 +82,8 @@ func Unmarshal(buf []byte) (*Envelope, error) {
 		return nil, err
 	}
 
-	if version != marshalVersion {
-		return nil, fmt.Errorf(
-			"unexpected version: %d, expected %d",
-			version,
-			marshalVersion)
+	if !supportedVersion(version) {
+		return nil, fmt.Errorf("unsupported version: %d", version)
 	}
 
 	readByteSlice := func() ([]byte, error) {
@@ -108,6 +114,16 @@ func Unmarshal(buf []byte) (*Envelope, error) {
 	}
 
 	for i := uint64(0); i < lenKeySlots; i++ {
+		kekType := KekTypeRsaOaepSha256
+		if version >= Version3 {
+			kekTypeRaw, err := binary.ReadUvarint(bufReader)
+			if err != nil {
+				return nil, err
+			}
+
+			kekType = KekType(kekTypeRaw)
+		}
+
 		kekId, err := readByteSlice()
 		if err != nil {
 			return nil, err
@@ -119,13 +135,19 @@ func Unmarshal(buf []byte) (*Envelope, error) {
 		}
 
 		keySlots = append(keySlots, envelopeKeySlot{
+			KekType:      kekType,
 			KekId:        string(kekId),
 			DekEncrypted: dekEncrypted,
 		})
 	}
 
 	return &Envelope{
+		Version:          version,
 		EncryptedContent: encryptedContent,
 		KeySlots:         keySlots,
 	}, nil
 }
+
+func supportedVersion(version uint64) bool {
+	return version == Version1 || version == Version2 || version == Version3
+}
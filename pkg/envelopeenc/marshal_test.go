@@ -7,8 +7,10 @@ import (
 
 func TestMarshalUnmarshal(t *testing.T) {
 	out, err := (&Envelope{
+		Version: Version2,
 		KeySlots: []envelopeKeySlot{
 			{
+				KekType:      KekTypeRsaOaepSha256,
 				KekId:        "foo",
 				DekEncrypted: []byte{0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01, 0x00},
 			},
@@ -21,12 +23,26 @@ func TestMarshalUnmarshal(t *testing.T) {
 	assert.Ok(t, err)
 
 	assert.EqualJson(t, env, `{
+  "version": 2,
   "key_slots": [
     {
+      "kek_type": 1,
       "kek_id": "foo",
       "dek_encrypted": "BwYFBAMCAQA="
     }
   ],
   "content": "AAECAwQFBgc="
 }`)
+
+	_, err = (&Envelope{Version: 4}).Marshal()
+	assert.EqualString(t, err.Error(), "Marshal: unsupported version: 4")
+
+	_, err = Unmarshal([]byte{0x04})
+	assert.EqualString(t, err.Error(), "unsupported version: 4")
+
+	_, err = (&Envelope{
+		Version:  Version2,
+		KeySlots: []envelopeKeySlot{{KekType: KekTypeX25519}},
+	}).Marshal()
+	assert.EqualString(t, err.Error(), "Marshal: version 2 supports only RSA key slots")
 }
@@ -0,0 +1,197 @@
+package envelopeenc
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/function61/passitron/pkg/securebuf"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+)
+
+// chunked encryption for content too big to be held in memory (e.g. file attachments).
+// the stream has its own random key, which is meant to be protected by a regular envelope.
+//
+// format: version byte, 16-byte random nonce prefix, then chunks of streamChunkSize
+// plaintext bytes (the last one can be shorter, even empty) sealed with XChaCha20-Poly1305.
+// nonce of a chunk is prefix || 7-byte chunk counter || last chunk flag, so chunks can't
+// be reordered, dropped or the stream truncated without it being detected.
+
+const (
+	StreamKeySize = chacha20poly1305.KeySize
+
+	streamVersion1    = 1
+	streamChunkSize   = 64 * 1024
+	streamNoncePrefix = 16
+)
+
+func NewStreamKey() ([]byte, error) {
+	key := make([]byte, StreamKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// associatedData is authenticated with each chunk, so the same must be given to
+// DecryptStream(). returns the count of plaintext bytes
+func EncryptStream(dst io.Writer, src io.Reader, key []byte, associatedData []byte) (int64, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, 1+streamNoncePrefix)
+	header[0] = streamVersion1
+	if _, err := io.ReadFull(rand.Reader, header[1:]); err != nil {
+		return 0, err
+	}
+
+	if _, err := dst.Write(header); err != nil {
+		return 0, err
+	}
+
+	nonces := newStreamNonces(header[1:], aead.NonceSize())
+
+	srcBuffered := bufio.NewReaderSize(src, streamChunkSize)
+
+	plaintext := make([]byte, streamChunkSize)
+	defer securebuf.Zero(plaintext)
+
+	ciphertext := make([]byte, 0, streamChunkSize+aead.Overhead())
+
+	total := int64(0)
+
+	for {
+		n, last, err := readChunk(srcBuffered, plaintext)
+		if err != nil {
+			return total, err
+		}
+
+		nonce, err := nonces.next(last)
+		if err != nil {
+			return total, err
+		}
+
+		ciphertext = aead.Seal(ciphertext[:0], nonce, plaintext[:n], associatedData)
+
+		if _, err := dst.Write(ciphertext); err != nil {
+			return total, err
+		}
+
+		total += int64(n)
+
+		if last {
+			return total, nil
+		}
+	}
+}
+
+// plaintext is written as soon as each chunk is authenticated, so on error dst can have
+// received a prefix of the content. returns the count of plaintext bytes
+func DecryptStream(dst io.Writer, src io.Reader, key []byte, associatedData []byte) (int64, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, 1+streamNoncePrefix)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return 0, fmt.Errorf("DecryptStream: header: %w", err)
+	}
+
+	if header[0] != streamVersion1 {
+		return 0, fmt.Errorf("DecryptStream: unsupported version: %d", header[0])
+	}
+
+	nonces := newStreamNonces(header[1:], aead.NonceSize())
+
+	srcBuffered := bufio.NewReaderSize(src, streamChunkSize+aead.Overhead())
+
+	ciphertext := make([]byte, streamChunkSize+aead.Overhead())
+	plaintext := make([]byte, 0, streamChunkSize)
+	defer func() { securebuf.Zero(plaintext[:cap(plaintext)]) }()
+
+	total := int64(0)
+
+	for {
+		n, last, err := readChunk(srcBuffered, ciphertext)
+		if err != nil {
+			return total, err
+		}
+
+		nonce, err := nonces.next(last)
+		if err != nil {
+			return total, err
+		}
+
+		plaintext, err = aead.Open(plaintext[:0], nonce, ciphertext[:n], associatedData)
+		if err != nil {
+			// tampered with, truncated or given in wrong context
+			return total, errors.New("DecryptStream: chunk authentication failed")
+		}
+
+		if _, err := dst.Write(plaintext); err != nil {
+			return total, err
+		}
+
+		total += int64(len(plaintext))
+
+		if last {
+			return total, nil
+		}
+	}
+}
+
+// fills buf as full as possible. last=true if src ended
+func readChunk(src *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(src, buf)
+	switch err {
+	case nil: // buf full, but src could've ended exactly at the boundary
+		if _, errPeek := src.Peek(1); errPeek != nil {
+			if errPeek == io.EOF {
+				return n, true, nil
+			}
+
+			return n, false, errPeek
+		}
+
+		return n, false, nil
+	case io.EOF, io.ErrUnexpectedEOF:
+		return n, true, nil
+	default:
+		return n, false, err
+	}
+}
+
+type streamNonces struct {
+	nonce   []byte
+	counter uint64
+}
+
+func newStreamNonces(prefix []byte, nonceSize int) *streamNonces {
+	nonce := make([]byte, nonceSize)
+	copy(nonce, prefix)
+
+	return &streamNonces{nonce: nonce}
+}
+
+// prefix || 7-byte big endian counter || last chunk flag
+func (s *streamNonces) next(last bool) ([]byte, error) {
+	if s.counter >= 1<<56 {
+		return nil, errors.New("stream too long")
+	}
+
+	counterAndFlag := s.nonce[len(s.nonce)-8:]
+	binary.BigEndian.PutUint64(counterAndFlag, s.counter<<8)
+	if last {
+		counterAndFlag[7] = 1
+	}
+
+	s.counter++
+
+	return s.nonce, nil
+}
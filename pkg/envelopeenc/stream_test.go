@@ -0,0 +1,67 @@
+package envelopeenc
+
+import (
+	"bytes"
+	"crypto/rand"
+	"github.com/function61/gokit/assert"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"testing"
+)
+
+func TestStreamRoundTrip(t *testing.T) {
+	key, err := NewStreamKey()
+	assert.Ok(t, err)
+
+	for _, size := range []int{0, 1, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3*streamChunkSize + 42} {
+		t.Run(strconv.Itoa(size), func(t *testing.T) {
+			plaintext := make([]byte, size)
+			_, err := io.ReadFull(rand.Reader, plaintext)
+			assert.Ok(t, err)
+
+			encrypted := &bytes.Buffer{}
+			written, err := EncryptStream(encrypted, bytes.NewReader(plaintext), key, []byte("acc1/file1"))
+			assert.Ok(t, err)
+			assert.Assert(t, written == int64(size))
+
+			decrypted := &bytes.Buffer{}
+			read, err := DecryptStream(decrypted, bytes.NewReader(encrypted.Bytes()), key, []byte("acc1/file1"))
+			assert.Ok(t, err)
+			assert.Assert(t, read == int64(size))
+			assert.Assert(t, bytes.Equal(decrypted.Bytes(), plaintext))
+		})
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	key, err := NewStreamKey()
+	assert.Ok(t, err)
+
+	encrypted := &bytes.Buffer{}
+	_, err = EncryptStream(encrypted, bytes.NewReader(make([]byte, 2*streamChunkSize+10)), key, nil)
+	assert.Ok(t, err)
+
+	decrypt := func(ciphertext []byte, associatedData []byte) error {
+		_, err := DecryptStream(ioutil.Discard, bytes.NewReader(ciphertext), key, associatedData)
+		return err
+	}
+
+	assert.Ok(t, decrypt(encrypted.Bytes(), nil))
+
+	assert.EqualString(t, decrypt(encrypted.Bytes(), []byte("other context")).Error(), "DecryptStream: chunk authentication failed")
+
+	flipped := append([]byte{}, encrypted.Bytes()...)
+	flipped[100] ^= 0x01
+	assert.EqualString(t, decrypt(flipped, nil).Error(), "DecryptStream: chunk authentication failed")
+
+	// truncated at chunk boundary, so the remaining chunks look intact
+	header := 1 + streamNoncePrefix
+	encryptedChunk := streamChunkSize + 16
+	truncated := encrypted.Bytes()[:header+2*encryptedChunk]
+	assert.EqualString(t, decrypt(truncated, nil).Error(), "DecryptStream: chunk authentication failed")
+
+	assert.EqualString(t, decrypt(encrypted.Bytes()[:header], nil).Error(), "DecryptStream: chunk authentication failed")
+
+	assert.EqualString(t, decrypt([]byte{2}, nil).Error(), "DecryptStream: header: unexpected EOF")
+}
@@ -0,0 +1,169 @@
+package envelopeenc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"github.com/function61/passitron/pkg/securebuf"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"io"
+)
+
+// ECIES-style key slots: for each slot we generate an ephemeral key pair, and encrypt the
+// DEK with a key derived from the ephemeral key's and recipient's shared secret. much
+// faster than RSA (especially key generation on a Pi Zero) and much smaller ciphertexts.
+
+const (
+	x25519KdfInfo = "envelopeenc x25519 kek"
+)
+
+type X25519PublicKey [32]byte
+
+type X25519PrivateKey struct {
+	PublicKey X25519PublicKey
+	scalar    *securebuf.Buffer // in locked memory
+}
+
+func GenerateX25519Key() (*X25519PrivateKey, error) {
+	return generateX25519Key(rand.Reader)
+}
+
+func generateX25519Key(random io.Reader) (*X25519PrivateKey, error) {
+	scalar := securebuf.New(32)
+	if _, err := io.ReadFull(random, scalar.Bytes()); err != nil {
+		scalar.Destroy()
+		return nil, err
+	}
+
+	return newX25519PrivateKey(scalar), nil
+}
+
+// scalar is copied, so caller should zero it
+func NewX25519PrivateKey(scalar []byte) (*X25519PrivateKey, error) {
+	if len(scalar) != 32 {
+		return nil, errors.New("X25519 private key must be 32 bytes")
+	}
+
+	return newX25519PrivateKey(securebuf.Copy(scalar)), nil
+}
+
+// takes ownership of scalar
+func newX25519PrivateKey(scalar *securebuf.Buffer) *X25519PrivateKey {
+	privKey := &X25519PrivateKey{scalar: scalar}
+
+	// X25519 clamps the scalar itself, so any 32 bytes are fine
+	curve25519.ScalarBaseMult((*[32]byte)(&privKey.PublicKey), scalar.Array32())
+
+	return privKey
+}
+
+func NewX25519PublicKey(key []byte) (*X25519PublicKey, error) {
+	if len(key) != 32 {
+		return nil, errors.New("X25519 public key must be 32 bytes")
+	}
+
+	pubKey := X25519PublicKey{}
+	copy(pubKey[:], key)
+
+	return &pubKey, nil
+}
+
+// copy of the scalar, in the Go heap. caller should zero it after use
+func (k *X25519PrivateKey) Bytes() []byte {
+	return append([]byte{}, k.scalar.Bytes()...)
+}
+
+// overwrites (and frees) the scalar, after which the key is unusable
+func (k *X25519PrivateKey) Zero() {
+	k.scalar.Destroy()
+}
+
+// same format as SSH fingerprints
+func (k *X25519PublicKey) fingerprint() string {
+	digest := sha256.Sum256(append([]byte("x25519"), k[:]...))
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(digest[:])
+}
+
+// ephemeralPub || ChaCha20Poly1305(wrappingKey, nonce=0, dek)
+func x25519SealDek(dek []byte, recipient *X25519PublicKey, random io.Reader) ([]byte, error) {
+	ephemeral, err := generateX25519Key(random)
+	if err != nil {
+		return nil, err
+	}
+
+	defer ephemeral.Zero()
+
+	wrappingKey, err := x25519WrappingKey(ephemeral.scalar.Array32(), recipient, &ephemeral.PublicKey, recipient)
+	if err != nil {
+		return nil, err
+	}
+	defer securebuf.Zero(wrappingKey)
+
+	aead, err := chacha20poly1305.New(wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// zero nonce is fine since the wrapping key is used only once (ephemeral key)
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+
+	return aead.Seal(append([]byte{}, ephemeral.PublicKey[:]...), nonce, dek, nil), nil
+}
+
+func x25519OpenDek(dekEncrypted []byte, recipient *X25519PrivateKey) ([]byte, error) {
+	if len(dekEncrypted) < 32 {
+		return nil, errors.New("x25519OpenDek: too short")
+	}
+
+	ephemeralPub := X25519PublicKey{}
+	copy(ephemeralPub[:], dekEncrypted[:32])
+
+	wrappingKey, err := x25519WrappingKey(recipient.scalar.Array32(), &ephemeralPub, &ephemeralPub, &recipient.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	defer securebuf.Zero(wrappingKey)
+
+	aead, err := chacha20poly1305.New(wrappingKey)
+	if err != nil {
+		return nil, err
+	}
+
+	dek, err := aead.Open(nil, make([]byte, chacha20poly1305.NonceSize), dekEncrypted[32:], nil)
+	if err != nil {
+		return nil, errors.New("x25519OpenDek: aead.Open failed")
+	}
+
+	return dek, nil
+}
+
+// both public keys are bound to the derived key, so the slot cannot be re-targeted
+func x25519WrappingKey(
+	ourScalar *[32]byte,
+	theirPub *X25519PublicKey,
+	ephemeralPub *X25519PublicKey,
+	recipientPub *X25519PublicKey,
+) ([]byte, error) {
+	var shared [32]byte
+	defer securebuf.Zero(shared[:])
+
+	curve25519.ScalarMult(&shared, ourScalar, (*[32]byte)(theirPub))
+
+	// low-order point as public key yields all-zero shared secret
+	if subtle.ConstantTimeCompare(shared[:], make([]byte, 32)) == 1 {
+		return nil, errors.New("x25519: invalid public key")
+	}
+
+	info := append(append([]byte(x25519KdfInfo), ephemeralPub[:]...), recipientPub[:]...)
+
+	wrappingKey := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared[:], nil, info), wrappingKey); err != nil {
+		return nil, err
+	}
+
+	return wrappingKey, nil
+}
@@ -40,20 +40,12 @@ func createMiddlewares(appState *state.AppState) (httpauth.MiddlewareChainMap, e
 			return "", false
 		}
 
-		token := authHeader[len(bearerPrefix):]
-		if token == "" { // important! user could have empty access token (if not set)
+		userData := appState.FindUserByAccessToken(authHeader[len(bearerPrefix):])
+		if userData == nil {
 			return "", false
 		}
 
-		for _, userId := range appState.UserIds() {
-			userScope := appState.User(userId)
-
-			if userScope.SensitiveUser().AccessToken == token {
-				return userScope.SensitiveUser().User.Id, true
-			}
-		}
-
-		return "", false
+		return userData.UserId(), true
 	}
 
 	/*
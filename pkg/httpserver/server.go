@@ -8,6 +8,7 @@ import (
 	"github.com/function61/gokit/logex"
 	"github.com/function61/gokit/taskrunner"
 	"github.com/function61/passitron/pkg/apitypes"
+	"github.com/function61/passitron/pkg/auditsink"
 	"github.com/function61/passitron/pkg/commands"
 	"github.com/function61/passitron/pkg/extractpublicfiles"
 	"github.com/function61/passitron/pkg/f61ui"
@@ -27,7 +28,8 @@ const (
 	keyFile  = "key.pem"
 )
 
-func Run(ctx context.Context, logger *log.Logger) error {
+// autoUnlockKeyFile is optional (empty = disabled)
+func Run(ctx context.Context, autoUnlockKeyFile string, logger *log.Logger) error {
 	downloadUrl := extractpublicfiles.BintrayDownloadUrl(
 		"function61",
 		"dl",
@@ -44,6 +46,29 @@ func Run(ctx context.Context, logger *log.Logger) error {
 	if err != nil {
 		return err
 	}
+	defer appState.Close()
+
+	auditSinkConfigs, err := auditsink.ReadConfig(auditsink.ConfigFilename)
+	if err != nil {
+		return err
+	}
+
+	auditSinks, err := auditsink.NewDispatcher(
+		auditSinkConfigs,
+		appState,
+		auditsink.CursorsFilename,
+		logex.Prefix("auditsink", logger))
+	if err != nil {
+		return err
+	}
+
+	appState.SetAuditListener(auditSinks.Submit)
+
+	if autoUnlockKeyFile != "" {
+		if err := appState.AutoUnlock(autoUnlockKeyFile, logex.Prefix("autounlock", logger)); err != nil {
+			return err
+		}
+	}
 
 	handler, err := createHandler(appState, logger)
 	if err != nil {
@@ -90,6 +115,14 @@ func Run(ctx context.Context, logger *log.Logger) error {
 
 	tasks.Start("listenershutdowner", httputils.ServerShutdownTask(srv))
 
+	tasks.Start("auditsink", func(ctx context.Context, _ string) error {
+		return auditSinks.Run(ctx)
+	})
+
+	tasks.Start("autosealer", func(ctx context.Context, _ string) error {
+		return appState.RunAutoSealer(ctx, logex.Prefix("autosealer", logger))
+	})
+
 	return tasks.Wait()
 }
 
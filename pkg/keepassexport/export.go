@@ -2,17 +2,27 @@ package keepassexport
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base32"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/function61/passitron/pkg/apitypes"
+	"github.com/function61/passitron/pkg/compositekey"
 	"github.com/function61/passitron/pkg/domain"
+	"github.com/function61/passitron/pkg/otptoken"
+	"github.com/function61/passitron/pkg/securebuf"
+	"github.com/function61/passitron/pkg/sshkey"
 	"github.com/function61/passitron/pkg/state"
 	"github.com/mattetti/filebuffer"
 	"github.com/tobischo/gokeepasslib"
@@ -23,7 +33,7 @@ import (
 	"time"
 )
 
-func Export(st *state.AppState, userId string, masterPassword string) error {
+func Export(st *state.AppState, userId string, masterKey *compositekey.Key) error {
 	conf := st.User(userId).S3ExportDetails()
 
 	if conf == nil {
@@ -34,13 +44,18 @@ func Export(st *state.AppState, userId string, masterPassword string) error {
 
 	// keep sure exported file password is same as master password so user doesn't by
 	// accident export it with the wrong password. TODO: this makes process inherently interactive
-	if err := userData.Crypto().VerifyPassword(masterPassword); err != nil {
+	passphrase, err := masterKey.Passphrase()
+	if err != nil {
+		return err
+	}
+
+	if err := userData.Crypto().VerifyPassword(passphrase); err != nil {
 		return err
 	}
 
 	var keepassOutFile bytes.Buffer
 
-	if err := keepassExport(masterPassword, &keepassOutFile, userData); err != nil {
+	if err := keepassExport(masterKey, &keepassOutFile, userData); err != nil {
 		return err
 	}
 
@@ -125,7 +140,7 @@ func exportRecursive(
 	id string,
 	meta *gokeepasslib.MetaData,
 	userStorage *state.UserStorage,
-	masterPassword string,
+	masterPassword string, // for SSH keys. empty if key file only (kdbx itself is still encrypted)
 ) (gokeepasslib.Group, int) {
 	entriesExported := 0
 
@@ -139,57 +154,81 @@ func exportRecursive(
 	for _, wacc := range waccs {
 		for idx, secret := range wacc.Secrets {
 			var entry *gokeepasslib.Entry = nil
-			switch domain.SecretKindExhaustive97ac5d(secret.Kind) {
+			switch domain.SecretKindExhaustive86cfe7(secret.Kind) {
 			case domain.SecretKindKeylist:
 				entry = entryForAccount(wacc.Account, idx, exportKeylistAsText(secret, userStorage))
 			case domain.SecretKindPassword:
-				password, err := userStorage.Crypto().Decrypt(secret.Envelope)
+				password, err := userStorage.DecryptSecret(secret)
 				if err != nil {
 					panic(err)
 				}
 
 				entry = entryForAccount(wacc.Account, idx, "")
-				entry.Values = append(entry.Values, mkProtectedValue("Password", string(password)))
+				entry.Values = append(entry.Values, mkProtectedValue("Password", string(password.Bytes())))
+				password.Destroy()
 			case domain.SecretKindSshKey:
+				if secret.NonExportable { // generated here, so the private key never leaves
+					entry = entryForAccount(wacc.Account, idx, "Non-exportable SSH key: "+secret.SshPublicKeyAuthorized)
+					break
+				}
+
 				entry = entryForAccount(wacc.Account, idx, "")
-				filename := wacc.Account.Id + ".id_rsa"
 
-				sshPrivateKey, err := userStorage.Crypto().Decrypt(secret.Envelope)
+				sshPrivateKey, err := userStorage.DecryptSecret(secret)
 				if err != nil {
 					panic(err)
 				}
 
-				plaintextSshBlock, rest := pem.Decode(sshPrivateKey)
-				if len(rest) > 0 {
-					panic("Extra data included in PEM content")
+				privateKey, err := sshkey.Parse(sshPrivateKey.Bytes(), nil)
+				sshPrivateKey.Destroy()
+				if err != nil {
+					panic(err)
 				}
 
-				encryptedSshKey := encryptPemBlock(
-					plaintextSshBlock,
-					[]byte(masterPassword))
+				filename := wacc.Account.Id + "." + sshkey.DefaultFilename(privateKey)
 
-				binary := meta.Binaries.Add(pem.EncodeToMemory(encryptedSshKey))
+				binary := meta.Binaries.Add(exportSshKey(privateKey, wacc.Account.Title, []byte(masterPassword)))
 				binaryReference := binary.CreateReference(filename)
 
+				securebuf.ZeroPrivateKey(privateKey)
+
 				entry.Binaries = append(entry.Binaries, binaryReference)
 			case domain.SecretKindNote:
-				note, err := userStorage.Crypto().Decrypt(secret.Envelope)
+				note, err := userStorage.DecryptSecret(secret)
 				if err != nil {
 					panic(err)
 				}
 
-				entry = entryForAccount(wacc.Account, idx, string(note))
+				entry = entryForAccount(wacc.Account, idx, string(note.Bytes()))
+				note.Destroy()
 			case domain.SecretKindOtpToken:
 				otpProvisioningUrl, err := userStorage.DecryptOtpProvisioningUrl(secret)
 				if err != nil {
 					panic(err)
 				}
 
+				token, err := userStorage.DecryptOtpToken(secret)
+				if err != nil {
+					panic(err)
+				}
+
 				entry = entryForAccount(wacc.Account, idx, "")
 				entry.Values = append(entry.Values, mkProtectedValue("Password", otpProvisioningUrl))
+				entry.Values = append(entry.Values, otpValues(token, otpProvisioningUrl)...)
 			case domain.SecretKindExternalToken:
 				entry = entryForAccount(wacc.Account, idx, "")
 				entry.Values = append(entry.Values, mkProtectedValue("Password", secret.Title))
+			case domain.SecretKindAttachment:
+				// the whole database is in memory anyway
+				content := &bytes.Buffer{}
+				if err := userStorage.WriteAttachment(secret, content); err != nil {
+					panic(err)
+				}
+
+				entry = entryForAccount(wacc.Account, idx, "")
+
+				binary := meta.Binaries.Add(content.Bytes())
+				entry.Binaries = append(entry.Binaries, binary.CreateReference(secret.AttachmentFilename))
 			default:
 				panic("invalid secret kind: " + secret.Kind)
 			}
@@ -223,9 +262,16 @@ func exportRecursive(
 	return group, entriesExported
 }
 
-func keepassExport(masterPassword string, output io.Writer, userStorage *state.UserStorage) error {
+func keepassExport(masterKey *compositekey.Key, output io.Writer, userStorage *state.UserStorage) error {
 	meta := gokeepasslib.NewMetaData()
 
+	// our key file parsing is KeePass-compatible (gokeepasslib's is not), so we give it
+	// the components directly
+	passwordHash, keyFileKey, err := masterKey.Components()
+	if err != nil {
+		return err
+	}
+
 	content := &gokeepasslib.DBContent{
 		Meta: meta,
 	}
@@ -234,7 +280,7 @@ func keepassExport(masterPassword string, output io.Writer, userStorage *state.U
 		domain.RootFolderId,
 		meta,
 		userStorage,
-		masterPassword)
+		masterKey.Password)
 
 	content.Root = &gokeepasslib.RootData{
 		Groups: []gokeepasslib.Group{rootGroup},
@@ -243,7 +289,7 @@ func keepassExport(masterPassword string, output io.Writer, userStorage *state.U
 	db := &gokeepasslib.Database{
 		Signature:   &gokeepasslib.DefaultSig,
 		Headers:     gokeepasslib.NewFileHeaders(),
-		Credentials: gokeepasslib.NewPasswordCredentials(masterPassword),
+		Credentials: &gokeepasslib.DBCredentials{Passphrase: passwordHash, Key: keyFileKey},
 		Content:     content,
 	}
 
@@ -269,6 +315,70 @@ func mkProtectedValue(key string, value string) gokeepasslib.ValueData {
 	return gokeepasslib.ValueData{Key: key, Value: gokeepasslib.V{Content: value, Protected: true}}
 }
 
+// "otp" is what KeePassXC understands (incl. Steam), the rest are KeePass's native
+// fields (https://keepass.info/help/base/placeholders.html#otp). KeePass doesn't do Steam
+func otpValues(token *otptoken.Token, otpProvisioningUrl string) []gokeepasslib.ValueData {
+	secretBase32 := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(token.Secret)
+
+	values := []gokeepasslib.ValueData{
+		mkProtectedValue("otp", otpProvisioningUrl),
+	}
+
+	switch {
+	case token.Steam:
+	case token.Kind == otptoken.KindHotp:
+		values = append(values,
+			mkProtectedValue("HmacOtp-Secret-Base32", secretBase32),
+			mkValue("HmacOtp-Counter", strconv.FormatUint(token.Counter, 10)))
+	default:
+		values = append(values,
+			mkProtectedValue("TimeOtp-Secret-Base32", secretBase32),
+			mkValue("TimeOtp-Length", strconv.Itoa(token.Digits)),
+			mkValue("TimeOtp-Period", strconv.Itoa(int(token.Period/time.Second))),
+			mkValue("TimeOtp-Algorithm", keepassOtpAlgorithm[token.Algorithm]))
+	}
+
+	return values
+}
+
+var keepassOtpAlgorithm = map[string]string{
+	otptoken.AlgorithmSha1:   "HMAC-SHA-1",
+	otptoken.AlgorithmSha256: "HMAC-SHA-256",
+	otptoken.AlgorithmSha512: "HMAC-SHA-512",
+}
+
+// in a format OpenSSH reads. RSA and ECDSA keys are additionally encrypted with the
+// password, but for Ed25519 there's no such PEM format (and we can't produce encrypted
+// OpenSSH format), so it's protected only by the database's encryption
+func exportSshKey(privateKey crypto.Signer, comment string, password []byte) []byte {
+	var plaintextBlock *pem.Block
+
+	switch key := privateKey.(type) {
+	case *rsa.PrivateKey:
+		plaintextBlock = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			panic(err)
+		}
+
+		plaintextBlock = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case ed25519.PrivateKey:
+		openSshKey, err := sshkey.MarshalOpenSshEd25519(key, comment)
+		if err != nil {
+			panic(err)
+		}
+
+		return openSshKey
+	default:
+		panic(fmt.Errorf("unsupported SSH key type %T", privateKey))
+	}
+
+	defer securebuf.Zero(plaintextBlock.Bytes)
+
+	return pem.EncodeToMemory(encryptPemBlock(plaintextBlock, password))
+}
+
 func encryptPemBlock(plaintextBlock *pem.Block, password []byte) *pem.Block {
 	ciphertextBlock, err := x509.EncryptPEMBlock(
 		rand.Reader,
@@ -40,8 +40,12 @@ func Run(csvPath string, userId string) error {
 	if err != nil {
 		return err
 	}
+	defer st.Close()
 
-	userCrypto := st.User(userId).Crypto()
+	userData := st.User(userId)
+	if userData == nil {
+		return fmt.Errorf("user not found: %s", userId)
+	}
 
 	csvFile, err := os.Open(csvPath)
 	if err != nil {
@@ -125,16 +129,31 @@ func Run(csvPath string, userId string) error {
 		}
 
 		if res["Password"] != "" {
-			envelope, err := userCrypto.Encrypt([]byte(res["Password"]))
+			// for the account's key (so deleting the account crypto-shreds the password)
+			accountKey, keyCreated, err := userData.CreateAccountKey(accountId, ehevent.Meta(modificationTime, userId))
+			if err != nil {
+				return err
+			}
+
+			pushEvent(keyCreated)
+
+			secretId := state.RandomId()
+
+			envelope, err := accountKey.Encrypt([]byte(res["Password"]), state.SecretContext{
+				AccountId: accountId,
+				SecretId:  secretId,
+				Kind:      domain.SecretKindPassword,
+			})
 			if err != nil {
 				return err
 			}
 
 			pushEvent(domain.NewAccountPasswordAdded(
 				accountId,
-				state.RandomId(),
+				secretId,
 				"",
 				envelope,
+				"",
 				ehevent.Meta(modificationTime, userId)))
 		}
 
@@ -0,0 +1,229 @@
+// One-time password tokens (TOTP, HOTP and Steam Guard) from "otpauth://" provisioning URLs.
+// spec: https://github.com/google/google-authenticator/wiki/Key-Uri-Format
+package otptoken
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Kind string
+
+const (
+	KindTotp Kind = "totp"
+	KindHotp Kind = "hotp"
+)
+
+const (
+	AlgorithmSha1   = "SHA1"
+	AlgorithmSha256 = "SHA256"
+	AlgorithmSha512 = "SHA512"
+)
+
+// Steam Guard codes are TOTP, but with 5 characters from this alphabet
+const steamAlphabet = "23456789BCDFGHJKMNPQRTVWXY"
+
+type Token struct {
+	Kind      Kind
+	Secret    []byte
+	Algorithm string
+	Digits    int           // for Steam, count of characters
+	Period    time.Duration // TOTP only
+	Counter   uint64        // HOTP only. the next counter value to use
+	Steam     bool
+}
+
+// supports "otpauth://totp/..." and "otpauth://hotp/..". Steam tokens are recognized
+// from "encoder=steam" (KeePassXC) or issuer=Steam without explicit digits
+func Parse(provisioningUrl string) (*Token, error) {
+	u, err := url.Parse(provisioningUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "otpauth" {
+		return nil, fmt.Errorf("unsupported scheme: %s", u.Scheme)
+	}
+
+	query := u.Query()
+
+	secret, err := decodeSecret(query.Get("secret"))
+	if err != nil {
+		return nil, err
+	}
+
+	token := &Token{
+		Kind:      Kind(strings.ToLower(u.Host)),
+		Secret:    secret,
+		Algorithm: AlgorithmSha1,
+		Digits:    6,
+		Period:    30 * time.Second,
+		Steam: query.Get("encoder") == "steam" ||
+			(strings.EqualFold(query.Get("issuer"), "steam") && query.Get("digits") == ""),
+	}
+
+	if token.Kind != KindTotp && token.Kind != KindHotp {
+		return nil, fmt.Errorf("unsupported token type: %s", u.Host)
+	}
+
+	if token.Steam {
+		token.Digits = 5
+	}
+
+	if algorithm := query.Get("algorithm"); algorithm != "" {
+		token.Algorithm = strings.ToUpper(algorithm)
+
+		if _, err := newHash(token.Algorithm); err != nil {
+			return nil, err
+		}
+	}
+
+	if digits := query.Get("digits"); digits != "" {
+		token.Digits, err = strconv.Atoi(digits)
+		if err != nil || token.Digits < 5 || token.Digits > 10 {
+			return nil, fmt.Errorf("unsupported digits: %s", digits)
+		}
+	}
+
+	if period := query.Get("period"); period != "" {
+		seconds, err := strconv.Atoi(period)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid period: %s", period)
+		}
+
+		token.Period = time.Duration(seconds) * time.Second
+	}
+
+	if token.Kind == KindHotp {
+		counter := query.Get("counter")
+		if counter == "" {
+			return nil, errors.New("HOTP token requires counter")
+		}
+
+		token.Counter, err = strconv.ParseUint(counter, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid counter: %s", counter)
+		}
+	}
+
+	return token, nil
+}
+
+// HOTP uses Counter, TOTP uses the time step of ts
+func (t *Token) Code(ts time.Time) string {
+	if t.Kind == KindHotp {
+		return t.CodeAt(t.Counter)
+	}
+
+	return t.CodeAt(t.TimeStep(ts))
+}
+
+// TOTP time step (= counter) for a point in time
+func (t *Token) TimeStep(ts time.Time) uint64 {
+	return uint64(ts.Unix()) / uint64(t.Period/time.Second)
+}
+
+// time window of a TOTP time step
+func (t *Token) TimeStepWindow(step uint64) (time.Time, time.Time) {
+	from := time.Unix(int64(step*uint64(t.Period/time.Second)), 0).UTC()
+	return from, from.Add(t.Period)
+}
+
+// RFC 4226 with the algorithm, digits and alphabet of the token
+func (t *Token) CodeAt(counter uint64) string {
+	newHashFn, err := newHash(t.Algorithm)
+	if err != nil { // validated in Parse()
+		panic(err)
+	}
+
+	counterBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(counterBytes, counter)
+
+	mac := hmac.New(newHashFn, t.Secret)
+	mac.Write(counterBytes)
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	truncated := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	if t.Steam {
+		code := make([]byte, t.Digits)
+		for i := range code {
+			code[i] = steamAlphabet[truncated%uint32(len(steamAlphabet))]
+			truncated /= uint32(len(steamAlphabet))
+		}
+
+		return string(code)
+	}
+
+	modulo := uint64(1)
+	for i := 0; i < t.Digits; i++ {
+		modulo *= 10
+	}
+
+	return fmt.Sprintf("%0*d", t.Digits, uint64(truncated)%modulo)
+}
+
+func newHash(algorithm string) (func() hash.Hash, error) {
+	switch algorithm {
+	case AlgorithmSha1:
+		return sha1.New, nil
+	case AlgorithmSha256:
+		return sha256.New, nil
+	case AlgorithmSha512:
+		return sha512.New, nil
+	default:
+		return nil, fmt.Errorf("unsupported algorithm: %s", algorithm)
+	}
+}
+
+// base32 as in Google Authenticator: case insensitive, padding optional
+func decodeSecret(secret string) ([]byte, error) {
+	normalized := strings.ToUpper(strings.TrimRight(strings.Replace(secret, " ", "", -1), "="))
+	if normalized == "" {
+		return nil, errors.New("secret missing")
+	}
+
+	decoded, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(normalized)
+	if err != nil {
+		return nil, fmt.Errorf("invalid secret: %v", err)
+	}
+
+	return decoded, nil
+}
+
+// the provisioning URL updated with our state of the token: HOTP counter (so exports
+// continue where we left off) and explicit Steam encoder (that KeePassXC understands)
+func ExportUrl(provisioningUrl string, token *Token) (string, error) {
+	if token.Kind != KindHotp && !token.Steam {
+		return provisioningUrl, nil
+	}
+
+	u, err := url.Parse(provisioningUrl)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	if token.Kind == KindHotp {
+		query.Set("counter", strconv.FormatUint(token.Counter, 10))
+	}
+	if token.Steam {
+		query.Set("encoder", "steam")
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
@@ -0,0 +1,119 @@
+package otptoken
+
+import (
+	"encoding/base32"
+	"github.com/function61/gokit/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestHotpRfc4226(t *testing.T) {
+	token, err := Parse("otpauth://hotp/Example:alice?counter=1&secret=" + b32("12345678901234567890"))
+	assert.Ok(t, err)
+
+	assert.Assert(t, token.Kind == KindHotp)
+	assert.Assert(t, token.Counter == 1)
+	assert.EqualString(t, token.Code(time.Now()), "287082")
+	assert.EqualString(t, token.CodeAt(0), "755224")
+	assert.EqualString(t, token.CodeAt(9), "520489")
+
+	_, err = Parse("otpauth://hotp/Example:alice?secret=" + b32("12345678901234567890"))
+	assert.EqualString(t, err.Error(), "HOTP token requires counter")
+}
+
+func TestTotpRfc6238(t *testing.T) {
+	t59 := time.Unix(59, 0)
+
+	for _, tc := range []struct {
+		algorithm string
+		secret    string
+		expected  string
+	}{
+		{"SHA1", "12345678901234567890", "94287082"},
+		{"SHA256", "12345678901234567890123456789012", "46119246"},
+		{"sha512", "1234567890123456789012345678901234567890123456789012345678901234", "90693936"},
+	} {
+		tc := tc // pin
+		t.Run(tc.algorithm, func(t *testing.T) {
+			token, err := Parse("otpauth://totp/Example:alice?digits=8&algorithm=" + tc.algorithm + "&secret=" + b32(tc.secret))
+			assert.Ok(t, err)
+			assert.EqualString(t, token.Code(t59), tc.expected)
+		})
+	}
+}
+
+func TestTotpPeriod(t *testing.T) {
+	token, err := Parse("otpauth://totp/Example:alice?period=60&secret=JBSWY3DPEHPK3PXP")
+	assert.Ok(t, err)
+
+	assert.Assert(t, token.TimeStep(time.Unix(119, 0)) == 1)
+
+	from, to := token.TimeStepWindow(1)
+	assert.EqualString(t, from.Format(time.RFC3339), "1970-01-01T00:01:00Z")
+	assert.EqualString(t, to.Format(time.RFC3339), "1970-01-01T00:02:00Z")
+
+	assert.EqualString(t, token.Code(time.Unix(60, 0)), token.Code(time.Unix(119, 0)))
+}
+
+func TestSteam(t *testing.T) {
+	token, err := Parse("otpauth://totp/Steam:alice?secret=JBSWY3DPEHPK3PXP&issuer=Steam")
+	assert.Ok(t, err)
+	assert.Assert(t, token.Steam)
+
+	code := token.Code(time.Unix(1500000000, 0))
+	assert.Assert(t, regexp.MustCompile("^[23456789BCDFGHJKMNPQRTVWXY]{5}$").MatchString(code))
+
+	keepassXc, err := Parse("otpauth://totp/Steam:alice?secret=JBSWY3DPEHPK3PXP&period=30&digits=5&encoder=steam")
+	assert.Ok(t, err)
+	assert.EqualString(t, keepassXc.Code(time.Unix(1500000000, 0)), code)
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		url string
+		err string
+	}{
+		{"https://example.com/", "unsupported scheme: https"},
+		{"otpauth://motp/x?secret=JBSWY3DPEHPK3PXP", "unsupported token type: motp"},
+		{"otpauth://totp/x", "secret missing"},
+		{"otpauth://totp/x?secret=JBSWY3DPEHPK3PXP&algorithm=MD5", "unsupported algorithm: MD5"},
+		{"otpauth://totp/x?secret=JBSWY3DPEHPK3PXP&digits=3", "unsupported digits: 3"},
+		{"otpauth://totp/x?secret=JBSWY3DPEHPK3PXP&period=0", "invalid period: 0"},
+	} {
+		_, err := Parse(tc.url)
+		assert.EqualString(t, err.Error(), tc.err)
+	}
+}
+
+func TestExportUrl(t *testing.T) {
+	totpUrl := "otpauth://totp/Example:alice?secret=JBSWY3DPEHPK3PXP&issuer=Example"
+	token, err := Parse(totpUrl)
+	assert.Ok(t, err)
+
+	exportUrl, err := ExportUrl(totpUrl, token)
+	assert.Ok(t, err)
+	assert.EqualString(t, exportUrl, totpUrl)
+
+	hotpUrl := "otpauth://hotp/Example:alice?counter=1&secret=JBSWY3DPEHPK3PXP"
+	token, err = Parse(hotpUrl)
+	assert.Ok(t, err)
+
+	token.Counter = 42
+
+	exportUrl, err = ExportUrl(hotpUrl, token)
+	assert.Ok(t, err)
+	assert.EqualString(t, exportUrl, "otpauth://hotp/Example:alice?counter=42&secret=JBSWY3DPEHPK3PXP")
+
+	steamUrl := "otpauth://totp/Steam:alice?secret=JBSWY3DPEHPK3PXP&issuer=Steam"
+	token, err = Parse(steamUrl)
+	assert.Ok(t, err)
+
+	exportUrl, err = ExportUrl(steamUrl, token)
+	assert.Ok(t, err)
+	assert.EqualString(t, exportUrl, "otpauth://totp/Steam:alice?encoder=steam&issuer=Steam&secret=JBSWY3DPEHPK3PXP")
+}
+
+func b32(secret string) string {
+	return base32.StdEncoding.EncodeToString([]byte(secret))
+}
@@ -0,0 +1,303 @@
+// Password generator with named policies, for sites with length limits or character rules
+package passwordgen
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type CharClass string
+
+const (
+	ClassLower   CharClass = "lower"
+	ClassUpper   CharClass = "upper"
+	ClassDigits  CharClass = "digits"
+	ClassSymbols CharClass = "symbols"
+)
+
+var classChars = map[CharClass]string{
+	ClassLower:   "abcdefghijklmnopqrstuvwxyz",
+	ClassUpper:   "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	ClassDigits:  "0123456789",
+	ClassSymbols: "!_-=:;,.", // conservative set that sites rarely reject
+}
+
+// easily confused with each other when read or typed by hand
+const ambiguousChars = "0O1lI"
+
+type Policy struct {
+	Name             string
+	Description      string
+	Length           int         // characters, or words for passphrases
+	Classes          []CharClass // alphabet
+	Required         []CharClass // at least one character from each
+	ExcludeAmbiguous bool
+	Passphrase       bool // words from diceware wordlist instead of characters
+	Separator        string
+}
+
+const DefaultPolicy = "default"
+
+var Policies = []Policy{
+	{
+		Name:        DefaultPolicy,
+		Description: "16 characters of letters, digits and symbols",
+		Length:      16,
+		Classes:     []CharClass{ClassLower, ClassUpper, ClassDigits, ClassSymbols},
+	},
+	{
+		Name:        "strong",
+		Description: "32 characters with every character class",
+		Length:      32,
+		Classes:     []CharClass{ClassLower, ClassUpper, ClassDigits, ClassSymbols},
+		Required:    []CharClass{ClassLower, ClassUpper, ClassDigits, ClassSymbols},
+	},
+	{
+		Name:        "short",
+		Description: "12 characters with every character class, for sites with length limits",
+		Length:      12,
+		Classes:     []CharClass{ClassLower, ClassUpper, ClassDigits, ClassSymbols},
+		Required:    []CharClass{ClassLower, ClassUpper, ClassDigits, ClassSymbols},
+	},
+	{
+		Name:             "alphanumeric",
+		Description:      "20 letters and digits, no look-alike characters. for sites that reject symbols",
+		Length:           20,
+		Classes:          []CharClass{ClassLower, ClassUpper, ClassDigits},
+		Required:         []CharClass{ClassLower, ClassUpper, ClassDigits},
+		ExcludeAmbiguous: true,
+	},
+	{
+		Name:        "pin",
+		Description: "6 digits",
+		Length:      6,
+		Classes:     []CharClass{ClassDigits},
+	},
+	{
+		Name:        "passphrase",
+		Description: "6 diceware words, easy to type by hand",
+		Length:      6,
+		Passphrase:  true,
+		Separator:   "-",
+	},
+}
+
+var dicewareWords = strings.Fields(dicewareWordlist)
+
+func PolicyByName(name string) (*Policy, error) {
+	for _, policy := range Policies {
+		if policy.Name == name {
+			return &policy, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown password policy: %s", name)
+}
+
+func Generate(policy Policy) (string, error) {
+	if err := policy.Validate(); err != nil {
+		return "", err
+	}
+
+	if policy.Passphrase {
+		words := []string{}
+		for i := 0; i < policy.Length; i++ {
+			idx, err := randomInt(len(dicewareWords))
+			if err != nil {
+				return "", err
+			}
+
+			words = append(words, dicewareWords[idx])
+		}
+
+		return strings.Join(words, policy.Separator), nil
+	}
+
+	alphabet := policy.alphabet()
+
+	// rejection sampling keeps each acceptable password equally likely
+	for {
+		password := make([]byte, policy.Length)
+		for i := range password {
+			idx, err := randomInt(len(alphabet))
+			if err != nil {
+				return "", err
+			}
+
+			password[i] = alphabet[idx]
+		}
+
+		if policy.hasRequiredClasses(string(password)) {
+			return string(password), nil
+		}
+	}
+}
+
+// upper bound. required classes reduce it a bit, but not enough to matter
+func (p Policy) EntropyBits() int {
+	if p.Passphrase {
+		return int(float64(p.Length) * math.Log2(float64(len(dicewareWords))))
+	}
+
+	return int(float64(p.Length) * math.Log2(float64(len(p.alphabet()))))
+}
+
+func (p Policy) Validate() error {
+	if p.Length <= 0 {
+		return errors.New("Length must be positive")
+	}
+
+	if p.Passphrase {
+		return nil
+	}
+
+	if len(p.Classes) == 0 {
+		return errors.New("Classes cannot be empty")
+	}
+
+	if len(p.Required) > p.Length {
+		return errors.New("more Required classes than Length")
+	}
+
+	for _, class := range append(append([]CharClass{}, p.Classes...), p.Required...) {
+		if _, found := classChars[class]; !found {
+			return fmt.Errorf("unknown character class: %s", class)
+		}
+	}
+
+	for _, required := range p.Required {
+		if !p.hasClass(required) {
+			return fmt.Errorf("required class %s not in Classes", required)
+		}
+	}
+
+	return nil
+}
+
+func (p Policy) alphabet() string {
+	alphabet := ""
+	for _, class := range p.Classes {
+		alphabet += p.classChars(class)
+	}
+
+	return alphabet
+}
+
+func (p Policy) classChars(class CharClass) string {
+	if !p.ExcludeAmbiguous {
+		return classChars[class]
+	}
+
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(ambiguousChars, r) {
+			return -1 // drop
+		}
+
+		return r
+	}, classChars[class])
+}
+
+func (p Policy) hasClass(class CharClass) bool {
+	for _, candidate := range p.Classes {
+		if candidate == class {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (p Policy) hasRequiredClasses(password string) bool {
+	for _, required := range p.Required {
+		if !strings.ContainsAny(password, p.classChars(required)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// uniform in [0, max)
+func randomInt(max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n.Int64()), nil
+}
+
+// rough estimate for passwords not generated by us: length * log2(size of the character
+// pools used). it overestimates human-chosen passwords ("Password1!"), so it's an upper
+// bound that only catches the clearly weak ones. takes bytes so the caller's (securebuf)
+// plaintext doesn't need to be copied to the heap as a string
+func EstimateEntropyBits(password []byte) int {
+	if len(password) == 0 {
+		return 0
+	}
+
+	if isDicewareWord(password) {
+		return int(math.Log2(float64(len(dicewareWords))))
+	}
+
+	poolSize := 0
+	for _, pool := range estimationPools {
+		if bytes.ContainsAny(password, pool) {
+			poolSize += len(pool)
+		}
+	}
+
+	if bytes.IndexFunc(password, func(r rune) bool { return r > unicode.MaxASCII }) != -1 {
+		poolSize += 100 // rough guess
+	}
+
+	return int(float64(utf8.RuneCount(password)) * math.Log2(float64(poolSize)))
+}
+
+// unlike the ones we generate from, people use all of ASCII's symbols
+var estimationPools = []string{
+	classChars[ClassLower],
+	classChars[ClassUpper],
+	classChars[ClassDigits],
+	" !\"#$%&'()*+,-./:;<=>?@[\\]^_`{|}~",
+}
+
+var dicewareWordSet = func() map[string]bool {
+	set := map[string]bool{}
+	for _, word := range dicewareWords {
+		set[word] = true
+	}
+
+	return set
+}()
+
+// case-insensitive. lowercases in a stack buffer (which gets zeroed) instead of the heap
+func isDicewareWord(word []byte) bool {
+	var lowered [32]byte // longer than any of the words
+	defer func() {
+		for i := range lowered {
+			lowered[i] = 0
+		}
+	}()
+
+	if len(word) > len(lowered) {
+		return false
+	}
+
+	for i, b := range word {
+		if b >= 'A' && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		lowered[i] = b
+	}
+
+	// map lookup with converted key doesn't allocate
+	return dicewareWordSet[string(lowered[:len(word)])]
+}
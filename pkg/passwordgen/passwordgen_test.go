@@ -0,0 +1,85 @@
+package passwordgen
+
+import (
+	"github.com/function61/gokit/assert"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPoliciesAreValid(t *testing.T) {
+	for _, policy := range Policies {
+		assert.Ok(t, policy.Validate())
+
+		password, err := Generate(policy)
+		assert.Ok(t, err)
+		assert.Assert(t, password != "")
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	alphanumeric, err := PolicyByName("alphanumeric")
+	assert.Ok(t, err)
+
+	for i := 0; i < 100; i++ {
+		password, err := Generate(*alphanumeric)
+		assert.Ok(t, err)
+
+		assert.Assert(t, len(password) == 20)
+		assert.Assert(t, !strings.ContainsAny(password, ambiguousChars+classChars[ClassSymbols]))
+		assert.Assert(t, strings.ContainsAny(password, "0123456789"))
+	}
+
+	passphrase, err := PolicyByName("passphrase")
+	assert.Ok(t, err)
+
+	password, err := Generate(*passphrase)
+	assert.Ok(t, err)
+	assert.Assert(t, len(strings.Split(password, "-")) == 6)
+
+	assert.Assert(t, len(dicewareWords) == 7775)
+	assert.Assert(t, passphrase.EntropyBits() == 77)
+
+	_, err = PolicyByName("doesNotExist")
+	assert.EqualString(t, err.Error(), "unknown password policy: doesNotExist")
+}
+
+func TestValidate(t *testing.T) {
+	invalid := func(policy Policy) string {
+		return policy.Validate().Error()
+	}
+
+	assert.EqualString(t, invalid(Policy{}), "Length must be positive")
+	assert.EqualString(t, invalid(Policy{Length: 8}), "Classes cannot be empty")
+	assert.EqualString(t, invalid(Policy{
+		Length:  8,
+		Classes: []CharClass{"emoji"},
+	}), "unknown character class: emoji")
+	assert.EqualString(t, invalid(Policy{
+		Length:   8,
+		Classes:  []CharClass{ClassDigits},
+		Required: []CharClass{ClassUpper},
+	}), "required class upper not in Classes")
+	assert.EqualString(t, invalid(Policy{
+		Length:   1,
+		Classes:  []CharClass{ClassDigits, ClassUpper},
+		Required: []CharClass{ClassDigits, ClassUpper},
+	}), "more Required classes than Length")
+}
+
+func TestEstimateEntropyBits(t *testing.T) {
+	for _, tc := range []struct {
+		password    string
+		entropyBits int
+	}{
+		{"", 0},
+		{"123456", 19},
+		{"qwerty", 28},
+		{"Hunter", 12}, // a dictionary word
+		{"hunter#2", 48},
+		{"Tr0ub4dor&3", 72},
+		{"päss", 27},
+	} {
+		assert.EqualString(t, strconv.Itoa(EstimateEntropyBits([]byte(tc.password))), strconv.Itoa(tc.entropyBits))
+	}
+}
@@ -0,0 +1,56 @@
+package restqueryapi
+
+import (
+	"fmt"
+	"github.com/function61/passitron/pkg/domain"
+	"github.com/function61/passitron/pkg/state"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// empty parameters are not used for filtering
+func parseAuditLogQuery(params url.Values) (*state.AuditLogQuery, error) {
+	query := &state.AuditLogQuery{
+		AccountId:      params.Get("account"),
+		SecretId:       params.Get("secret"),
+		SecretUsedType: domain.SecretUsedType(params.Get("type")),
+		IpAddress:      params.Get("ip"),
+	}
+
+	var err error
+
+	if query.From, err = parseOptionalTime(params.Get("from")); err != nil {
+		return nil, fmt.Errorf("from: %w", err)
+	}
+
+	if query.To, err = parseOptionalTime(params.Get("to")); err != nil {
+		return nil, fmt.Errorf("to: %w", err)
+	}
+
+	if query.Before, err = parseOptionalInt(params.Get("before")); err != nil {
+		return nil, fmt.Errorf("before: %w", err)
+	}
+
+	if query.Limit, err = parseOptionalInt(params.Get("limit")); err != nil {
+		return nil, fmt.Errorf("limit: %w", err)
+	}
+
+	return query, nil
+}
+
+func parseOptionalTime(serialized string) (time.Time, error) {
+	if serialized == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, serialized)
+}
+
+func parseOptionalInt(serialized string) (int, error) {
+	if serialized == "" {
+		return 0, nil
+	}
+
+	return strconv.Atoi(serialized)
+}
@@ -1,6 +1,7 @@
 package restqueryapi
 
 import (
+	"bytes"
 	"github.com/boombuler/barcode"
 	"github.com/boombuler/barcode/qr"
 	"github.com/function61/eventhorizon/pkg/ehevent"
@@ -9,15 +10,22 @@ import (
 	"github.com/function61/passitron/pkg/domain"
 	"github.com/function61/passitron/pkg/httpserver/muxregistrator"
 	"github.com/function61/passitron/pkg/httputil"
+	"github.com/function61/passitron/pkg/passwordgen"
 	"github.com/function61/passitron/pkg/state"
 	"github.com/function61/passitron/pkg/u2futil"
 	"github.com/gorilla/mux"
 	"github.com/tstranex/u2f"
 	"image/png"
+	"mime"
 	"net/http"
+	"strconv"
 	"time"
 )
 
+const (
+	maxAttachmentSize = 64 * 1024 * 1024
+)
+
 func Register(router *mux.Router, mwares httpauth.MiddlewareChainMap, st *state.AppState) {
 	apitypes.RegisterRoutes(&queryHandlers{
 		state: st,
@@ -171,8 +179,17 @@ func (a *queryHandlers) GetSecrets(rctx *httpauth.RequestContext, u2fResponse ap
 	}
 
 	secretIdsForAudit := []string{}
+	hotpCounterEvents := []ehevent.Event{}
 	for _, secret := range secrets {
 		secretIdsForAudit = append(secretIdsForAudit, secret.Secret.Id)
+
+		if secret.OtpCounter != nil { // HOTP code was shown => it's used
+			hotpCounterEvents = append(hotpCounterEvents, domain.NewAccountOtpTokenCounterAdvanced(
+				acc.Account.Id,
+				secret.Secret.Id,
+				*secret.OtpCounter,
+				ehevent.Meta(time.Now(), rctx.User.Id)))
+		}
 	}
 
 	secretUsedEvent := domain.NewAccountSecretUsed(
@@ -182,7 +199,7 @@ func (a *queryHandlers) GetSecrets(rctx *httpauth.RequestContext, u2fResponse ap
 		"",
 		ehevent.Meta(time.Now(), rctx.User.Id))
 
-	if err := a.state.EventLog.Append([]ehevent.Event{secretUsedEvent}); err != nil {
+	if err := a.state.EventLog.Append(append([]ehevent.Event{secretUsedEvent}, hotpCounterEvents...)); err != nil {
 		httputil.RespondHttpJson(httputil.GenericError("audit_event_append_failed", err), http.StatusInternalServerError, w)
 		return nil
 	}
@@ -190,9 +207,15 @@ func (a *queryHandlers) GetSecrets(rctx *httpauth.RequestContext, u2fResponse ap
 	return &secrets
 }
 
-func (a *queryHandlers) AuditLogEntries(rctx *httpauth.RequestContext, w http.ResponseWriter, r *http.Request) *[]apitypes.AuditlogEntry {
-	auditLog := a.userData(rctx).AuditLog()
-	return &auditLog
+func (a *queryHandlers) AuditLogEntries(rctx *httpauth.RequestContext, w http.ResponseWriter, r *http.Request) *apitypes.AuditlogPage {
+	query, err := parseAuditLogQuery(r.URL.Query())
+	if err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("invalid_auditlog_query", err), http.StatusBadRequest, w)
+		return nil
+	}
+
+	page := a.userData(rctx).QueryAuditLog(*query)
+	return &page
 }
 
 func (a *queryHandlers) GetAccount(rctx *httpauth.RequestContext, w http.ResponseWriter, r *http.Request) *apitypes.WrappedAccount {
@@ -231,6 +254,82 @@ func (a *queryHandlers) Search(rctx *httpauth.RequestContext, w http.ResponseWri
 	}
 }
 
+func (a *queryHandlers) PasswordPolicies(rctx *httpauth.RequestContext, w http.ResponseWriter, r *http.Request) *[]apitypes.PasswordPolicy {
+	policies := []apitypes.PasswordPolicy{}
+
+	for _, policy := range passwordgen.Policies {
+		policies = append(policies, apitypes.PasswordPolicy{
+			Name:             policy.Name,
+			Description:      policy.Description,
+			Length:           policy.Length,
+			Classes:          charClassesToStrings(policy.Classes),
+			Required:         charClassesToStrings(policy.Required),
+			ExcludeAmbiguous: policy.ExcludeAmbiguous,
+			Passphrase:       policy.Passphrase,
+			Separator:        policy.Separator,
+			EntropyBits:      policy.EntropyBits(),
+		})
+	}
+
+	return &policies
+}
+
+func (a *queryHandlers) GeneratePassword(rctx *httpauth.RequestContext, w http.ResponseWriter, r *http.Request) *apitypes.GeneratedPassword {
+	policyName := r.URL.Query().Get("policy")
+	if policyName == "" {
+		policyName = passwordgen.DefaultPolicy
+	}
+
+	policy, err := passwordgen.PolicyByName(policyName)
+	if err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("unknown_password_policy", err), http.StatusBadRequest, w)
+		return nil
+	}
+
+	password, err := passwordgen.Generate(*policy)
+	if err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("password_generation_failed", err), http.StatusInternalServerError, w)
+		return nil
+	}
+
+	return &apitypes.GeneratedPassword{
+		Password:    password,
+		Policy:      policy.Name,
+		EntropyBits: policy.EntropyBits(),
+	}
+}
+
+// no U2F needed, since the report doesn't contain any plaintexts
+func (a *queryHandlers) HealthReport(rctx *httpauth.RequestContext, w http.ResponseWriter, r *http.Request) *apitypes.HealthReport {
+	maxAgeDays := 365
+
+	if maxAgeDaysSerialized := r.URL.Query().Get("maxAgeDays"); maxAgeDaysSerialized != "" {
+		var err error
+		maxAgeDays, err = strconv.Atoi(maxAgeDaysSerialized)
+		if err != nil || maxAgeDays < 1 {
+			httputil.RespondHttpJson(httputil.GenericError("invalid_max_age_days", err), http.StatusBadRequest, w)
+			return nil
+		}
+	}
+
+	report, auditEvents, err := a.userData(rctx).HealthReport(
+		time.Duration(maxAgeDays)*24*time.Hour,
+		ehevent.Meta(time.Now(), rctx.User.Id))
+	if err != nil {
+		respondSecretDecryptionFailed(w, err)
+		return nil
+	}
+
+	if len(auditEvents) > 0 { // no passwords => nothing was looked at
+		if err := a.state.EventLog.Append(auditEvents); err != nil {
+			httputil.RespondHttpJson(httputil.GenericError("audit_event_append_failed", err), http.StatusInternalServerError, w)
+			return nil
+		}
+	}
+
+	return report
+}
+
 func (a *queryHandlers) U2fEnrollmentChallenge(rctx *httpauth.RequestContext, w http.ResponseWriter, r *http.Request) *apitypes.U2FEnrollmentChallenge {
 	c, err := u2f.NewChallenge(u2futil.GetAppIdHostname(), u2futil.MakeTrustedFacets())
 	if err != nil {
@@ -274,6 +373,10 @@ func (a *queryHandlers) U2fEnrolledTokens(rctx *httpauth.RequestContext, w http.
 
 func (a *queryHandlers) GetSignInChallenge(rctx *httpauth.RequestContext, w http.ResponseWriter, r *http.Request) *apitypes.U2FChallengeBundle {
 	userData := a.state.User(mux.Vars(r)["userId"])
+	if userData == nil {
+		httputil.RespondHttpJson(httputil.GenericError("user_not_found", nil), http.StatusNotFound, w)
+		return nil
+	}
 
 	// list of keyhandles for user is not exactly the most sensitive data, but still better
 	// have a mac proving that user knew username/password combo before exposing this data
@@ -317,23 +420,95 @@ func (a *queryHandlers) TotpBarcodeExport(rctx *httpauth.RequestContext, w http.
 		return
 	}
 
-	qrCode, err := qr.Encode(otpProvisioningUrl, qr.M, qr.Auto)
+	respondQrCodePng(otpProvisioningUrl, w)
+}
+
+// the shares together are equivalent to the decryption key, so treat them like secrets
+func (a *queryHandlers) RecoveryShares(rctx *httpauth.RequestContext, u2fResponse apitypes.U2FResponseBundle, w http.ResponseWriter, r *http.Request) *apitypes.RecoveryShares {
+	userData := a.userData(rctx)
+
+	u2fTokenUsedEvent, err := u2futil.SignatureOk(u2fResponse, u2futil.ChallengeHashForRecoveryShares(rctx.User.Id), userData)
+	if err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("u2f_challenge_response_failed", err), http.StatusForbidden, w)
+		return nil
+	}
+	if err := a.state.EventLog.Append([]ehevent.Event{u2fTokenUsedEvent}); err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("u2f_audit_failed", err), http.StatusInternalServerError, w)
+		return nil
+	}
+
+	recoveryShares, err := userData.RecoveryShares()
+	if err != nil {
+		respondSecretDecryptionFailed(w, err)
+		return nil
+	}
+
+	if recoveryShares == nil {
+		httputil.RespondHttpJson(httputil.GenericError("recovery_shares_not_created", nil), http.StatusNotFound, w)
+		return nil
+	}
+
+	recoveryShares.QrCodesPng = [][]byte{}
+	for _, share := range recoveryShares.Shares {
+		qrCode, err := qrCodePng(share)
+		if err != nil {
+			httputil.RespondHttpJson(httputil.GenericError("qr_encode", err), http.StatusInternalServerError, w)
+			return nil
+		}
+
+		recoveryShares.QrCodesPng = append(recoveryShares.QrCodesPng, qrCode)
+	}
+
+	viewedEvent := domain.NewUserRecoverySharesViewed(ehevent.Meta(time.Now(), rctx.User.Id))
+
+	if err := a.state.EventLog.Append([]ehevent.Event{viewedEvent}); err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("audit_event_append_failed", err), http.StatusInternalServerError, w)
+		return nil
+	}
+
+	return recoveryShares
+}
+
+func (a *queryHandlers) RecoverySharesChallenge(rctx *httpauth.RequestContext, w http.ResponseWriter, r *http.Request) *apitypes.U2FChallengeBundle {
+	challengeBundle, err := u2futil.MakeChallengeBundle(
+		u2futil.ChallengeHashForRecoveryShares(rctx.User.Id),
+		a.userData(rctx))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil
+	}
+
+	return challengeBundle
+}
+
+func respondQrCodePng(content string, w http.ResponseWriter) {
+	qrCode, err := qrCodePng(content)
 	if err != nil {
 		httputil.RespondHttpJson(httputil.GenericError("qr_encode", err), http.StatusInternalServerError, w)
 		return
 	}
 
+	w.Header().Set("Content-Type", "image/png")
+	_, _ = w.Write(qrCode)
+}
+
+func qrCodePng(content string) ([]byte, error) {
+	qrCode, err := qr.Encode(content, qr.M, qr.Auto)
+	if err != nil {
+		return nil, err
+	}
+
 	qrCode, err = barcode.Scale(qrCode, 200, 200)
 	if err != nil {
-		httputil.RespondHttpJson(httputil.GenericError("barcode_scale", err), http.StatusInternalServerError, w)
-		return
+		return nil, err
 	}
 
-	w.Header().Set("Content-Type", "image/png")
-	if err := png.Encode(w, qrCode); err != nil {
-		httputil.RespondHttpJson(httputil.GenericError("png_encode", err), http.StatusInternalServerError, w)
-		return
+	qrCodePng := &bytes.Buffer{}
+	if err := png.Encode(qrCodePng, qrCode); err != nil {
+		return nil, err
 	}
+
+	return qrCodePng.Bytes(), nil
 }
 
 func respondSecretDecryptionFailed(w http.ResponseWriter, err error) {
@@ -348,3 +523,129 @@ func respondSecretDecryptionFailed(w http.ResponseWriter, err error) {
 		httputil.RespondHttpJson(httputil.GenericError("secret_decryption_failed", err), http.StatusInternalServerError, w)
 	}
 }
+
+// not a command, because commands are JSON and attachments can be big
+func (a *queryHandlers) UploadAttachment(rctx *httpauth.RequestContext, w http.ResponseWriter, r *http.Request) {
+	accountId := mux.Vars(r)["accountId"]
+
+	userData := a.userData(rctx)
+
+	if userData.WrappedAccountById(accountId) == nil {
+		httputil.RespondHttpJson(httputil.GenericError("account_not_found", nil), http.StatusNotFound, w)
+		return
+	}
+
+	title := r.URL.Query().Get("title")
+	filename := r.URL.Query().Get("filename")
+
+	if filename == "" {
+		httputil.RespondHttpJson(httputil.GenericError("filename_missing", nil), http.StatusBadRequest, w)
+		return
+	}
+
+	meta := ehevent.Meta(time.Now(), rctx.User.Id)
+
+	events := []ehevent.Event{}
+
+	accountKey, keyCreated, err := userData.AccountKeyOrCreate(accountId, meta)
+	if err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("account_key_create_failed", err), http.StatusInternalServerError, w)
+		return
+	}
+
+	if keyCreated != nil {
+		events = append(events, keyCreated)
+	}
+
+	attachmentAdded, err := userData.AddAttachment(
+		accountKey,
+		title,
+		filename,
+		http.MaxBytesReader(w, r.Body, maxAttachmentSize),
+		meta)
+	if err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("attachment_store_failed", err), http.StatusBadRequest, w)
+		return
+	}
+
+	if err := a.state.EventLog.Append(append(events, attachmentAdded)); err != nil {
+		// if this fails, the blob only wastes space (its key was in the event)
+		_ = userData.DiscardAttachment(attachmentAdded)
+
+		httputil.RespondHttpJson(httputil.GenericError("event_append_failed", err), http.StatusInternalServerError, w)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (a *queryHandlers) AttachmentDownload(rctx *httpauth.RequestContext, w http.ResponseWriter, r *http.Request) {
+	accountId := mux.Vars(r)["accountId"]
+	secretId := mux.Vars(r)["secretId"]
+
+	userData := a.userData(rctx)
+
+	secret := userData.InternalSecretById(accountId, secretId)
+	if secret == nil || secret.Kind != domain.SecretKindAttachment {
+		httputil.RespondHttpJson(httputil.GenericError("account_or_secret_not_found", nil), http.StatusNotFound, w)
+		return
+	}
+
+	// mac is only handed out with U2F-protected secrets reveal
+	if err := userData.AttachmentDownloadMac(secret).Authenticate(r.URL.Query().Get("mac")); err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("invalid_mac", err), http.StatusForbidden, w)
+		return
+	}
+
+	secretUsedEvent := domain.NewAccountSecretUsed(
+		accountId,
+		[]string{secretId},
+		domain.SecretUsedTypeAttachmentDownloaded,
+		"",
+		ehevent.Meta(time.Now(), rctx.User.Id))
+
+	if err := a.state.EventLog.Append([]ehevent.Event{secretUsedEvent}); err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("audit_event_append_failed", err), http.StatusInternalServerError, w)
+		return
+	}
+
+	// headers are sent on first write, so nothing has been sent if we fail before that
+	output := &writeTracker{ResponseWriter: w}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{
+		"filename": secret.AttachmentFilename,
+	}))
+	w.Header().Set("Content-Length", strconv.Itoa(secret.AttachmentSize))
+
+	if err := userData.WriteAttachment(*secret, output); err != nil {
+		if output.written {
+			// can't send an error anymore. make sure the client sees a broken response
+			panic(http.ErrAbortHandler)
+		}
+
+		w.Header().Del("Content-Disposition")
+		w.Header().Del("Content-Length")
+
+		respondSecretDecryptionFailed(w, err)
+	}
+}
+
+type writeTracker struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (w *writeTracker) Write(p []byte) (int, error) {
+	w.written = true
+	return w.ResponseWriter.Write(p)
+}
+
+func charClassesToStrings(classes []passwordgen.CharClass) []string {
+	strs := []string{}
+	for _, class := range classes {
+		strs = append(strs, string(class))
+	}
+
+	return strs
+}
@@ -0,0 +1,167 @@
+// +build !windows
+
+package securebuf
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+// small buffers are carved from shared pages. each mapping takes at least a page and
+// RLIMIT_MEMLOCK is often only 64 KiB, so bulk operations (exports, reports) that decrypt
+// many secrets would otherwise run out of lockable memory in no time.
+const (
+	slotSize = 64
+)
+
+var (
+	pageSize = os.Getpagesize()
+	// bigger buffers get a mapping of their own
+	maxPooledSize = pageSize / 4
+
+	// swappable for tests
+	mlock = syscall.Mlock
+
+	smallBuffers = &pagePool{}
+)
+
+// anonymous mapping, so the memory is not managed (or moved) by the Go runtime. mlock
+// can fail because of RLIMIT_MEMLOCK, in which case we still use the mapping, unlocked.
+func allocate(size int) ([]byte, func(), bool) {
+	if size <= maxPooledSize {
+		return smallBuffers.allocate(size)
+	}
+
+	mapped, locked, err := mapPages(size)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	return mapped, func() { unmapPages(mapped, locked) }, locked
+}
+
+func mapPages(size int) ([]byte, bool, error) {
+	mapped, err := syscall.Mmap(-1, 0, size, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_ANON|syscall.MAP_PRIVATE)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return mapped, mlock(mapped) == nil, nil
+}
+
+func unmapPages(mapped []byte, locked bool) {
+	if locked {
+		_ = syscall.Munlock(mapped)
+	}
+
+	_ = syscall.Munmap(mapped)
+}
+
+type pagePool struct {
+	pages []*poolPage
+	mu    sync.Mutex
+}
+
+type poolPage struct {
+	mem       []byte
+	locked    bool
+	slotsUsed []bool
+	used      int // count of slotsUsed
+}
+
+func (p *pagePool) allocate(size int) ([]byte, func(), bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	slots := (size + slotSize - 1) / slotSize
+
+	for _, page := range p.pages {
+		if buf, release, ok := p.allocateFrom(page, size, slots); ok {
+			return buf, release, page.locked
+		}
+	}
+
+	mem, locked, err := mapPages(pageSize)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	page := &poolPage{
+		mem:       mem,
+		locked:    locked,
+		slotsUsed: make([]bool, pageSize/slotSize),
+	}
+
+	p.pages = append(p.pages, page)
+
+	buf, release, _ := p.allocateFrom(page, size, slots) // fits, because the page is empty
+
+	return buf, release, locked
+}
+
+// caller must hold p.mu
+func (p *pagePool) allocateFrom(page *poolPage, size int, slots int) ([]byte, func(), bool) {
+	firstSlot := findFreeRun(page.slotsUsed, slots)
+	if firstSlot == -1 {
+		return nil, nil, false
+	}
+
+	for i := firstSlot; i < firstSlot+slots; i++ {
+		page.slotsUsed[i] = true
+	}
+	page.used += slots
+
+	offset := firstSlot * slotSize
+
+	// capacity is limited, so appending cannot write over the neighbours
+	buf := page.mem[offset : offset+size : offset+size]
+
+	release := func() {
+		p.release(page, firstSlot, slots)
+	}
+
+	return buf, release, true
+}
+
+func (p *pagePool) release(page *poolPage, firstSlot int, slots int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for i := firstSlot; i < firstSlot+slots; i++ {
+		page.slotsUsed[i] = false
+	}
+	page.used -= slots
+
+	if page.used > 0 {
+		return
+	}
+
+	// give empty pages back, so our share of RLIMIT_MEMLOCK is only what's in use
+	for idx, candidate := range p.pages {
+		if candidate == page {
+			p.pages = append(p.pages[:idx], p.pages[idx+1:]...)
+			break
+		}
+	}
+
+	unmapPages(page.mem, page.locked)
+}
+
+// index of first slot of a run of n free slots, or -1
+func findFreeRun(slotsUsed []bool, n int) int {
+	run := 0
+	for idx, used := range slotsUsed {
+		if used {
+			run = 0
+			continue
+		}
+
+		run++
+		if run == n {
+			return idx - n + 1
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,56 @@
+// +build !windows
+
+package securebuf
+
+import (
+	"github.com/function61/gokit/assert"
+	"syscall"
+	"testing"
+)
+
+func TestSmallBuffersSharePages(t *testing.T) {
+	previous := smallBuffers
+	smallBuffers = &pagePool{} // so leftovers from other tests don't count
+	defer func() { smallBuffers = previous }()
+
+	pagesBefore := len(smallBuffers.pages)
+
+	first := Copy([]byte("hunter2"))
+	second := Copy(make([]byte, slotSize+1)) // takes two slots
+	third := Copy([]byte("hunter3"))
+
+	assert.Assert(t, len(smallBuffers.pages) == pagesBefore+1)
+
+	// doesn't spill over to its neighbours
+	assert.Assert(t, cap(first.Bytes()) == len("hunter2"))
+	assert.EqualString(t, string(first.Bytes()), "hunter2")
+	assert.EqualString(t, string(third.Bytes()), "hunter3")
+
+	first.Destroy()
+	second.Destroy()
+
+	assert.Assert(t, len(smallBuffers.pages) == pagesBefore+1)
+
+	third.Destroy()
+
+	// empty page is given back
+	assert.Assert(t, len(smallBuffers.pages) == pagesBefore)
+}
+
+func TestMlockFailure(t *testing.T) {
+	mlock = func([]byte) error { return syscall.ENOMEM } // as if RLIMIT_MEMLOCK was reached
+	defer func() { mlock = syscall.Mlock }()
+
+	small := Copy([]byte("hunter2"))
+	defer small.Destroy()
+
+	big := New(maxPooledSize + 1)
+	defer big.Destroy()
+
+	// still usable, just not locked
+	assert.EqualString(t, string(small.Bytes()), "hunter2")
+	assert.Assert(t, !small.Locked())
+
+	big.Bytes()[maxPooledSize] = 42
+	assert.Assert(t, !big.Locked())
+}
@@ -0,0 +1,153 @@
+// Memory for secret material. buffers are allocated outside of the Go heap and mlock()'d
+// where the OS allows, so the secrets don't get swapped to disk (or copied around by the
+// runtime), and they are zeroed when no longer needed. if the OS doesn't allow locking
+// (e.g. RLIMIT_MEMLOCK is reached), buffers still work but are not locked.
+package securebuf
+
+import (
+	"crypto"
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"fmt"
+	"golang.org/x/crypto/ed25519"
+	"math/big"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+type Buffer struct {
+	data    []byte
+	release func() // returns memory to OS. nil if memory is from the Go heap
+	locked  bool
+	mu      sync.Mutex
+}
+
+// zeroed buffer of given size
+func New(size int) *Buffer {
+	b := &Buffer{}
+
+	if size > 0 {
+		b.data, b.release, b.locked = allocate(size)
+	}
+
+	if b.data == nil { // zero size, or allocation outside heap not supported or failed
+		b.data = make([]byte, size)
+	}
+
+	// safety net for forgotten Destroy()
+	runtime.SetFinalizer(b, (*Buffer).Destroy)
+
+	return b
+}
+
+// copies src into a new buffer. zeroing src is the caller's responsibility
+func Copy(src []byte) *Buffer {
+	b := New(len(src))
+	copy(b.data, src)
+	return b
+}
+
+// like Copy(), but also zeroes src
+func Take(src []byte) *Buffer {
+	b := Copy(src)
+	Zero(src)
+	return b
+}
+
+// valid until Destroy(). don't keep references to it (or copies of it) around
+func (b *Buffer) Bytes() []byte {
+	return b.data
+}
+
+// for APIs that want a fixed size array (e.g. curve25519). panics if size is not 32
+func (b *Buffer) Array32() *[32]byte {
+	if len(b.data) != 32 {
+		panic(fmt.Errorf("Array32: buffer size %d", len(b.data)))
+	}
+
+	return (*[32]byte)(unsafe.Pointer(&b.data[0]))
+}
+
+// whether the memory is protected from being swapped out
+func (b *Buffer) Locked() bool {
+	return b.locked
+}
+
+// zeroes and frees the buffer. safe to call multiple times
+func (b *Buffer) Destroy() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.data == nil {
+		return
+	}
+
+	Zero(b.data)
+
+	if b.release != nil {
+		b.release()
+	}
+
+	b.data = nil
+	b.release = nil
+	b.locked = false
+
+	runtime.SetFinalizer(b, nil)
+}
+
+func Zero(buf []byte) {
+	for i := range buf {
+		buf[i] = 0
+	}
+
+	// don't let the compiler think the writes are useless
+	runtime.KeepAlive(buf)
+}
+
+// overwrites private key material. best effort for keys that live in the Go heap (e.g.
+// math/big may have left copies around), so prefer keys that use Buffer internally.
+// (users' legacy RSA decryption keys are such; rotating the key moves them to X25519)
+func ZeroPrivateKey(privKey crypto.PrivateKey) {
+	switch key := privKey.(type) {
+	case *rsa.PrivateKey:
+		zeroBigInt(key.D)
+		for _, prime := range key.Primes {
+			zeroBigInt(prime)
+		}
+		zeroBigInt(key.Precomputed.Dp)
+		zeroBigInt(key.Precomputed.Dq)
+		zeroBigInt(key.Precomputed.Qinv)
+		for _, crtValue := range key.Precomputed.CRTValues {
+			zeroBigInt(crtValue.Exp)
+			zeroBigInt(crtValue.Coeff)
+			zeroBigInt(crtValue.R)
+		}
+	case *ecdsa.PrivateKey:
+		zeroBigInt(key.D)
+	case *dsa.PrivateKey:
+		zeroBigInt(key.X)
+	case ed25519.PrivateKey:
+		Zero(key)
+	case *ed25519.PrivateKey:
+		Zero(*key)
+	case interface{ Zero() }:
+		key.Zero()
+	default:
+		panic(fmt.Errorf("ZeroPrivateKey: unsupported private key type: %T", privKey))
+	}
+}
+
+func zeroBigInt(i *big.Int) {
+	if i == nil {
+		return
+	}
+
+	words := i.Bits()
+	for idx := range words {
+		words[idx] = 0
+	}
+
+	i.SetInt64(0)
+}
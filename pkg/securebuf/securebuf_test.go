@@ -0,0 +1,53 @@
+package securebuf
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/function61/gokit/assert"
+	"testing"
+)
+
+func TestCopyAndTake(t *testing.T) {
+	src := []byte("hunter2")
+
+	copied := Copy(src)
+	defer copied.Destroy()
+
+	assert.EqualString(t, string(copied.Bytes()), "hunter2")
+	assert.EqualString(t, string(src), "hunter2")
+
+	taken := Take(src)
+	defer taken.Destroy()
+
+	assert.EqualString(t, string(taken.Bytes()), "hunter2")
+	assert.Assert(t, bytes.Equal(src, make([]byte, 7)))
+}
+
+func TestDestroy(t *testing.T) {
+	buf := Copy([]byte("hunter2"))
+	buf.Destroy()
+	buf.Destroy() // idempotent
+
+	assert.Assert(t, buf.Bytes() == nil)
+	assert.Assert(t, !buf.Locked())
+}
+
+func TestArray32(t *testing.T) {
+	buf := New(32)
+	defer buf.Destroy()
+
+	buf.Array32()[0] = 42
+
+	assert.Assert(t, buf.Bytes()[0] == 42)
+}
+
+func TestZeroPrivateKey(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Ok(t, err)
+
+	ZeroPrivateKey(key)
+
+	assert.Assert(t, key.D.Sign() == 0)
+	assert.Assert(t, key.Primes[0].Sign() == 0)
+}
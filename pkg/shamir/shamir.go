@@ -0,0 +1,163 @@
+// Shamir's secret sharing over GF(2^8): secret is split into N shares, of which any K
+// (threshold) can be combined to get the secret back. less than K shares reveal nothing.
+package shamir
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"io"
+)
+
+// share = <one y-byte for each byte of secret> <x>
+const shareOverhead = 1
+
+func Split(secret []byte, shareCount int, threshold int) ([][]byte, error) {
+	return splitWithRand(secret, shareCount, threshold, rand.Reader)
+}
+
+func splitWithRand(secret []byte, shareCount int, threshold int, random io.Reader) ([][]byte, error) {
+	switch {
+	case len(secret) == 0:
+		return nil, errors.New("empty secret")
+	case threshold < 2:
+		return nil, errors.New("threshold must be at least 2")
+	case shareCount < threshold:
+		return nil, errors.New("share count cannot be less than threshold")
+	case shareCount > 255: // x=0 is the secret itself
+		return nil, errors.New("share count cannot exceed 255")
+	}
+
+	shares := make([][]byte, shareCount)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+shareOverhead)
+		shares[i][len(secret)] = byte(i + 1) // x
+	}
+
+	// coefficients for one byte's polynomial. coefficients[0] is the secret byte
+	coefficients := make([]byte, threshold)
+
+	for byteIdx, secretByte := range secret {
+		coefficients[0] = secretByte
+		// uniformly random, zero included. rejecting a zero top coefficient would make
+		// (threshold-1) shares leak information about the secret byte
+		if _, err := io.ReadFull(random, coefficients[1:]); err != nil {
+			return nil, err
+		}
+
+		for _, share := range shares {
+			share[byteIdx] = evaluatePolynomial(coefficients, share[len(secret)])
+		}
+	}
+
+	return shares, nil
+}
+
+// all shares must be from the same split. if you give less shares than threshold, you
+// get garbage (there's no way for us to know)
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("need at least 2 shares")
+	}
+
+	shareLen := len(shares[0])
+	if shareLen <= shareOverhead {
+		return nil, errors.New("share too short")
+	}
+
+	xs := make([]byte, len(shares))
+
+	for i, share := range shares {
+		if len(share) != shareLen {
+			return nil, errors.New("shares have different lengths")
+		}
+
+		xs[i] = share[shareLen-1]
+
+		if xs[i] == 0 {
+			return nil, errors.New("invalid share")
+		}
+
+		for j := 0; j < i; j++ {
+			if subtle.ConstantTimeByteEq(xs[i], xs[j]) == 1 {
+				return nil, errors.New("duplicate share")
+			}
+		}
+	}
+
+	secret := make([]byte, shareLen-shareOverhead)
+	ys := make([]byte, len(shares))
+
+	for byteIdx := range secret {
+		for i, share := range shares {
+			ys[i] = share[byteIdx]
+		}
+
+		secret[byteIdx] = interpolateAtZero(xs, ys)
+	}
+
+	return secret, nil
+}
+
+// Horner's method
+func evaluatePolynomial(coefficients []byte, x byte) byte {
+	result := byte(0)
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = gfAdd(gfMul(result, x), coefficients[i])
+	}
+
+	return result
+}
+
+// Lagrange interpolation at x=0
+func interpolateAtZero(xs []byte, ys []byte) byte {
+	result := byte(0)
+
+	for i := range xs {
+		basis := byte(1)
+
+		for j := range xs {
+			if i == j {
+				continue
+			}
+
+			// (0 - x_j) / (x_i - x_j). subtraction is addition in GF(2^8)
+			basis = gfMul(basis, gfDiv(xs[j], gfAdd(xs[i], xs[j])))
+		}
+
+		result = gfAdd(result, gfMul(ys[i], basis))
+	}
+
+	return result
+}
+
+func gfAdd(a, b byte) byte {
+	return a ^ b
+}
+
+// constant-time multiplication (AES polynomial x^8 + x^4 + x^3 + x + 1)
+func gfMul(a, b byte) byte {
+	result := byte(0)
+
+	for i := 0; i < 8; i++ {
+		// result ^= a if lowest bit of b set, without branching
+		result ^= a & -(b & 1)
+
+		carry := -(a >> 7) // 0xFF if high bit set
+		a = (a << 1) ^ (0x1B & carry)
+		b >>= 1
+	}
+
+	return result
+}
+
+// a / b = a * b^254 (b^-1 since b^255 = 1). b must not be zero
+func gfDiv(a, b byte) byte {
+	inverse := b
+	for i := 0; i < 6; i++ { // b^254 = b^(2+4+8+16+32+64+128)
+		inverse = gfMul(gfMul(inverse, inverse), b)
+	}
+	inverse = gfMul(inverse, inverse)
+
+	return gfMul(a, inverse)
+}
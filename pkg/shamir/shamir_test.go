@@ -0,0 +1,78 @@
+package shamir
+
+import (
+	"bytes"
+	"github.com/function61/gokit/assert"
+	"testing"
+)
+
+func TestGfMulAndDiv(t *testing.T) {
+	// from AES spec (FIPS-197 4.2)
+	assert.Assert(t, gfMul(0x57, 0x83) == 0xc1)
+	assert.Assert(t, gfMul(0x57, 0x13) == 0xfe)
+
+	for a := 0; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			assert.Assert(t, gfMul(gfDiv(byte(a), byte(b)), byte(b)) == byte(a))
+		}
+	}
+}
+
+func TestSplitAndCombine(t *testing.T) {
+	secret := []byte("the germans are coming")
+
+	shares, err := Split(secret, 5, 3)
+	assert.Ok(t, err)
+	assert.Assert(t, len(shares) == 5)
+	assert.Assert(t, len(shares[0]) == len(secret)+1)
+
+	// every combination of 3 shares
+	for i := 0; i < 5; i++ {
+		for j := i + 1; j < 5; j++ {
+			for k := j + 1; k < 5; k++ {
+				combined, err := Combine([][]byte{shares[k], shares[i], shares[j]})
+				assert.Ok(t, err)
+				assert.EqualString(t, string(combined), string(secret))
+			}
+		}
+	}
+
+	// more than threshold is fine too
+	combined, err := Combine(shares)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(combined), string(secret))
+
+	// not enough shares
+	combined, err = Combine(shares[0:2])
+	assert.Ok(t, err)
+	assert.Assert(t, !bytes.Equal(combined, secret))
+
+	_, err = Combine([][]byte{shares[0], shares[0]})
+	assert.EqualString(t, err.Error(), "duplicate share")
+
+	_, err = Combine([][]byte{shares[0], shares[1][1:]})
+	assert.EqualString(t, err.Error(), "shares have different lengths")
+}
+
+// zero coefficients are as likely as any other, and must still combine correctly
+func TestSplitWithZeroCoefficients(t *testing.T) {
+	secret := []byte("hunter2")
+
+	shares, err := splitWithRand(secret, 3, 2, bytes.NewReader(make([]byte, len(secret))))
+	assert.Ok(t, err)
+
+	combined, err := Combine(shares[1:])
+	assert.Ok(t, err)
+	assert.EqualString(t, string(combined), string(secret))
+}
+
+func TestSplitValidation(t *testing.T) {
+	_, err := Split([]byte("x"), 3, 1)
+	assert.EqualString(t, err.Error(), "threshold must be at least 2")
+
+	_, err = Split([]byte("x"), 2, 3)
+	assert.EqualString(t, err.Error(), "share count cannot be less than threshold")
+
+	_, err = Split([]byte("x"), 256, 3)
+	assert.EqualString(t, err.Error(), "share count cannot exceed 255")
+}
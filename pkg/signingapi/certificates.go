@@ -0,0 +1,185 @@
+package signingapi
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/httpauth"
+	"github.com/function61/passitron/pkg/domain"
+	"github.com/function61/passitron/pkg/httputil"
+	"github.com/function61/passitron/pkg/state"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"net/http"
+	"time"
+)
+
+// certificates are meant to be short-lived (that's the whole point over authorized_keys)
+const maxCertificateValidity = 7 * 24 * time.Hour
+
+// some leeway for clock skew and scheduling, but certificates can't be pre-minted for use
+// far in the future
+const maxCertificateValidAfterInFuture = 24 * time.Hour
+
+// same as ssh-keygen gives by default
+var defaultCertificateExtensions = []CertificateExtension{
+	{Name: "permit-X11-forwarding"},
+	{Name: "permit-agent-forwarding"},
+	{Name: "permit-port-forwarding"},
+	{Name: "permit-pty"},
+	{Name: "permit-user-rc"},
+}
+
+func (h *handlers) IssueCertificate(rctx *httpauth.RequestContext, input IssueCertificateInput, w http.ResponseWriter, r *http.Request) *IssuedCertificate {
+	uid := rctx.User.Id
+
+	cert, err := certificateFromInput(input, uid, time.Now())
+	if err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("invalid_certificate_request", err), http.StatusBadRequest, w)
+		return nil
+	}
+
+	caPubKey, err := lookupCaPubKey(input.CaPublicKey, h.st.User(uid))
+	if err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("ca_key_not_found", err), http.StatusBadRequest, w)
+		return nil
+	}
+
+	signer, wipe, wacc, secretId, err := lookupSignerByPubKey(caPubKey, true, h.st.User(uid))
+	if err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("privkey_for_pubkey_not_found", err), http.StatusBadRequest, w)
+		return nil
+	}
+
+	err = cert.SignCert(rand.Reader, signer)
+	wipe()
+	if err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("signing_failed", err), http.StatusInternalServerError, w)
+		return nil
+	}
+
+	secretUsedEvent := domain.NewAccountSecretUsed(
+		wacc.Account.Id,
+		[]string{secretId},
+		domain.SecretUsedTypeSshCertificateIssued,
+		"",
+		ehevent.Meta(time.Now(), uid))
+
+	if err := h.st.EventLog.Append([]ehevent.Event{secretUsedEvent}); err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("audit_event_saving_failed", err), http.StatusInternalServerError, w)
+		return nil
+	}
+
+	return &IssuedCertificate{
+		Certificate:           cert.Marshal(),
+		CertificateAuthorized: string(ssh.MarshalAuthorizedKey(cert)),
+	}
+}
+
+// unsigned user certificate
+func certificateFromInput(input IssueCertificateInput, uid string, now time.Time) (*ssh.Certificate, error) {
+	publicKey, err := ssh.ParsePublicKey(input.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, isCert := publicKey.(*ssh.Certificate); isCert {
+		return nil, errors.New("PublicKey is a certificate")
+	}
+
+	// OpenSSH treats empty principals as "any principal"
+	if len(input.Principals) == 0 {
+		return nil, errors.New("Principals cannot be empty")
+	}
+
+	if !input.ValidBefore.After(input.ValidAfter) {
+		return nil, errors.New("ValidBefore must be after ValidAfter")
+	}
+
+	if input.ValidBefore.Sub(input.ValidAfter) > maxCertificateValidity {
+		return nil, fmt.Errorf("validity window cannot exceed %s", maxCertificateValidity)
+	}
+
+	if input.ValidAfter.Sub(now) > maxCertificateValidAfterInFuture {
+		return nil, fmt.Errorf("ValidAfter cannot be more than %s in the future", maxCertificateValidAfterInFuture)
+	}
+
+	extensions := defaultCertificateExtensions
+	if input.Extensions != nil {
+		extensions = *input.Extensions
+	}
+
+	permissions := ssh.Permissions{
+		Extensions: map[string]string{},
+	}
+
+	for _, extension := range extensions {
+		permissions.Extensions[extension.Name] = extension.Value
+	}
+
+	keyId := input.KeyId
+	if keyId == "" {
+		keyId = uid
+	}
+
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ssh.Certificate{
+		Key:             publicKey,
+		Serial:          serial,
+		CertType:        ssh.UserCert,
+		KeyId:           keyId,
+		ValidPrincipals: input.Principals,
+		ValidAfter:      uint64(input.ValidAfter.Unix()),
+		ValidBefore:     uint64(input.ValidBefore.Unix()),
+		Permissions:     permissions,
+	}, nil
+}
+
+// if caPubKeyMarshaled is empty, the user must have exactly one CA key
+func lookupCaPubKey(caPubKeyMarshaled []byte, userStorage *state.UserStorage) ([]byte, error) {
+	caPubKeys := [][]byte{}
+
+	for _, wacc := range userStorage.WrappedAccounts() {
+		for _, secret := range wacc.Secrets {
+			if secret.Kind != domain.SecretKindSshKey || !secret.SshCa {
+				continue
+			}
+
+			publicKey, err := parseSshPublicKeyFromAuthorizedFormat(secret.SshPublicKeyAuthorized)
+			if err != nil { // shouldn't happen
+				return nil, err
+			}
+
+			if len(caPubKeyMarshaled) > 0 && string(publicKey.Marshal()) == string(caPubKeyMarshaled) {
+				return caPubKeyMarshaled, nil
+			}
+
+			caPubKeys = append(caPubKeys, publicKey.Marshal())
+		}
+	}
+
+	if len(caPubKeyMarshaled) > 0 {
+		return nil, errors.New("CA key not found by pubkey")
+	}
+
+	if len(caPubKeys) != 1 {
+		return nil, fmt.Errorf("CaPublicKey required, because you have %d CA keys", len(caPubKeys))
+	}
+
+	return caPubKeys[0], nil
+}
+
+func randomSerial() (uint64, error) {
+	serial := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, serial); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint64(serial), nil
+}
@@ -0,0 +1,74 @@
+package signingapi
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/function61/gokit/assert"
+	"golang.org/x/crypto/ssh"
+	"testing"
+	"time"
+)
+
+func TestCertificateFromInput(t *testing.T) {
+	userPubKey, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.Ok(t, err)
+
+	_, caPrivKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Ok(t, err)
+
+	userKey, err := ssh.NewPublicKey(userPubKey)
+	assert.Ok(t, err)
+
+	caSigner, err := ssh.NewSignerFromKey(caPrivKey)
+	assert.Ok(t, err)
+
+	t0 := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	input := func(validity time.Duration, principals ...string) IssueCertificateInput {
+		return IssueCertificateInput{
+			PublicKey:   userKey.Marshal(),
+			Principals:  principals,
+			ValidAfter:  t0,
+			ValidBefore: t0.Add(validity),
+		}
+	}
+
+	cert, err := certificateFromInput(input(time.Hour, "joonas", "root"), "uid1", t0)
+	assert.Ok(t, err)
+	assert.Ok(t, cert.SignCert(rand.Reader, caSigner))
+
+	assert.EqualString(t, cert.KeyId, "uid1")
+	assert.Assert(t, cert.CertType == ssh.UserCert)
+	assert.Assert(t, len(cert.Permissions.Extensions) == 5)
+
+	checker := &ssh.CertChecker{
+		Clock: func() time.Time { return t0.Add(30 * time.Minute) },
+		IsUserAuthority: func(auth ssh.PublicKey) bool {
+			return string(auth.Marshal()) == string(caSigner.PublicKey().Marshal())
+		},
+	}
+
+	assert.Ok(t, checker.CheckCert("root", cert))
+	assert.EqualString(t, checker.CheckCert("bob", cert).Error(), `ssh: principal "bob" not in the set of valid principals for given certificate: ["joonas" "root"]`)
+
+	checker.Clock = func() time.Time { return t0.Add(2 * time.Hour) }
+	assert.EqualString(t, checker.CheckCert("root", cert).Error(), "ssh: cert has expired")
+
+	noExtensions := input(time.Hour, "joonas")
+	noExtensions.Extensions = &[]CertificateExtension{}
+	cert, err = certificateFromInput(noExtensions, "uid1", t0)
+	assert.Ok(t, err)
+	assert.Assert(t, len(cert.Permissions.Extensions) == 0)
+
+	_, err = certificateFromInput(input(time.Hour), "uid1", t0)
+	assert.EqualString(t, err.Error(), "Principals cannot be empty")
+
+	_, err = certificateFromInput(input(30*24*time.Hour, "joonas"), "uid1", t0)
+	assert.EqualString(t, err.Error(), "validity window cannot exceed 168h0m0s")
+
+	_, err = certificateFromInput(input(-time.Hour, "joonas"), "uid1", t0)
+	assert.EqualString(t, err.Error(), "ValidBefore must be after ValidAfter")
+
+	_, err = certificateFromInput(input(time.Hour, "joonas"), "uid1", t0.Add(-25*time.Hour))
+	assert.EqualString(t, err.Error(), "ValidAfter cannot be more than 24h0m0s in the future")
+}
@@ -0,0 +1,118 @@
+package signingapi
+
+import (
+	"errors"
+	"fmt"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/httpauth"
+	"github.com/function61/passitron/pkg/domain"
+	"github.com/function61/passitron/pkg/httputil"
+	"github.com/function61/passitron/pkg/otptoken"
+	"github.com/function61/passitron/pkg/state"
+	"net/http"
+	"time"
+)
+
+// for scripts that need a code. unlike GetSecrets, the OTP secret itself never leaves
+func (h *handlers) OtpCode(rctx *httpauth.RequestContext, input OtpCodeInput, w http.ResponseWriter, r *http.Request) *OtpCode {
+	uid := rctx.User.Id
+	userStorage := h.st.User(uid)
+
+	wacc, secret, err := lookupOtpSecret(input, userStorage)
+	if err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("otp_token_not_found", err), http.StatusBadRequest, w)
+		return nil
+	}
+
+	token, err := userStorage.DecryptOtpToken(*secret)
+	if err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("otp_token_decryption_failed", err), http.StatusInternalServerError, w)
+		return nil
+	}
+
+	now := time.Now()
+
+	events := []ehevent.Event{
+		domain.NewAccountSecretUsed(
+			wacc.Account.Id,
+			[]string{secret.Id},
+			domain.SecretUsedTypeOtpCodeGenerated,
+			"",
+			ehevent.Meta(now, uid)),
+	}
+
+	if token.Kind == otptoken.KindHotp { // handing out a HOTP code uses it
+		events = append(events, domain.NewAccountOtpTokenCounterAdvanced(
+			wacc.Account.Id,
+			secret.Id,
+			int(token.Counter),
+			ehevent.Meta(now, uid)))
+	}
+
+	if err := h.st.EventLog.Append(events); err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("audit_event_saving_failed", err), http.StatusInternalServerError, w)
+		return nil
+	}
+
+	code := otpCodeAt(token, now)
+	return &code
+}
+
+func otpCodeAt(token *otptoken.Token, now time.Time) OtpCode {
+	// HOTP codes don't expire, they're valid until used
+	if token.Kind == otptoken.KindHotp {
+		return OtpCode{
+			Code:     token.CodeAt(token.Counter),
+			NextCode: token.CodeAt(token.Counter + 1),
+		}
+	}
+
+	step := token.TimeStep(now)
+	validFrom, validUntil := token.TimeStepWindow(step)
+
+	return OtpCode{
+		Code:       token.CodeAt(step),
+		ValidFrom:  &validFrom,
+		ValidUntil: &validUntil,
+		NextCode:   token.CodeAt(step + 1),
+	}
+}
+
+// Account is matched by ID or title. SecretId is only needed if the account has many OTP tokens
+func lookupOtpSecret(input OtpCodeInput, userStorage *state.UserStorage) (*state.InternalAccount, *state.InternalSecret, error) {
+	if input.Account == "" {
+		return nil, nil, errors.New("Account cannot be empty")
+	}
+
+	var matchAccount *state.InternalAccount
+	var matchSecret *state.InternalSecret
+
+	for _, wacc := range userStorage.WrappedAccounts() {
+		wacc := wacc // pin
+
+		if wacc.Account.Id != input.Account && wacc.Account.Title != input.Account {
+			continue
+		}
+
+		for _, secret := range wacc.Secrets {
+			secret := secret // pin
+
+			if secret.Kind != domain.SecretKindOtpToken || (input.SecretId != "" && secret.Id != input.SecretId) {
+				continue
+			}
+
+			if matchSecret != nil {
+				return nil, nil, fmt.Errorf("%s matches many OTP tokens. specify SecretId", input.Account)
+			}
+
+			matchAccount = &wacc
+			matchSecret = &secret
+		}
+	}
+
+	if matchSecret == nil {
+		return nil, nil, fmt.Errorf("no OTP token found for %s", input.Account)
+	}
+
+	return matchAccount, matchSecret, nil
+}
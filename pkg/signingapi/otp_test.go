@@ -0,0 +1,31 @@
+package signingapi
+
+import (
+	"github.com/function61/gokit/assert"
+	"github.com/function61/passitron/pkg/otptoken"
+	"testing"
+	"time"
+)
+
+func TestOtpCodeAt(t *testing.T) {
+	// RFC 6238 test vectors
+	totp, err := otptoken.Parse("otpauth://totp/Example:alice?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&digits=8")
+	assert.Ok(t, err)
+
+	code := otpCodeAt(totp, time.Unix(1111111109, 0))
+
+	assert.EqualString(t, code.Code, "07081804")
+	assert.EqualString(t, code.NextCode, "14050471")
+	assert.EqualString(t, code.ValidFrom.Format(time.RFC3339), "2005-03-18T01:58:00Z")
+	assert.EqualString(t, code.ValidUntil.Format(time.RFC3339), "2005-03-18T01:58:30Z")
+
+	// RFC 4226 test vectors
+	hotp, err := otptoken.Parse("otpauth://hotp/Example:alice?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&counter=0")
+	assert.Ok(t, err)
+
+	code = otpCodeAt(hotp, time.Unix(1111111109, 0))
+
+	assert.EqualString(t, code.Code, "755224")
+	assert.EqualString(t, code.NextCode, "287082")
+	assert.Assert(t, code.ValidFrom == nil && code.ValidUntil == nil)
+}
@@ -9,6 +9,8 @@ import (
 	"github.com/function61/passitron/pkg/domain"
 	"github.com/function61/passitron/pkg/httpserver/muxregistrator"
 	"github.com/function61/passitron/pkg/httputil"
+	"github.com/function61/passitron/pkg/securebuf"
+	"github.com/function61/passitron/pkg/sshkey"
 	"github.com/function61/passitron/pkg/state"
 	"github.com/gorilla/mux"
 	"golang.org/x/crypto/ssh"
@@ -16,19 +18,23 @@ import (
 	"time"
 )
 
+// call the returned wipe func when done with the signer. it overwrites the private key.
+// CA keys are only found with ca=true, so they can only be used to issue certificates
+// (with the checks and auditing that go with it), and regular keys only with ca=false
 func lookupSignerByPubKey(
 	pubKeyMarshaled []byte,
+	ca bool,
 	userStorage *state.UserStorage,
-) (ssh.Signer, *state.InternalAccount, string, error) {
+) (ssh.Signer, func(), *state.InternalAccount, string, error) {
 	for _, wacc := range userStorage.WrappedAccounts() {
 		for _, secret := range wacc.Secrets {
-			if secret.Kind != domain.SecretKindSshKey {
+			if secret.Kind != domain.SecretKindSshKey || secret.SshCa != ca {
 				continue
 			}
 
 			publicKey, err := parseSshPublicKeyFromAuthorizedFormat(secret.SshPublicKeyAuthorized)
 			if err != nil { // shouldn't happen
-				return nil, nil, "", err
+				return nil, nil, nil, "", err
 			}
 
 			// apparently identities can only be compared by Marshal(), this is is done
@@ -37,21 +43,33 @@ func lookupSignerByPubKey(
 				continue
 			}
 
-			sshKeyDecrypted, err := userStorage.Crypto().Decrypt(secret.Envelope)
+			sshKeyDecrypted, err := userStorage.DecryptSecret(secret)
 			if err != nil {
-				return nil, nil, "", err
+				return nil, nil, nil, "", err
 			}
+			defer sshKeyDecrypted.Destroy()
 
-			signer, err := ssh.ParsePrivateKey(sshKeyDecrypted)
+			// parsing raw key first so we can zero it after signing. RSA, ECDSA or Ed25519
+			privKey, err := sshkey.Parse(sshKeyDecrypted.Bytes(), nil)
 			if err != nil { // shouldn't happen
-				return nil, nil, "", err
+				return nil, nil, nil, "", err
 			}
 
-			return signer, &wacc, secret.Id, nil
+			wipe := func() {
+				securebuf.ZeroPrivateKey(privKey)
+			}
+
+			signer, err := ssh.NewSignerFromKey(privKey)
+			if err != nil {
+				wipe()
+				return nil, nil, nil, "", err
+			}
+
+			return signer, wipe, &wacc, secret.Id, nil
 		}
 	}
 
-	return nil, nil, "", errors.New("privkey not found by pubkey")
+	return nil, nil, nil, "", errors.New("privkey not found by pubkey")
 }
 
 type handlers struct {
@@ -63,7 +81,8 @@ func (h *handlers) GetPublicKeys(rctx *httpauth.RequestContext, w http.ResponseW
 
 	for _, wacc := range h.st.User(rctx.User.Id).WrappedAccounts() {
 		for _, secret := range wacc.Secrets {
-			if secret.Kind != domain.SecretKindSshKey {
+			// CA keys can't be used for signing arbitrary data (see lookupSignerByPubKey)
+			if secret.Kind != domain.SecretKindSshKey || secret.SshCa {
 				continue
 			}
 
@@ -90,13 +109,14 @@ func (h *handlers) GetPublicKeys(rctx *httpauth.RequestContext, w http.ResponseW
 func (h *handlers) Sign(rctx *httpauth.RequestContext, input SignRequestInput, w http.ResponseWriter, r *http.Request) *Signature {
 	uid := rctx.User.Id
 
-	signer, wacc, secretId, err := lookupSignerByPubKey(input.PublicKey, h.st.User(uid))
+	signer, wipe, wacc, secretId, err := lookupSignerByPubKey(input.PublicKey, false, h.st.User(uid))
 	if err != nil {
 		httputil.RespondHttpJson(httputil.GenericError("privkey_for_pubkey_not_found", err), http.StatusBadRequest, w)
 		return nil
 	}
 
 	signature, err := signer.Sign(rand.Reader, input.Data)
+	wipe()
 	if err != nil {
 		httputil.RespondHttpJson(httputil.GenericError("signing_failed", err), http.StatusInternalServerError, w)
 		return nil
@@ -120,6 +140,22 @@ func (h *handlers) Sign(rctx *httpauth.RequestContext, input SignRequestInput, w
 	}
 }
 
+func (h *handlers) Lock(rctx *httpauth.RequestContext, w http.ResponseWriter, r *http.Request) {
+	uid := rctx.User.Id
+
+	sealed := h.st.User(uid).SealDecryptionKey(
+		domain.DecryptionKeySealReasonSshAgentLock,
+		ehevent.Meta(time.Now(), uid))
+	if sealed == nil { // already sealed
+		return
+	}
+
+	if err := h.st.EventLog.Append([]ehevent.Event{sealed}); err != nil {
+		httputil.RespondHttpJson(httputil.GenericError("audit_event_saving_failed", err), http.StatusInternalServerError, w)
+		return
+	}
+}
+
 func Setup(router *mux.Router, mwares httpauth.MiddlewareChainMap, st *state.AppState) {
 	RegisterRoutes(&handlers{st}, mwares, muxregistrator.New(router))
 }
@@ -1,27 +1,94 @@
-// Crypto operations designed to be slow (internally utilizing PBKDF2)
+// Crypto operations designed to be slow (internally utilizing Argon2id, or PBKDF2 for
+// data encrypted before Argon2id support)
 package slowcrypto
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/nacl/secretbox"
 	"golang.org/x/crypto/pbkdf2"
 	"io"
 )
 
+// blob = <version> <kdf id> <kdf params> <salt length> <salt> <24 bytes of nonce> <ciphertext>
+//
+// legacy blob (no version) = <24 bytes of nonce> <ciphertext>, where nonce doubles as
+// PBKDF2 salt
+const (
+	formatVersion1 = 0x01
+)
+
+type KdfId byte
+
+const (
+	KdfPbkdf2Sha256 KdfId = 0x01 // params: <iterations uint32>
+	KdfArgon2id     KdfId = 0x02 // params: <time uint32> <memory KiB uint32> <threads uint8>
+)
+
+// parameters stored along with the ciphertext, so we can change defaults without breaking
+// decryption of old data
+type KdfParams struct {
+	Kdf        KdfId
+	Iterations uint32 // PBKDF2 iterations or Argon2 time
+	MemoryKiB  uint32 // Argon2 only
+	Threads    uint8  // Argon2 only
+}
+
+var (
+	// RFC 9106 second recommended option (for memory-constrained environments). our target
+	// hardware (Raspberry Pi Zero) has 512 MB of memory
+	CurrentBestKdfParams = KdfParams{
+		Kdf:        KdfArgon2id,
+		Iterations: 3,
+		MemoryKiB:  64 * 1024,
+		Threads:    4,
+	}
+
+	legacyKdfParams = KdfParams{
+		Kdf:        KdfPbkdf2Sha256,
+		Iterations: 100 * 1000,
+	}
+)
+
+const (
+	saltLength = 16
+	// sanity limits, so a doctored blob cannot make us allocate all memory or spin forever.
+	// memory has to fit in our target hardware along with everything else. Argon2 time is
+	// passes over all that memory, so its limit is way smaller than PBKDF2's
+	maxPbkdf2Iterations = 10 * 1000 * 1000
+	maxArgon2Time       = 16
+	maxArgon2MemoryKiB  = 128 * 1024
+)
+
+var (
+	errDecryption  = errors.New("decryption error. wrong password?")
+	errNotVersion1 = errors.New("not a version 1 blob")
+)
+
 func WithPassword(password string) passwordCrypto {
 	return passwordCrypto(password)
 }
 
 type passwordCrypto string
 
-// envelope = <24 bytes of nonce> <ciphertext>
 func (p passwordCrypto) Encrypt(plaintext []byte) ([]byte, error) {
-	return p.encryptWithRandom(plaintext, rand.Reader)
+	return p.EncryptWithParams(plaintext, CurrentBestKdfParams)
+}
+
+func (p passwordCrypto) EncryptWithParams(plaintext []byte, params KdfParams) ([]byte, error) {
+	return p.encryptWithRandom(plaintext, params, rand.Reader)
 }
 
-func (p passwordCrypto) encryptWithRandom(plaintext []byte, random io.Reader) ([]byte, error) {
+func (p passwordCrypto) encryptWithRandom(plaintext []byte, params KdfParams, random io.Reader) ([]byte, error) {
+	salt := make([]byte, saltLength)
+	if _, err := io.ReadFull(random, salt); err != nil {
+		return nil, err
+	}
+
 	// You must use a different nonce for each message you encrypt with the
 	// same key. Since the nonce here is 192 bits long, a random value
 	// provides a sufficiently small probability of repeats.
@@ -30,15 +97,146 @@ func (p passwordCrypto) encryptWithRandom(plaintext []byte, random io.Reader) ([
 		return nil, err
 	}
 
-	// using Seal() nonce as PBKDF2 salt
-	encryptionKey := passwordTo256BitEncryptionKey100k(string(p), nonce[:])
+	encryptionKey, err := deriveKey(string(p), salt, params)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &bytes.Buffer{}
+	header.WriteByte(formatVersion1)
+	header.WriteByte(byte(params.Kdf))
+
+	switch params.Kdf {
+	case KdfPbkdf2Sha256:
+		_ = binary.Write(header, binary.BigEndian, params.Iterations)
+	case KdfArgon2id:
+		_ = binary.Write(header, binary.BigEndian, params.Iterations)
+		_ = binary.Write(header, binary.BigEndian, params.MemoryKiB)
+		header.WriteByte(params.Threads)
+	}
+
+	header.WriteByte(byte(len(salt)))
+	header.Write(salt)
+	header.Write(nonce[:])
+
+	return secretbox.Seal(header.Bytes(), plaintext, &nonce, &encryptionKey), nil
+}
+
+func (p passwordCrypto) Decrypt(blob []byte) ([]byte, error) {
+	plaintext, _, err := p.decrypt(blob)
+	return plaintext, err
+}
+
+// like Decrypt(), but if the blob was not encrypted with CurrentBestKdfParams, returns
+// the plaintext re-encrypted with them as well (non-nil upgraded) so you can store it to
+// replace the old blob. same idea as storedpassword.Verify()
+func (p passwordCrypto) DecryptAndUpgrade(blob []byte) ([]byte, []byte, error) {
+	plaintext, params, err := p.decrypt(blob)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if params == CurrentBestKdfParams {
+		return plaintext, nil, nil
+	}
+
+	upgraded, err := p.Encrypt(plaintext)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return plaintext, upgraded, nil
+}
 
-	nonceAndCiphertextEnvelope := secretbox.Seal(nonce[:], plaintext, &nonce, &encryptionKey)
+func (p passwordCrypto) decrypt(blob []byte) ([]byte, KdfParams, error) {
+	plaintext, params, err := p.decryptVersion1(blob)
+	if err != errNotVersion1 { // success or a wrong password
+		return plaintext, params, err
+	}
 
-	return nonceAndCiphertextEnvelope, nil
+	// legacy blobs begin with a random nonce, so roughly 1/256 of them look like they
+	// have a version byte. that's why we can't decide by the version byte alone. it's only
+	// taken as version 1 if all of it parses as such, which for a random nonce is unlikely
+	// enough to not matter
+	plaintext, err = p.decryptLegacy(blob)
+	if err != nil {
+		return nil, KdfParams{}, err
+	}
+
+	return plaintext, legacyKdfParams, nil
 }
 
-func (p passwordCrypto) Decrypt(nonceAndCiphertextEnvelope []byte) ([]byte, error) {
+func (p passwordCrypto) decryptVersion1(blob []byte) ([]byte, KdfParams, error) {
+	if len(blob) < 1 || blob[0] != formatVersion1 {
+		return nil, KdfParams{}, errNotVersion1
+	}
+
+	reader := bytes.NewReader(blob[1:])
+
+	params := KdfParams{}
+
+	kdf, err := reader.ReadByte()
+	if err != nil {
+		return nil, KdfParams{}, errNotVersion1
+	}
+	params.Kdf = KdfId(kdf)
+
+	switch params.Kdf {
+	case KdfPbkdf2Sha256:
+		err = binary.Read(reader, binary.BigEndian, &params.Iterations)
+	case KdfArgon2id:
+		err = binary.Read(reader, binary.BigEndian, &params.Iterations)
+		if err == nil {
+			err = binary.Read(reader, binary.BigEndian, &params.MemoryKiB)
+		}
+		if err == nil {
+			params.Threads, err = reader.ReadByte()
+		}
+	default:
+		return nil, KdfParams{}, errNotVersion1
+	}
+	if err != nil {
+		return nil, KdfParams{}, errNotVersion1
+	}
+
+	saltLen, err := reader.ReadByte()
+	if err != nil {
+		return nil, KdfParams{}, errNotVersion1
+	}
+
+	salt := make([]byte, saltLen)
+	var nonce [24]byte
+	if _, err := io.ReadFull(reader, salt); err != nil {
+		return nil, KdfParams{}, errNotVersion1
+	}
+	if _, err := io.ReadFull(reader, nonce[:]); err != nil {
+		return nil, KdfParams{}, errNotVersion1
+	}
+
+	if reader.Len() < secretbox.Overhead {
+		return nil, KdfParams{}, errNotVersion1
+	}
+
+	ciphertext := blob[len(blob)-reader.Len():]
+
+	encryptionKey, err := deriveKey(string(p), salt, params)
+	if err != nil {
+		return nil, KdfParams{}, errNotVersion1
+	}
+
+	plaintext, ok := secretbox.Open(nil, ciphertext, &nonce, &encryptionKey)
+	if !ok {
+		return nil, KdfParams{}, errDecryption
+	}
+
+	return plaintext, params, nil
+}
+
+func (p passwordCrypto) decryptLegacy(nonceAndCiphertextEnvelope []byte) ([]byte, error) {
+	if len(nonceAndCiphertextEnvelope) < 24+secretbox.Overhead {
+		return nil, errors.New("ciphertext too short")
+	}
+
 	// When you decrypt, you must use the same nonce and key you used to
 	// encrypt the message. One way to achieve this is to store the nonce
 	// alongside the encrypted message. Above, we stored the nonce in the first
@@ -52,12 +250,37 @@ func (p passwordCrypto) Decrypt(nonceAndCiphertextEnvelope []byte) ([]byte, erro
 
 	plaintextBytes, ok := secretbox.Open(nil, nonceAndCiphertextEnvelope[24:], &decryptNonce, &encryptionKey)
 	if !ok {
-		return nil, errors.New("decryption error. wrong password?")
+		return nil, errDecryption
 	}
 
 	return plaintextBytes, nil
 }
 
+func deriveKey(password string, salt []byte, params KdfParams) ([32]byte, error) {
+	var derivedKey [32]byte
+
+	switch params.Kdf {
+	case KdfPbkdf2Sha256:
+		if params.Iterations == 0 || params.Iterations > maxPbkdf2Iterations {
+			return derivedKey, errors.New("invalid iterations")
+		}
+
+		copy(derivedKey[:], pbkdf2.Key([]byte(password), salt, int(params.Iterations), sha256.Size, sha256.New))
+	case KdfArgon2id:
+		if params.Iterations == 0 || params.Iterations > maxArgon2Time ||
+			params.MemoryKiB == 0 || params.MemoryKiB > maxArgon2MemoryKiB ||
+			params.Threads == 0 {
+			return derivedKey, errors.New("invalid Argon2id params")
+		}
+
+		copy(derivedKey[:], argon2.IDKey([]byte(password), salt, params.Iterations, params.MemoryKiB, params.Threads, 32))
+	default:
+		return derivedKey, errors.New("unsupported KDF")
+	}
+
+	return derivedKey, nil
+}
+
 func passwordTo256BitEncryptionKey100k(password string, salt []byte) [32]byte {
 	var derivedKey [32]byte
 	copy(derivedKey[:], Pbkdf2Sha256100kDerive([]byte(password), salt))
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/hex"
 	"github.com/function61/gokit/assert"
+	"golang.org/x/crypto/nacl/secretbox"
 	"io"
 	"testing"
 )
@@ -27,20 +28,105 @@ func TestPbkdf2Sha256100kDerive(t *testing.T) {
 func TestEncryptAndDecrypt(t *testing.T) {
 	ciphertext, err := WithPassword("hunter2").encryptWithRandom(
 		[]byte("the germans are coming"),
+		CurrentBestKdfParams,
 		constRandom())
 	assert.Ok(t, err)
 
+	// version=1 kdf=argon2id time=3 memory=65536 threads=4 saltLen=16 ...
+	assert.EqualString(t, hex.EncodeToString(ciphertext[:21]), "010200000003000100000410000102030405060708")
+
 	_, err = WithPassword("incorrect").Decrypt(ciphertext)
 	assert.EqualString(t, err.Error(), "decryption error. wrong password?")
 
+	plaintext, upgraded, err := WithPassword("hunter2").DecryptAndUpgrade(ciphertext)
+	assert.Ok(t, err)
+	assert.Assert(t, upgraded == nil)
+
+	assert.EqualString(t, string(plaintext), "the germans are coming")
+
+	// doctored to take forever (time=17) or too much memory (256 MiB). rejected before
+	// running the KDF (not being valid version 1, it's tried as a legacy blob)
+	for _, doctoredHeader := range []string{"01020000001100010000", "01020000000300040000"} {
+		doctored := append([]byte{}, ciphertext...)
+		header, err := hex.DecodeString(doctoredHeader)
+		assert.Ok(t, err)
+		copy(doctored, header)
+
+		_, err = WithPassword("hunter2").Decrypt(doctored)
+		assert.EqualString(t, err.Error(), "decryption error. wrong password?")
+	}
+}
+
+func TestPbkdf2Params(t *testing.T) {
+	ciphertext, err := WithPassword("hunter2").encryptWithRandom(
+		[]byte("the germans are coming"),
+		KdfParams{Kdf: KdfPbkdf2Sha256, Iterations: 1000},
+		constRandom())
+	assert.Ok(t, err)
+
+	assert.EqualString(t, hex.EncodeToString(ciphertext[:7]), "0101000003e810")
+
 	plaintext, err := WithPassword("hunter2").Decrypt(ciphertext)
 	assert.Ok(t, err)
+	assert.EqualString(t, string(plaintext), "the germans are coming")
+}
+
+func TestDecryptLegacyAndUpgrade(t *testing.T) {
+	// PBKDF2 100k, nonce as salt. encrypted before versioned format existed
+	legacy, err := hex.DecodeString("000102030405060708090a0b0c0d0e0f1011121324252627e922ba6be4d6eced5da6e1480189b9bba3054f490f16fff74f813fc8950419fba17b2a1af513")
+	assert.Ok(t, err)
+
+	_, _, err = WithPassword("incorrect").DecryptAndUpgrade(legacy)
+	assert.EqualString(t, err.Error(), "decryption error. wrong password?")
 
+	plaintext, upgraded, err := WithPassword("hunter2").DecryptAndUpgrade(legacy)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(plaintext), "the germans are coming")
+	assert.Assert(t, upgraded != nil)
+	assert.Assert(t, upgraded[0] == formatVersion1 && KdfId(upgraded[1]) == KdfArgon2id)
+
+	plaintext, upgradedAgain, err := WithPassword("hunter2").DecryptAndUpgrade(upgraded)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(plaintext), "the germans are coming")
+	assert.Assert(t, upgradedAgain == nil)
+}
+
+func TestLegacyThatLooksVersioned(t *testing.T) {
+	// legacy nonce is random, so its first byte can be the version byte
+	nonce := [24]byte{formatVersion1, byte(KdfPbkdf2Sha256)}
+	key := passwordTo256BitEncryptionKey100k("hunter2", nonce[:])
+	legacy := secretbox.Seal(nonce[:], []byte("the germans are coming"), &nonce, &key)
+
+	plaintext, upgraded, err := WithPassword("hunter2").DecryptAndUpgrade(legacy)
+	assert.Ok(t, err)
 	assert.EqualString(t, string(plaintext), "the germans are coming")
+	assert.Assert(t, upgraded != nil)
+}
+
+func TestVersionedDoesNotFallBackToLegacy(t *testing.T) {
+	// parses fully as version 1 (PBKDF2, 1000 iterations, no salt), so it's taken as such
+	nonce := [24]byte{formatVersion1, byte(KdfPbkdf2Sha256), 0x00, 0x00, 0x03, 0xe8, 0x00}
+	key := passwordTo256BitEncryptionKey100k("hunter2", nonce[:])
+	legacy := secretbox.Seal(nonce[:], []byte("the germans are coming"), &nonce, &key)
+
+	_, err := WithPassword("hunter2").Decrypt(legacy)
+	assert.EqualString(t, err.Error(), "decryption error. wrong password?")
+}
+
+func TestArgon2MemoryLimit(t *testing.T) {
+	_, err := WithPassword("hunter2").encryptWithRandom(
+		[]byte("the germans are coming"),
+		KdfParams{Kdf: KdfArgon2id, Iterations: 1, MemoryKiB: 256 * 1024, Threads: 1},
+		constRandom())
+	assert.EqualString(t, err.Error(), "invalid Argon2id params")
 }
 
 func constRandom() io.Reader {
 	return bytes.NewBuffer([]byte{
+		// salt
+		0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
+		0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F,
+		// nonce
 		0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
 		0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F,
 		0x10, 0x11, 0x12, 0x13, 0x24, 0x25, 0x26, 0x27,
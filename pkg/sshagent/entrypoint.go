@@ -7,9 +7,13 @@ import (
 	"github.com/function61/gokit/systemdinstaller"
 	"github.com/spf13/cobra"
 	"os"
+	"time"
 )
 
 func Entrypoint() *cobra.Command {
+	certPrincipals := []string{}
+	certValidity := 8 * time.Hour
+
 	sshAgent := &cobra.Command{
 		Use:   "ssh-agent-proxy [baseurl] [token]",
 		Short: "Starts the SSH agent proxy, which will forward SSH signing requests to Passitron",
@@ -20,14 +24,26 @@ func Entrypoint() *cobra.Command {
 
 			rootLogger := logex.StandardLogger()
 
+			var certOpts *CertificateOptions
+			if len(certPrincipals) > 0 {
+				certOpts = &CertificateOptions{
+					Principals: certPrincipals,
+					Validity:   certValidity,
+				}
+			}
+
 			exitIfError(Run(
 				ossignal.InterruptOrTerminateBackgroundCtx(rootLogger),
 				baseurl,
 				token,
+				certOpts,
 				rootLogger))
 		},
 	}
 
+	sshAgent.Flags().StringSliceVarP(&certPrincipals, "cert-principal", "", certPrincipals, "Also list certificates (issued by your CA key) for the keys, valid for these principals")
+	sshAgent.Flags().DurationVarP(&certValidity, "cert-validity", "", certValidity, "Validity of the certificates")
+
 	sshAgent.AddCommand(&cobra.Command{
 		Use:   "install [baseurl] [token]",
 		Short: "Installs systemd unit file to make ssh-agent-proxy start on system boot",
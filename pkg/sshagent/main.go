@@ -10,6 +10,8 @@ import (
 	"golang.org/x/crypto/ssh/agent"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
 // SSH agent RFC:
@@ -25,10 +27,20 @@ var errNotImplemented = errors.New("not implemented")
 	2) Sign(pkey, dataToSign) if server accepts any of keys returned previously
 */
 
+// if given, the agent asks the server's CA for a certificate for each of its keys, and
+// lists the certificates along with the keys
+type CertificateOptions struct {
+	Principals []string
+	Validity   time.Duration
+}
+
 // implements golang.org/x/crypto/ssh/agent.Agent
 type AgentServer struct {
 	endpoints   *signingapi.RestClientUrlBuilder
 	bearerToken string
+	certOpts    *CertificateOptions
+	certs       map[string]*ssh.Certificate // key is marshaled public key
+	certsMu     sync.Mutex
 	logl        *logex.Leveled
 }
 
@@ -57,14 +69,83 @@ func (a *AgentServer) List() ([]*agent.Key, error) {
 		}
 
 		knownKeys = append(knownKeys, knownKey)
+
+		if a.certOpts == nil {
+			continue
+		}
+
+		cert, err := a.certificateFor(key.Blob)
+		if err != nil { // keys work without certificates, so don't fail the listing
+			a.logl.Error.Printf("certificate for %s: %v", key.Comment, err)
+			continue
+		}
+
+		knownKeys = append(knownKeys, &agent.Key{
+			Format:  cert.Type(),
+			Blob:    cert.Marshal(),
+			Comment: key.Comment + " (certificate)",
+		})
 	}
 
 	return knownKeys, nil
 }
 
+// returns cached certificate, unless it's about to expire
+func (a *AgentServer) certificateFor(publicKey []byte) (*ssh.Certificate, error) {
+	a.certsMu.Lock()
+	defer a.certsMu.Unlock()
+
+	if cert, found := a.certs[string(publicKey)]; found {
+		if time.Unix(int64(cert.ValidBefore), 0).After(time.Now().Add(a.certOpts.Validity / 4)) {
+			return cert, nil
+		}
+	}
+
+	now := time.Now()
+
+	req := signingapi.IssueCertificateInput{
+		PublicKey:   publicKey,
+		Principals:  a.certOpts.Principals,
+		ValidAfter:  now.Add(-5 * time.Minute), // tolerate clock skew
+		ValidBefore: now.Add(a.certOpts.Validity),
+	}
+	res := signingapi.IssuedCertificate{}
+
+	ctx, cancel := context.WithTimeout(context.TODO(), ezhttp.DefaultTimeout10s)
+	defer cancel()
+
+	if _, err := ezhttp.Post(
+		ctx,
+		a.endpoints.IssueCertificate(),
+		ezhttp.AuthBearer(a.bearerToken),
+		ezhttp.SendJson(&req),
+		ezhttp.RespondsJson(&res, false)); err != nil {
+		return nil, err
+	}
+
+	certKey, err := ssh.ParsePublicKey(res.Certificate)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok := certKey.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("server did not return a certificate")
+	}
+
+	a.certs[string(publicKey)] = cert
+
+	return cert, nil
+}
+
 func (a *AgentServer) Sign(key ssh.PublicKey, data []byte) (*ssh.Signature, error) {
 	a.logl.Debug.Printf("Sign()")
 
+	// signing with certificate = signing with its key
+	if cert, isCert := key.(*ssh.Certificate); isCert {
+		key = cert.Key
+	}
+
 	req := signingapi.SignRequestInput{
 		PublicKey: key.Marshal(),
 		Data:      data,
@@ -107,10 +188,19 @@ func (a *AgentServer) RemoveAll() error {
 	return errNotImplemented
 }
 
+// "$ ssh-add -x" seals the decryption key on the server. passphrase is ignored, since
+// unlocking is done with the master password in the UI
 func (a *AgentServer) Lock(passphrase []byte) error {
 	a.logl.Debug.Printf("Lock()")
 
-	return errNotImplemented
+	ctx, cancel := context.WithTimeout(context.TODO(), ezhttp.DefaultTimeout10s)
+	defer cancel()
+
+	_, err := ezhttp.Post(
+		ctx,
+		a.endpoints.Lock(),
+		ezhttp.AuthBearer(a.bearerToken))
+	return err
 }
 
 func (a *AgentServer) Unlock(passphrase []byte) error {
@@ -139,11 +229,14 @@ func Run(
 	ctx context.Context,
 	baseurl string,
 	token string,
+	certOpts *CertificateOptions,
 	logger *log.Logger,
 ) error {
 	agentServer := &AgentServer{
 		endpoints:   signingapi.NewRestClientUrlBuilder(baseurl),
 		bearerToken: token,
+		certOpts:    certOpts,
+		certs:       map[string]*ssh.Certificate{},
 		logl:        logex.Levels(logex.Prefix("AgentServer", logger)),
 	}
 
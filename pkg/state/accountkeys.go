@@ -0,0 +1,576 @@
+package state
+
+import (
+	"crypto"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/atomicfilewrite"
+	"github.com/function61/passitron/pkg/domain"
+	"github.com/function61/passitron/pkg/envelopeenc"
+	"github.com/function61/passitron/pkg/securebuf"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// each account has its own (X25519) key that its secrets are encrypted for. the account
+// key is encrypted for the user's decryption key, but stored outside of the event log
+// (which is append-only), so deleting an account can destroy its key and therefore make
+// its secrets unrecoverable even from the history of the event log ("crypto-shredding").
+//
+// accounts created before account keys get one when they get their next secret. their
+// older secrets stay encrypted for the user's decryption key (and thus survive deleting
+// the account) until the decryption key gets rotated, which moves them to the account key.
+//
+// commands run concurrently, so an account can end up with more than one key. they're
+// stored by key id (derived from the key), so a key never replaces another one. new
+// secrets are encrypted for the latest key, and older keys still decrypt their secrets.
+//
+// keys are destroyed only when the event that says so gets applied, i.e. after it's safely
+// in the event log. the event log, account keys and blobs (see attachments.go) go together:
+// back them up together and restore them together, otherwise secrets (or deletions) get lost.
+
+const (
+	accountKeysDir = "accountkeys"
+)
+
+var ErrAccountKeyDestroyed = errors.New("account key destroyed")
+
+// wrapped = envelope of the account key, encrypted for the user's decryption key
+type AccountKeyStore interface {
+	// os.ErrNotExist if the key does not exist (anymore)
+	Get(userId string, accountId string, keyId string) ([]byte, error)
+	// same keyId means the same key, so this only replaces the key's wrapping
+	Put(userId string, accountId string, keyId string, wrapped []byte) error
+	// destroys all the account's keys. must not fail if there are none
+	Destroy(userId string, accountId string) error
+}
+
+// keeps each wrapped key in a file of its own, in a directory of the account's keys.
+// destroying overwrites the files before removing them, but that's best effort on SSDs and
+// copy-on-write filesystems. also, backups of this directory defeat the purpose, so they
+// should not be kept for long.
+type fileAccountKeyStore struct {
+	dir string
+}
+
+func newFileAccountKeyStore(dir string) (*fileAccountKeyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &fileAccountKeyStore{dir}, nil
+}
+
+func (f *fileAccountKeyStore) Get(userId string, accountId string, keyId string) ([]byte, error) {
+	wrapped, err := ioutil.ReadFile(f.pathFor(userId, accountId, keyId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, os.ErrNotExist
+		}
+
+		return nil, err
+	}
+
+	return wrapped, nil
+}
+
+func (f *fileAccountKeyStore) Put(userId string, accountId string, keyId string, wrapped []byte) error {
+	if err := os.MkdirAll(f.accountDir(userId, accountId), 0700); err != nil {
+		return err
+	}
+
+	return atomicfilewrite.Write(f.pathFor(userId, accountId, keyId), func(sink io.Writer) error {
+		_, err := sink.Write(wrapped)
+		return err
+	})
+}
+
+func (f *fileAccountKeyStore) Destroy(userId string, accountId string) error {
+	accountDir := f.accountDir(userId, accountId)
+
+	keyFiles, err := ioutil.ReadDir(accountDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	for _, keyFile := range keyFiles {
+		if err := destroyFile(filepath.Join(accountDir, keyFile.Name())); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(accountDir)
+}
+
+func (f *fileAccountKeyStore) accountDir(userId string, accountId string) string {
+	return filepath.Join(f.dir, userId, accountId)
+}
+
+func (f *fileAccountKeyStore) pathFor(userId string, accountId string, keyId string) string {
+	return filepath.Join(f.accountDir(userId, accountId), keyId+".key")
+}
+
+func destroyFile(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY, 0600)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if err := overwriteWithZeros(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+func overwriteWithZeros(file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.WriteAt(make([]byte, info.Size()), 0); err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+// public half of an account key. only needed for encrypting
+type AccountKey struct {
+	accountId string
+	publicKey *envelopeenc.X25519PublicKey
+}
+
+func (a *AccountKey) Encrypt(secret []byte, secretCtx SecretContext) ([]byte, error) {
+	if secretCtx.AccountId != a.accountId {
+		return nil, fmt.Errorf("account key of %s used for account %s", a.accountId, secretCtx.AccountId)
+	}
+
+	env, err := envelopeenc.Encrypt(
+		secret,
+		[]crypto.PublicKey{a.publicKey},
+		secretCtx.associatedData())
+	if err != nil {
+		return nil, err
+	}
+
+	return env.Marshal()
+}
+
+// identifies the key in AccountKeyStore
+func (a *AccountKey) id() string {
+	return hex.EncodeToString(a.publicKey[:])
+}
+
+// returns nil if the account doesn't have a key (yet). if it has many, returns the latest
+func (s *UserStorage) AccountKey(accountId string) *AccountKey {
+	accountKeys := s.accountKeysOf(accountId)
+	if len(accountKeys) == 0 {
+		return nil
+	}
+
+	return accountKeys[len(accountKeys)-1]
+}
+
+// oldest first
+func (s *UserStorage) accountKeysOf(accountId string) []*AccountKey {
+	s.mu.Lock()
+	publicKeyPems := s.accountKeys[accountId]
+	s.mu.Unlock()
+
+	accountKeys := []*AccountKey{}
+	for _, publicKeyPem := range publicKeyPems {
+		accountKeys = append(accountKeys, parseAccountKey(accountId, publicKeyPem))
+	}
+
+	return accountKeys
+}
+
+func parseAccountKey(accountId string, publicKeyPem string) *AccountKey {
+	publicKey, err := parsePublicKeyPem([]byte(publicKeyPem))
+	if err != nil { // shouldn't happen, as we validated it when creating
+		panic(err)
+	}
+
+	x25519PublicKey, ok := publicKey.(*envelopeenc.X25519PublicKey)
+	if !ok {
+		panic(fmt.Errorf("account key of %s is %T", accountId, publicKey))
+	}
+
+	return &AccountKey{accountId, x25519PublicKey}
+}
+
+// stores the new key in the key store right away, because secrets encrypted for it can be
+// in the same batch as the returned event. if the event doesn't get saved, the key is an
+// orphan that decrypts nothing. it gets destroyed along with the account's other keys.
+// only the user's public key is needed.
+func (s *UserStorage) CreateAccountKey(
+	accountId string,
+	meta ehevent.EventMeta,
+) (*AccountKey, *domain.AccountKeyCreated, error) {
+	if s.crypto == nil {
+		return nil, nil, errors.New("CreateAccountKey: user does not have a decryption key")
+	}
+
+	return s.createAccountKey(accountId, s.crypto.publicKey, meta)
+}
+
+// userPublicKey is the user's decryption key that gets access to the account key
+func (s *UserStorage) createAccountKey(
+	accountId string,
+	userPublicKey crypto.PublicKey,
+	meta ehevent.EventMeta,
+) (*AccountKey, *domain.AccountKeyCreated, error) {
+	if s.accountKeyStore == nil {
+		return nil, nil, errors.New("CreateAccountKey: account key store not available")
+	}
+
+	privateKey, err := envelopeenc.GenerateX25519Key()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer privateKey.Zero()
+
+	scalar := privateKey.Bytes()
+	defer securebuf.Zero(scalar)
+
+	wrappedEnvelope, err := envelopeenc.Encrypt(
+		scalar,
+		[]crypto.PublicKey{userPublicKey},
+		accountKeyAssociatedData(accountId))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err := wrappedEnvelope.Marshal()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	accountKey := &AccountKey{accountId, &privateKey.PublicKey}
+
+	if err := s.accountKeyStore.Put(s.UserId(), accountId, accountKey.id(), wrapped); err != nil {
+		return nil, nil, fmt.Errorf("CreateAccountKey: %w", err)
+	}
+
+	publicKeyPem, err := marshalPublicKeyPem(accountKey.publicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return accountKey, domain.NewAccountKeyCreated(accountId, string(publicKeyPem), meta), nil
+}
+
+// new secrets are encrypted for the account's key, so they can be crypto-shredded. accounts
+// that predate account keys get one now, in which case the returned event must be stored
+// along with the secret. otherwise the event is nil.
+func (s *UserStorage) AccountKeyOrCreate(
+	accountId string,
+	meta ehevent.EventMeta,
+) (*AccountKey, *domain.AccountKeyCreated, error) {
+	if accountKey := s.AccountKey(accountId); accountKey != nil {
+		return accountKey, nil, nil
+	}
+
+	return s.CreateAccountKey(accountId, meta)
+}
+
+// the keys get destroyed when the returned event gets applied. returns nil if the account
+// doesn't have a key
+func (s *UserStorage) DestroyAccountKey(
+	accountId string,
+	meta ehevent.EventMeta,
+) (*domain.AccountKeyDestroyed, error) {
+	if s.AccountKey(accountId) == nil {
+		return nil, nil
+	}
+
+	if s.accountKeyStore == nil {
+		return nil, errors.New("DestroyAccountKey: account key store not available")
+	}
+
+	return domain.NewAccountKeyDestroyed(accountId, meta), nil
+}
+
+// called from the event projection, so the event is already stored and there's nobody to
+// return an error to. we'll try again if the event gets replayed (e.g. after a restart).
+func (s *UserStorage) destroyAccountKey(accountId string) {
+	if s.accountKeyStore == nil {
+		return
+	}
+
+	if err := s.accountKeyStore.Destroy(s.UserId(), accountId); err != nil {
+		s.logl.Error.Printf("destroyAccountKey %s: %v", accountId, err)
+	}
+}
+
+// gives the rotated decryption key access to the account keys. the current key keeps its
+// access until the rotation is stored (see retireAccountKeyRecipient()), so the account
+// keys stay usable if that fails
+func (s *UserStorage) RewrapAccountKeys(rotation *KeyRotation) error {
+	s.mu.Lock()
+	accountKeys := []*AccountKey{}
+	for accountId, publicKeyPems := range s.accountKeys {
+		for _, publicKeyPem := range publicKeyPems {
+			accountKeys = append(accountKeys, parseAccountKey(accountId, publicKeyPem))
+		}
+	}
+	s.mu.Unlock()
+
+	if len(accountKeys) == 0 {
+		return nil
+	}
+
+	if s.accountKeyStore == nil {
+		return errors.New("RewrapAccountKeys: account key store not available")
+	}
+
+	recipients := []crypto.PublicKey{publicKeyOf(rotation.newKey), publicKeyOf(rotation.oldKeys[0])}
+
+	for _, accountKey := range accountKeys {
+		wrapped, err := s.accountKeyStore.Get(s.UserId(), accountKey.accountId, accountKey.id())
+		if err != nil {
+			if err == os.ErrNotExist { // destroyed, but the event is not applied yet
+				continue
+			}
+
+			return fmt.Errorf("RewrapAccountKeys: %w", err)
+		}
+
+		rewrapped, err := rotation.rewrapFor(
+			wrapped,
+			recipients,
+			accountKeyAssociatedData(accountKey.accountId))
+		if err != nil {
+			return fmt.Errorf("RewrapAccountKeys: account %s: %w", accountKey.accountId, err)
+		}
+
+		if err := s.accountKeyStore.Put(s.UserId(), accountKey.accountId, accountKey.id(), rewrapped); err != nil {
+			return fmt.Errorf("RewrapAccountKeys: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// secrets from before account keys are encrypted for the user's decryption key, so deleting
+// their account cannot shred them. the old key gets retired in the rotation, so they have to
+// be rewrapped anyway: they're moved to their account's key (accounts without one get a key
+// that only the rotated key has access to). without a key store they're rewrapped for the
+// rotated key instead. the returned events must be stored along with the rotation.
+func (s *UserStorage) RewrapLegacySecrets(
+	rotation *KeyRotation,
+	meta ehevent.EventMeta,
+) ([]ehevent.Event, error) {
+	events := []ehevent.Event{}
+
+	for _, account := range s.WrappedAccounts() {
+		accountKey := s.AccountKey(account.Account.Id)
+
+		for _, secret := range account.Secrets {
+			if len(secret.Envelope) == 0 { // not all kinds of secrets have one
+				continue
+			}
+
+			// account key got rewrapped instead
+			if s.EncryptedWithAccountKey(secret) {
+				continue
+			}
+
+			if s.accountKeyStore == nil {
+				envelope, err := rotation.Rewrap(secret.Envelope, secret.EnvelopeContext())
+				if err != nil {
+					return nil, fmt.Errorf("account %s secret %s: %w", account.Account.Id, secret.Id, err)
+				}
+
+				events = append(events, domain.NewAccountSecretEnvelopeRewrapped(
+					account.Account.Id,
+					secret.Id,
+					envelope,
+					meta))
+				continue
+			}
+
+			if accountKey == nil {
+				var keyCreated *domain.AccountKeyCreated
+				var err error
+				accountKey, keyCreated, err = s.createAccountKey(
+					account.Account.Id,
+					publicKeyOf(rotation.newKey),
+					meta)
+				if err != nil {
+					return nil, err
+				}
+
+				events = append(events, keyCreated)
+			}
+
+			envelope, err := rotation.rewrapFor(
+				secret.Envelope,
+				[]crypto.PublicKey{accountKey.publicKey},
+				secret.EnvelopeContext().associatedData())
+			if err != nil {
+				return nil, fmt.Errorf("account %s secret %s: %w", account.Account.Id, secret.Id, err)
+			}
+
+			events = append(events, domain.NewAccountSecretEnvelopeRewrapped(
+				account.Account.Id,
+				secret.Id,
+				envelope,
+				meta))
+		}
+	}
+
+	return events, nil
+}
+
+// called from the event projection once the rotation is stored. takes away the retired
+// key's access to the account keys that the rotated key has access to. on replay of older
+// rotations this is a no-op, because the later rotations' keys are the recipients.
+func (s *UserStorage) retireAccountKeyRecipient(retired crypto.PublicKey, rotated crypto.PublicKey) {
+	if s.accountKeyStore == nil {
+		return
+	}
+
+	for accountId, publicKeyPems := range s.accountKeys {
+		for _, publicKeyPem := range publicKeyPems {
+			accountKey := parseAccountKey(accountId, publicKeyPem)
+
+			if err := func() error {
+				wrapped, err := s.accountKeyStore.Get(s.UserId(), accountId, accountKey.id())
+				if err != nil {
+					if err == os.ErrNotExist {
+						return nil
+					}
+
+					return err
+				}
+
+				env, err := envelopeenc.Unmarshal(wrapped)
+				if err != nil {
+					return err
+				}
+
+				if !env.HasRecipient(rotated) || !env.HasRecipient(retired) {
+					return nil
+				}
+
+				withoutRetired, err := env.WithoutRecipient(retired)
+				if err != nil {
+					return err
+				}
+
+				rewrapped, err := withoutRetired.Marshal()
+				if err != nil {
+					return err
+				}
+
+				return s.accountKeyStore.Put(s.UserId(), accountId, accountKey.id(), rewrapped)
+			}(); err != nil {
+				s.logl.Error.Printf("retireAccountKeyRecipient %s: %v", accountId, err)
+			}
+		}
+	}
+}
+
+// false for secrets that predate the account's key (they're encrypted for the user's key)
+func (s *UserStorage) EncryptedWithAccountKey(secret InternalSecret) bool {
+	return s.accountKeyOfSecret(secret) != nil
+}
+
+// nil if the secret is not encrypted for any of its account's keys
+func (s *UserStorage) accountKeyOfSecret(secret InternalSecret) *AccountKey {
+	env, err := envelopeenc.Unmarshal(secret.Envelope)
+	if err != nil {
+		return nil
+	}
+
+	for _, accountKey := range s.accountKeysOf(secret.accountId) {
+		if env.HasRecipient(accountKey.publicKey) {
+			return accountKey
+		}
+	}
+
+	return nil
+}
+
+// caller must Destroy() the plaintext as soon as it's no longer needed
+func (s *UserStorage) DecryptSecret(secret InternalSecret) (*securebuf.Buffer, error) {
+	if s.crypto == nil {
+		return nil, ErrDecryptionKeyLocked
+	}
+
+	accountKey := s.accountKeyOfSecret(secret)
+	if accountKey == nil {
+		return s.crypto.Decrypt(secret.Envelope, secret.EnvelopeContext())
+	}
+
+	privateKey, err := s.unwrapAccountKey(accountKey)
+	if err != nil {
+		return nil, err
+	}
+	defer privateKey.Zero()
+
+	env, err := envelopeenc.Unmarshal(secret.Envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := env.Decrypt(privateKey, secret.EnvelopeContext().associatedData())
+	if err != nil {
+		return nil, err
+	}
+
+	return securebuf.Take(plaintext), nil
+}
+
+func (s *UserStorage) unwrapAccountKey(accountKey *AccountKey) (*envelopeenc.X25519PrivateKey, error) {
+	if s.accountKeyStore == nil {
+		return nil, errors.New("unwrapAccountKey: account key store not available")
+	}
+
+	wrapped, err := s.accountKeyStore.Get(s.UserId(), accountKey.accountId, accountKey.id())
+	if err != nil {
+		if err == os.ErrNotExist {
+			return nil, ErrAccountKeyDestroyed
+		}
+
+		return nil, err
+	}
+
+	scalar, err := s.crypto.decrypt(wrapped, accountKeyAssociatedData(accountKey.accountId))
+	if err != nil {
+		return nil, err
+	}
+	defer scalar.Destroy()
+
+	return envelopeenc.NewX25519PrivateKey(scalar.Bytes())
+}
+
+func accountKeyAssociatedData(accountId string) []byte {
+	ad, err := json.Marshal([]string{"accountKey", accountId})
+	if err != nil {
+		panic(err)
+	}
+
+	return ad
+}
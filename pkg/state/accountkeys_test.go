@@ -0,0 +1,231 @@
+package state
+
+import (
+	"context"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/eventhorizon/pkg/ehreader/ehreadertest"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/passitron/pkg/domain"
+	"github.com/function61/passitron/pkg/envelopeenc"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccountKeys(t *testing.T) {
+	tc := &testContext{
+		user:     newUserStorage(ehreader.TenantId("42")),
+		eventLog: ehreadertest.NewEventLog(),
+		ctx:      context.Background(),
+	}
+
+	tc.reader = ehreader.New(tc.user, tc.eventLog, nil)
+
+	dir, err := ioutil.TempDir("", "accountkeys")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	keyStore, err := newFileAccountKeyStore(dir)
+	assert.Ok(t, err)
+
+	tc.user.accountKeyStore = keyStore
+
+	setupUser(t, tc)
+	unlockDecryptionKey(t, tc)
+
+	tc.appendAndLoad(
+		domain.NewAccountCreated(testAccId, domain.RootFolderId, "google.com", ehevent.Meta(t0, joonasUid)))
+
+	// a secret from before account keys
+	tc.appendAndLoad(domain.NewAccountPasswordAdded(
+		testAccId,
+		"legacyPwd",
+		"",
+		tc.encrypt("legacy", "legacyPwd", domain.SecretKindPassword),
+		"",
+		ehevent.Meta(t0, joonasUid)))
+
+	assert.Assert(t, tc.user.AccountKey(testAccId) == nil)
+
+	// another account that only has a legacy secret
+	tc.appendAndLoad(
+		domain.NewAccountCreated("accId2", domain.RootFolderId, "github.com", ehevent.Meta(t0, joonasUid)))
+
+	legacyEnvelope2, err := tc.user.Crypto().Encrypt([]byte("legacy2"), SecretContext{
+		AccountId: "accId2",
+		SecretId:  "legacyPwd2",
+		Kind:      domain.SecretKindPassword,
+	})
+	assert.Ok(t, err)
+
+	tc.appendAndLoad(domain.NewAccountPasswordAdded(
+		"accId2",
+		"legacyPwd2",
+		"",
+		legacyEnvelope2,
+		"",
+		ehevent.Meta(t0, joonasUid)))
+
+	// as if two commands ran concurrently, neither seeing the other's key
+	accountKey, keyCreated, err := tc.user.CreateAccountKey(testAccId, ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+
+	accountKey2, keyCreated2, err := tc.user.CreateAccountKey(testAccId, ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+
+	envelope, err := accountKey.Encrypt([]byte("hunter2"), SecretContext{
+		AccountId: testAccId,
+		SecretId:  "pwd",
+		Kind:      domain.SecretKindPassword,
+	})
+	assert.Ok(t, err)
+
+	envelope2, err := accountKey2.Encrypt([]byte("hunter3"), SecretContext{
+		AccountId: testAccId,
+		SecretId:  "pwd2",
+		Kind:      domain.SecretKindPassword,
+	})
+	assert.Ok(t, err)
+
+	_, err = accountKey.Encrypt([]byte("hunter2"), SecretContext{AccountId: "otherAccount"})
+	assert.EqualString(t, err.Error(), "account key of accId1 used for account otherAccount")
+
+	tc.appendAndLoad(keyCreated)
+	tc.appendAndLoad(domain.NewAccountPasswordAdded(
+		testAccId,
+		"pwd",
+		"",
+		envelope,
+		"",
+		ehevent.Meta(t0, joonasUid)))
+
+	tc.appendAndLoad(keyCreated2)
+	tc.appendAndLoad(domain.NewAccountPasswordAdded(
+		testAccId,
+		"pwd2",
+		"",
+		envelope2,
+		"",
+		ehevent.Meta(t0, joonasUid)))
+
+	// new secrets get the latest key
+	assert.EqualString(t, tc.user.AccountKey(testAccId).id(), accountKey2.id())
+
+	secrets := tc.user.accounts[testAccId].Secrets
+
+	decrypt := func(secret InternalSecret) (string, error) {
+		plaintext, err := tc.user.DecryptSecret(secret)
+		if err != nil {
+			return "", err
+		}
+		defer plaintext.Destroy()
+
+		return string(plaintext.Bytes()), nil
+	}
+
+	assertDecrypts := func(secrets []InternalSecret, expected ...string) {
+		t.Helper()
+
+		for i, secret := range secrets {
+			plaintext, err := decrypt(secret)
+			assert.Ok(t, err)
+			assert.EqualString(t, plaintext, expected[i])
+		}
+	}
+
+	assert.Assert(t, !tc.user.EncryptedWithAccountKey(secrets[0]))
+	assert.Assert(t, tc.user.EncryptedWithAccountKey(secrets[1]))
+	assert.Assert(t, tc.user.EncryptedWithAccountKey(secrets[2]))
+
+	// the first key was not overwritten by the second one
+	assertDecrypts(secrets, "legacy", "hunter2", "hunter3")
+
+	// rotation retires the old key, also from the account keys
+	oldKeys, err := tc.user.crypto.unlockedKeys()
+	assert.Ok(t, err)
+	defer zeroPrivateKeys(oldKeys)
+
+	rotation, err := tc.user.crypto.RotateDecryptionKey("myMasterPassword", ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+	defer rotation.Destroy()
+
+	assert.Ok(t, tc.user.RewrapAccountKeys(rotation))
+
+	legacyRewrapped, err := tc.user.RewrapLegacySecrets(rotation, ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+	// accId1: legacyPwd moved to the existing key. accId2: key created, legacyPwd2 moved to it
+	assert.Assert(t, len(legacyRewrapped) == 3)
+
+	// rotation not stored yet, so the old key still works
+	_, err = tc.user.unwrapAccountKey(accountKey)
+	assert.Ok(t, err)
+
+	tc.appendAndLoad(rotation.Event)
+	for _, event := range legacyRewrapped {
+		tc.appendAndLoad(event)
+	}
+
+	for _, key := range []*AccountKey{accountKey, accountKey2} {
+		wrapped, err := keyStore.Get(tc.user.UserId(), testAccId, key.id())
+		assert.Ok(t, err)
+		wrappedEnv, err := envelopeenc.Unmarshal(wrapped)
+		assert.Ok(t, err)
+		assert.Assert(t, len(wrappedEnv.KeySlots) == 1)
+		assert.Assert(t, !wrappedEnv.HasRecipient(publicKeyOf(oldKeys[0])))
+	}
+
+	assert.Ok(t, tc.user.crypto.UnlockDecryptionKey("myMasterPassword"))
+
+	secrets = tc.user.accounts[testAccId].Secrets
+
+	assert.Assert(t, tc.user.EncryptedWithAccountKey(secrets[0]))
+	assertDecrypts(secrets, "legacy", "hunter2", "hunter3")
+
+	secrets2 := tc.user.accounts["accId2"].Secrets
+	assert.Assert(t, tc.user.AccountKey("accId2") != nil)
+	assert.Assert(t, tc.user.EncryptedWithAccountKey(secrets2[0]))
+	assertDecrypts(secrets2, "legacy2")
+
+	// user's key alone cannot open them
+	for _, secret := range []InternalSecret{secrets[0], secrets[1], secrets2[0]} {
+		_, err = tc.user.crypto.Decrypt(secret.Envelope, secret.EnvelopeContext())
+		assert.Assert(t, err != nil)
+	}
+
+	keyDestroyed, err := tc.user.DestroyAccountKey(testAccId, ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+
+	// not before the event is stored
+	_, err = tc.user.unwrapAccountKey(accountKey)
+	assert.Ok(t, err)
+
+	tc.appendAndLoad(keyDestroyed)
+
+	assert.Assert(t, tc.user.AccountKey(testAccId) == nil)
+	assert.EqualString(t, tc.user.auditLog[len(tc.user.auditLog)-1].Event, "account.KeyDestroyed")
+
+	// even with the user's key and the event log's history, the secrets are gone. including
+	// the one that predates account keys
+	for _, key := range []*AccountKey{accountKey, accountKey2} {
+		_, err = tc.user.unwrapAccountKey(key)
+		assert.Assert(t, err == ErrAccountKeyDestroyed)
+	}
+
+	for _, secret := range secrets {
+		env, err := envelopeenc.Unmarshal(secret.Envelope)
+		assert.Ok(t, err)
+		_, err = env.Decrypt(oldKeys[0], secret.EnvelopeContext().associatedData())
+		assert.Assert(t, err != nil)
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, tc.user.UserId()))
+	assert.Ok(t, err)
+	assert.Assert(t, len(files) == 1) // accId2's keys
+
+	// nothing to destroy anymore
+	keyDestroyed, err = tc.user.DestroyAccountKey(testAccId, ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+	assert.Assert(t, keyDestroyed == nil)
+}
@@ -2,51 +2,168 @@ package state
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/function61/eventhorizon/pkg/ehclient"
 	"github.com/function61/eventhorizon/pkg/ehevent"
 	"github.com/function61/eventhorizon/pkg/ehreader"
-	"github.com/function61/eventhorizon/pkg/ehreader/ehreadertest"
 	"github.com/function61/eventkit/eventlog"
 	"github.com/function61/gokit/cryptorandombytes"
+	"github.com/function61/gokit/logex"
+	"github.com/function61/passitron/pkg/apitypes"
+	"github.com/function61/passitron/pkg/breachcheck"
+	"github.com/function61/passitron/pkg/domain"
+	"github.com/function61/passitron/pkg/ehfilelog"
 	"log"
+	"os"
+	"sort"
+	"sync"
 )
 
+const (
+	eventLogFilename = "events.log"
+	snapshotsDir     = "snapshots"
+	// how many new log entries a user's stream needs before we store a new snapshot
+	snapshotInterval = 100
+	// directory of users. contains only user.Created events, from which we discover the
+	// users (and therefore their streams) that exist
+	usersStream = "/users"
+)
+
+var ErrNotOwnUser = errors.New("you can only manage your own user")
+
 type AppState struct {
 	validatedJwtConf *JwtConfig
 	users            map[string]*UserStorage // keyed by id
-	EventLog         eventlog.Log            // FIXME: outdated (non-stream-aware) interface
+	usersMu          sync.Mutex
+	auditListener    func(apitypes.AuditlogEntry)
+	auditListenerMu  sync.Mutex
+	accountKeyStore  AccountKeyStore     // nil if not available
+	blobStore        BlobStore           // nil if not available
+	breachedPwds     breachcheck.Dataset // nil if not available
+	fileLog          *ehfilelog.EventLog // nil if not opened by us
+	EventLog         eventlog.Log        // FIXME: outdated (non-stream-aware) interface
 }
 
+// caller should Close() the state when done
 func New(logger *log.Logger) (*AppState, error) {
 	validatedJwtConf, err := readAndValidateJwtConfig()
 	if err != nil {
 		return nil, err
 	}
 
-	users := map[string]*UserStorage{}
-	users["2"] = newUserStorage(ehreader.TenantId("1"))
+	return open(validatedJwtConf, logger)
+}
+
+func open(validatedJwtConf *JwtConfig, logger *log.Logger) (*AppState, error) {
+	snapshots, err := ehfilelog.NewSnapshotStore(snapshotsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	accountKeyStore, err := newFileAccountKeyStore(accountKeysDir)
+	if err != nil {
+		return nil, err
+	}
+
+	blobStore, err := newFileBlobStore(blobsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	// opened after the things that don't need closing, as it holds an exclusive lock
+	fileLog, err := ehfilelog.Open(eventLogFilename, logex.Prefix("ehfilelog", logger))
+	if err != nil {
+		return nil, err
+	}
+
+	breachedPwds, err := breachcheck.OpenDefault()
+	if err != nil {
+		fileLog.Close()
+		return nil, err
+	}
+
+	app, err := newAppState(validatedJwtConf, fileLog, snapshots, accountKeyStore, blobStore, breachedPwds, logger)
+	if err != nil {
+		fileLog.Close()
+		if breachedPwds != nil {
+			breachedPwds.Close()
+		}
+		return nil, err
+	}
+
+	app.fileLog = fileLog
+
+	fileLog.SetMacKeyResolver(app.eventLogMacKey)
+
+	return app, nil
+}
+
+func (a *AppState) Close() error {
+	if a.breachedPwds != nil {
+		if err := a.breachedPwds.Close(); err != nil {
+			return err
+		}
+	}
 
-	// state from the event log is computed & populated mainly under State field
+	if a.fileLog != nil {
+		return a.fileLog.Close()
+	}
+
+	return nil
+}
+
+// snapshots can be nil, in which case the projections are always built with a full replay.
+// accountKeyStore and blobStore can be nil, in which case secrets encrypted with account
+// keys and attachments are inaccessible. breachedPwds can be nil, in which case passwords
+// are not checked for breaches.
+func newAppState(
+	validatedJwtConf *JwtConfig,
+	client ehclient.ReaderWriter,
+	snapshots ehreader.SnapshotStore,
+	accountKeyStore AccountKeyStore,
+	blobStore BlobStore,
+	breachedPwds breachcheck.Dataset,
+	logger *log.Logger,
+) (*AppState, error) {
 	s := &AppState{
 		validatedJwtConf: validatedJwtConf,
-		EventLog:         newTempAdapter(users["2"]),
-		users:            users,
+		users:            map[string]*UserStorage{},
+		accountKeyStore:  accountKeyStore,
+		blobStore:        blobStore,
+		breachedPwds:     breachedPwds,
 	}
 
-	if err := createAdminUser("admin", "admin", s); err != nil {
+	eventLog := newEventLogAdapter(s, client, snapshots, logger)
+
+	// state from the event log is computed & populated mainly under UserStorage
+	if err := eventLog.loadUntilRealtime(); err != nil {
 		return nil, err
 	}
 
+	s.EventLog = eventLog
+
 	return s, nil
 }
 
 // lists user known user IDs
 func (a *AppState) UserIds() []string {
-	return []string{"2"}
+	a.usersMu.Lock()
+	defer a.usersMu.Unlock()
+
+	ids := []string{}
+	for id := range a.users {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids
 }
 
 func (a *AppState) FindUserByUsername(username string) *UserStorage {
 	for _, userId := range a.UserIds() {
-		userData := a.users[userId]
+		userData := a.User(userId)
 		if userData.SensitiveUser().User.Username == username {
 			return userData
 		}
@@ -55,10 +172,90 @@ func (a *AppState) FindUserByUsername(username string) *UserStorage {
 	return nil
 }
 
+func (a *AppState) FindUserByAccessToken(token string) *UserStorage {
+	if token == "" { // important! user could have empty access token (if not set)
+		return nil
+	}
+
+	for _, userId := range a.UserIds() {
+		userData := a.User(userId)
+		if userData.SensitiveUser().AccessToken == token {
+			return userData
+		}
+	}
+
+	return nil
+}
+
 func (a *AppState) User(id string) *UserStorage {
+	a.usersMu.Lock()
+	defer a.usersMu.Unlock()
+
 	return a.users[id]
 }
 
+// for commands that manage a user (their password, access tokens etc.). there is no admin
+// role, so users can only manage themselves. nil if the user does not exist
+func (a *AppState) UserManagedBy(userId string, actorUserId string) (*UserStorage, error) {
+	if userId != actorUserId {
+		return nil, ErrNotOwnUser
+	}
+
+	return a.User(userId), nil
+}
+
+// listener gets called for each new audit log entry (but not for ones that existed at
+// startup). it must not block, since it's called synchronously from EventLog.Append()
+func (a *AppState) SetAuditListener(listener func(apitypes.AuditlogEntry)) {
+	a.auditListenerMu.Lock()
+	defer a.auditListenerMu.Unlock()
+
+	a.auditListener = listener
+}
+
+// implements auditsink.Source. empty if user does not exist
+func (a *AppState) AuditLogAfter(userId string, seq int) []apitypes.AuditlogEntry {
+	user := a.User(userId)
+	if user == nil {
+		return []apitypes.AuditlogEntry{}
+	}
+
+	return user.AuditLogAfter(seq)
+}
+
+func (a *AppState) notifyAuditListener(entry apitypes.AuditlogEntry) {
+	a.auditListenerMu.Lock()
+	listener := a.auditListener
+	a.auditListenerMu.Unlock()
+
+	if listener != nil {
+		listener(entry)
+	}
+}
+
+// user's entries get MAC'd while their decryption key is unlocked
+func (a *AppState) eventLogMacKey(logStream string) *ehfilelog.MacKey {
+	for _, userId := range a.UserIds() {
+		if userTenant(userId).Stream(stream) != logStream {
+			continue
+		}
+
+		crypto := a.User(userId).Crypto()
+		if crypto == nil {
+			return nil
+		}
+
+		macKey, err := crypto.eventLogMacKey()
+		if err != nil {
+			return nil // not worth failing the append for
+		}
+
+		return macKey
+	}
+
+	return nil
+}
+
 func (a *AppState) ValidatedJwtConf() *JwtConfig {
 	return a.validatedJwtConf
 }
@@ -67,32 +264,428 @@ func RandomId() string {
 	return cryptorandombytes.Base64UrlWithoutLeadingDash(4)
 }
 
-// pushes appends directly to in-memory event log only meant for testing
-type tempAdapter struct {
-	reader *ehreader.Reader
-	log    *ehreadertest.EventLog
-	ctx    context.Context
+// each user has their own tenant, and therefore a stream of their own
+func userTenant(userId string) ehreader.Tenant {
+	return ehreader.TenantId(userId)
 }
 
-func newTempAdapter(proc *UserStorage) *tempAdapter {
-	eventLog := ehreadertest.NewEventLog()
+// appends to the durable event log and then synchronously feeds the appended events
+// (along with anything else we hadn't yet seen) to the projections.
+//
+// events are routed to the stream of the user they target (EventMeta.UserId), except for
+// user.Created, which goes to the users directory.
+//
+// user projections are started from the latest snapshot (if any), so only the tail of
+// their stream needs to be replayed. snapshots are sealed (see sealedSnapshot), so a
+// snapshot that doesn't match the log gets replaced by a full replay.
+type eventLogAdapter struct {
+	app                 *AppState
+	client              ehclient.ReaderWriter
+	entryHashes         entryHasher // nil if client doesn't have a hash chain
+	directory           *ehreader.Reader
+	usersCreated        map[string]*domain.UserCreated // keyed by user id
+	userReaders         map[string]*ehreader.Reader    // keyed by user id
+	snapshots           ehreader.SnapshotStore         // nil = snapshots disabled
+	snapshotVersions    map[string]int64               // latest stored snapshot for user id
+	unverifiedSnapshots map[string]*sealedSnapshot     // installed while user was locked
+	logger              *log.Logger
+	logl                *logex.Leveled
+	mu                  sync.Mutex // ehreader.Reader is not safe for concurrent use
+	ctx                 context.Context
+}
 
-	return &tempAdapter{
-		reader: ehreader.New(proc, eventLog, nil),
-		log:    eventLog,
-		ctx:    context.Background(),
+// implemented by ehfilelog.EventLog
+type entryHasher interface {
+	EntryHash(cursor ehclient.Cursor) ([]byte, error)
+}
+
+func newEventLogAdapter(
+	app *AppState,
+	client ehclient.ReaderWriter,
+	snapshots ehreader.SnapshotStore,
+	logger *log.Logger,
+) *eventLogAdapter {
+	entryHashes, _ := client.(entryHasher)
+	if entryHashes == nil { // snapshots could not be tied to the log
+		snapshots = nil
+	}
+
+	m := &eventLogAdapter{
+		app:                 app,
+		client:              client,
+		entryHashes:         entryHashes,
+		usersCreated:        map[string]*domain.UserCreated{},
+		userReaders:         map[string]*ehreader.Reader{},
+		snapshots:           snapshots,
+		snapshotVersions:    map[string]int64{},
+		unverifiedSnapshots: map[string]*sealedSnapshot{},
+		logger:              logger,
+		logl:                logex.Levels(logger),
+		ctx:                 context.Background(),
 	}
+
+	m.directory = ehreader.New(newUserDirectory(m.userDiscovered), client, logger)
+
+	return m
 }
 
-func (m *tempAdapter) Append(events []ehevent.Event) error {
-	serialized := []string{}
+// the log can only append atomically to one stream, so a batch can only have events of one
+// user. a batch can also create that user: user.Created gets appended to the users
+// directory only after the rest, because until then the user's stream is not read by
+// anyone. therefore an interrupted batch never gets partially applied. (a retry with the
+// same user id appends after the unread events, but they get superseded by the retry's.)
+func (m *eventLogAdapter) Append(events []ehevent.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var userCreated *domain.UserCreated
+	var firstUserEvent ehevent.Event
+	userId := ""
+	userEvents := []string{}
+
 	for _, event := range events {
-		serialized = append(serialized, ehevent.Serialize(event))
+		if created, is := event.(*domain.UserCreated); is {
+			if _, exists := m.userReaders[created.Id]; exists {
+				return fmt.Errorf("user %s already exists", created.Id)
+			}
+
+			// sign-in finds users by username
+			if m.app.FindUserByUsername(created.Username) != nil {
+				return fmt.Errorf("username %s already taken", created.Username)
+			}
+
+			if userCreated != nil {
+				return errors.New("only one user can be created per batch")
+			}
+
+			userCreated = created
+			continue
+		}
+
+		eventUserId := event.Meta().UserId
+
+		if userId != "" && eventUserId != userId {
+			return fmt.Errorf("batch has events of multiple users: %s and %s", userId, eventUserId)
+		}
+
+		if firstUserEvent == nil {
+			firstUserEvent = event
+		}
+
+		userId = eventUserId
+		userEvents = append(userEvents, ehevent.Serialize(event))
+	}
+
+	if userId != "" {
+		if userCreated != nil {
+			if userId != userCreated.Id {
+				return fmt.Errorf("batch creates user %s but has events of %s", userCreated.Id, userId)
+			}
+		} else if _, exists := m.userReaders[userId]; !exists {
+			return fmt.Errorf("%s for unknown user '%s'", firstUserEvent.MetaType(), userId)
+		}
+
+		if _, err := m.client.Append(m.ctx, userTenant(userId).Stream(stream), userEvents); err != nil {
+			return err
+		}
+	}
+
+	if userCreated != nil {
+		if _, err := m.client.Append(m.ctx, usersStream, []string{ehevent.Serialize(userCreated)}); err != nil {
+			return err
+		}
 	}
 
-	if _, err := m.log.Append(m.ctx, "/t-1/pism", serialized); err != nil {
+	return m.loadUntilRealtime()
+}
+
+// caller must hold m.mu (or have exclusive access otherwise)
+func (m *eventLogAdapter) loadUntilRealtime() error {
+	// discovers new users first, so the loop below reads their streams as well
+	if err := m.directory.LoadUntilRealtime(m.ctx); err != nil {
 		return err
 	}
 
-	return m.reader.LoadUntilRealtime(m.ctx)
+	for _, reader := range m.userReaders {
+		if err := reader.LoadUntilRealtime(m.ctx); err != nil {
+			return err
+		}
+	}
+
+	if err := m.verifySnapshotsOfUnlockedUsers(); err != nil {
+		return err
+	}
+
+	m.storeSnapshotsIfDue()
+
+	return nil
+}
+
+// invoked by user directory
+func (m *eventLogAdapter) userDiscovered(e *domain.UserCreated) error {
+	user, reader, err := m.loadUser(e, true)
+	if err != nil {
+		// snapshot could be from an older version of the software, or otherwise unusable.
+		// it's always safe to rebuild the projection from scratch.
+		m.logl.Error.Printf("user %s: starting from snapshot failed, replaying fully: %v", e.Id, err)
+
+		user, reader, err = m.loadUser(e, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	m.usersCreated[e.Id] = e
+
+	m.setUser(e.Id, user, reader)
+
+	return nil
+}
+
+func (m *eventLogAdapter) setUser(userId string, user *UserStorage, reader *ehreader.Reader) {
+	m.userReaders[userId] = reader
+
+	m.app.usersMu.Lock()
+	defer m.app.usersMu.Unlock()
+
+	m.app.users[userId] = user
+}
+
+func (m *eventLogAdapter) loadUser(
+	e *domain.UserCreated,
+	fromSnapshot bool,
+) (*UserStorage, *ehreader.Reader, error) {
+	user := newUserStorage(userTenant(e.Id))
+	user.audited = m.app.notifyAuditListener
+	user.accountKeyStore = m.app.accountKeyStore
+	user.blobStore = m.app.blobStore
+	user.breachedPwds = m.app.breachedPwds
+	user.logl = logex.Levels(logex.Prefix("user "+e.Id, m.logger))
+
+	// the rest of user's events are in their own stream, but we need this one for the basics
+	if err := user.processEvent(e); err != nil {
+		return nil, nil, err
+	}
+
+	// not stored yet (as far as we know). we'll overwrite a possible unusable snapshot.
+	m.snapshotVersions[e.Id] = user.cursor.Version()
+
+	var unverifiedSnapshot *sealedSnapshot
+
+	if fromSnapshot && m.snapshots != nil {
+		snap, err := m.snapshots.LoadSnapshot(m.ctx, user.cursor)
+		switch {
+		case err == os.ErrNotExist: // ok, just start from the beginning
+		case err != nil:
+			return nil, nil, err
+		default:
+			if unverifiedSnapshot, err = m.installSealedSnapshot(e, user, snap); err != nil {
+				return nil, nil, err
+			}
+
+			m.snapshotVersions[e.Id] = snap.Cursor.Version()
+		}
+	}
+
+	reader := ehreader.New(
+		user,
+		m.client,
+		logex.Prefix("user "+e.Id, m.logger))
+
+	// also validates that the snapshot is compatible with the log
+	if err := reader.LoadUntilRealtime(m.ctx); err != nil {
+		return nil, nil, err
+	}
+
+	if unverifiedSnapshot != nil {
+		m.unverifiedSnapshots[e.Id] = unverifiedSnapshot
+	} else {
+		delete(m.unverifiedSnapshots, e.Id)
+	}
+
+	return user, reader, nil
+}
+
+// the user's key is locked at this point, so only the binding to the log can be checked.
+// the MAC is verified later by verifySnapshotsOfUnlockedUsers(). signing in (and unlocking)
+// has to happen before that, so the data they're checked against is not taken from the
+// snapshot but replayed from the log.
+func (m *eventLogAdapter) installSealedSnapshot(
+	e *domain.UserCreated,
+	user *UserStorage,
+	snap *ehreader.Snapshot,
+) (*sealedSnapshot, error) {
+	chainHash, err := m.entryHashes.EntryHash(snap.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	unsealed, sealed, err := unsealSnapshot(snap, chainHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := user.InstallSnapshot(unsealed); err != nil {
+		return nil, err
+	}
+
+	authData, err := m.replayAuthData(e, snap.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	user.adoptAuthData(authData)
+
+	// we only store snapshots of users with a decryption key (to MAC them with), so the
+	// snapshot would never get verified
+	if user.Crypto() == nil {
+		return nil, errors.New("snapshot of user without decryption key")
+	}
+
+	return sealed, nil
+}
+
+// replays user's stream up to (and including) until, but only the events that auth data is
+// derived from (see authEventTypes). the rest are skipped without deserializing them, which
+// is what keeps this cheaper than a full replay.
+func (m *eventLogAdapter) replayAuthData(
+	e *domain.UserCreated,
+	until ehclient.Cursor,
+) (*UserStorage, error) {
+	authData := newUserStorage(userTenant(e.Id))
+
+	if err := authData.processEvent(e); err != nil {
+		return nil, err
+	}
+
+	cursor := authData.cursor
+
+	for {
+		result, err := m.client.Read(m.ctx, cursor)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range result.Entries {
+			if entry.Version > until.Version() {
+				return authData, nil
+			}
+
+			for _, line := range entry.Events {
+				if !authEventTypes[eventTypeOfLine(line)] {
+					continue
+				}
+
+				ev, err := ehevent.Deserialize(line, domain.EventTypes)
+				if err != nil {
+					return nil, err
+				}
+
+				if err := authData.processEvent(ev); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if !result.More {
+			return authData, nil
+		}
+
+		cursor = result.LastEntry
+	}
+}
+
+// a snapshot whose MAC doesn't verify was not made by us, so the user's projection is
+// rebuilt with a full replay. the replaced projection's key (which was unlocked from what
+// the snapshot had) is sealed, so the user has to unlock again.
+func (m *eventLogAdapter) verifySnapshotsOfUnlockedUsers() error {
+	for userId, sealed := range m.unverifiedSnapshots {
+		crypto := m.app.User(userId).Crypto()
+
+		macKeys, err := crypto.eventLogMacKeysHistory()
+		if err != nil {
+			return err
+		}
+
+		if macKeys == nil { // still locked
+			continue
+		}
+
+		errVerify := sealed.verifyMac(macKeys)
+		zeroMacKeys(macKeys)
+
+		delete(m.unverifiedSnapshots, userId)
+
+		if errVerify == nil {
+			continue
+		}
+
+		m.logl.Error.Printf("user %s: %v; rebuilding with full replay", userId, errVerify)
+
+		user, reader, err := m.loadUser(m.usersCreated[userId], false)
+		if err != nil {
+			return err
+		}
+
+		m.setUser(userId, user, reader)
+
+		crypto.Seal()
+	}
+
+	return nil
+}
+
+// storing snapshots is an optimization, so failures are not fatal
+func (m *eventLogAdapter) storeSnapshotsIfDue() {
+	if m.snapshots == nil {
+		return
+	}
+
+	for userId := range m.userReaders {
+		user := m.app.User(userId)
+
+		if user.version()-m.snapshotVersions[userId] < snapshotInterval {
+			continue
+		}
+
+		crypto := user.Crypto()
+		if crypto == nil { // nothing to MAC the snapshot with
+			continue
+		}
+
+		macKey, err := crypto.currentEventLogMacKey(false)
+		if err != nil {
+			m.logl.Error.Printf("user %s: currentEventLogMacKey: %v", userId, err)
+			continue
+		}
+
+		if macKey == nil { // locked. we'll try again on a later append
+			continue
+		}
+
+		snap, err := user.Snapshot()
+		if err != nil {
+			m.logl.Error.Printf("user %s: Snapshot: %v", userId, err)
+			continue
+		}
+
+		chainHash, err := m.entryHashes.EntryHash(snap.Cursor)
+		if err != nil {
+			m.logl.Error.Printf("user %s: EntryHash: %v", userId, err)
+			continue
+		}
+
+		sealed, err := sealSnapshot(snap, chainHash, macKey)
+		if err != nil {
+			m.logl.Error.Printf("user %s: sealSnapshot: %v", userId, err)
+			continue
+		}
+
+		if err := m.snapshots.StoreSnapshot(m.ctx, *sealed); err != nil {
+			m.logl.Error.Printf("user %s: StoreSnapshot: %v", userId, err)
+			continue
+		}
+
+		m.snapshotVersions[userId] = snap.Cursor.Version()
+	}
 }
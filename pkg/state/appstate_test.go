@@ -0,0 +1,281 @@
+package state
+
+import (
+	"context"
+	"fmt"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/passitron/pkg/domain"
+	"github.com/function61/passitron/pkg/ehfilelog"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMultipleUsers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "appstate")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	eventLogPath := filepath.Join(dir, eventLogFilename)
+
+	fileLog, err := ehfilelog.Open(eventLogPath, nil)
+	assert.Ok(t, err)
+
+	app, err := newAppState(nil, fileLog, nil, nil, nil, nil, nil)
+	assert.Ok(t, err)
+
+	assert.Assert(t, len(app.UserIds()) == 0)
+
+	assert.Ok(t, app.EventLog.Append([]ehevent.Event{
+		domain.NewUserCreated("u1", "joonas", ehevent.Meta(t0, "u1")),
+		domain.NewUserAccessTokenAdded("u1", "tid1", "token1", "", ehevent.Meta(t0, "u1")),
+		domain.NewAccountCreated("acc1", domain.RootFolderId, "Joonas' account", ehevent.Meta(t0, "u1")),
+	}))
+
+	assert.Ok(t, app.EventLog.Append([]ehevent.Event{
+		domain.NewUserCreated("u2", "mikko", ehevent.Meta(t0, "u2")),
+		domain.NewAccountCreated("acc2", domain.RootFolderId, "Mikko's account", ehevent.Meta(t0, "u2")),
+		// admin acting on another user's resources
+		domain.NewUserAccessTokenAdded("u2", "tid2", "token2", "", ehevent.MetaWithImpersonator(t0, "u2", "u1")),
+	}))
+
+	assertUsers := func(app *AppState) {
+		t.Helper()
+
+		assert.EqualJson(t, app.UserIds(), `[
+  "u1",
+  "u2"
+]`)
+
+		assert.EqualString(t, app.FindUserByUsername("mikko").UserId(), "u2")
+		assert.Assert(t, app.FindUserByUsername("nobody") == nil)
+
+		assert.EqualString(t, app.FindUserByAccessToken("token1").UserId(), "u1")
+		assert.EqualString(t, app.FindUserByAccessToken("token2").UserId(), "u2")
+		assert.Assert(t, app.FindUserByAccessToken("") == nil)
+
+		// users' data is kept separate
+		assert.EqualJson(t, UnwrapAccounts(app.User("u1").WrappedAccounts()), `[
+  {
+    "Created": "2020-02-20T14:02:00Z",
+    "Description": "",
+    "Email": "",
+    "FolderId": "root",
+    "Id": "acc1",
+    "PasswordBreached": false,
+    "Title": "Joonas' account",
+    "Url": "",
+    "Username": ""
+  }
+]`)
+		assert.Assert(t, len(app.User("u2").WrappedAccounts()) == 1)
+		assert.EqualString(t, app.User("u2").WrappedAccounts()[0].Account.Id, "acc2")
+	}
+
+	assertUsers(app)
+
+	assert.EqualString(t, app.EventLog.Append([]ehevent.Event{
+		domain.NewAccountCreated("acc3", domain.RootFolderId, "Orphan", ehevent.Meta(t0, "u3")),
+	}).Error(), "account.Created for unknown user 'u3'")
+
+	assert.EqualString(t, app.EventLog.Append([]ehevent.Event{
+		domain.NewUserCreated("u2", "mikko2", ehevent.Meta(t0, "u2")),
+	}).Error(), "user u2 already exists")
+
+	assert.EqualString(t, app.EventLog.Append([]ehevent.Event{
+		domain.NewUserCreated("u3", "mikko", ehevent.Meta(t0, "u3")),
+	}).Error(), "username mikko already taken")
+
+	// mikko cannot manage joonas (e.g. set password or add access token)
+	_, err = app.UserManagedBy("u1", "u2")
+	assert.Assert(t, err == ErrNotOwnUser)
+
+	ownUser, err := app.UserManagedBy("u2", "u2")
+	assert.Ok(t, err)
+	assert.EqualString(t, ownUser.UserId(), "u2")
+
+	// a batch can only be appended atomically if it's in one stream
+	assert.EqualString(t, app.EventLog.Append([]ehevent.Event{
+		domain.NewAccountCreated("acc3", domain.RootFolderId, "u1's", ehevent.Meta(t0, "u1")),
+		domain.NewAccountCreated("acc4", domain.RootFolderId, "u2's", ehevent.Meta(t0, "u2")),
+	}).Error(), "batch has events of multiple users: u1 and u2")
+
+	assert.EqualString(t, app.EventLog.Append([]ehevent.Event{
+		domain.NewUserCreated("u3", "kalle", ehevent.Meta(t0, "u3")),
+		domain.NewAccountCreated("acc3", domain.RootFolderId, "u1's", ehevent.Meta(t0, "u1")),
+	}).Error(), "batch creates user u3 but has events of u1")
+
+	// as if a batch creating u3 got interrupted before user.Created was stored
+	_, err = fileLog.Append(context.Background(), userTenant("u3").Stream(stream), []string{
+		ehevent.Serialize(domain.NewAccountCreated("acc3", domain.RootFolderId, "Interrupted", ehevent.Meta(t0, "u3"))),
+	})
+	assert.Ok(t, err)
+
+	// users are discovered again from the durable log
+	assert.Ok(t, fileLog.Close())
+
+	fileLog, err = ehfilelog.Open(eventLogPath, nil)
+	assert.Ok(t, err)
+	defer fileLog.Close()
+
+	appReopened, err := newAppState(nil, fileLog, nil, nil, nil, nil, nil)
+	assert.Ok(t, err)
+
+	assertUsers(appReopened)
+}
+
+func TestSnapshots(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "appstate")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	fileLog, err := ehfilelog.Open(filepath.Join(dir, eventLogFilename), nil)
+	assert.Ok(t, err)
+	defer fileLog.Close()
+
+	snapshots := ehreader.NewInMemSnapshotStore()
+
+	app, err := newAppState(nil, fileLog, snapshots, nil, nil, nil, nil)
+	assert.Ok(t, err)
+
+	keyCreated, err := NewDecryptionKey("myMasterPassword", ehevent.Meta(t0, "u1"))
+	assert.Ok(t, err)
+
+	assert.Ok(t, app.EventLog.Append([]ehevent.Event{
+		domain.NewUserCreated("u1", "joonas", ehevent.Meta(t0, "u1")),
+		keyCreated,
+		domain.NewAccountCreated("acc1", domain.RootFolderId, "In log", ehevent.Meta(t0, "u1")),
+	}))
+
+	// not stored while locked, as the snapshot could not be MAC'd
+	app.EventLog.(*eventLogAdapter).snapshotVersions["u1"] = -snapshotInterval
+	assert.Ok(t, app.EventLog.Append([]ehevent.Event{
+		domain.NewUserDecryptionKeyUnlocked(ehevent.Meta(t0, "u1")),
+	}))
+	_, err = snapshots.LoadSnapshot(ctx, ehclient.At(userTenant("u1").Stream(stream), 0))
+	assert.Assert(t, err == os.ErrNotExist)
+
+	unlockAndAppend := func(app *AppState) {
+		t.Helper()
+
+		assert.Ok(t, app.User("u1").Crypto().UnlockDecryptionKey("myMasterPassword"))
+		assert.Ok(t, app.EventLog.Append([]ehevent.Event{
+			domain.NewUserDecryptionKeyUnlocked(ehevent.Meta(t0, "u1")),
+		}))
+	}
+
+	// the unlock was the last entry of the snapshot
+	unlockAndAppend(app)
+	snap, err := snapshots.LoadSnapshot(ctx, ehclient.At(userTenant("u1").Stream(stream), 0))
+	assert.Ok(t, err)
+
+	macKey, err := app.User("u1").Crypto().currentEventLogMacKey(false)
+	assert.Ok(t, err)
+
+	// the tail, which is not in the snapshot
+	assert.Ok(t, app.EventLog.Append([]ehevent.Event{
+		domain.NewAccountCreated("acc2", domain.RootFolderId, "Tail", ehevent.Meta(t0, "u1")),
+	}))
+
+	chainHash, err := fileLog.EntryHash(snap.Cursor)
+	assert.Ok(t, err)
+
+	unsealed, sealed, err := unsealSnapshot(snap, chainHash)
+	assert.Ok(t, err)
+	assert.Ok(t, sealed.verifyMac(map[string][]byte{macKey.Id: macKey.Key}))
+
+	// doctor the snapshot so we can tell whether it was used. sealed like we would do it,
+	// unless given a different chain hash or MAC key
+	storeSnapshot := func(from string, to string, chainHash []byte, macKey *ehfilelog.MacKey) {
+		t.Helper()
+
+		assert.Assert(t, strings.Contains(string(unsealed.Data), from))
+		doctored := ehreader.NewSnapshot(
+			unsealed.Cursor,
+			[]byte(strings.Replace(string(unsealed.Data), from, to, 1)))
+
+		sealed, err := sealSnapshot(doctored, chainHash, macKey)
+		assert.Ok(t, err)
+
+		assert.Ok(t, snapshots.StoreSnapshot(ctx, *sealed))
+	}
+
+	accountTitles := func(app *AppState) string {
+		titles := []string{}
+		for _, acc := range UnwrapAccounts(app.User("u1").WrappedAccounts()) {
+			titles = append(titles, acc.Title)
+		}
+		sort.Strings(titles)
+
+		return strings.Join(titles, ", ")
+	}
+
+	storeSnapshot(`"Title":"In log"`, `"Title":"In snapshot"`, chainHash, macKey)
+
+	fromSnapshot, err := newAppState(nil, fileLog, snapshots, nil, nil, nil, nil)
+	assert.Ok(t, err)
+
+	assert.EqualString(t, accountTitles(fromSnapshot), "In snapshot, Tail")
+
+	// MAC gets verified on unlock
+	unlockAndAppend(fromSnapshot)
+	assert.EqualString(t, accountTitles(fromSnapshot), "In snapshot, Tail")
+
+	// snapshot made by an incompatible version gets ignored in favour of a full replay
+	storeSnapshot(fmt.Sprintf(`"Version":%d,`, snapshotVersion), `"Version":0,`, chainHash, macKey)
+
+	fullyReplayed, err := newAppState(nil, fileLog, snapshots, nil, nil, nil, nil)
+	assert.Ok(t, err)
+
+	assert.EqualString(t, accountTitles(fullyReplayed), "In log, Tail")
+
+	// so is a snapshot that was not made from this log
+	storeSnapshot(`"Title":"In log"`, `"Title":"In snapshot"`, make([]byte, len(chainHash)), macKey)
+
+	fullyReplayed, err = newAppState(nil, fileLog, snapshots, nil, nil, nil, nil)
+	assert.Ok(t, err)
+
+	assert.EqualString(t, accountTitles(fullyReplayed), "In log, Tail")
+
+	forgedMacKey := &ehfilelog.MacKey{
+		Id:  macKey.Id,
+		Key: []byte("forged"),
+	}
+
+	// auth data is replayed from the log, as the MAC can only be verified after signing in
+	storeSnapshot(`"AccessToken":""`, `"AccessToken":"forged"`, chainHash, forgedMacKey)
+
+	forgedAuth, err := newAppState(nil, fileLog, snapshots, nil, nil, nil, nil)
+	assert.Ok(t, err)
+
+	assert.Assert(t, forgedAuth.FindUserByAccessToken("forged") == nil)
+
+	storeSnapshot(`"Username":"joonas"`, `"Username":"mallory"`, chainHash, forgedMacKey)
+
+	forgedAuth, err = newAppState(nil, fileLog, snapshots, nil, nil, nil, nil)
+	assert.Ok(t, err)
+
+	assert.Assert(t, forgedAuth.FindUserByUsername("mallory") == nil)
+	assert.Assert(t, forgedAuth.FindUserByUsername("joonas") != nil)
+
+	// forged snapshot can only be detected after unlock, after which it gets replaced with
+	// a full replay. the unlock is not carried over to the rebuilt projection
+	storeSnapshot(`"Title":"In log"`, `"Title":"In snapshot"`, chainHash, forgedMacKey)
+
+	forged, err := newAppState(nil, fileLog, snapshots, nil, nil, nil, nil)
+	assert.Ok(t, err)
+
+	assert.EqualString(t, accountTitles(forged), "In snapshot, Tail")
+
+	unlockAndAppend(forged)
+	assert.EqualString(t, accountTitles(forged), "In log, Tail")
+	assert.Assert(t, !forged.User("u1").Crypto().isUnlocked())
+}
@@ -0,0 +1,176 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/atomicfilewrite"
+	"github.com/function61/gokit/mac"
+	"github.com/function61/passitron/pkg/domain"
+	"github.com/function61/passitron/pkg/envelopeenc"
+	"github.com/function61/passitron/pkg/securebuf"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// attachments (certificates, recovery PDFs etc.) can be big, so their content is stored
+// as an encrypted stream outside of the event log. the stream's key is a regular secret
+// (encrypted with the account key) in the event log. content is deleted only after the
+// secret's deletion is in the event log.
+
+const (
+	blobsDir = "blobs"
+)
+
+type BlobStore interface {
+	// blob is not visible to Open() before write returns successfully
+	Put(userId string, blobId string, write func(sink io.Writer) error) error
+	// os.ErrNotExist if blob does not exist
+	Open(userId string, blobId string) (io.ReadCloser, error)
+	// must not fail if blob does not exist
+	Delete(userId string, blobId string) error
+}
+
+type fileBlobStore struct {
+	dir string
+}
+
+func newFileBlobStore(dir string) (*fileBlobStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	return &fileBlobStore{dir}, nil
+}
+
+func (f *fileBlobStore) Put(userId string, blobId string, write func(sink io.Writer) error) error {
+	return atomicfilewrite.Write(f.pathFor(userId, blobId), write)
+}
+
+func (f *fileBlobStore) Open(userId string, blobId string) (io.ReadCloser, error) {
+	file, err := os.Open(f.pathFor(userId, blobId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, os.ErrNotExist
+		}
+
+		return nil, err
+	}
+
+	return file, nil
+}
+
+func (f *fileBlobStore) Delete(userId string, blobId string) error {
+	if err := os.Remove(f.pathFor(userId, blobId)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+func (f *fileBlobStore) pathFor(userId string, blobId string) string {
+	return filepath.Join(f.dir, userId+"_"+blobId+".blob")
+}
+
+// streams content to encrypted storage. only the account key's public half is needed, so
+// this works while the decryption key is locked. the content is stored before the returned
+// event, so DiscardAttachment() if storing the event fails
+func (s *UserStorage) AddAttachment(
+	accountKey *AccountKey,
+	title string,
+	filename string,
+	content io.Reader,
+	meta ehevent.EventMeta,
+) (*domain.AccountAttachmentAdded, error) {
+	if s.blobStore == nil {
+		return nil, errors.New("AddAttachment: blob store not available")
+	}
+
+	secretCtx := SecretContext{
+		AccountId: accountKey.accountId,
+		SecretId:  RandomId(),
+		Kind:      domain.SecretKindAttachment,
+	}
+
+	contentKey, err := envelopeenc.NewStreamKey()
+	if err != nil {
+		return nil, err
+	}
+	defer securebuf.Zero(contentKey)
+
+	size := int64(0)
+
+	if err := s.blobStore.Put(s.UserId(), secretCtx.SecretId, func(sink io.Writer) error {
+		var err error
+		size, err = envelopeenc.EncryptStream(sink, content, contentKey, secretCtx.associatedData())
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("AddAttachment: %w", err)
+	}
+
+	contentKeyEnvelope, err := accountKey.Encrypt(contentKey, secretCtx)
+	if err != nil {
+		return nil, err
+	}
+
+	return domain.NewAccountAttachmentAdded(
+		secretCtx.AccountId,
+		secretCtx.SecretId,
+		title,
+		filename,
+		int(size),
+		contentKeyEnvelope,
+		meta), nil
+}
+
+// for when the event returned by AddAttachment() could not be stored
+func (s *UserStorage) DiscardAttachment(attachmentAdded *domain.AccountAttachmentAdded) error {
+	if s.blobStore == nil {
+		return nil
+	}
+
+	return s.blobStore.Delete(s.UserId(), attachmentAdded.Id)
+}
+
+// on error, dst may have received a part of the content
+func (s *UserStorage) WriteAttachment(secret InternalSecret, dst io.Writer) error {
+	if secret.Kind != domain.SecretKindAttachment {
+		return errors.New("WriteAttachment with invalid kind")
+	}
+
+	if s.blobStore == nil {
+		return errors.New("WriteAttachment: blob store not available")
+	}
+
+	contentKey, err := s.DecryptSecret(secret)
+	if err != nil {
+		return err
+	}
+	defer contentKey.Destroy()
+
+	blob, err := s.blobStore.Open(s.UserId(), secret.Id)
+	if err != nil {
+		return fmt.Errorf("WriteAttachment: %w", err)
+	}
+	defer blob.Close()
+
+	_, err = envelopeenc.DecryptStream(dst, blob, contentKey.Bytes(), secret.EnvelopeContext().associatedData())
+	return err
+}
+
+// removes attachment content (if the secret is an attachment). called from the event
+// projection, like destroyAccountKey()
+func (s *UserStorage) deleteAttachmentContent(secret InternalSecret) {
+	if secret.Kind != domain.SecretKindAttachment || s.blobStore == nil {
+		return
+	}
+
+	if err := s.blobStore.Delete(s.UserId(), secret.Id); err != nil {
+		s.logl.Error.Printf("deleteAttachmentContent %s: %v", secret.Id, err)
+	}
+}
+
+func (s *UserStorage) AttachmentDownloadMac(secret *InternalSecret) *mac.Mac {
+	return s.mac("attachment:" + secret.Id)
+}
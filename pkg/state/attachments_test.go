@@ -0,0 +1,115 @@
+package state
+
+import (
+	"bytes"
+	"context"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/eventhorizon/pkg/ehreader/ehreadertest"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/passitron/pkg/domain"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAttachments(t *testing.T) {
+	tc := &testContext{
+		user:     newUserStorage(ehreader.TenantId("42")),
+		eventLog: ehreadertest.NewEventLog(),
+		ctx:      context.Background(),
+	}
+
+	tc.reader = ehreader.New(tc.user, tc.eventLog, nil)
+
+	dir, err := ioutil.TempDir("", "attachments")
+	assert.Ok(t, err)
+	defer os.RemoveAll(dir)
+
+	keyStore, err := newFileAccountKeyStore(filepath.Join(dir, accountKeysDir))
+	assert.Ok(t, err)
+
+	blobStore, err := newFileBlobStore(filepath.Join(dir, blobsDir))
+	assert.Ok(t, err)
+
+	tc.user.accountKeyStore = keyStore
+	tc.user.blobStore = blobStore
+
+	setupUser(t, tc)
+	unlockDecryptionKey(t, tc)
+
+	tc.appendAndLoad(
+		domain.NewAccountCreated(testAccId, domain.RootFolderId, "google.com", ehevent.Meta(t0, joonasUid)))
+
+	accountKey, keyCreated, err := tc.user.AccountKeyOrCreate(testAccId, ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+	tc.appendAndLoad(keyCreated)
+
+	// already has one
+	_, keyCreated, err = tc.user.AccountKeyOrCreate(testAccId, ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+	assert.Assert(t, keyCreated == nil)
+
+	// as if storing the event failed
+	discarded, err := tc.user.AddAttachment(
+		accountKey,
+		"Discarded",
+		"discarded.txt",
+		strings.NewReader("discarded"),
+		ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+	assert.Ok(t, tc.user.DiscardAttachment(discarded))
+
+	_, err = blobStore.Open(tc.user.UserId(), discarded.Id)
+	assert.Assert(t, err == os.ErrNotExist)
+
+	content := strings.Repeat("backup codes\n", 10000)
+
+	attachmentAdded, err := tc.user.AddAttachment(
+		accountKey,
+		"Recovery codes",
+		"codes.txt",
+		strings.NewReader(content),
+		ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+	tc.appendAndLoad(attachmentAdded)
+
+	secret := tc.user.accounts[testAccId].Secrets[0]
+	assert.Assert(t, secret.Kind == domain.SecretKindAttachment)
+	assert.EqualString(t, secret.AttachmentFilename, "codes.txt")
+	assert.Assert(t, secret.AttachmentSize == len(content))
+
+	download := func(secret InternalSecret) (string, error) {
+		buf := &bytes.Buffer{}
+		err := tc.user.WriteAttachment(secret, buf)
+		return buf.String(), err
+	}
+
+	downloaded, err := download(secret)
+	assert.Ok(t, err)
+	assert.Assert(t, downloaded == content)
+
+	// blob is bound to its secret
+	moved := secret
+	moved.Id = "otherId"
+	assert.Ok(t, blobStore.Put(tc.user.UserId(), moved.Id, func(sink io.Writer) error {
+		blob, err := blobStore.Open(tc.user.UserId(), secret.Id)
+		if err != nil {
+			return err
+		}
+		defer blob.Close()
+
+		_, err = io.Copy(sink, blob)
+		return err
+	}))
+	_, err = download(moved)
+	assert.Assert(t, err != nil)
+
+	tc.appendAndLoad(domain.NewAccountSecretDeleted(testAccId, secret.Id, ehevent.Meta(t0, joonasUid)))
+
+	_, err = download(secret)
+	assert.EqualString(t, err.Error(), "WriteAttachment: file does not exist")
+}
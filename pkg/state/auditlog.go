@@ -0,0 +1,136 @@
+package state
+
+import (
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/passitron/pkg/apitypes"
+	"github.com/function61/passitron/pkg/domain"
+	"strconv"
+	"time"
+)
+
+const (
+	auditLogDefaultPageSize = 50
+	auditLogMaxPageSize     = 500
+)
+
+// zero values mean "don't filter by this"
+type AuditLogQuery struct {
+	From           time.Time // inclusive
+	To             time.Time // exclusive
+	AccountId      string
+	SecretId       string
+	SecretUsedType domain.SecretUsedType
+	IpAddress      string
+	Before         int // paging: only entries with Seq less than this
+	Limit          int
+}
+
+func (q *AuditLogQuery) matches(entry *apitypes.AuditlogEntry) bool {
+	if q.Before != 0 && entry.Seq >= q.Before {
+		return false
+	}
+
+	if !q.From.IsZero() && entry.Timestamp.Before(q.From) {
+		return false
+	}
+
+	if !q.To.IsZero() && !entry.Timestamp.Before(q.To) {
+		return false
+	}
+
+	if q.AccountId != "" && entry.AccountId != q.AccountId {
+		return false
+	}
+
+	if q.SecretId != "" && !containsString(entry.SecretIds, q.SecretId) {
+		return false
+	}
+
+	if q.SecretUsedType != "" && (entry.SecretUsedType == nil || *entry.SecretUsedType != q.SecretUsedType) {
+		return false
+	}
+
+	if q.IpAddress != "" && entry.IpAddress != q.IpAddress {
+		return false
+	}
+
+	return true
+}
+
+// newest entries first. NextPage is empty when there are no more entries
+func (s *UserStorage) QueryAuditLog(q AuditLogQuery) apitypes.AuditlogPage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = auditLogDefaultPageSize
+	}
+	if limit > auditLogMaxPageSize {
+		limit = auditLogMaxPageSize
+	}
+
+	page := apitypes.AuditlogPage{
+		Entries: []apitypes.AuditlogEntry{},
+	}
+
+	for i := len(s.auditLog) - 1; i >= 0; i-- {
+		entry := &s.auditLog[i]
+
+		if !q.matches(entry) {
+			continue
+		}
+
+		if len(page.Entries) == limit {
+			// there's at least one more, so continue from the last one we returned
+			page.NextPage = strconv.Itoa(page.Entries[len(page.Entries)-1].Seq)
+			break
+		}
+
+		page.Entries = append(page.Entries, *entry)
+	}
+
+	return page
+}
+
+// oldest first. for following the audit log (like auditsink does)
+func (s *UserStorage) AuditLogAfter(seq int) []apitypes.AuditlogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq < 0 || seq >= len(s.auditLog) {
+		return []apitypes.AuditlogEntry{}
+	}
+
+	// Seq starts from 1, so entry with seq is at index seq-1
+	return append([]apitypes.AuditlogEntry{}, s.auditLog[seq:]...)
+}
+
+// fields identifying the user & time are filled by us, rest are the caller's
+// responsibility. the audit log is never truncated (the event log isn't either).
+func (l *UserStorage) audit(entry apitypes.AuditlogEntry, ev ehevent.Event) {
+	entry.Seq = len(l.auditLog) + 1 // starts from 1, so zero can mean "no paging"
+	entry.Timestamp = ev.Meta().Timestamp
+	entry.UserId = ev.Meta().UserId
+	entry.Event = ev.MetaType()
+
+	if entry.SecretIds == nil {
+		entry.SecretIds = []string{}
+	}
+
+	l.auditLog = append(l.auditLog, entry)
+
+	if l.audited != nil {
+		l.audited(entry)
+	}
+}
+
+func containsString(items []string, item string) bool {
+	for _, candidate := range items {
+		if candidate == item {
+			return true
+		}
+	}
+
+	return false
+}
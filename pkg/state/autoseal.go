@@ -0,0 +1,103 @@
+package state
+
+import (
+	"context"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/logex"
+	"github.com/function61/passitron/pkg/domain"
+	"log"
+	"time"
+)
+
+const (
+	autoSealCheckInterval = 15 * time.Second
+)
+
+// zero durations mean disabled
+type autoSealConfig struct {
+	IdleTimeout         time.Duration
+	MaxUnlockedDuration time.Duration
+}
+
+// returns nil if the key was not unlocked
+func (s *UserStorage) SealDecryptionKey(
+	reason domain.DecryptionKeySealReason,
+	meta ehevent.EventMeta,
+) *domain.UserDecryptionKeySealed {
+	if s.crypto == nil || !s.crypto.Seal() {
+		return nil
+	}
+
+	return domain.NewUserDecryptionKeySealed(reason, meta)
+}
+
+// returns false if the key should stay unlocked
+func (s *UserStorage) autoSealReason(now time.Time) (domain.DecryptionKeySealReason, bool) {
+	s.mu.Lock()
+	config := s.autoSeal
+	s.mu.Unlock()
+
+	if s.crypto == nil {
+		return "", false
+	}
+
+	s.crypto.mu.Lock()
+	defer s.crypto.mu.Unlock()
+
+	if s.crypto.privateKey == nil {
+		return "", false
+	}
+
+	if config.MaxUnlockedDuration != 0 && now.Sub(s.crypto.unlockedAt) >= config.MaxUnlockedDuration {
+		return domain.DecryptionKeySealReasonMaxUnlockedDuration, true
+	}
+
+	if config.IdleTimeout != 0 && now.Sub(s.crypto.lastUsed) >= config.IdleTimeout {
+		return domain.DecryptionKeySealReasonIdleTimeout, true
+	}
+
+	return "", false
+}
+
+// seals decryption keys of users whose idle timeout or max unlocked duration has passed
+func (a *AppState) RunAutoSealer(ctx context.Context, logger *log.Logger) error {
+	logl := logex.Levels(logger)
+
+	ticker := time.NewTicker(autoSealCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			if err := a.autoSeal(now, logl); err != nil {
+				logl.Error.Printf("autoSeal: %v", err)
+			}
+		}
+	}
+}
+
+func (a *AppState) autoSeal(now time.Time, logl *logex.Leveled) error {
+	for _, userId := range a.UserIds() {
+		userData := a.User(userId)
+
+		reason, due := userData.autoSealReason(now)
+		if !due {
+			continue
+		}
+
+		sealed := userData.SealDecryptionKey(reason, ehevent.Meta(now, userId))
+		if sealed == nil { // got sealed by someone else in the meantime
+			continue
+		}
+
+		logl.Info.Printf("sealing decryption key of %s: %s", userId, reason)
+
+		if err := a.EventLog.Append([]ehevent.Event{sealed}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
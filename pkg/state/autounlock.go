@@ -0,0 +1,72 @@
+package state
+
+import (
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/logex"
+	"github.com/function61/passitron/pkg/compositekey"
+	"github.com/function61/passitron/pkg/domain"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+// unlocks decryption keys of users whose key is protected by this key file alone. meant
+// for a key file on a removable medium, so the file not being present is not an error.
+//
+// anyone who has the device with the medium attached has the secrets, so this trades
+// security for convenience (e.g. unattended restarts after power outage).
+func (a *AppState) AutoUnlock(keyFilePath string, logger *log.Logger) error {
+	logl := logex.Levels(logger)
+
+	keyFile, err := ioutil.ReadFile(keyFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logl.Info.Printf("key file %s not present; not unlocking", keyFilePath)
+			return nil
+		}
+
+		return err
+	}
+
+	masterKey, err := compositekey.New("", keyFile)
+	if err != nil {
+		return err
+	}
+
+	passphrase, err := masterKey.Passphrase()
+	if err != nil {
+		return err
+	}
+
+	for _, userId := range a.UserIds() {
+		crypto := a.User(userId).Crypto()
+		if crypto == nil { // user has no decryption key
+			continue
+		}
+
+		if err := crypto.UnlockDecryptionKey(passphrase); err != nil {
+			// most likely user's key is not protected by this key file
+			logl.Debug.Printf("user %s: %v", userId, err)
+			continue
+		}
+
+		meta := ehevent.Meta(time.Now(), userId)
+
+		events := []ehevent.Event{}
+
+		if upgraded := crypto.DecryptionKeyUpgrade(meta); upgraded != nil {
+			events = append(events, upgraded)
+		}
+
+		events = append(events, domain.NewUserDecryptionKeyUnlocked(meta))
+
+		if err := a.EventLog.Append(events); err != nil {
+			return err
+		}
+
+		logl.Info.Printf("unlocked decryption key of %s", userId)
+	}
+
+	return nil
+}
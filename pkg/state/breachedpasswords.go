@@ -0,0 +1,64 @@
+package state
+
+import (
+	"errors"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/passitron/pkg/domain"
+)
+
+// passwords are checked against an on-device dataset of breached passwords (see breachcheck)
+
+var errBreachCheckNotAvailable = errors.New("dataset of breached passwords not available on the device")
+
+// nil event if the password isn't breached (or we've no dataset to check against)
+func (s *UserStorage) CheckPasswordBreached(
+	accountId string,
+	secretId string,
+	password []byte,
+	meta ehevent.EventMeta,
+) (*domain.AccountPasswordBreachDetected, error) {
+	if s.breachedPwds == nil {
+		return nil, nil
+	}
+
+	breached, err := s.breachedPwds.Contains(password)
+	if err != nil || !breached {
+		return nil, err
+	}
+
+	return domain.NewAccountPasswordBreachDetected(accountId, secretId, meta), nil
+}
+
+// checks all passwords not already flagged. needs the decryption key to be unlocked
+func (s *UserStorage) ScanBreachedPasswords(meta ehevent.EventMeta) ([]ehevent.Event, error) {
+	if s.breachedPwds == nil {
+		return nil, errBreachCheckNotAvailable
+	}
+
+	breachEvents := []ehevent.Event{}
+
+	for _, wacc := range s.WrappedAccounts() {
+		for _, secret := range wacc.Secrets {
+			if secret.Kind != domain.SecretKindPassword || secret.Breached {
+				continue
+			}
+
+			password, err := s.DecryptSecret(secret)
+			if err != nil {
+				return nil, err
+			}
+
+			breachEvent, err := s.CheckPasswordBreached(wacc.Account.Id, secret.Id, password.Bytes(), meta)
+			password.Destroy()
+			if err != nil {
+				return nil, err
+			}
+
+			if breachEvent != nil {
+				breachEvents = append(breachEvents, breachEvent)
+			}
+		}
+	}
+
+	return breachEvents, nil
+}
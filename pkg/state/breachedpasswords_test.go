@@ -0,0 +1,70 @@
+package state
+
+import (
+	"context"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/eventhorizon/pkg/ehreader/ehreadertest"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/passitron/pkg/domain"
+	"testing"
+)
+
+type testBreachDataset map[string]bool
+
+func (t testBreachDataset) Contains(password []byte) (bool, error) {
+	return t[string(password)], nil
+}
+
+func (t testBreachDataset) Close() error {
+	return nil
+}
+
+func TestScanBreachedPasswords(t *testing.T) {
+	tc := &testContext{
+		user:     newUserStorage(ehreader.TenantId("42")),
+		eventLog: ehreadertest.NewEventLog(),
+		ctx:      context.Background(),
+	}
+
+	tc.reader = ehreader.New(tc.user, tc.eventLog, nil)
+
+	_, err := tc.user.ScanBreachedPasswords(ehevent.Meta(t0, joonasUid))
+	assert.EqualString(t, err.Error(), "dataset of breached passwords not available on the device")
+
+	tc.user.breachedPwds = testBreachDataset{"hunter2": true}
+
+	setupUser(t, tc)
+	unlockDecryptionKey(t, tc)
+	addAccount(t, tc)
+
+	for _, pwd := range []string{"hunter2", "correct horse battery staple"} {
+		tc.appendAndLoad(domain.NewAccountPasswordAdded(
+			testAccId,
+			pwd,
+			"",
+			tc.encrypt(pwd, pwd, domain.SecretKindPassword),
+			"",
+			ehevent.Meta(t0, joonasUid)))
+	}
+
+	breachEvents, err := tc.user.ScanBreachedPasswords(ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+	assert.Assert(t, len(breachEvents) == 1)
+	assert.EqualString(t, breachEvents[0].(*domain.AccountPasswordBreachDetected).Id, "hunter2")
+
+	tc.appendAndLoad(breachEvents[0])
+
+	acc := tc.user.accounts[testAccId]
+	assert.Assert(t, acc.Account.PasswordBreached)
+	assert.Assert(t, acc.Secrets[0].Breached && !acc.Secrets[1].Breached)
+
+	// already flagged ones aren't reported again
+	breachEvents, err = tc.user.ScanBreachedPasswords(ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+	assert.Assert(t, len(breachEvents) == 0)
+
+	tc.appendAndLoad(domain.NewAccountSecretDeleted(testAccId, "hunter2", ehevent.Meta(t0, joonasUid)))
+
+	assert.Assert(t, !tc.user.accounts[testAccId].Account.PasswordBreached)
+}
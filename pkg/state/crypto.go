@@ -1,29 +1,48 @@
 package state
 
 import (
-	"crypto/rsa"
-	"crypto/x509"
+	"crypto"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
 	"github.com/function61/eventhorizon/pkg/ehevent"
-	"github.com/function61/gokit/cryptoutil"
 	"github.com/function61/passitron/pkg/domain"
+	"github.com/function61/passitron/pkg/ehfilelog"
 	"github.com/function61/passitron/pkg/envelopeenc"
+	"github.com/function61/passitron/pkg/securebuf"
 	"github.com/function61/passitron/pkg/slowcrypto"
+	"sync"
+	"time"
 )
 
 var (
 	ErrDecryptionKeyLocked = errors.New("decryption key locked")
+
+	previousKeysAssociatedData = []byte(`["previousKeys"]`)
 )
 
+// keys are *rsa.PrivateKey or *envelopeenc.X25519PrivateKey (and their public counterparts).
+// X25519 keys live in locked memory. RSA keys live in the Go heap (math/big) so we can
+// only zero them on seal - rotating them to X25519 is recommended.
 type cryptoThingie struct {
-	privateKeyEncrypted []byte          // slowcrypto(pem(pkcs1(rsaPrivateKey)))
-	privateKey          *rsa.PrivateKey // gets decrypted here from privateKeyEncrypted
-	publicKey           *rsa.PublicKey
+	privateKeyEncrypted   []byte            // slowcrypto(pem(privateKey))
+	privateKey            crypto.PrivateKey // gets decrypted here from privateKeyEncrypted
+	publicKey             crypto.PublicKey
+	publicKeyPem          string              // so we can snapshot the public key in its original form
+	previousKeysEncrypted []byte              // envelope(pem(previousKey or its MAC key)...) for privateKey, if key has been rotated
+	previousKeys          []crypto.PrivateKey // decrypted from previousKeysEncrypted along with privateKey (older rotations carried these)
+	previousMacKeys       map[string][]byte   // same, but only the event log MAC keys of the retired keys. by MacKey.Id
+	upgradedKeyEncrypted  []byte              // privateKeyEncrypted in current slowcrypto format, if it was outdated
+	unlockedAt            time.Time
+	lastUsed              time.Time  // last use of the private key (by any path), for idle timeout
+	mu                    sync.Mutex // sealing can happen in the background, while decrypting
 }
 
-func newCryptoThingie(rsaPublicKeyPemPkcs string, decryptionKeyEncrypted []byte) (*cryptoThingie, error) {
-	pubKey, err := cryptoutil.ParsePemPkcs1EncodedRsaPublicKey([]byte(rsaPublicKeyPemPkcs))
+var errAlreadyUnlocked = errors.New("already unlocked")
+
+func newCryptoThingie(publicKeyPem string, decryptionKeyEncrypted []byte) (*cryptoThingie, error) {
+	pubKey, err := parsePublicKeyPem([]byte(publicKeyPem))
 	if err != nil {
 		return nil, err
 	}
@@ -31,11 +50,33 @@ func newCryptoThingie(rsaPublicKeyPemPkcs string, decryptionKeyEncrypted []byte)
 	return &cryptoThingie{
 		privateKeyEncrypted: decryptionKeyEncrypted,
 		publicKey:           pubKey,
+		publicKeyPem:        publicKeyPem,
 	}, nil
 }
 
-func (c *cryptoThingie) Encrypt(secret []byte) ([]byte, error) {
-	env, err := envelopeenc.Encrypt(secret, []*rsa.PublicKey{c.publicKey})
+// where a secret's envelope belongs. authenticated along with the content, so an envelope
+// cannot be swapped into another account or secret (or be used as another kind of secret)
+type SecretContext struct {
+	AccountId string
+	SecretId  string
+	Kind      domain.SecretKind
+}
+
+func (s SecretContext) associatedData() []byte {
+	// JSON array, so field boundaries are unambiguous
+	ad, err := json.Marshal([]string{"secret", s.AccountId, s.SecretId, string(s.Kind)})
+	if err != nil {
+		panic(err)
+	}
+
+	return ad
+}
+
+func (c *cryptoThingie) Encrypt(secret []byte, secretCtx SecretContext) ([]byte, error) {
+	env, err := envelopeenc.Encrypt(
+		secret,
+		[]crypto.PublicKey{c.publicKey},
+		secretCtx.associatedData())
 	if err != nil {
 		return nil, err
 	}
@@ -44,37 +85,259 @@ func (c *cryptoThingie) Encrypt(secret []byte) ([]byte, error) {
 }
 
 func (c *cryptoThingie) UnlockDecryptionKey(pwd string) error {
-	if c.privateKey != nil {
-		return errors.New("UnlockDecryptionKey: already unlocked")
+	if c.isUnlocked() {
+		return fmt.Errorf("UnlockDecryptionKey: %w", errAlreadyUnlocked)
 	}
 
-	decryptionKey, err := slowcrypto.WithPassword(pwd).Decrypt(c.privateKeyEncrypted)
+	decryptionKey, upgradedKeyEncrypted, err := slowcrypto.WithPassword(pwd).DecryptAndUpgrade(
+		c.privateKeyEncrypted)
 	if err != nil {
 		return fmt.Errorf("UnlockDecryptionKey: %w", err)
 	}
+	defer securebuf.Zero(decryptionKey)
+
+	privKeyBlock, _ := pem.Decode(decryptionKey)
+	if privKeyBlock == nil {
+		return errors.New("UnlockDecryptionKey: no PEM block found")
+	}
+	defer securebuf.Zero(privKeyBlock.Bytes)
 
-	privKey, err := cryptoutil.ParsePemPkcs1EncodedRsaPrivateKey(decryptionKey)
+	privKey, err := parsePrivateKeyPem(privKeyBlock)
 	if err != nil {
 		return err
 	}
 
+	previousKeys, previousMacKeys, err := decryptPreviousKeys(c.previousKeysEncrypted, privKey)
+	if err != nil {
+		return fmt.Errorf("UnlockDecryptionKey: previous keys: %w", err)
+	}
+
+	if err := c.setUnlocked(privKey, previousKeys, previousMacKeys, upgradedKeyEncrypted, time.Now()); err != nil {
+		return fmt.Errorf("UnlockDecryptionKey: %w", err)
+	}
+
+	return nil
+}
+
+// someone else may have unlocked it while we were decrypting the key. in that case the
+// given keys are zeroed and errAlreadyUnlocked returned
+func (c *cryptoThingie) setUnlocked(
+	privKey crypto.PrivateKey,
+	previousKeys []crypto.PrivateKey,
+	previousMacKeys map[string][]byte,
+	upgradedKeyEncrypted []byte,
+	now time.Time,
+) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.privateKey != nil {
+		zeroPrivateKeys(append([]crypto.PrivateKey{privKey}, previousKeys...))
+		zeroMacKeys(previousMacKeys)
+		return errAlreadyUnlocked
+	}
+
 	c.privateKey = privKey
+	c.previousKeys = previousKeys
+	c.previousMacKeys = previousMacKeys
+	c.upgradedKeyEncrypted = upgradedKeyEncrypted
+	c.unlockedAt = now
+	c.lastUsed = now
 
 	return nil
 }
 
-// this will be a network hop or done in a browser
-func (c *cryptoThingie) Decrypt(envelopeBytes []byte) ([]byte, error) {
+func (c *cryptoThingie) isUnlocked() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.privateKey != nil
+}
+
+// copies of the current key and its predecessors (current first), so they can be used
+// without holding the lock, even if sealing zeroes the originals meanwhile. caller must
+// zeroPrivateKeys() them after use
+func (c *cryptoThingie) unlockedKeys() ([]crypto.PrivateKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.privateKey == nil {
+		return nil, ErrDecryptionKeyLocked
+	}
+
+	c.lastUsed = time.Now()
+
+	keys := []crypto.PrivateKey{}
+	for _, privKey := range append([]crypto.PrivateKey{c.privateKey}, c.previousKeys...) {
+		keyCopy, err := clonePrivateKey(privKey)
+		if err != nil {
+			zeroPrivateKeys(keys)
+			return nil, err
+		}
+
+		keys = append(keys, keyCopy)
+	}
+
+	return keys, nil
+}
+
+// for when the same key gets new password protection. the keys are moved, so sealing
+// previous (if someone still has it) doesn't zero our keys
+func (c *cryptoThingie) carryOverUnlockedKey(previous *cryptoThingie) {
+	previous.mu.Lock()
+	defer previous.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.privateKey = previous.privateKey
+	c.previousKeys = previous.previousKeys
+	c.previousMacKeys = previous.previousMacKeys
+	c.unlockedAt = previous.unlockedAt
+	c.lastUsed = previous.lastUsed
+
+	previous.privateKey = nil
+	previous.previousKeys = nil
+	previous.previousMacKeys = nil
+}
+
+// forgets the decryption key (and overwrites it in memory). returns false if it was
+// not unlocked
+func (c *cryptoThingie) Seal() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.privateKey == nil {
+		return false
+	}
+
+	for _, privKey := range append([]crypto.PrivateKey{c.privateKey}, c.previousKeys...) {
+		securebuf.ZeroPrivateKey(privKey)
+	}
+	zeroMacKeys(c.previousMacKeys)
+
+	c.privateKey = nil
+	c.previousKeys = nil
+	c.previousMacKeys = nil
+	c.unlockedAt = time.Time{}
+	c.lastUsed = time.Time{}
+
+	return true
+}
+
+// if the key was unlocked from an outdated slowcrypto format (e.g. PBKDF2), returns an
+// event that stores it in the current format. nil if no upgrade is needed. the password
+// was only available at unlock, so this is the only chance to upgrade.
+func (c *cryptoThingie) DecryptionKeyUpgrade(meta ehevent.EventMeta) *domain.UserDecryptionKeyPasswordChanged {
+	c.mu.Lock()
+	upgradedKeyEncrypted := c.upgradedKeyEncrypted
+	c.mu.Unlock()
+
+	if upgradedKeyEncrypted == nil {
+		return nil
+	}
+
+	return domain.NewUserDecryptionKeyPasswordChanged(
+		c.publicKeyPem,
+		upgradedKeyEncrypted,
+		meta)
+}
+
+// this will be a network hop or done in a browser.
+// caller must Destroy() the plaintext as soon as it's no longer needed
+func (c *cryptoThingie) Decrypt(envelopeBytes []byte, secretCtx SecretContext) (*securebuf.Buffer, error) {
+	return c.decrypt(envelopeBytes, secretCtx.associatedData())
+}
+
+func (c *cryptoThingie) decrypt(envelopeBytes []byte, associatedData []byte) (*securebuf.Buffer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.privateKey == nil {
 		return nil, ErrDecryptionKeyLocked
 	}
 
+	c.lastUsed = time.Now()
+
 	env, err := envelopeenc.Unmarshal(envelopeBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	return env.Decrypt(c.privateKey)
+	plaintext, err := env.Decrypt(c.privateKey, associatedData)
+	if err == nil {
+		return securebuf.Take(plaintext), nil
+	}
+
+	// envelope not yet rewrapped for our current key (only possible with older rotations,
+	// which carried the previous keys)
+	for _, previousKey := range c.previousKeys {
+		if plaintext, errPrevious := env.Decrypt(previousKey, associatedData); errPrevious == nil {
+			return securebuf.Take(plaintext), nil
+		}
+	}
+
+	return nil, err
+}
+
+// for MAC'ing the user's entries in the event log. only available while unlocked, so
+// someone with just disk access cannot forge them. returns nil if locked.
+func (c *cryptoThingie) eventLogMacKey() (*ehfilelog.MacKey, error) {
+	return c.currentEventLogMacKey(true)
+}
+
+// same key as eventLogMacKey(). markUsed=false is for background tasks, which must not
+// keep the key from being sealed for being idle
+func (c *cryptoThingie) currentEventLogMacKey(markUsed bool) (*ehfilelog.MacKey, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.privateKey == nil {
+		return nil, nil
+	}
+
+	if markUsed {
+		c.lastUsed = time.Now()
+	}
+
+	keyId, err := envelopeenc.KekId(c.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ehfilelog.MacKey{
+		Id:  keyId,
+		Key: eventLogMacKeyFor(c.privateKey),
+	}, nil
+}
+
+// keys for all the keys we have had, keyed by MacKey.Id. returns nil if locked.
+func (c *cryptoThingie) eventLogMacKeysHistory() (map[string][]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.privateKey == nil {
+		return nil, nil
+	}
+
+	c.lastUsed = time.Now()
+
+	keys := map[string][]byte{}
+
+	for keyId, macKey := range c.previousMacKeys {
+		keys[keyId] = append([]byte{}, macKey...)
+	}
+
+	for _, privKey := range append([]crypto.PrivateKey{c.privateKey}, c.previousKeys...) {
+		keyId, err := envelopeenc.KekId(publicKeyOf(privKey))
+		if err != nil {
+			return nil, err
+		}
+
+		keys[keyId] = eventLogMacKeyFor(privKey)
+	}
+
+	return keys, nil
 }
 
 func (c *cryptoThingie) VerifyPassword(pwd string) error {
@@ -86,30 +349,231 @@ func (c *cryptoThingie) ChangeDecryptionKeyPassword(
 	newPassword string,
 	meta ehevent.EventMeta,
 ) (*domain.UserDecryptionKeyPasswordChanged, error) {
-	if c.privateKey == nil {
+	keys, err := c.unlockedKeys()
+	if err != nil {
+		return nil, err
+	}
+	defer zeroPrivateKeys(keys)
+
+	return ExportPrivateKeyWithPassword(keys[0], newPassword, meta)
+}
+
+// result of generating a new decryption key to replace the current one. has copies of the
+// keys, so Destroy() it after rewrapping
+type KeyRotation struct {
+	Event   *domain.UserDecryptionKeyRotated
+	oldKeys []crypto.PrivateKey // current key first
+	newKey  crypto.PrivateKey
+}
+
+func (k *KeyRotation) Destroy() {
+	zeroPrivateKeys(append([]crypto.PrivateKey{k.newKey}, k.oldKeys...))
+}
+
+// new key is protected by the same password as the current one. the current key (along
+// with all its predecessors) gets retired: only their event log MAC keys are stored
+// encrypted for the new key, so the log's history stays verifiable. therefore everything
+// encrypted for the old keys (envelopes, account keys, recovery) must be rewrapped in the
+// same batch as the rotation.
+func (c *cryptoThingie) RotateDecryptionKey(
+	password string,
+	meta ehevent.EventMeta,
+) (*KeyRotation, error) {
+	if !c.isUnlocked() {
 		return nil, ErrDecryptionKeyLocked
 	}
 
-	return ExportPrivateKeyWithPassword(c.privateKey, newPassword, meta)
+	if err := c.VerifyPassword(password); err != nil {
+		return nil, err
+	}
+
+	oldKeys, err := c.unlockedKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	oldMacKeys, err := c.eventLogMacKeysHistory()
+	if err != nil || oldMacKeys == nil { // nil = sealed meanwhile
+		zeroPrivateKeys(oldKeys)
+		if err == nil {
+			err = ErrDecryptionKeyLocked
+		}
+		return nil, err
+	}
+	defer zeroMacKeys(oldMacKeys)
+
+	newKey, err := newDecryptionKeyPair()
+	if err != nil {
+		zeroPrivateKeys(oldKeys)
+		return nil, err
+	}
+
+	rotation, err := rotateDecryptionKeyTo(newKey, oldKeys, oldMacKeys, password, meta)
+	if err != nil {
+		zeroPrivateKeys(append([]crypto.PrivateKey{newKey}, oldKeys...))
+		return nil, err
+	}
+
+	return rotation, nil
+}
+
+// takes ownership of the keys (on success). oldMacKeys are all the event log MAC keys of
+// oldKeys and their predecessors
+func rotateDecryptionKeyTo(
+	newKey crypto.PrivateKey,
+	oldKeys []crypto.PrivateKey,
+	oldMacKeys map[string][]byte,
+	password string,
+	meta ehevent.EventMeta,
+) (*KeyRotation, error) {
+	newKeyExported, err := ExportPrivateKeyWithPassword(newKey, password, meta)
+	if err != nil {
+		return nil, err
+	}
+
+	oldMacKeysPem := marshalMacKeysPem(oldMacKeys)
+	defer securebuf.Zero(oldMacKeysPem)
+
+	oldKeysEnvelope, err := envelopeenc.Encrypt(
+		oldMacKeysPem,
+		[]crypto.PublicKey{publicKeyOf(newKey)},
+		previousKeysAssociatedData)
+	if err != nil {
+		return nil, err
+	}
+
+	oldKeysEncrypted, err := oldKeysEnvelope.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	return &KeyRotation{
+		Event: domain.NewUserDecryptionKeyRotated(
+			newKeyExported.PublicKey,
+			newKeyExported.PrivateKeyEncrypted,
+			oldKeysEncrypted,
+			meta),
+		oldKeys: oldKeys,
+		newKey:  newKey,
+	}, nil
+}
+
+// gives the new key access to the secret's envelope (and takes it away from the old keys).
+// Version1 envelopes only support RSA key slots, so they get upgraded and bound to secretCtx
+func (k *KeyRotation) Rewrap(envelopeBytes []byte, secretCtx SecretContext) ([]byte, error) {
+	return k.rewrapFor(envelopeBytes, []crypto.PublicKey{publicKeyOf(k.newKey)}, secretCtx.associatedData())
+}
+
+func (k *KeyRotation) rewrapFor(
+	envelopeBytes []byte,
+	recipients []crypto.PublicKey,
+	associatedData []byte,
+) ([]byte, error) {
+	env, err := envelopeenc.Unmarshal(envelopeBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var errFirst error
+	for _, oldKey := range k.oldKeys {
+		rewrapped, err := env.Rewrap(oldKey, recipients, associatedData)
+		if err != nil {
+			if errFirst == nil {
+				errFirst = err
+			}
+			continue
+		}
+
+		return rewrapped.Marshal()
+	}
+
+	return nil, errFirst
+}
+
+// previous keys are private keys (from older rotations) and/or MAC keys of retired keys
+func decryptPreviousKeys(
+	previousKeysEncrypted []byte,
+	privKey crypto.PrivateKey,
+) ([]crypto.PrivateKey, map[string][]byte, error) {
+	if previousKeysEncrypted == nil {
+		return nil, nil, nil
+	}
+
+	env, err := envelopeenc.Unmarshal(previousKeysEncrypted)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	previousKeysPem, err := env.Decrypt(privKey, previousKeysAssociatedData)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer securebuf.Zero(previousKeysPem)
+
+	previousKeys := []crypto.PrivateKey{}
+	previousMacKeys := map[string][]byte{}
+
+	for {
+		block, rest := pem.Decode(previousKeysPem)
+		if block == nil {
+			break
+		}
+
+		previousKeysPem = rest
+
+		if block.Type == pemTypeEventLogMacKey {
+			previousMacKeys[block.Headers[pemHeaderKeyId]] = block.Bytes
+			continue
+		}
+
+		previousKey, err := parsePrivateKeyPem(block)
+		securebuf.Zero(block.Bytes)
+		if err != nil {
+			zeroPrivateKeys(previousKeys)
+			zeroMacKeys(previousMacKeys)
+			return nil, nil, err
+		}
+
+		previousKeys = append(previousKeys, previousKey)
+	}
+
+	return previousKeys, previousMacKeys, nil
+}
+
+// generates a new (X25519) decryption key for a user, protected by given password
+func NewDecryptionKey(
+	password string,
+	meta ehevent.EventMeta,
+) (*domain.UserDecryptionKeyPasswordChanged, error) {
+	privKey, err := newDecryptionKeyPair()
+	if err != nil {
+		return nil, err
+	}
+	defer securebuf.ZeroPrivateKey(privKey) // only needed in exported form
+
+	return ExportPrivateKeyWithPassword(privKey, password, meta)
 }
 
 func ExportPrivateKeyWithPassword(
-	privKey *rsa.PrivateKey,
+	privKey crypto.PrivateKey,
 	password string,
 	meta ehevent.EventMeta,
 ) (*domain.UserDecryptionKeyPasswordChanged, error) {
-	privateKeyPem := cryptoutil.MarshalPemBytes(
-		x509.MarshalPKCS1PrivateKey(privKey),
-		cryptoutil.PemTypeRsaPrivateKey)
+	privateKeyPem, err := marshalPrivateKeyPem(privKey)
+	if err != nil {
+		return nil, err
+	}
+	defer securebuf.Zero(privateKeyPem)
 
 	privateKeyEncrypted, err := slowcrypto.WithPassword(password).Encrypt(privateKeyPem)
 	if err != nil {
 		return nil, err
 	}
 
-	pubKeyPem := cryptoutil.MarshalPemBytes(
-		x509.MarshalPKCS1PublicKey(&privKey.PublicKey),
-		cryptoutil.PemTypeRsaPublicKey)
+	pubKeyPem, err := marshalPublicKeyPem(publicKeyOf(privKey))
+	if err != nil {
+		return nil, err
+	}
 
 	return domain.NewUserDecryptionKeyPasswordChanged(
 		string(pubKeyPem),
@@ -0,0 +1,100 @@
+package state
+
+import (
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/passitron/pkg/domain"
+	"sync"
+	"testing"
+)
+
+// auto-sealer runs in the background. the keys we write to events must never be zeroed
+// ones (that would lose the vault), so run this with -race
+func TestSealDuringKeyChanges(t *testing.T) {
+	keyCreated, err := NewDecryptionKey("myMasterPassword", ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+
+	crypto, err := newCryptoThingie(keyCreated.PublicKey, keyCreated.PrivateKeyEncrypted)
+	assert.Ok(t, err)
+
+	secretCtx := SecretContext{AccountId: testAccId, SecretId: "pwdId1", Kind: domain.SecretKindPassword}
+
+	env, err := crypto.Encrypt([]byte("hunter2"), secretCtx)
+	assert.Ok(t, err)
+
+	// checks that the exported key is intact by decrypting with it
+	assertExportedKeyWorks := func(publicKeyPem string, privateKeyEncrypted []byte) {
+		t.Helper()
+
+		exported, err := newCryptoThingie(publicKeyPem, privateKeyEncrypted)
+		assert.Ok(t, err)
+		assert.Ok(t, exported.UnlockDecryptionKey("myMasterPassword"))
+		defer exported.Seal()
+
+		plaintext, err := exported.Decrypt(env, secretCtx)
+		assert.Ok(t, err)
+		defer plaintext.Destroy()
+		assert.EqualString(t, string(plaintext.Bytes()), "hunter2")
+	}
+
+	for i := 0; i < 3; i++ {
+		assert.Ok(t, crypto.UnlockDecryptionKey("myMasterPassword"))
+
+		var passwordChanged *domain.UserDecryptionKeyPasswordChanged
+		var passwordChangeErr error
+		var rotation *KeyRotation
+		var rotationErr error
+
+		wg := &sync.WaitGroup{}
+		wg.Add(3)
+
+		go func() {
+			defer wg.Done()
+			passwordChanged, passwordChangeErr = crypto.ChangeDecryptionKeyPassword(
+				"myMasterPassword",
+				ehevent.Meta(t0, joonasUid))
+		}()
+
+		go func() {
+			defer wg.Done()
+			rotation, rotationErr = crypto.RotateDecryptionKey(
+				"myMasterPassword",
+				ehevent.Meta(t0, joonasUid))
+		}()
+
+		go func() {
+			defer wg.Done()
+			crypto.Seal()
+		}()
+
+		wg.Wait()
+
+		// either we got the key before it was sealed, or we noticed it was sealed
+		if passwordChangeErr != nil {
+			assert.Assert(t, passwordChangeErr == ErrDecryptionKeyLocked)
+		} else {
+			assertExportedKeyWorks(passwordChanged.PublicKey, passwordChanged.PrivateKeyEncrypted)
+		}
+
+		if rotationErr != nil {
+			assert.Assert(t, rotationErr == ErrDecryptionKeyLocked)
+		} else {
+			rewrapped, err := rotation.Rewrap(env, secretCtx)
+			assert.Ok(t, err)
+			rotation.Destroy()
+
+			rotated, err := newCryptoThingie(rotation.Event.PublicKey, rotation.Event.PrivateKeyEncrypted)
+			assert.Ok(t, err)
+			rotated.previousKeysEncrypted = rotation.Event.PreviousKeysEncrypted
+			assert.Ok(t, rotated.UnlockDecryptionKey("myMasterPassword"))
+
+			plaintext, err := rotated.Decrypt(rewrapped, secretCtx)
+			assert.Ok(t, err)
+			assert.EqualString(t, string(plaintext.Bytes()), "hunter2")
+			plaintext.Destroy()
+			rotated.Seal()
+		}
+
+		crypto.Seal()
+	}
+}
@@ -0,0 +1,160 @@
+package state
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/function61/gokit/cryptoutil"
+	"github.com/function61/passitron/pkg/envelopeenc"
+	"github.com/function61/passitron/pkg/securebuf"
+	"sort"
+)
+
+// decryption keys are RSA (users created before X25519 support) or X25519
+
+const (
+	pemTypeX25519PrivateKey = "X25519 PRIVATE KEY" // raw 32-byte scalar
+	pemTypeX25519PublicKey  = "X25519 PUBLIC KEY"  // raw 32 bytes
+	pemTypeEventLogMacKey   = "EVENT LOG MAC KEY"  // eventLogMacKeyFor() of a retired key
+	pemHeaderKeyId          = "Key-Id"             // MacKey.Id
+)
+
+func newDecryptionKeyPair() (crypto.PrivateKey, error) {
+	return envelopeenc.GenerateX25519Key()
+}
+
+func marshalPrivateKeyPem(privKey crypto.PrivateKey) ([]byte, error) {
+	switch key := privKey.(type) {
+	case *rsa.PrivateKey:
+		return cryptoutil.MarshalPemBytes(x509.MarshalPKCS1PrivateKey(key), cryptoutil.PemTypeRsaPrivateKey), nil
+	case *envelopeenc.X25519PrivateKey:
+		scalar := key.Bytes()
+		defer securebuf.Zero(scalar)
+
+		return cryptoutil.MarshalPemBytes(scalar, pemTypeX25519PrivateKey), nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type: %T", privKey)
+	}
+}
+
+func marshalPublicKeyPem(pubKey crypto.PublicKey) ([]byte, error) {
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		return cryptoutil.MarshalPemBytes(x509.MarshalPKCS1PublicKey(key), cryptoutil.PemTypeRsaPublicKey), nil
+	case *envelopeenc.X25519PublicKey:
+		return cryptoutil.MarshalPemBytes(key[:], pemTypeX25519PublicKey), nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type: %T", pubKey)
+	}
+}
+
+func parsePrivateKeyPem(block *pem.Block) (crypto.PrivateKey, error) {
+	switch block.Type {
+	case cryptoutil.PemTypeRsaPrivateKey:
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case pemTypeX25519PrivateKey:
+		return envelopeenc.NewX25519PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported private key PEM type: %s", block.Type)
+	}
+}
+
+func parsePublicKeyPem(pemBytes []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("parsePublicKeyPem: no PEM block found")
+	}
+
+	switch block.Type {
+	case cryptoutil.PemTypeRsaPublicKey:
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case pemTypeX25519PublicKey:
+		return envelopeenc.NewX25519PublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported public key PEM type: %s", block.Type)
+	}
+}
+
+func publicKeyOf(privKey crypto.PrivateKey) crypto.PublicKey {
+	switch key := privKey.(type) {
+	case *rsa.PrivateKey:
+		return &key.PublicKey
+	case *envelopeenc.X25519PrivateKey:
+		return &key.PublicKey
+	default:
+		panic(fmt.Errorf("unsupported private key type: %T", privKey))
+	}
+}
+
+// independent copy, so it stays usable even if the original gets zeroed. caller should
+// zero it after use
+func clonePrivateKey(privKey crypto.PrivateKey) (crypto.PrivateKey, error) {
+	privKeyPem, err := marshalPrivateKeyPem(privKey)
+	if err != nil {
+		return nil, err
+	}
+	defer securebuf.Zero(privKeyPem)
+
+	block, _ := pem.Decode(privKeyPem)
+	if block == nil {
+		return nil, errors.New("clonePrivateKey: no PEM block found")
+	}
+	defer securebuf.Zero(block.Bytes)
+
+	return parsePrivateKeyPem(block)
+}
+
+func zeroPrivateKeys(privKeys []crypto.PrivateKey) {
+	for _, privKey := range privKeys {
+		securebuf.ZeroPrivateKey(privKey)
+	}
+}
+
+func zeroMacKeys(macKeys map[string][]byte) {
+	for _, macKey := range macKeys {
+		securebuf.Zero(macKey)
+	}
+}
+
+// sorted by key id, so the output is deterministic
+func marshalMacKeysPem(macKeys map[string][]byte) []byte {
+	keyIds := []string{}
+	for keyId := range macKeys {
+		keyIds = append(keyIds, keyId)
+	}
+	sort.Strings(keyIds)
+
+	macKeysPem := []byte{}
+	for _, keyId := range keyIds {
+		macKeysPem = append(macKeysPem, pem.EncodeToMemory(&pem.Block{
+			Type:    pemTypeEventLogMacKey,
+			Headers: map[string]string{pemHeaderKeyId: keyId},
+			Bytes:   macKeys[keyId],
+		})...)
+	}
+
+	return macKeysPem
+}
+
+func eventLogMacKeyFor(privKey crypto.PrivateKey) []byte {
+	var keyMaterial []byte
+	switch key := privKey.(type) {
+	case *rsa.PrivateKey:
+		keyMaterial = x509.MarshalPKCS1PrivateKey(key)
+	case *envelopeenc.X25519PrivateKey:
+		keyMaterial = key.Bytes()
+	default:
+		panic(fmt.Errorf("unsupported private key type: %T", privKey))
+	}
+	defer securebuf.Zero(keyMaterial)
+
+	// don't use the private key directly
+	kdf := hmac.New(sha256.New, keyMaterial)
+	_, _ = kdf.Write([]byte("eventlog-mac"))
+	return kdf.Sum(nil)
+}
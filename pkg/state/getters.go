@@ -6,8 +6,7 @@ import (
 	"github.com/function61/gokit/mac"
 	"github.com/function61/passitron/pkg/apitypes"
 	"github.com/function61/passitron/pkg/domain"
-	"github.com/pquerna/otp"
-	"github.com/pquerna/otp/totp"
+	"github.com/function61/passitron/pkg/otptoken"
 	"strings"
 	"time"
 )
@@ -164,28 +163,66 @@ func (s *UserStorage) SearchFolders(query string) []apitypes.Folder {
 	return matches
 }
 
+// for HOTP the URL has our current counter, so the token can be moved elsewhere
 func (s *UserStorage) DecryptOtpProvisioningUrl(secret InternalSecret) (string, error) {
+	otpProvisioningUrl, token, err := s.decryptOtpToken(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return otptoken.ExportUrl(otpProvisioningUrl, token)
+}
+
+func (s *UserStorage) DecryptOtpToken(secret InternalSecret) (*otptoken.Token, error) {
+	_, token, err := s.decryptOtpToken(secret)
+	return token, err
+}
+
+func (s *UserStorage) decryptOtpToken(secret InternalSecret) (string, *otptoken.Token, error) {
 	// could be dangerous to expose other secret material as "otp provisioning URL"
 	if secret.Kind != domain.SecretKindOtpToken {
-		return "", errors.New("DecryptOtpProvisioningUrl with invalid kind")
+		return "", nil, errors.New("DecryptOtpProvisioningUrl with invalid kind")
+	}
+
+	otpProvisioningUrl, err := s.decryptString(secret)
+	if err != nil {
+		return "", nil, err
+	}
+
+	token, err := otptoken.Parse(otpProvisioningUrl)
+	if err != nil {
+		return "", nil, err
 	}
 
-	otpProvisioningUrl, err := s.crypto.Decrypt(secret.Envelope)
+	// the URL has the counter the token was added with
+	if token.Kind == otptoken.KindHotp && secret.hotpCounter != nil {
+		token.Counter = uint64(*secret.hotpCounter)
+	}
+
+	return otpProvisioningUrl, token, nil
+}
+
+// for secrets that end up in API responses. strings cannot be zeroed, but at least the
+// plaintext bytes don't outlive this
+func (s *UserStorage) decryptString(secret InternalSecret) (string, error) {
+	plaintext, err := s.DecryptSecret(secret)
 	if err != nil {
 		return "", err
 	}
+	defer plaintext.Destroy()
 
-	return string(otpProvisioningUrl), nil
+	return string(plaintext.Bytes()), nil
 }
 
 func (s *UserStorage) DecryptKeylist(secret InternalSecret) ([]domain.AccountKeylistAddedKeysItem, error) {
-	keylistJson, err := s.crypto.Decrypt(secret.Envelope)
+	keylistJson, err := s.DecryptSecret(secret)
 	if err != nil {
 		return nil, err
 	}
+	defer keylistJson.Destroy()
 
 	keys := []domain.AccountKeylistAddedKeysItem{}
-	if err := json.Unmarshal(keylistJson, &keys); err != nil {
+	if err := json.Unmarshal(keylistJson.Bytes(), &keys); err != nil {
 		return nil, err
 	}
 
@@ -202,51 +239,57 @@ func (s *UserStorage) DecryptSecrets(
 	for _, internalSecret := range secrets {
 		otpProof := ""
 		otpKeyExportMac := ""
-		note := []byte{}
-		password := []byte{}
+		var otpCounter *int
+		attachmentDownloadMac := ""
+		note := ""
+		password := ""
 
 		var err error
 
-		switch domain.SecretKindExhaustive97ac5d(internalSecret.Kind) {
+		switch domain.SecretKindExhaustive86cfe7(internalSecret.Kind) {
 		case domain.SecretKindNote:
-			note, err = s.crypto.Decrypt(internalSecret.Envelope)
+			note, err = s.decryptString(internalSecret)
 			if err != nil {
 				return nil, err
 			}
 		case domain.SecretKindPassword:
-			password, err = s.crypto.Decrypt(internalSecret.Envelope)
+			password, err = s.decryptString(internalSecret)
 			if err != nil {
 				return nil, err
 			}
 		case domain.SecretKindOtpToken:
-			otpProvisioningUrl, err := s.DecryptOtpProvisioningUrl(internalSecret)
+			token, err := s.DecryptOtpToken(internalSecret)
 			if err != nil {
 				return nil, err
 			}
 
-			key, err := otp.NewKeyFromURL(otpProvisioningUrl)
-			if err != nil {
-				return nil, err
-			}
+			otpProof = token.Code(otpProofTime)
 
-			otpProof, err = totp.GenerateCode(key.Secret(), otpProofTime)
-			if err != nil {
-				return nil, err
+			// HOTP code is consumed by exposing it. caller must advance the counter
+			if token.Kind == otptoken.KindHotp {
+				counter := int(token.Counter)
+				otpCounter = &counter
 			}
 
 			otpKeyExportMac = s.OtpKeyExportMac(&internalSecret).Sign()
 		case domain.SecretKindSshKey:
-			// special handling elsewhere, never exposed to UI
+			// special handling elsewhere, never exposed to UI. generated ones (NonExportable)
+			// aren't even exported to KeePass
 		case domain.SecretKindKeylist:
 			// special handling elsewhere
 		case domain.SecretKindExternalToken:
 			// informational - there's no secret
+		case domain.SecretKindAttachment:
+			// content is streamed separately, as it can be big
+			attachmentDownloadMac = s.AttachmentDownloadMac(&internalSecret).Sign()
 		}
 
 		exposed = append(exposed, apitypes.ExposedSecret{
-			OtpProof:        otpProof,
-			OtpProofTime:    otpProofTime,
-			OtpKeyExportMac: otpKeyExportMac,
+			OtpProof:              otpProof,
+			OtpProofTime:          otpProofTime,
+			OtpCounter:            otpCounter,
+			OtpKeyExportMac:       otpKeyExportMac,
+			AttachmentDownloadMac: attachmentDownloadMac,
 			Secret: apitypes.Secret{
 				Id:                     internalSecret.Id,
 				Kind:                   internalSecret.Kind,
@@ -255,8 +298,14 @@ func (s *UserStorage) DecryptSecrets(
 				ExternalTokenKind:      internalSecret.externalTokenKind,
 				KeylistKeyExample:      internalSecret.keylistKeyExample,
 				SshPublicKeyAuthorized: internalSecret.SshPublicKeyAuthorized,
-				Note:                   string(note),
-				Password:               string(password),
+				Note:                   note,
+				Password:               password,
+				Filename:               internalSecret.AttachmentFilename,
+				Size:                   internalSecret.AttachmentSize,
+				NonExportable:          internalSecret.NonExportable,
+				SshCa:                  internalSecret.SshCa,
+				PasswordPolicy:         internalSecret.PasswordPolicy,
+				Breached:               internalSecret.Breached,
 			},
 		})
 	}
@@ -290,13 +339,6 @@ func UnwrapAccounts(iaccounts []InternalAccount) []apitypes.Account {
 	return accounts
 }
 
-func (s *UserStorage) AuditLog() []apitypes.AuditlogEntry {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	return s.auditLog
-}
-
 func (s *UserStorage) S3ExportDetails() *S3ExportDetails {
 	s.mu.Lock()
 	defer s.mu.Unlock()
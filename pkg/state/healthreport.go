@@ -0,0 +1,123 @@
+package state
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/gokit/cryptorandombytes"
+	"github.com/function61/passitron/pkg/apitypes"
+	"github.com/function61/passitron/pkg/domain"
+	"github.com/function61/passitron/pkg/passwordgen"
+	"sort"
+	"time"
+)
+
+// estimates are rough upper bounds, so this only catches the clearly weak ones
+const weakBelowEntropyBits = 60
+
+// the report has no plaintexts. reuse is detected by comparing keyed hashes, and the key
+// only lives for the duration of building the report. returns audit events for the
+// passwords that were looked at. needs the decryption key to be unlocked
+func (s *UserStorage) HealthReport(
+	maxAge time.Duration,
+	meta ehevent.EventMeta,
+) (*apitypes.HealthReport, []ehevent.Event, error) {
+	reuseHashKey := []byte(cryptorandombytes.Base64Url(32))
+
+	report := &apitypes.HealthReport{
+		MaxAgeDays:           int(maxAge / (24 * time.Hour)),
+		WeakBelowEntropyBits: weakBelowEntropyBits,
+		Reused:               []apitypes.ReusedPasswordGroup{},
+		Weak:                 []apitypes.PasswordHealth{},
+		Old:                  []apitypes.PasswordHealth{},
+		Breached:             []apitypes.PasswordHealth{},
+	}
+
+	auditEvents := []ehevent.Event{}
+
+	reuseGroups := map[string][]apitypes.PasswordHealth{} // keyed by keyed hash
+	reuseHashesInOrder := []string{}
+
+	waccs := s.WrappedAccounts()
+	sort.Slice(waccs, func(i, j int) bool { return waccs[i].Account.Title < waccs[j].Account.Title })
+
+	for _, wacc := range waccs {
+		checkedSecretIds := []string{}
+
+		for _, secret := range wacc.Secrets {
+			if secret.Kind != domain.SecretKindPassword {
+				continue
+			}
+
+			password, err := s.DecryptSecret(secret)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			reuseHash := hmac.New(sha256.New, reuseHashKey)
+			reuseHash.Write(password.Bytes())
+			reuseHashStr := string(reuseHash.Sum(nil))
+
+			entropyBits := passwordEntropyBits(secret, password.Bytes())
+			password.Destroy()
+
+			health := apitypes.PasswordHealth{
+				AccountId:    wacc.Account.Id,
+				AccountTitle: wacc.Account.Title,
+				SecretId:     secret.Id,
+				SecretTitle:  secret.Title,
+				Created:      secret.created,
+				EntropyBits:  entropyBits,
+			}
+
+			if _, seen := reuseGroups[reuseHashStr]; !seen {
+				reuseHashesInOrder = append(reuseHashesInOrder, reuseHashStr)
+			}
+			reuseGroups[reuseHashStr] = append(reuseGroups[reuseHashStr], health)
+
+			if entropyBits < weakBelowEntropyBits {
+				report.Weak = append(report.Weak, health)
+			}
+
+			if meta.Timestamp.Sub(secret.created) > maxAge {
+				report.Old = append(report.Old, health)
+			}
+
+			if secret.Breached {
+				report.Breached = append(report.Breached, health)
+			}
+
+			checkedSecretIds = append(checkedSecretIds, secret.Id)
+		}
+
+		if len(checkedSecretIds) > 0 {
+			auditEvents = append(auditEvents, domain.NewAccountSecretUsed(
+				wacc.Account.Id,
+				checkedSecretIds,
+				domain.SecretUsedTypePasswordHealthChecked,
+				"",
+				meta))
+		}
+	}
+
+	for _, reuseHash := range reuseHashesInOrder {
+		if passwords := reuseGroups[reuseHash]; len(passwords) > 1 {
+			report.Reused = append(report.Reused, apitypes.ReusedPasswordGroup{
+				Passwords: passwords,
+			})
+		}
+	}
+
+	return report, auditEvents, nil
+}
+
+// for passwords we generated, we know the entropy exactly
+func passwordEntropyBits(secret InternalSecret, password []byte) int {
+	if secret.PasswordPolicy != "" {
+		if policy, err := passwordgen.PolicyByName(secret.PasswordPolicy); err == nil {
+			return policy.EntropyBits()
+		}
+	}
+
+	return passwordgen.EstimateEntropyBits(password)
+}
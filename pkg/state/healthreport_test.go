@@ -0,0 +1,72 @@
+package state
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/eventhorizon/pkg/ehreader/ehreadertest"
+	"github.com/function61/gokit/assert"
+	"github.com/function61/passitron/pkg/domain"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthReport(t *testing.T) {
+	tc := &testContext{
+		user:     newUserStorage(ehreader.TenantId("42")),
+		eventLog: ehreadertest.NewEventLog(),
+		ctx:      context.Background(),
+	}
+
+	tc.reader = ehreader.New(tc.user, tc.eventLog, nil)
+
+	setupUser(t, tc)
+	unlockDecryptionKey(t, tc)
+	addAccount(t, tc)
+
+	t1 := t0.Add(400 * 24 * time.Hour)
+
+	addPassword := func(id string, password string, policy string, created time.Time) {
+		tc.appendAndLoad(domain.NewAccountPasswordAdded(
+			testAccId,
+			id,
+			"",
+			tc.encrypt(password, id, domain.SecretKindPassword),
+			policy,
+			ehevent.Meta(created, joonasUid)))
+	}
+
+	addPassword("old", "hunter2", "", t0)
+	addPassword("reused", "hunter2", "", t1)
+	addPassword("generated", "Kx3-b9_mQ.zT7!pW", "default", t1)
+
+	report, auditEvents, err := tc.user.HealthReport(365*24*time.Hour, ehevent.Meta(t1, joonasUid))
+	assert.Ok(t, err)
+
+	assert.Assert(t, report.MaxAgeDays == 365)
+
+	assert.Assert(t, len(report.Reused) == 1)
+	assert.Assert(t, len(report.Reused[0].Passwords) == 2)
+	assert.EqualString(t, report.Reused[0].Passwords[0].SecretId, "old")
+	assert.EqualString(t, report.Reused[0].Passwords[1].SecretId, "reused")
+
+	assert.Assert(t, len(report.Weak) == 2)
+	assert.Assert(t, report.Weak[0].EntropyBits == 36)
+
+	assert.Assert(t, len(report.Old) == 1)
+	assert.EqualString(t, report.Old[0].SecretId, "old")
+
+	assert.Assert(t, len(report.Breached) == 0)
+
+	assert.Assert(t, len(auditEvents) == 1)
+	secretUsed := auditEvents[0].(*domain.AccountSecretUsed)
+	assert.EqualString(t, string(secretUsed.Type), string(domain.SecretUsedTypePasswordHealthChecked))
+	assert.EqualString(t, strings.Join(secretUsed.Secrets, ","), "old,reused,generated")
+
+	reportJson, err := json.Marshal(report)
+	assert.Ok(t, err)
+	assert.Assert(t, !strings.Contains(string(reportJson), "hunter2"))
+	assert.Assert(t, !strings.Contains(string(reportJson), "Kx3-b9_mQ.zT7!pW"))
+}
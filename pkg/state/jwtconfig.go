@@ -1,8 +1,6 @@
 package state
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
 	"errors"
 	"github.com/function61/eventhorizon/pkg/ehevent"
 	"github.com/function61/gokit/fileexists"
@@ -64,12 +62,18 @@ func InitConfig(adminUsername string, adminPassword string) error {
 		AuthenticatorKey: string(pubKeyPem),
 	}
 
-	if err := writeJwtConfig(cfg); err != nil {
+	state, err := open(cfg, nil)
+	if err != nil {
 		return err
 	}
+	defer state.Close()
 
-	state, err := New(nil)
-	if err != nil {
+	// don't leave a config behind if we refuse to init
+	if len(state.UserIds()) > 0 {
+		return errors.New("event log already contains users")
+	}
+
+	if err := writeJwtConfig(cfg); err != nil {
 		return err
 	}
 
@@ -97,12 +101,7 @@ func createAdminUser(adminUsername string, adminPassword string, state *AppState
 		false,
 		meta)
 
-	privKey, err := rsa.GenerateKey(rand.Reader, 4096)
-	if err != nil {
-		return err
-	}
-
-	decryptionKeyChanged, err := ExportPrivateKeyWithPassword(privKey, adminPassword, meta)
+	decryptionKeyChanged, err := NewDecryptionKey(adminPassword, meta)
 	if err != nil {
 		return err
 	}
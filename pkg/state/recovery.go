@@ -0,0 +1,369 @@
+package state
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/passitron/pkg/apitypes"
+	"github.com/function61/passitron/pkg/domain"
+	"github.com/function61/passitron/pkg/envelopeenc"
+	"github.com/function61/passitron/pkg/securebuf"
+	"github.com/function61/passitron/pkg/shamir"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recovery shares let the user regain access to the decryption key if the password is
+// forgotten. a random recovery key is split with Shamir's secret sharing, and the
+// decryption key is stored encrypted for that recovery key (an X25519 key pair).
+//
+// share text format: passitron-share-v1:<set id>:<threshold>:<base32(share)>
+
+const (
+	recoverySharePrefix = "passitron-share-v1"
+)
+
+var (
+	ErrRecoveryNotConfigured = errors.New("recovery shares have not been created")
+
+	recoveryDecryptionKeyAssociatedData = []byte(`["recoveryDecryptionKey"]`)
+	recoverySharesAssociatedData        = []byte(`["recoveryShares"]`)
+
+	shareEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+)
+
+type recoveryDetails struct {
+	PublicKey              string // recovery key's public key PEM
+	DecryptionKeyEncrypted []byte // envelope(pem(decryption key)) for recovery key
+	SharesEncrypted        []byte // envelope(json(share texts)) for decryption key, so they can be re-printed
+	Threshold              int
+	ShareCount             int
+	Created                time.Time
+}
+
+// splits a new recovery key into shares. requires the decryption key to be unlocked
+func (c *cryptoThingie) CreateRecoveryShares(
+	threshold int,
+	shareCount int,
+	meta ehevent.EventMeta,
+) (*domain.UserRecoverySharesCreated, error) {
+	keys, err := c.unlockedKeys()
+	if err != nil {
+		return nil, err
+	}
+	defer zeroPrivateKeys(keys)
+
+	recoveryKeyBytes := securebuf.New(32)
+	defer recoveryKeyBytes.Destroy()
+	if _, err := rand.Read(recoveryKeyBytes.Bytes()); err != nil {
+		return nil, err
+	}
+
+	recoveryKey, err := envelopeenc.NewX25519PrivateKey(recoveryKeyBytes.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer recoveryKey.Zero()
+
+	shares, err := shamir.Split(recoveryKeyBytes.Bytes(), shareCount, threshold)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroShares(shares)
+
+	setId := recoverySetId(&recoveryKey.PublicKey)
+
+	shareTexts := []string{}
+	for _, share := range shares {
+		shareTexts = append(shareTexts, strings.Join([]string{
+			recoverySharePrefix,
+			setId,
+			strconv.Itoa(threshold),
+			shareEncoding.EncodeToString(share),
+		}, ":"))
+	}
+
+	decryptionKeyEncrypted, err := encryptDecryptionKeyForRecovery(keys[0], &recoveryKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sharesJson, err := json.Marshal(shareTexts)
+	if err != nil {
+		return nil, err
+	}
+	defer securebuf.Zero(sharesJson)
+
+	sharesEnvelope, err := envelopeenc.Encrypt(
+		sharesJson,
+		[]crypto.PublicKey{c.publicKey},
+		recoverySharesAssociatedData)
+	if err != nil {
+		return nil, err
+	}
+
+	sharesEncrypted, err := sharesEnvelope.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryPubPem, err := marshalPublicKeyPem(&recoveryKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return domain.NewUserRecoverySharesCreated(
+		string(recoveryPubPem),
+		decryptionKeyEncrypted,
+		sharesEncrypted,
+		threshold,
+		shareCount,
+		meta), nil
+}
+
+// shares that were handed out, for re-printing. nil if recovery shares were not created
+func (s *UserStorage) RecoveryShares() (*apitypes.RecoveryShares, error) {
+	recovery := s.recoveryDetails()
+	if recovery == nil {
+		return nil, nil
+	}
+
+	keys, err := s.crypto.unlockedKeys()
+	if err != nil {
+		return nil, err
+	}
+	defer zeroPrivateKeys(keys)
+
+	env, err := envelopeenc.Unmarshal(recovery.SharesEncrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	sharesJson, err := env.Decrypt(keys[0], recoverySharesAssociatedData)
+	if err != nil {
+		return nil, err
+	}
+	defer securebuf.Zero(sharesJson)
+
+	shares := []string{}
+	if err := json.Unmarshal(sharesJson, &shares); err != nil {
+		return nil, err
+	}
+
+	return &apitypes.RecoveryShares{
+		Created:   recovery.Created,
+		Threshold: recovery.Threshold,
+		Shares:    shares,
+	}, nil
+}
+
+// combines the shares to the recovery key, with which the decryption key is unlocked and
+// then protected by a new password
+func (s *UserStorage) RecoverDecryptionKey(
+	shareTexts []string,
+	newPassword string,
+	meta ehevent.EventMeta,
+) (*domain.UserDecryptionKeyPasswordChanged, error) {
+	recovery := s.recoveryDetails()
+	if recovery == nil {
+		return nil, ErrRecoveryNotConfigured
+	}
+
+	recoveryPub, err := parsePublicKeyPem([]byte(recovery.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryX25519Pub, ok := recoveryPub.(*envelopeenc.X25519PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("unsupported recovery key type: %T", recoveryPub)
+	}
+
+	shares, err := parseRecoveryShares(shareTexts, recoverySetId(recoveryX25519Pub))
+	if err != nil {
+		return nil, err
+	}
+	defer zeroShares(shares)
+
+	if len(shares) < recovery.Threshold {
+		return nil, fmt.Errorf("need %d shares, got %d", recovery.Threshold, len(shares))
+	}
+
+	recoveryKeyBytes, err := shamir.Combine(shares)
+	if err != nil {
+		return nil, err
+	}
+	defer securebuf.Zero(recoveryKeyBytes)
+
+	recoveryKey, err := envelopeenc.NewX25519PrivateKey(recoveryKeyBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer recoveryKey.Zero()
+
+	if recoveryKey.PublicKey != *recoveryX25519Pub {
+		return nil, errors.New("shares did not combine to the recovery key. corrupted share?")
+	}
+
+	env, err := envelopeenc.Unmarshal(recovery.DecryptionKeyEncrypted)
+	if err != nil {
+		return nil, err
+	}
+
+	privKeyPem, err := env.Decrypt(recoveryKey, recoveryDecryptionKeyAssociatedData)
+	if err != nil {
+		return nil, err
+	}
+	defer securebuf.Zero(privKeyPem)
+
+	privKeyBlock, _ := pem.Decode(privKeyPem)
+	if privKeyBlock == nil {
+		return nil, errors.New("RecoverDecryptionKey: no PEM block found")
+	}
+	defer securebuf.Zero(privKeyBlock.Bytes)
+
+	privKey, err := parsePrivateKeyPem(privKeyBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.crypto.unlockWithPrivateKey(privKey); err != nil {
+		securebuf.ZeroPrivateKey(privKey)
+		return nil, fmt.Errorf("RecoverDecryptionKey: %w", err)
+	}
+
+	return s.crypto.ChangeDecryptionKeyPassword(newPassword, meta)
+}
+
+// recovery key must get access to the rotated decryption key. nil if recovery shares
+// were not created
+func (s *UserStorage) RewrapRecovery(
+	rotation *KeyRotation,
+	meta ehevent.EventMeta,
+) (*domain.UserRecoveryRewrapped, error) {
+	recovery := s.recoveryDetails()
+	if recovery == nil {
+		return nil, nil
+	}
+
+	recoveryPub, err := parsePublicKeyPem([]byte(recovery.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+
+	decryptionKeyEncrypted, err := encryptDecryptionKeyForRecovery(rotation.newKey, recoveryPub)
+	if err != nil {
+		return nil, err
+	}
+
+	sharesEncrypted, err := rotation.rewrapFor(
+		recovery.SharesEncrypted,
+		[]crypto.PublicKey{publicKeyOf(rotation.newKey)},
+		recoverySharesAssociatedData)
+	if err != nil {
+		return nil, err
+	}
+
+	return domain.NewUserRecoveryRewrapped(decryptionKeyEncrypted, sharesEncrypted, meta), nil
+}
+
+func (s *UserStorage) recoveryDetails() *recoveryDetails {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.recovery
+}
+
+// for when the key was obtained some other way than by password
+func (c *cryptoThingie) unlockWithPrivateKey(privKey crypto.PrivateKey) error {
+	pubKeyPem, err := marshalPublicKeyPem(publicKeyOf(privKey))
+	if err != nil {
+		return err
+	}
+
+	if string(pubKeyPem) != c.publicKeyPem {
+		return errors.New("private key is not for current public key")
+	}
+
+	previousKeys, previousMacKeys, err := decryptPreviousKeys(c.previousKeysEncrypted, privKey)
+	if err != nil {
+		return fmt.Errorf("previous keys: %w", err)
+	}
+
+	// already unlocked is fine, since it's the same key (ours just gets zeroed then)
+	_ = c.setUnlocked(privKey, previousKeys, previousMacKeys, nil, time.Now())
+
+	return nil
+}
+
+func encryptDecryptionKeyForRecovery(privKey crypto.PrivateKey, recoveryPub crypto.PublicKey) ([]byte, error) {
+	privKeyPem, err := marshalPrivateKeyPem(privKey)
+	if err != nil {
+		return nil, err
+	}
+	defer securebuf.Zero(privKeyPem)
+
+	env, err := envelopeenc.Encrypt(
+		privKeyPem,
+		[]crypto.PublicKey{recoveryPub},
+		recoveryDecryptionKeyAssociatedData)
+	if err != nil {
+		return nil, err
+	}
+
+	return env.Marshal()
+}
+
+func zeroShares(shares [][]byte) {
+	for _, share := range shares {
+		securebuf.Zero(share)
+	}
+}
+
+// identifies shares that belong together, so that shares from an old set are not mixed in
+func recoverySetId(recoveryPub *envelopeenc.X25519PublicKey) string {
+	digest := sha256.Sum256(recoveryPub[:])
+	return hex.EncodeToString(digest[:4])
+}
+
+// blank lines are skipped, so the shares can be pasted in with extra whitespace
+func parseRecoveryShares(shareTexts []string, expectedSetId string) ([][]byte, error) {
+	shares := [][]byte{}
+
+	// errors identify the share by its position, since its content is key material that
+	// must not end up in API responses or logs
+	for idx, shareText := range shareTexts {
+		shareText = strings.TrimSpace(shareText)
+		if shareText == "" {
+			continue
+		}
+
+		position := idx + 1
+
+		parts := strings.Split(shareText, ":")
+		if len(parts) != 4 || parts[0] != recoverySharePrefix {
+			return nil, fmt.Errorf("share #%d: invalid share format", position)
+		}
+
+		if parts[1] != expectedSetId {
+			return nil, fmt.Errorf("share #%d: share is not from the current set of shares", position)
+		}
+
+		share, err := shareEncoding.DecodeString(strings.ToUpper(parts[3]))
+		if err != nil {
+			return nil, fmt.Errorf("share #%d: invalid share: %w", position, err)
+		}
+
+		shares = append(shares, share)
+	}
+
+	return shares, nil
+}
@@ -0,0 +1,337 @@
+package state
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/passitron/pkg/apitypes"
+	"github.com/function61/passitron/pkg/domain"
+	"github.com/function61/passitron/pkg/ehfilelog"
+	"strings"
+	"time"
+)
+
+// bump this whenever the structure (or meaning) of the projection changes, so stale
+// snapshots get ignored and the projection is rebuilt with a full replay instead
+const snapshotVersion = 14
+
+var (
+	errSnapshotVersionMismatch = errors.New("snapshot version mismatch")
+	errSnapshotChainMismatch   = errors.New("snapshot not made from this event log (hash chain mismatch)")
+	errSnapshotMacMismatch     = errors.New("snapshot MAC mismatch")
+)
+
+// interface assertion
+var _ ehreader.EventsProcessorSnapshotCapability = (*UserStorage)(nil)
+
+type userStorageSnapshot struct {
+	Version         int
+	User            *SensitiveUser
+	Accounts        []accountSnapshot
+	AccountKeys     map[string][]string
+	Folders         []*apitypes.Folder
+	U2FTokens       []*U2FToken
+	Crypto          *cryptoSnapshot
+	AuditLog        []apitypes.AuditlogEntry
+	S3ExportDetails *S3ExportDetails
+	Recovery        *recoveryDetails
+	AutoSeal        autoSealConfig
+}
+
+type accountSnapshot struct {
+	Account apitypes.Account
+	Secrets []secretSnapshot
+}
+
+// InternalSecret has unexported fields, so it cannot be serialized as-is
+type secretSnapshot struct {
+	Id                     string
+	Created                time.Time
+	Title                  string
+	SshPublicKeyAuthorized string
+	ExternalTokenKind      *domain.ExternalTokenKind
+	KeylistKeyExample      string
+	AttachmentFilename     string
+	AttachmentSize         int
+	NonExportable          bool
+	SshCa                  bool
+	HotpCounter            *int
+	PasswordPolicy         string
+	Breached               bool
+	Kind                   domain.SecretKind
+	Envelope               []byte
+}
+
+// decryption key is never included in unlocked form
+type cryptoSnapshot struct {
+	PublicKey             string
+	PrivateKeyEncrypted   []byte
+	PreviousKeysEncrypted []byte
+}
+
+// version of the stream that the projection has seen
+func (l *UserStorage) version() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.cursor.Version()
+}
+
+func (l *UserStorage) Snapshot() (*ehreader.Snapshot, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	accounts := []accountSnapshot{}
+	for _, acc := range l.accounts {
+		secrets := []secretSnapshot{}
+		for _, secret := range acc.Secrets {
+			secrets = append(secrets, secretSnapshot{
+				Id:                     secret.Id,
+				Created:                secret.created,
+				Title:                  secret.Title,
+				SshPublicKeyAuthorized: secret.SshPublicKeyAuthorized,
+				ExternalTokenKind:      secret.externalTokenKind,
+				KeylistKeyExample:      secret.keylistKeyExample,
+				AttachmentFilename:     secret.AttachmentFilename,
+				AttachmentSize:         secret.AttachmentSize,
+				NonExportable:          secret.NonExportable,
+				SshCa:                  secret.SshCa,
+				HotpCounter:            secret.hotpCounter,
+				PasswordPolicy:         secret.PasswordPolicy,
+				Breached:               secret.Breached,
+				Kind:                   secret.Kind,
+				Envelope:               secret.Envelope,
+			})
+		}
+
+		accounts = append(accounts, accountSnapshot{
+			Account: acc.Account,
+			Secrets: secrets,
+		})
+	}
+
+	var crypto *cryptoSnapshot
+	if l.crypto != nil {
+		crypto = &cryptoSnapshot{
+			PublicKey:             l.crypto.publicKeyPem,
+			PrivateKeyEncrypted:   l.crypto.privateKeyEncrypted,
+			PreviousKeysEncrypted: l.crypto.previousKeysEncrypted,
+		}
+	}
+
+	data, err := json.Marshal(&userStorageSnapshot{
+		Version:         snapshotVersion,
+		User:            l.sUser,
+		Accounts:        accounts,
+		AccountKeys:     l.accountKeys,
+		Folders:         l.folders,
+		U2FTokens:       l.u2FTokens,
+		Crypto:          crypto,
+		AuditLog:        l.auditLog,
+		S3ExportDetails: l.s3ExportDetails,
+		Recovery:        l.recovery,
+		AutoSeal:        l.autoSeal,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ehreader.NewSnapshot(l.cursor, data), nil
+}
+
+func (l *UserStorage) InstallSnapshot(snap *ehreader.Snapshot) error {
+	if snap.Cursor.Stream() != l.cursor.Stream() {
+		return fmt.Errorf(
+			"InstallSnapshot: expected stream %s, got %s",
+			l.cursor.Stream(),
+			snap.Cursor.Stream())
+	}
+
+	s := userStorageSnapshot{}
+	if err := json.Unmarshal(snap.Data, &s); err != nil {
+		return fmt.Errorf("InstallSnapshot: %w", err)
+	}
+
+	// check before mutating anything, so the caller can fall back to a full replay
+	if s.Version != snapshotVersion {
+		return fmt.Errorf(
+			"InstallSnapshot: %w: got %d, expected %d",
+			errSnapshotVersionMismatch,
+			s.Version,
+			snapshotVersion)
+	}
+
+	var crypto *cryptoThingie
+	var macKey []byte
+	if s.Crypto != nil {
+		var err error
+		crypto, err = newCryptoThingie(s.Crypto.PublicKey, s.Crypto.PrivateKeyEncrypted)
+		if err != nil {
+			return fmt.Errorf("InstallSnapshot: %w", err)
+		}
+
+		crypto.previousKeysEncrypted = s.Crypto.PreviousKeysEncrypted
+
+		macKey = macKeyFromPrivateKeyEncrypted(s.Crypto.PrivateKeyEncrypted)
+	}
+
+	accountKeys := s.AccountKeys
+	if accountKeys == nil {
+		accountKeys = map[string][]string{}
+	}
+
+	accounts := map[string]*InternalAccount{}
+	for _, acc := range s.Accounts {
+		secrets := []InternalSecret{}
+		for _, secret := range acc.Secrets {
+			secrets = append(secrets, InternalSecret{
+				Id:                     secret.Id,
+				accountId:              acc.Account.Id,
+				created:                secret.Created,
+				Title:                  secret.Title,
+				SshPublicKeyAuthorized: secret.SshPublicKeyAuthorized,
+				externalTokenKind:      secret.ExternalTokenKind,
+				keylistKeyExample:      secret.KeylistKeyExample,
+				AttachmentFilename:     secret.AttachmentFilename,
+				AttachmentSize:         secret.AttachmentSize,
+				NonExportable:          secret.NonExportable,
+				SshCa:                  secret.SshCa,
+				hotpCounter:            secret.HotpCounter,
+				PasswordPolicy:         secret.PasswordPolicy,
+				Breached:               secret.Breached,
+				Kind:                   secret.Kind,
+				Envelope:               secret.Envelope,
+			})
+		}
+
+		accounts[acc.Account.Id] = &InternalAccount{
+			Account: acc.Account,
+			Secrets: secrets,
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.cursor = snap.Cursor
+	l.sUser = s.User
+	l.accounts = accounts
+	l.accountKeys = accountKeys
+	l.folders = s.Folders
+	l.u2FTokens = s.U2FTokens
+	l.crypto = crypto
+	l.macKey = macKey
+	l.auditLog = s.AuditLog
+	l.s3ExportDetails = s.S3ExportDetails
+	l.recovery = s.Recovery
+	l.autoSeal = s.AutoSeal
+
+	return nil
+}
+
+// events that auth data (what signing in and unlocking are checked against) is derived from.
+// they're replayed from the log even when starting from a snapshot, because the snapshot's
+// MAC can only be verified after the user has signed in and unlocked.
+var authEventTypes = map[string]bool{
+	"user.PasswordUpdated":              true,
+	"user.AccessTokenAdded":             true,
+	"user.U2FTokenRegistered":           true,
+	"user.U2FTokenUsed":                 true,
+	"user.DecryptionKeyPasswordChanged": true,
+	"user.DecryptionKeyRotated":         true,
+	"user.AutoSealConfigured":           true,
+	"user.RecoverySharesCreated":        true,
+	"user.RecoveryRewrapped":            true,
+}
+
+// replaces auth data with that of authData (see authEventTypes)
+func (l *UserStorage) adoptAuthData(authData *UserStorage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sUser = authData.sUser
+	l.u2FTokens = authData.u2FTokens
+	l.crypto = authData.crypto
+	l.macKey = authData.macKey
+	l.recovery = authData.recovery
+	l.autoSeal = authData.autoSeal
+}
+
+// "<time> <event> ..." => "<event>". see ehevent.Serialize()
+func eventTypeOfLine(line string) string {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// snapshot as stored. binds the projection's data to the event log it was made from:
+// ChainHash is the log's hash chain hash at the snapshot's cursor, and Mac covers both it
+// and the data. the MAC is made with the user's event log MAC key, so someone with just
+// disk access cannot forge snapshots. the key is only available while the user's decryption
+// key is unlocked, so the MAC of a snapshot installed while locked is verified on unlock.
+type sealedSnapshot struct {
+	ChainHash []byte
+	MacKeyId  string
+	Mac       []byte
+	Data      []byte // userStorageSnapshot
+}
+
+func sealSnapshot(
+	snap *ehreader.Snapshot,
+	chainHash []byte,
+	macKey *ehfilelog.MacKey,
+) (*ehreader.Snapshot, error) {
+	sealed, err := json.Marshal(&sealedSnapshot{
+		ChainHash: chainHash,
+		MacKeyId:  macKey.Id,
+		Mac:       snapshotMac(macKey.Key, chainHash, snap.Data),
+		Data:      snap.Data,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ehreader.NewSnapshot(snap.Cursor, sealed), nil
+}
+
+// checks that the snapshot was made from the log whose hash at the snapshot's cursor is
+// chainHash. the MAC is not verified here (see verifyMac()).
+func unsealSnapshot(snap *ehreader.Snapshot, chainHash []byte) (*ehreader.Snapshot, *sealedSnapshot, error) {
+	sealed := &sealedSnapshot{}
+	if err := json.Unmarshal(snap.Data, sealed); err != nil {
+		return nil, nil, fmt.Errorf("unsealSnapshot: %w", err)
+	}
+
+	if len(sealed.ChainHash) == 0 || !hmac.Equal(sealed.ChainHash, chainHash) {
+		return nil, nil, fmt.Errorf("unsealSnapshot: %w", errSnapshotChainMismatch)
+	}
+
+	return ehreader.NewSnapshot(snap.Cursor, sealed.Data), sealed, nil
+}
+
+// macKeys are all the event log MAC keys the user has had, by MacKey.Id
+func (s *sealedSnapshot) verifyMac(macKeys map[string][]byte) error {
+	macKey, found := macKeys[s.MacKeyId]
+	if !found || !hmac.Equal(s.Mac, snapshotMac(macKey, s.ChainHash, s.Data)) {
+		return errSnapshotMacMismatch
+	}
+
+	return nil
+}
+
+// chain hash and data hash are of fixed length, so their concatenation is unambiguous
+func snapshotMac(macKey []byte, chainHash []byte, data []byte) []byte {
+	dataHash := sha256.Sum256(data)
+
+	mac := hmac.New(sha256.New, macKey)
+	_, _ = mac.Write([]byte("snapshot:"))
+	_, _ = mac.Write(chainHash)
+	_, _ = mac.Write(dataHash[:])
+	return mac.Sum(nil)
+}
@@ -0,0 +1,45 @@
+package state
+
+import (
+	"context"
+	"github.com/function61/eventhorizon/pkg/ehclient"
+	"github.com/function61/eventhorizon/pkg/ehevent"
+	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/passitron/pkg/domain"
+)
+
+// projection of the users directory stream. its only job is to tell us about new users
+type userDirectory struct {
+	cursor         ehclient.Cursor
+	userDiscovered func(*domain.UserCreated) error
+}
+
+func newUserDirectory(userDiscovered func(*domain.UserCreated) error) *userDirectory {
+	return &userDirectory{
+		cursor:         ehclient.Beginning(usersStream),
+		userDiscovered: userDiscovered,
+	}
+}
+
+func (d *userDirectory) GetEventTypes() ehevent.Allocators {
+	return domain.EventTypes
+}
+
+func (d *userDirectory) ProcessEvents(ctx context.Context, handle ehreader.EventProcessorHandler) error {
+	return handle(
+		d.cursor,
+		func(e ehevent.Event) error { return d.processEvent(e) },
+		func(commit ehclient.Cursor) error {
+			d.cursor = commit
+			return nil
+		})
+}
+
+func (d *userDirectory) processEvent(ev ehevent.Event) error {
+	switch e := ev.(type) {
+	case *domain.UserCreated:
+		return d.userDiscovered(e)
+	default:
+		return ehreader.UnsupportedEventTypeErr(ev)
+	}
+}
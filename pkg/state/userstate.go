@@ -3,19 +3,19 @@ package state
 import (
 	"context"
 	"crypto/sha256"
-	"fmt"
 	"github.com/function61/eventhorizon/pkg/ehclient"
 	"github.com/function61/eventhorizon/pkg/ehevent"
 	"github.com/function61/eventhorizon/pkg/ehreader"
+	"github.com/function61/gokit/logex"
 	"github.com/function61/passitron/pkg/apitypes"
+	"github.com/function61/passitron/pkg/breachcheck"
 	"github.com/function61/passitron/pkg/domain"
 	"sync"
 	"time"
 )
 
 const (
-	stream             = "/pism"
-	maxAuditLogEntries = 30
+	stream = "/pism"
 )
 
 type InternalAccount struct {
@@ -25,13 +25,30 @@ type InternalAccount struct {
 
 type InternalSecret struct {
 	Id                     string
+	accountId              string
 	created                time.Time
 	Title                  string
 	SshPublicKeyAuthorized string
 	externalTokenKind      *domain.ExternalTokenKind
 	keylistKeyExample      string
+	AttachmentFilename     string
+	AttachmentSize         int
+	NonExportable          bool   // SSH keys generated here. only usable for signing
+	SshCa                  bool   // SSH key can issue certificates
+	hotpCounter            *int   // next HOTP counter, if advanced here (otherwise the provisioning URL's)
+	PasswordPolicy         string // generator policy, if password was generated
+	Breached               bool   // password found in dataset of breached passwords
 	Kind                   domain.SecretKind
-	Envelope               []byte // depending on Kind: password | secret note | OTP provisioning URL | SSH key
+	Envelope               []byte // depending on Kind: password | secret note | OTP provisioning URL | SSH key | attachment's content key
+}
+
+// what the secret's envelope is bound to
+func (s InternalSecret) EnvelopeContext() SecretContext {
+	return SecretContext{
+		AccountId: s.accountId,
+		SecretId:  s.Id,
+		Kind:      s.Kind,
+	}
 }
 
 type U2FToken struct {
@@ -62,18 +79,27 @@ type UserStorage struct {
 	mu              sync.Mutex
 	sUser           *SensitiveUser
 	accounts        map[string]*InternalAccount
+	accountKeys     map[string][]string // account id => public key PEMs, latest last
+	accountKeyStore AccountKeyStore     // nil if not available
+	blobStore       BlobStore           // nil if not available
+	breachedPwds    breachcheck.Dataset // nil if not available
 	folders         []*apitypes.Folder
 	u2FTokens       []*U2FToken
 	crypto          *cryptoThingie
 	auditLog        []apitypes.AuditlogEntry
 	s3ExportDetails *S3ExportDetails
+	recovery        *recoveryDetails
+	autoSeal        autoSealConfig
 	macKey          []byte
+	audited         func(apitypes.AuditlogEntry) // optional
+	logl            *logex.Leveled
 }
 
 func newUserStorage(tenant ehreader.Tenant) *UserStorage {
 	return &UserStorage{
-		cursor:   ehclient.Beginning(tenant.Stream(stream)),
-		accounts: map[string]*InternalAccount{},
+		cursor:      ehclient.Beginning(tenant.Stream(stream)),
+		accounts:    map[string]*InternalAccount{},
+		accountKeys: map[string][]string{},
 		folders: []*apitypes.Folder{
 			{
 				Id:       domain.RootFolderId,
@@ -83,6 +109,7 @@ func newUserStorage(tenant ehreader.Tenant) *UserStorage {
 		},
 		u2FTokens: []*U2FToken{},
 		auditLog:  []apitypes.AuditlogEntry{},
+		logl:      logex.Levels(logex.Discard),
 	}
 }
 
@@ -112,22 +139,85 @@ func (l *UserStorage) processEvent(ev ehevent.Event) error {
 			ApiKeySecret: e.Secret,
 		}
 	case *domain.UserDecryptionKeyPasswordChanged:
+		previous := l.crypto
+
 		var err error
 		l.crypto, err = newCryptoThingie(e.PublicKey, e.PrivateKeyEncrypted)
 		if err != nil {
 			return err
 		}
 
-		// add a couple bytes to not hash PrivateKeyEncrypted directly just to be extra safe,
-		// though PrivateKeyEncrypted is pretty safe already
-		macKey := sha256.Sum256(append(e.PrivateKeyEncrypted, []byte{0xFF, 0x01}...))
-		l.macKey = macKey[:]
+		// same key, so history of previous keys stays the same. if it was unlocked (e.g.
+		// the key was upgraded to current slowcrypto format while unlocking), it stays so.
+		if previous != nil {
+			l.crypto.previousKeysEncrypted = previous.previousKeysEncrypted
+
+			if previous.publicKeyPem == e.PublicKey {
+				l.crypto.carryOverUnlockedKey(previous)
+			}
+		}
+
+		l.macKey = macKeyFromPrivateKeyEncrypted(e.PrivateKeyEncrypted)
+
+		l.audit(apitypes.AuditlogEntry{}, ev)
+	case *domain.UserDecryptionKeyRotated:
+		previous := l.crypto
+
+		var err error
+		l.crypto, err = newCryptoThingie(e.PublicKey, e.PrivateKeyEncrypted)
+		if err != nil {
+			return err
+		}
+
+		if previous != nil {
+			l.retireAccountKeyRecipient(previous.publicKey, l.crypto.publicKey)
+
+			// retired, so no reason to keep it in memory
+			previous.Seal()
+		}
+
+		l.crypto.previousKeysEncrypted = e.PreviousKeysEncrypted
+
+		l.macKey = macKeyFromPrivateKeyEncrypted(e.PrivateKeyEncrypted)
 
-		l.audit("Changed the decryption key password", ev.Meta())
+		l.audit(apitypes.AuditlogEntry{}, ev)
 	case *domain.UserDecryptionKeyUnlocked:
-		l.audit("Unlocked the decryption key", ev.Meta())
+		l.audit(apitypes.AuditlogEntry{}, ev)
+	case *domain.UserDecryptionKeySealed:
+		l.audit(apitypes.AuditlogEntry{}, ev)
+	case *domain.UserAutoSealConfigured:
+		l.autoSeal = autoSealConfig{
+			IdleTimeout:         time.Duration(e.IdleTimeoutMinutes) * time.Minute,
+			MaxUnlockedDuration: time.Duration(e.MaxUnlockedMinutes) * time.Minute,
+		}
+
+		l.audit(apitypes.AuditlogEntry{}, ev)
+	case *domain.UserRecoverySharesCreated:
+		l.recovery = &recoveryDetails{
+			PublicKey:              e.RecoveryPublicKey,
+			DecryptionKeyEncrypted: e.DecryptionKeyEncrypted,
+			SharesEncrypted:        e.SharesEncrypted,
+			Threshold:              e.Threshold,
+			ShareCount:             e.ShareCount,
+			Created:                e.Meta().Timestamp,
+		}
+
+		l.audit(apitypes.AuditlogEntry{}, ev)
+	case *domain.UserRecoveryRewrapped:
+		// copy, so readers of the previous pointer don't see a half-updated struct
+		rewrapped := *l.recovery
+		rewrapped.DecryptionKeyEncrypted = e.DecryptionKeyEncrypted
+		rewrapped.SharesEncrypted = e.SharesEncrypted
+		l.recovery = &rewrapped
+	case *domain.UserDecryptionKeyRecovered:
+		l.audit(apitypes.AuditlogEntry{}, ev)
+	case *domain.UserRecoverySharesViewed:
+		l.audit(apitypes.AuditlogEntry{}, ev)
 	case *domain.SessionSignedIn:
-		l.audit(fmt.Sprintf("Signed in with IP %s with %s", e.IpAddress, e.UserAgent), ev.Meta())
+		l.audit(apitypes.AuditlogEntry{
+			IpAddress: e.IpAddress,
+			UserAgent: e.UserAgent,
+		}, ev)
 	case *domain.UserCreated:
 		l.sUser = &SensitiveUser{
 			User: apitypes.User{
@@ -161,6 +251,8 @@ func (l *UserStorage) processEvent(ev ehevent.Event) error {
 				token.Counter = uint32(e.Counter)
 			}
 		}
+
+		l.audit(apitypes.AuditlogEntry{}, ev)
 	case *domain.AccountFolderCreated:
 		l.folders = append(l.folders, &apitypes.Folder{
 			Id:       e.Id,
@@ -188,15 +280,37 @@ func (l *UserStorage) processEvent(ev ehevent.Event) error {
 				break
 			}
 		}
+	case *domain.AccountSecretEnvelopeRewrapped:
+		acc := l.accounts[e.Account]
+
+		for idx := range acc.Secrets {
+			if acc.Secrets[idx].Id == e.Secret {
+				acc.Secrets[idx].Envelope = e.Envelope
+				break
+			}
+		}
 	case *domain.AccountSecretDeleted:
 		acc := l.accounts[e.Account]
 
 		for idx, secret := range acc.Secrets {
 			if secret.Id == e.Secret {
+				l.deleteAttachmentContent(secret)
+
 				acc.Secrets = append(acc.Secrets[:idx], acc.Secrets[idx+1:]...)
 				break
 			}
 		}
+
+		acc.Account.PasswordBreached = anySecretBreached(acc.Secrets)
+	case *domain.AccountPasswordBreachDetected:
+		acc := l.accounts[e.Account]
+		for idx, secret := range acc.Secrets {
+			if secret.Id == e.Id {
+				acc.Secrets[idx].Breached = true
+			}
+		}
+
+		acc.Account.PasswordBreached = anySecretBreached(acc.Secrets)
 	case *domain.AccountCreated:
 		l.accounts[e.Id] = &InternalAccount{
 			Account: apitypes.Account{
@@ -220,37 +334,57 @@ func (l *UserStorage) processEvent(ev ehevent.Event) error {
 	case *domain.AccountMoved:
 		l.accounts[e.Id].Account.FolderId = e.NewParentFolder
 	case *domain.AccountDeleted:
+		for _, secret := range l.accounts[e.Id].Secrets {
+			l.deleteAttachmentContent(secret)
+		}
+
+		// also cleans up possible orphaned keys (see CreateAccountKey())
+		l.destroyAccountKey(e.Id)
+
 		delete(l.accounts, e.Id)
+	case *domain.AccountKeyCreated:
+		l.accountKeys[e.Id] = append(l.accountKeys[e.Id], e.PublicKey)
+	case *domain.AccountKeyDestroyed:
+		l.destroyAccountKey(e.Id)
+
+		delete(l.accountKeys, e.Id)
+
+		l.audit(apitypes.AuditlogEntry{}, ev)
 	case *domain.AccountSecretNoteAdded:
 		acc := l.accounts[e.Account]
 		acc.Secrets = append(acc.Secrets, InternalSecret{
-			Id:       e.Id,
-			created:  e.Meta().Timestamp,
-			Title:    e.Title,
-			Kind:     domain.SecretKindNote,
-			Envelope: e.Note,
+			Id:        e.Id,
+			accountId: e.Account,
+			created:   e.Meta().Timestamp,
+			Title:     e.Title,
+			Kind:      domain.SecretKindNote,
+			Envelope:  e.Note,
 		})
 	case *domain.AccountPasswordAdded:
 		acc := l.accounts[e.Account]
 		acc.Secrets = append(acc.Secrets, InternalSecret{
-			Id:       e.Id,
-			created:  e.Meta().Timestamp,
-			Kind:     domain.SecretKindPassword,
-			Title:    e.Title,
-			Envelope: e.Password,
+			Id:             e.Id,
+			accountId:      e.Account,
+			created:        e.Meta().Timestamp,
+			Kind:           domain.SecretKindPassword,
+			Title:          e.Title,
+			Envelope:       e.Password,
+			PasswordPolicy: e.Policy,
 		})
 	case *domain.AccountOtpTokenAdded:
 		acc := l.accounts[e.Account]
 		acc.Secrets = append(acc.Secrets, InternalSecret{
-			Id:       e.Id,
-			created:  e.Meta().Timestamp,
-			Kind:     domain.SecretKindOtpToken,
-			Envelope: e.OtpProvisioningUrl,
+			Id:        e.Id,
+			accountId: e.Account,
+			created:   e.Meta().Timestamp,
+			Kind:      domain.SecretKindOtpToken,
+			Envelope:  e.OtpProvisioningUrl,
 		})
 	case *domain.AccountKeylistAdded:
 		acc := l.accounts[e.Account]
 		acc.Secrets = append(acc.Secrets, InternalSecret{
 			Id:                e.Id,
+			accountId:         e.Account,
 			created:           e.Meta().Timestamp,
 			Kind:              domain.SecretKindKeylist,
 			Title:             e.Title,
@@ -261,6 +395,7 @@ func (l *UserStorage) processEvent(ev ehevent.Event) error {
 		acc := l.accounts[e.Account]
 		acc.Secrets = append(acc.Secrets, InternalSecret{
 			Id:                e.Id,
+			accountId:         e.Account,
 			created:           e.Meta().Timestamp,
 			Title:             e.Description,
 			Kind:              domain.SecretKindExternalToken,
@@ -270,13 +405,59 @@ func (l *UserStorage) processEvent(ev ehevent.Event) error {
 		acc := l.accounts[e.Account]
 		acc.Secrets = append(acc.Secrets, InternalSecret{
 			Id:                     e.Id,
+			accountId:              e.Account,
+			created:                e.Meta().Timestamp,
+			SshPublicKeyAuthorized: e.SshPublicKeyAuthorized,
+			Kind:                   domain.SecretKindSshKey,
+			Envelope:               e.SshPrivateKey,
+		})
+	case *domain.AccountSshKeyGenerated:
+		acc := l.accounts[e.Account]
+		acc.Secrets = append(acc.Secrets, InternalSecret{
+			Id:                     e.Id,
+			accountId:              e.Account,
 			created:                e.Meta().Timestamp,
 			SshPublicKeyAuthorized: e.SshPublicKeyAuthorized,
+			NonExportable:          true,
 			Kind:                   domain.SecretKindSshKey,
 			Envelope:               e.SshPrivateKey,
 		})
+	case *domain.AccountSshKeyCaChanged:
+		acc := l.accounts[e.Account]
+		for idx, secret := range acc.Secrets {
+			if secret.Id == e.Id {
+				acc.Secrets[idx].SshCa = e.Ca
+			}
+		}
+	case *domain.AccountOtpTokenCounterAdvanced:
+		acc := l.accounts[e.Account]
+		for idx, secret := range acc.Secrets {
+			if secret.Id == e.Id {
+				nextCounter := e.Counter + 1
+				acc.Secrets[idx].hotpCounter = &nextCounter
+			}
+		}
+	case *domain.AccountAttachmentAdded:
+		acc := l.accounts[e.Account]
+		acc.Secrets = append(acc.Secrets, InternalSecret{
+			Id:                 e.Id,
+			accountId:          e.Account,
+			created:            e.Meta().Timestamp,
+			Title:              e.Title,
+			AttachmentFilename: e.Filename,
+			AttachmentSize:     e.Size,
+			Kind:               domain.SecretKindAttachment,
+			Envelope:           e.ContentKey,
+		})
 	case *domain.AccountSecretUsed:
-		l.audit(fmt.Sprintf("Account %s secret %v - %s", e.Account, e.Secrets, e.Type), ev.Meta())
+		secretUsedType := e.Type
+
+		l.audit(apitypes.AuditlogEntry{
+			AccountId:      e.Account,
+			SecretIds:      e.Secrets,
+			SecretUsedType: &secretUsedType,
+			KeylistKey:     e.KeylistKey,
+		}, ev)
 	default:
 		return ehreader.UnsupportedEventTypeErr(ev)
 	}
@@ -284,18 +465,19 @@ func (l *UserStorage) processEvent(ev ehevent.Event) error {
 	return nil
 }
 
-func (l *UserStorage) audit(message string, meta *ehevent.EventMeta) {
-	entry := apitypes.AuditlogEntry{
-		Timestamp: meta.Timestamp,
-		Message:   message,
-	}
+func macKeyFromPrivateKeyEncrypted(privateKeyEncrypted []byte) []byte {
+	// add a couple bytes to not hash PrivateKeyEncrypted directly just to be extra safe,
+	// though PrivateKeyEncrypted is pretty safe already
+	macKey := sha256.Sum256(append(privateKeyEncrypted, []byte{0xFF, 0x01}...))
+	return macKey[:]
+}
 
-	high := len(l.auditLog)
-	if high > maxAuditLogEntries-1 {
-		high = maxAuditLogEntries - 1
+func anySecretBreached(secrets []InternalSecret) bool {
+	for _, secret := range secrets {
+		if secret.Breached {
+			return true
+		}
 	}
 
-	l.auditLog = append(
-		[]apitypes.AuditlogEntry{entry},
-		l.auditLog[0:high]...)
+	return false
 }
@@ -1,7 +1,13 @@
 package state
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
 	"encoding/json"
 	"github.com/function61/eventhorizon/pkg/ehevent"
 	"github.com/function61/eventhorizon/pkg/ehreader"
@@ -9,6 +15,12 @@ import (
 	"github.com/function61/gokit/assert"
 	"github.com/function61/gokit/cryptoutil"
 	"github.com/function61/passitron/pkg/domain"
+	"github.com/function61/passitron/pkg/envelopeenc"
+	"github.com/function61/passitron/pkg/slowcrypto"
+	"golang.org/x/crypto/nacl/secretbox"
+	"io"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 )
@@ -38,14 +50,61 @@ func (t *testContext) appendAndLoad(e ehevent.Event) {
 	}
 }
 
-func (t *testContext) encrypt(data string) []byte {
-	env, err := t.user.Crypto().Encrypt([]byte(data))
+func (t *testContext) encrypt(data string, secretId string, kind domain.SecretKind) []byte {
+	env, err := t.user.Crypto().Encrypt([]byte(data), SecretContext{
+		AccountId: testAccId,
+		SecretId:  secretId,
+		Kind:      kind,
+	})
 	if err != nil {
 		panic(err)
 	}
 	return env
 }
 
+// envelope as stored before envelopes were bound to their secret (Version1 = secretbox
+// content, RSA key slots only)
+func (t *testContext) encryptVersion1(data string) []byte {
+	pubKey := t.user.crypto.publicKey.(*rsa.PublicKey)
+
+	kekId, err := envelopeenc.KekId(pubKey)
+	if err != nil {
+		panic(err)
+	}
+
+	var dek [32]byte
+	var nonce [24]byte
+	if _, err := io.ReadFull(rand.Reader, dek[:]); err != nil {
+		panic(err)
+	}
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		panic(err)
+	}
+
+	dekEncrypted, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pubKey, dek[:], nil)
+	if err != nil {
+		panic(err)
+	}
+
+	out := &bytes.Buffer{}
+	writeUvarint := func(num uint64) {
+		buf := make([]byte, binary.MaxVarintLen64)
+		out.Write(buf[0:binary.PutUvarint(buf, num)])
+	}
+	writeBytes := func(data []byte) {
+		writeUvarint(uint64(len(data)))
+		out.Write(data)
+	}
+
+	writeUvarint(envelopeenc.Version1)
+	writeBytes(secretbox.Seal(nonce[:], []byte(data), &nonce, &dek))
+	writeUvarint(1) // amount of key slots
+	writeBytes([]byte(kekId))
+	writeBytes(dekEncrypted)
+
+	return out.Bytes()
+}
+
 func TestMain(t *testing.T) {
 	tc := &testContext{
 		user:     newUserStorage(ehreader.TenantId("42")),
@@ -83,10 +142,18 @@ func TestMain(t *testing.T) {
 
 	secretUsed(t, tc)
 
+	queryAuditLog(t, tc)
+
 	deleteSecret(t, tc)
 
 	renameAccount(t, tc)
 
+	createRecoveryShares(t, tc)
+
+	rotateDecryptionKey(t, tc)
+
+	recoverDecryptionKey(t, tc)
+
 	moveAccount(t, tc)
 
 	deleteAccount(t, tc)
@@ -188,6 +255,163 @@ func unlockDecryptionKey(t *testing.T, tc *testContext) {
 	assert.Ok(t, tc.user.crypto.UnlockDecryptionKey("myMasterPassword"))
 }
 
+func TestDecryptionKeyUpgrade(t *testing.T) {
+	tc := &testContext{
+		user:     newUserStorage(ehreader.TenantId("42")),
+		eventLog: ehreadertest.NewEventLog(),
+		ctx:      context.Background(),
+	}
+
+	tc.reader = ehreader.New(tc.user, tc.eventLog, nil)
+
+	tc.appendAndLoad(
+		domain.NewUserCreated(joonasUid, "joonas", ehevent.MetaSystemUser(t0)))
+
+	privKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Ok(t, err)
+
+	exported, err := ExportPrivateKeyWithPassword(privKey, "myMasterPassword", ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+
+	// simulate key stored before Argon2id was the default
+	exported.PrivateKeyEncrypted, err = slowcrypto.WithPassword("myMasterPassword").EncryptWithParams(
+		cryptoutil.MarshalPemBytes(x509.MarshalPKCS1PrivateKey(privKey), cryptoutil.PemTypeRsaPrivateKey),
+		slowcrypto.KdfParams{Kdf: slowcrypto.KdfPbkdf2Sha256, Iterations: 100 * 1000})
+	assert.Ok(t, err)
+
+	tc.appendAndLoad(exported)
+
+	assert.Assert(t, tc.user.Crypto().DecryptionKeyUpgrade(ehevent.Meta(t0, joonasUid)) == nil)
+
+	assert.Ok(t, tc.user.Crypto().UnlockDecryptionKey("myMasterPassword"))
+
+	upgrade := tc.user.Crypto().DecryptionKeyUpgrade(ehevent.Meta(t0, joonasUid))
+	assert.Assert(t, upgrade != nil)
+	assert.EqualString(t, upgrade.PublicKey, exported.PublicKey)
+
+	tc.appendAndLoad(upgrade)
+
+	// upgrading didn't lock the key
+	helloCtx := SecretContext{AccountId: testAccId, SecretId: "pwdId1", Kind: domain.SecretKindPassword}
+	env := tc.encrypt("hello", helloCtx.SecretId, helloCtx.Kind)
+	plaintext, err := tc.user.Crypto().Decrypt(env, helloCtx)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(plaintext.Bytes()), "hello")
+
+	// already in current format
+	tc.user.Crypto().privateKey = nil
+	assert.Ok(t, tc.user.Crypto().UnlockDecryptionKey("myMasterPassword"))
+	assert.Assert(t, tc.user.Crypto().DecryptionKeyUpgrade(ehevent.Meta(t0, joonasUid)) == nil)
+}
+
+func TestNewDecryptionKeyIsX25519(t *testing.T) {
+	keyCreated, err := NewDecryptionKey("myMasterPassword", ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+	assert.Assert(t, strings.HasPrefix(keyCreated.PublicKey, "-----BEGIN X25519 PUBLIC KEY-----"))
+
+	crypto, err := newCryptoThingie(keyCreated.PublicKey, keyCreated.PrivateKeyEncrypted)
+	assert.Ok(t, err)
+
+	secretCtx := SecretContext{AccountId: testAccId, SecretId: "pwdId1", Kind: domain.SecretKindPassword}
+
+	env, err := crypto.Encrypt([]byte("hunter2"), secretCtx)
+	assert.Ok(t, err)
+
+	assert.Ok(t, crypto.UnlockDecryptionKey("myMasterPassword"))
+
+	plaintext, err := crypto.Decrypt(env, secretCtx)
+	assert.Ok(t, err)
+	assert.EqualString(t, string(plaintext.Bytes()), "hunter2")
+
+	macKey, err := crypto.eventLogMacKey()
+	assert.Ok(t, err)
+	assert.Assert(t, strings.HasPrefix(macKey.Id, "SHA256:") && len(macKey.Key) == 32)
+}
+
+func TestSealDecryptionKey(t *testing.T) {
+	tc := &testContext{
+		user:     newUserStorage(ehreader.TenantId("42")),
+		eventLog: ehreadertest.NewEventLog(),
+		ctx:      context.Background(),
+	}
+
+	tc.reader = ehreader.New(tc.user, tc.eventLog, nil)
+
+	tc.appendAndLoad(
+		domain.NewUserCreated(joonasUid, "joonas", ehevent.MetaSystemUser(t0)))
+
+	keyCreated, err := NewDecryptionKey("myMasterPassword", ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+
+	tc.appendAndLoad(keyCreated)
+
+	assert.Assert(t, tc.user.SealDecryptionKey(domain.DecryptionKeySealReasonManual, ehevent.Meta(t0, joonasUid)) == nil)
+
+	assert.Ok(t, tc.user.crypto.UnlockDecryptionKey("myMasterPassword"))
+
+	// not configured = never
+	_, due := tc.user.autoSealReason(time.Now().Add(1000 * time.Hour))
+	assert.Assert(t, !due)
+
+	tc.appendAndLoad(domain.NewUserAutoSealConfigured(5, 60, ehevent.Meta(t0, joonasUid)))
+
+	tc.user.crypto.unlockedAt = t0
+	tc.user.crypto.lastUsed = t0.Add(50 * time.Minute)
+
+	autoSealReasonAt := func(minutesFromT0 int) string {
+		reason, due := tc.user.autoSealReason(t0.Add(time.Duration(minutesFromT0) * time.Minute))
+		if !due {
+			return "<not due>"
+		}
+		return string(reason)
+	}
+
+	assert.EqualString(t, autoSealReasonAt(54), "<not due>")
+	assert.EqualString(t, autoSealReasonAt(55), "IdleTimeout")
+	assert.EqualString(t, autoSealReasonAt(60), "MaxUnlockedDuration")
+
+	// not only decryption counts as use of the key
+	for _, useKey := range []func(){
+		func() {
+			keys, err := tc.user.crypto.unlockedKeys() // rotation, recovery etc.
+			assert.Ok(t, err)
+			zeroPrivateKeys(keys)
+		},
+		func() {
+			_, err := tc.user.crypto.eventLogMacKey()
+			assert.Ok(t, err)
+		},
+		func() {
+			macKeys, err := tc.user.crypto.eventLogMacKeysHistory()
+			assert.Ok(t, err)
+			zeroMacKeys(macKeys)
+		},
+	} {
+		tc.user.crypto.lastUsed = t0.Add(50 * time.Minute)
+		useKey()
+		assert.Assert(t, tc.user.crypto.lastUsed.After(t0.Add(50*time.Minute)))
+	}
+
+	tc.user.crypto.lastUsed = t0.Add(50 * time.Minute)
+
+	privKey := tc.user.crypto.privateKey.(*envelopeenc.X25519PrivateKey)
+
+	sealed := tc.user.SealDecryptionKey(domain.DecryptionKeySealReasonIdleTimeout, ehevent.Meta(t0, joonasUid))
+	assert.Assert(t, sealed != nil)
+	tc.appendAndLoad(sealed)
+
+	assert.Assert(t, tc.user.crypto.privateKey == nil)
+	assert.Assert(t, len(privKey.Bytes()) == 0) // zeroed and freed
+
+	_, err = tc.user.crypto.Decrypt(nil, SecretContext{})
+	assert.Assert(t, err == ErrDecryptionKeyLocked)
+
+	_, due = tc.user.autoSealReason(t0.Add(1000 * time.Hour))
+	assert.Assert(t, !due)
+
+	assert.EqualString(t, tc.user.auditLog[len(tc.user.auditLog)-1].Event, "user.DecryptionKeySealed")
+}
+
 func signIn(t *testing.T, tc *testContext) {
 	tc.appendAndLoad(
 		domain.NewSessionSignedIn("127.0.0.1", "Mozilla Firefox v1.0", ehevent.Meta(t0, joonasUid)))
@@ -250,6 +474,7 @@ func addAccount(t *testing.T, tc *testContext) {
   "Email": "joonas@example.com",
   "FolderId": "root",
   "Id": "accId1",
+  "PasswordBreached": false,
   "Title": "google.com",
   "Url": "https://google.com/",
   "Username": "joonas.fi"
@@ -262,7 +487,8 @@ func addPassword(t *testing.T, tc *testContext) {
 			testAccId,
 			"pwdId1",
 			"My cool pwd",
-			tc.encrypt("hunter2"),
+			tc.encrypt("hunter2", "pwdId1", domain.SecretKindPassword),
+			"",
 			ehevent.Meta(t0, joonasUid)))
 
 	secret := tc.user.accounts[testAccId].Secrets[0]
@@ -270,10 +496,20 @@ func addPassword(t *testing.T, tc *testContext) {
 	assert.Assert(t, secret.Kind == domain.SecretKindPassword)
 	assert.EqualString(t, secret.Title, "My cool pwd")
 
-	pwd, err := tc.user.crypto.Decrypt(secret.Envelope)
+	pwd, err := tc.user.crypto.Decrypt(secret.Envelope, secret.EnvelopeContext())
 	assert.Ok(t, err)
 
-	assert.EqualString(t, string(pwd), "hunter2")
+	assert.EqualString(t, string(pwd.Bytes()), "hunter2")
+
+	// envelope cannot be swapped into another account, secret or kind of secret
+	for _, wrongCtx := range []SecretContext{
+		{AccountId: "accId2", SecretId: "pwdId1", Kind: domain.SecretKindPassword},
+		{AccountId: testAccId, SecretId: "pwdId2", Kind: domain.SecretKindPassword},
+		{AccountId: testAccId, SecretId: "pwdId1", Kind: domain.SecretKindNote},
+	} {
+		_, err := tc.user.crypto.Decrypt(secret.Envelope, wrongCtx)
+		assert.EqualString(t, err.Error(), "aead.Open failed")
+	}
 }
 
 func addSecretNote(t *testing.T, tc *testContext) {
@@ -282,17 +518,17 @@ func addSecretNote(t *testing.T, tc *testContext) {
 			testAccId,
 			"snId3",
 			"Account recovery codes",
-			tc.encrypt("01: abcd\n02: efgh\n03: ijkl\n04: mnop"),
+			tc.encrypt("01: abcd\n02: efgh\n03: ijkl\n04: mnop", "snId3", domain.SecretKindNote),
 			ehevent.Meta(t0, joonasUid)))
 
 	secret := tc.user.accounts[testAccId].Secrets[1]
 
 	assert.Assert(t, secret.Kind == domain.SecretKindNote)
 
-	pwd, err := tc.user.crypto.Decrypt(secret.Envelope)
+	pwd, err := tc.user.crypto.Decrypt(secret.Envelope, secret.EnvelopeContext())
 	assert.Ok(t, err)
 
-	assert.EqualString(t, string(pwd), `01: abcd
+	assert.EqualString(t, string(pwd.Bytes()), `01: abcd
 02: efgh
 03: ijkl
 04: mnop`)
@@ -303,7 +539,7 @@ func addOtpToken(t *testing.T, tc *testContext) {
 		domain.NewAccountOtpTokenAdded(
 			testAccId,
 			"otpId4",
-			tc.encrypt("otpauth://totp/Google%3Afoo%40example.com?secret=qlt6vmy6svfx4bt4rpmisaiyol6hihca&issuer=Google"),
+			tc.encrypt("otpauth://totp/Google%3Afoo%40example.com?secret=qlt6vmy6svfx4bt4rpmisaiyol6hihca&issuer=Google", "otpId4", domain.SecretKindOtpToken),
 			ehevent.Meta(t0, joonasUid)))
 
 	secret := tc.user.accounts[testAccId].Secrets[2]
@@ -319,6 +555,50 @@ func addOtpToken(t *testing.T, tc *testContext) {
 		"otpauth://totp/Google%3Afoo%40example.com?secret=qlt6vmy6svfx4bt4rpmisaiyol6hihca&issuer=Google")
 }
 
+func TestHotpCounterAdvanced(t *testing.T) {
+	tc := &testContext{
+		user:     newUserStorage(ehreader.TenantId("42")),
+		eventLog: ehreadertest.NewEventLog(),
+		ctx:      context.Background(),
+	}
+
+	tc.reader = ehreader.New(tc.user, tc.eventLog, nil)
+
+	setupUser(t, tc)
+
+	unlockDecryptionKey(t, tc)
+
+	addAccount(t, tc)
+
+	// RFC 4226 test secret
+	tc.appendAndLoad(
+		domain.NewAccountOtpTokenAdded(
+			testAccId,
+			"hotpId1",
+			tc.encrypt("otpauth://hotp/Example:alice?secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ&counter=1", "hotpId1", domain.SecretKindOtpToken),
+			ehevent.Meta(t0, joonasUid)))
+
+	exposed, err := tc.user.DecryptSecrets(tc.user.accounts[testAccId].Secrets)
+	assert.Ok(t, err)
+	assert.EqualString(t, exposed[0].OtpProof, "287082")
+	assert.Assert(t, *exposed[0].OtpCounter == 1)
+
+	tc.appendAndLoad(
+		domain.NewAccountOtpTokenCounterAdvanced(testAccId, "hotpId1", 1, ehevent.Meta(t0, joonasUid)))
+
+	exposed, err = tc.user.DecryptSecrets(tc.user.accounts[testAccId].Secrets)
+	assert.Ok(t, err)
+	assert.EqualString(t, exposed[0].OtpProof, "359152")
+	assert.Assert(t, *exposed[0].OtpCounter == 2)
+
+	otpProvisioningUrl, err := tc.user.DecryptOtpProvisioningUrl(tc.user.accounts[testAccId].Secrets[0])
+	assert.Ok(t, err)
+	assert.EqualString(
+		t,
+		otpProvisioningUrl,
+		"otpauth://hotp/Example:alice?counter=2&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ")
+}
+
 func addKeylist(t *testing.T, tc *testContext) {
 	itemsJson, err := json.Marshal([]domain.AccountKeylistAddedKeysItem{
 		{
@@ -338,7 +618,7 @@ func addKeylist(t *testing.T, tc *testContext) {
 			"klId5",
 			"Keylist 567",
 			"01",
-			tc.encrypt(string(itemsJson)),
+			tc.encrypt(string(itemsJson), "klId5", domain.SecretKindKeylist),
 			ehevent.Meta(t0, joonasUid)))
 
 	secret := tc.user.accounts[testAccId].Secrets[3]
@@ -346,11 +626,11 @@ func addKeylist(t *testing.T, tc *testContext) {
 	assert.EqualString(t, secret.Title, "Keylist 567")
 	assert.EqualString(t, secret.keylistKeyExample, "01")
 
-	klJson, err := tc.user.crypto.Decrypt(secret.Envelope)
+	klJson, err := tc.user.crypto.Decrypt(secret.Envelope, secret.EnvelopeContext())
 	assert.Ok(t, err)
 
 	kl := []domain.AccountKeylistAddedKeysItem{}
-	assert.Ok(t, json.Unmarshal(klJson, &kl))
+	assert.Ok(t, json.Unmarshal(klJson.Bytes(), &kl))
 
 	assert.EqualJson(t, kl, `[
   {
@@ -402,20 +682,25 @@ vD2QakbdLBUy2JF2E2GHmGyTXQ6yp4rWgcCVPeeFRw==
 		domain.NewAccountSshKeyAdded(
 			testAccId,
 			"sshId5",
-			tc.encrypt(dummyButWorkingKey),
+			tc.encrypt(dummyButWorkingKey, "sshId5", domain.SecretKindSshKey),
 			"fixme SshPublicKeyAuthorized",
 			ehevent.Meta(t0, joonasUid)))
 
 	secret := tc.user.accounts[testAccId].Secrets[5]
 
 	assert.Assert(t, secret.Kind == domain.SecretKindSshKey)
+	assert.Assert(t, !secret.NonExportable)
 
 	assert.EqualString(t, secret.SshPublicKeyAuthorized, "fixme SshPublicKeyAuthorized")
 
-	sshKey, err := tc.user.crypto.Decrypt(secret.Envelope)
+	sshKey, err := tc.user.crypto.Decrypt(secret.Envelope, secret.EnvelopeContext())
 	assert.Ok(t, err)
 
-	assert.EqualString(t, string(sshKey), dummyButWorkingKey)
+	assert.EqualString(t, string(sshKey.Bytes()), dummyButWorkingKey)
+
+	tc.appendAndLoad(domain.NewAccountSshKeyCaChanged(testAccId, "sshId5", true, ehevent.Meta(t0, joonasUid)))
+
+	assert.Assert(t, tc.user.accounts[testAccId].Secrets[5].SshCa)
 }
 
 func secretUsed(t *testing.T, tc *testContext) {
@@ -428,6 +713,71 @@ func secretUsed(t *testing.T, tc *testContext) {
 			ehevent.Meta(t0, joonasUid)))
 }
 
+func queryAuditLog(t *testing.T, tc *testContext) {
+	t1 := t0.Add(1 * time.Hour)
+
+	tc.appendAndLoad(
+		domain.NewAccountSecretUsed(
+			testAccId,
+			[]string{"pwdId1"},
+			domain.SecretUsedTypePasswordExposed,
+			"",
+			ehevent.Meta(t1, joonasUid)))
+
+	seqs := func(q AuditLogQuery) string {
+		t.Helper()
+
+		page := tc.user.QueryAuditLog(q)
+
+		seqs := []string{}
+		for _, entry := range page.Entries {
+			seqs = append(seqs, strconv.Itoa(entry.Seq))
+		}
+
+		return strings.Join(seqs, ",") + " next=" + page.NextPage
+	}
+
+	// decryption key password changed, U2F token used, signed in, keylist key exposed,
+	// password exposed
+	assert.EqualString(t, seqs(AuditLogQuery{}), "5,4,3,2,1 next=")
+	assert.EqualString(t, seqs(AuditLogQuery{Limit: 3}), "5,4,3 next=3")
+	assert.EqualString(t, seqs(AuditLogQuery{Limit: 3, Before: 3}), "2,1 next=")
+	assert.EqualString(t, seqs(AuditLogQuery{IpAddress: "127.0.0.1"}), "3 next=")
+	assert.EqualString(t, seqs(AuditLogQuery{AccountId: testAccId}), "5,4 next=")
+	assert.EqualString(t, seqs(AuditLogQuery{SecretId: "klId5"}), "4 next=")
+	assert.EqualString(t, seqs(AuditLogQuery{SecretUsedType: domain.SecretUsedTypePasswordExposed}), "5 next=")
+	assert.EqualString(t, seqs(AuditLogQuery{From: t1}), "5 next=")
+	assert.EqualString(t, seqs(AuditLogQuery{To: t1}), "4,3,2,1 next=")
+
+	after := func(seq int) string {
+		seqs := []string{}
+		for _, entry := range tc.user.AuditLogAfter(seq) {
+			seqs = append(seqs, strconv.Itoa(entry.Seq))
+		}
+
+		return strings.Join(seqs, ",")
+	}
+
+	assert.EqualString(t, after(0), "1,2,3,4,5")
+	assert.EqualString(t, after(3), "4,5")
+	assert.EqualString(t, after(5), "")
+
+	assert.EqualJson(t, tc.user.QueryAuditLog(AuditLogQuery{Limit: 1}).Entries[0], `{
+  "AccountId": "accId1",
+  "Event": "account.SecretUsed",
+  "IpAddress": "",
+  "KeylistKey": "",
+  "SecretIds": [
+    "pwdId1"
+  ],
+  "SecretUsedType": "PasswordExposed",
+  "Seq": 5,
+  "Timestamp": "2020-02-20T15:02:00Z",
+  "UserAgent": "",
+  "UserId": "1"
+}`)
+}
+
 func deleteSecret(t *testing.T, tc *testContext) {
 	tc.appendAndLoad(
 		domain.NewAccountExternalTokenAdded(
@@ -473,6 +823,171 @@ func moveAccount(t *testing.T, tc *testContext) {
 		"fld1")
 }
 
+func rotateDecryptionKey(t *testing.T, tc *testContext) {
+	decryptPassword := func() string {
+		t.Helper()
+
+		secret := tc.user.InternalSecretById(testAccId, "pwdId1")
+
+		pwd, err := tc.user.crypto.Decrypt(secret.Envelope, secret.EnvelopeContext())
+		assert.Ok(t, err)
+
+		return string(pwd.Bytes())
+	}
+
+	oldKeys, err := tc.user.crypto.unlockedKeys()
+	assert.Ok(t, err)
+	defer zeroPrivateKeys(oldKeys)
+	oldKey := oldKeys[0]
+
+	// stored before envelopes were bound to their secret. only supports RSA key slots
+	tc.appendAndLoad(
+		domain.NewAccountPasswordAdded(
+			testAccId,
+			"pwdV1",
+			"Old pwd",
+			tc.encryptVersion1("oldhunter2"),
+			"",
+			ehevent.Meta(t0, joonasUid)))
+
+	_, err = tc.user.crypto.RotateDecryptionKey("wrong password", ehevent.Meta(t0, joonasUid))
+	assert.EqualString(t, err.Error(), "decryption error. wrong password?")
+
+	// migrates from RSA to X25519
+	rotation, err := tc.user.crypto.RotateDecryptionKey("myMasterPassword", ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+	assert.Assert(t, strings.HasPrefix(rotation.Event.PublicKey, "-----BEGIN X25519 PUBLIC KEY-----"))
+
+	tc.appendAndLoad(rotation.Event)
+
+	// new key is locked at first
+	pwdSecret := tc.user.InternalSecretById(testAccId, "pwdId1")
+	_, err = tc.user.crypto.Decrypt(pwdSecret.Envelope, pwdSecret.EnvelopeContext())
+	assert.Assert(t, err == ErrDecryptionKeyLocked)
+
+	assert.Ok(t, tc.user.crypto.UnlockDecryptionKey("myMasterPassword"))
+
+	// the old key is retired, so envelopes must be rewrapped along with the rotation
+	_, err = tc.user.crypto.Decrypt(pwdSecret.Envelope, pwdSecret.EnvelopeContext())
+	assert.Assert(t, err != nil)
+
+	// no account key store, so they're rewrapped for the rotated key
+	secretsRewrapped, err := tc.user.RewrapLegacySecrets(rotation, ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+
+	for _, secretRewrapped := range secretsRewrapped {
+		tc.appendAndLoad(secretRewrapped)
+	}
+
+	assert.EqualString(t, decryptPassword(), "hunter2")
+
+	// Version1 envelope got upgraded, so now it's bound to the secret
+	v1Secret := tc.user.InternalSecretById(testAccId, "pwdV1")
+	v1Env, err := envelopeenc.Unmarshal(v1Secret.Envelope)
+	assert.Ok(t, err)
+	assert.Assert(t, v1Env.Version == envelopeenc.Version3)
+
+	v1Pwd, err := tc.user.crypto.Decrypt(v1Secret.Envelope, v1Secret.EnvelopeContext())
+	assert.Ok(t, err)
+	assert.EqualString(t, string(v1Pwd.Bytes()), "oldhunter2")
+	v1Pwd.Destroy()
+
+	_, err = tc.user.crypto.Decrypt(v1Secret.Envelope, SecretContext{
+		AccountId: "accId2",
+		SecretId:  "pwdV1",
+		Kind:      domain.SecretKindPassword,
+	})
+	assert.EqualString(t, err.Error(), "aead.Open failed")
+
+	// only MAC keys were carried over
+	assert.Assert(t, len(tc.user.crypto.previousKeys) == 0)
+
+	recoveryRewrapped, err := tc.user.RewrapRecovery(rotation, ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+	tc.appendAndLoad(recoveryRewrapped)
+
+	// old key no longer has access to rewrapped envelopes
+	pwdSecret = tc.user.InternalSecretById(testAccId, "pwdId1")
+	env, err := envelopeenc.Unmarshal(pwdSecret.Envelope)
+	assert.Ok(t, err)
+	_, err = env.Decrypt(oldKey, pwdSecret.EnvelopeContext().associatedData())
+	assert.Assert(t, err != nil)
+
+	macKeys, err := tc.user.crypto.eventLogMacKeysHistory()
+	assert.Ok(t, err)
+	assert.Assert(t, len(macKeys) == 2)
+}
+
+func createRecoveryShares(t *testing.T, tc *testContext) {
+	noShares, err := tc.user.RecoveryShares()
+	assert.Ok(t, err)
+	assert.Assert(t, noShares == nil)
+
+	_, err = tc.user.crypto.CreateRecoveryShares(1, 3, ehevent.Meta(t0, joonasUid))
+	assert.EqualString(t, err.Error(), "threshold must be at least 2")
+
+	created, err := tc.user.crypto.CreateRecoveryShares(2, 3, ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+
+	tc.appendAndLoad(created)
+
+	shares, err := tc.user.RecoveryShares()
+	assert.Ok(t, err)
+	assert.Assert(t, shares.Threshold == 2)
+	assert.Assert(t, len(shares.Shares) == 3)
+	assert.Assert(t, strings.HasPrefix(shares.Shares[0], "passitron-share-v1:"))
+
+	tc.appendAndLoad(domain.NewUserRecoverySharesViewed(ehevent.Meta(t0, joonasUid)))
+	assert.EqualString(t, tc.user.auditLog[len(tc.user.auditLog)-1].Event, "user.RecoverySharesViewed")
+}
+
+// after rotation, so this also checks that the recovery key got access to the new key
+func recoverDecryptionKey(t *testing.T, tc *testContext) {
+	shares, err := tc.user.RecoveryShares()
+	assert.Ok(t, err)
+
+	// forgot the password
+	tc.user.crypto.privateKey = nil
+	tc.user.crypto.previousKeys = nil
+
+	_, err = tc.user.RecoverDecryptionKey(shares.Shares[0:1], "newPassword", ehevent.Meta(t0, joonasUid))
+	assert.EqualString(t, err.Error(), "need 2 shares, got 1")
+
+	_, err = tc.user.RecoverDecryptionKey([]string{"passitron-share-v1:00000000:2:AAAA", shares.Shares[1]}, "newPassword", ehevent.Meta(t0, joonasUid))
+	assert.EqualString(t, err.Error(), "share #1: share is not from the current set of shares")
+
+	_, err = tc.user.RecoverDecryptionKey([]string{shares.Shares[0], "hunter2"}, "newPassword", ehevent.Meta(t0, joonasUid))
+	assert.EqualString(t, err.Error(), "share #2: invalid share format")
+
+	corrupted := []byte(shares.Shares[0])
+	firstShareChar := strings.LastIndex(shares.Shares[0], ":") + 1
+	if corrupted[firstShareChar] == 'A' {
+		corrupted[firstShareChar] = 'B'
+	} else {
+		corrupted[firstShareChar] = 'A'
+	}
+
+	_, err = tc.user.RecoverDecryptionKey([]string{string(corrupted), shares.Shares[1]}, "newPassword", ehevent.Meta(t0, joonasUid))
+	assert.EqualString(t, err.Error(), "shares did not combine to the recovery key. corrupted share?")
+
+	passwordChanged, err := tc.user.RecoverDecryptionKey(
+		[]string{shares.Shares[2], "", shares.Shares[0]},
+		"newPassword",
+		ehevent.Meta(t0, joonasUid))
+	assert.Ok(t, err)
+
+	tc.appendAndLoad(domain.NewUserDecryptionKeyRecovered(ehevent.Meta(t0, joonasUid)))
+	tc.appendAndLoad(passwordChanged)
+
+	pwdSecret := tc.user.InternalSecretById(testAccId, "pwdId1")
+	pwd, err := tc.user.crypto.Decrypt(pwdSecret.Envelope, pwdSecret.EnvelopeContext())
+	assert.Ok(t, err)
+	assert.EqualString(t, string(pwd.Bytes()), "hunter2")
+
+	tc.user.crypto.privateKey = nil
+	assert.Ok(t, tc.user.crypto.UnlockDecryptionKey("newPassword"))
+}
+
 func deleteAccount(t *testing.T, tc *testContext) {
 	accId := "accId2"
 
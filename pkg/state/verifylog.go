@@ -0,0 +1,54 @@
+package state
+
+import (
+	"errors"
+	"github.com/function61/passitron/pkg/ehfilelog"
+)
+
+// verifies the event log's hash chain. if username is given, that user's MACs are verified
+// as well (which requires their password). works while the server is running.
+func VerifyEventLog(username string, password string) (*ehfilelog.VerifyReport, error) {
+	if username == "" {
+		return ehfilelog.VerifyFile(eventLogFilename, nil)
+	}
+
+	readOnlyLog, err := ehfilelog.OpenReadOnly(eventLogFilename, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer readOnlyLog.Close()
+
+	app, err := newAppState(nil, readOnlyLog, nil, nil, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	user := app.FindUserByUsername(username)
+	if user == nil {
+		return nil, errors.New("user not found")
+	}
+
+	if user.Crypto() == nil {
+		return nil, errors.New("user does not have a decryption key")
+	}
+
+	if err := user.Crypto().UnlockDecryptionKey(password); err != nil {
+		return nil, err
+	}
+
+	// entries MAC'd before key rotations were MAC'd with the previous keys
+	macKeys, err := user.Crypto().eventLogMacKeysHistory()
+	if err != nil {
+		return nil, err
+	}
+
+	userStream := userTenant(user.UserId()).Stream(stream)
+
+	return ehfilelog.VerifyFile(eventLogFilename, func(logStream string, keyId string) []byte {
+		if logStream != userStream {
+			return nil
+		}
+
+		return macKeys[keyId]
+	})
+}
@@ -165,6 +165,10 @@ func ChallengeHashForSignIn(userId string) [32]byte {
 	return stringToU2FChallengeHash("signin", userId)
 }
 
+func ChallengeHashForRecoveryShares(userId string) [32]byte {
+	return stringToU2FChallengeHash("recoveryshares", userId)
+}
+
 func ChallengeHashForKeylistKey(accountId, secretId, keylistKey string) [32]byte {
 	return stringToU2FChallengeHash("keylistkey", accountId, secretId, keylistKey)
 }